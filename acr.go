@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureResource       = "https://management.azure.com/"
+	azureLoginURL       = "https://login.microsoftonline.com/%v/oauth2/v2.0/token"
+	azureIMDSTokenURL   = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureIMDSAPIVersion = "2018-02-01"
+
+	// the username ACR expects next to a refresh token
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+	// ACR refresh tokens are valid for three hours
+	acrRefreshTokenTTL = 3 * time.Hour
+)
+
+// azureCredentials exchanges an AAD access token for an ACR refresh token.
+// The AAD token comes from AZURE_TENANT_ID/AZURE_CLIENT_ID/AZURE_CLIENT_SECRET,
+// then a managed identity and finally the az CLI login.
+type azureCredentials struct {
+	host   string
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newAzureCredentials exchanges tokens with the registry through its TLS,
+// proxy and timeout settings. The registry client itself cannot be used, as
+// it asks these credentials on the way.
+func newAzureCredentials(reg *Registry) *azureCredentials {
+	return &azureCredentials{
+		host:   reg.Host,
+		client: &http.Client{Transport: newRetryTransport(reg.transport(), reg.requestTimeout(), reg.maxRetries())},
+	}
+}
+
+func (a *azureCredentials) credentials() (string, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expiry) {
+		return acrUsername, a.token, nil
+	}
+	aad, err := azureAccessToken()
+	if err != nil {
+		return "", "", fmt.Errorf("acr: %v", err)
+	}
+	token, err := a.exchange(aad)
+	if err != nil {
+		return "", "", fmt.Errorf("acr: %v", err)
+	}
+	a.token = token
+	a.expiry = time.Now().Add(acrRefreshTokenTTL - 5*time.Minute)
+	return acrUsername, a.token, nil
+}
+
+func (a *azureCredentials) exchange(aad string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {a.host},
+		"access_token": {aad},
+	}
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	res, err := a.client.PostForm(fmt.Sprintf("https://%v/oauth2/exchange", a.host), form)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = decodeJsonResponse(res, &body)
+	return body.RefreshToken, err
+}
+
+func azureAccessToken() (string, error) {
+	tenant, client, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && client != "" && secret != "" {
+		res, err := httpClient.PostForm(fmt.Sprintf(azureLoginURL, tenant), url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {client},
+			"client_secret": {secret},
+			"scope":         {azureResource + ".default"},
+		})
+		if err != nil {
+			return "", err
+		}
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		err = decodeJsonResponse(res, &body)
+		return body.AccessToken, err
+	}
+
+	token, err := azureManagedIdentityToken(client)
+	if err == nil {
+		return token, nil
+	}
+
+	out, cliErr := exec.Command("az", "account", "get-access-token",
+		"--resource", azureResource, "--query", "accessToken", "--output", "tsv").Output()
+	if cliErr != nil {
+		return "", fmt.Errorf("no azure credentials: managed identity: %v; az cli: %v", err, cliErr)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func azureManagedIdentityToken(clientID string) (string, error) {
+	q := url.Values{
+		"api-version": {azureIMDSAPIVersion},
+		"resource":    {azureResource},
+	}
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	c := &http.Client{Transport: httpClient.Transport, Timeout: 2 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = decodeJsonResponse(res, &body)
+	return body.AccessToken, err
+}
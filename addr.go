@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"strings"
+)
+
+// unixHost is the host in the urls of registries reached over a unix socket.
+const unixHost = "unix"
+
+// parseAddr parses a registry address: a base url such as
+// https://example.org/registry, host:port for plain http, or
+// unix:///path/to/registry.sock. It returns the url requests are built on
+// and the socket to connect to, if any.
+func parseAddr(addr string) (base string, socket string, err error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := neturl.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("%v: no host", addr)
+		}
+		return strings.TrimSuffix(u.String(), "/"), "", nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("%v: no socket path", addr)
+		}
+		return "http://" + unixHost, u.Path, nil
+	}
+	return "", "", fmt.Errorf("%v: unsupported scheme %q", addr, u.Scheme)
+}
+
+// displayAddr returns the address of reg as configured: its base url, or for
+// a unix socket the socket path followed by the path prefix.
+func (reg *Registry) displayAddr() string {
+	if reg.socket != "" {
+		return "unix://" + reg.socket + strings.TrimPrefix(reg.Addr, "http://"+unixHost)
+	}
+	return reg.Addr
+}
+
+// key is the address reg is matched by.
+func (reg *Registry) key() string {
+	return addrKey(reg.displayAddr())
+}
+
+func dialUnix(socket string) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+}
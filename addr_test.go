@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		base   string
+		socket string
+		err    bool
+	}{
+		{"localhost:5000", "http://localhost:5000", "", false},
+		{"https://example.org/registry/", "https://example.org/registry", "", false},
+		{"http://[::1]:5000", "http://[::1]:5000", "", false},
+		{"unix:///run/registry.sock", "http://" + unixHost, "/run/registry.sock", false},
+		{"unix://", "", "", true},
+		{"https:///v2", "", "", true},
+		{"ftp://example.org", "", "", true},
+	}
+	for _, tt := range tests {
+		base, socket, err := parseAddr(tt.addr)
+		if (err != nil) != tt.err || base != tt.base || socket != tt.socket {
+			t.Errorf("parseAddr(%q) = %q, %q, %v", tt.addr, base, socket, err)
+		}
+	}
+}
+
+func TestSetupAddr(t *testing.T) {
+	tests := []struct {
+		reg     *Registry
+		addr    string
+		display string
+		key     string
+	}{
+		{&Registry{Host: "reg.example.org", Port: 443}, "https://reg.example.org:443", "https://reg.example.org:443", "reg.example.org"},
+		{&Registry{Addr: "https://example.org/artifactory/api/docker/team"}, "https://example.org/artifactory/api/docker/team", "https://example.org/artifactory/api/docker/team", "example.org/artifactory/api/docker/team"},
+		{&Registry{Addr: "unix:///run/registry.sock"}, "http://" + unixHost, "unix:///run/registry.sock", "/run/registry.sock"},
+		{&Registry{Addr: "unix:///run/registry.sock", Path: "team"}, "http://" + unixHost + "/team", "unix:///run/registry.sock/team", "/run/registry.sock/team"},
+	}
+	for _, tt := range tests {
+		reg := tt.reg
+		if err := reg.setup(); err != nil {
+			t.Errorf("%v: %v", tt.display, err)
+			continue
+		}
+		if reg.Addr != tt.addr || reg.displayAddr() != tt.display || reg.key() != tt.key {
+			t.Errorf("%v: addr %v, displayed %v, key %v", tt.display, reg.Addr, reg.displayAddr(), reg.key())
+		}
+	}
+}
+
+func TestUnixSocketRegistry(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "registry.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	reg := &Registry{Alias: "local", Addr: "unix://" + socket}
+	if err := reg.setup(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := reg.client().Get(reg.Addr + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status %v", res.Status)
+	}
+
+	conf := &Config{Registries: []*Registry{reg}}
+	if found, ok := conf.findRegistryByAddr("unix://" + socket); !ok || found != reg {
+		t.Errorf("registry not found by its socket")
+	}
+}
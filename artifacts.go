@@ -0,0 +1,33 @@
+package main
+
+import "strings"
+
+// artifactKinds names the artifact types commonly stored in registries
+// besides container images, by prefix.
+var artifactKinds = []struct {
+	prefix string
+	kind   string
+}{
+	{"application/vnd.cncf.helm.", "helm chart"},
+	{"application/vnd.wasm.", "wasm"},
+	{"application/vnd.module.wasm.", "wasm"},
+	{"application/vnd.cncf.flux.", "flux"},
+	{"application/vnd.dev.cosign.", "signature"},
+	{"application/vnd.dev.sigstore.", "signature"},
+	{"application/vnd.cncf.notary.", "signature"},
+	{"application/vnd.in-toto", "attestation"},
+	{"application/spdx", "sbom"},
+	{"application/vnd.cyclonedx", "sbom"},
+	{"application/vnd.unknown.", "oras artifact"},
+}
+
+// artifactKind returns a short name for an artifact type, such as "helm
+// chart", or the type itself when it is not a well-known one.
+func artifactKind(artifactType string) string {
+	for _, k := range artifactKinds {
+		if strings.HasPrefix(artifactType, k.prefix) {
+			return k.kind
+		}
+	}
+	return artifactType
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// AuditEntry is an old tag with the team to ask before deleting it.
+type AuditEntry struct {
+	Registry string
+	Repo     string
+	Tag      string
+	Created  JsonTime
+	AgeDays  int
+	Size     int64
+	Digest   string
+	Owner    string
+}
+
+// auditEntries returns the tags of repos created longer than minAge ago,
+// oldest first. Signatures and other artifacts kept next to images go with
+// their image and are left out.
+func auditEntries(conf *Config, registry string, repos map[string][]TagDetail, minAge time.Duration, now time.Time) []*AuditEntry {
+	var entries []*AuditEntry
+	for repo, tags := range repos {
+		for _, tag := range tags {
+			if isArtifactTag(tag.Tag) {
+				continue
+			}
+			age := now.Sub(time.Time(tag.Created))
+			if age < minAge {
+				continue
+			}
+			entries = append(entries, &AuditEntry{
+				Registry: registry,
+				Repo:     repo,
+				Tag:      tag.Tag,
+				Created:  tag.Created,
+				AgeDays:  int(age.Hours() / 24),
+				Size:     tag.Size,
+				Digest:   tag.Digest,
+				Owner:    conf.ownerOf(repo, tag.Labels),
+			})
+		}
+	}
+	return entries
+}
+
+func sortAuditEntries(entries []*AuditEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !time.Time(a.Created).Equal(time.Time(b.Created)) {
+			return time.Time(a.Created).Before(time.Time(b.Created))
+		}
+		if a.Registry != b.Registry {
+			return a.Registry < b.Registry
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Tag < b.Tag
+	})
+}
+
+// writeAuditCsv writes entries as CSV with a header line. The creation time
+// and age of tags whose creation time is unknown are left empty.
+func writeAuditCsv(out io.Writer, entries []*AuditEntry) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"registry", "repo", "tag", "created", "age_days", "size", "digest", "owner"})
+	for _, e := range entries {
+		created, age := "", ""
+		if !time.Time(e.Created).IsZero() {
+			created = time.Time(e.Created).Format(TimeOutputLayout)
+			age = fmt.Sprint(e.AgeDays)
+		}
+		w.Write([]string{
+			e.Registry,
+			e.Repo,
+			e.Tag,
+			created,
+			age,
+			fmt.Sprint(e.Size),
+			e.Digest,
+			e.Owner,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeAuditCsvs writes one <owner>.csv per owner of entries into dir.
+func writeAuditCsvs(dir string, entries []*AuditEntry) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	byOwner := make(map[string][]*AuditEntry)
+	var owners []string
+	for _, e := range entries {
+		if byOwner[e.Owner] == nil {
+			owners = append(owners, e.Owner)
+		}
+		byOwner[e.Owner] = append(byOwner[e.Owner], e)
+	}
+	names := teamFileNames(owners, ".csv")
+	for owner, entries := range byOwner {
+		f, err := os.Create(filepath.Join(dir, names[owner]))
+		if err != nil {
+			return err
+		}
+		err = writeAuditCsv(f, entries)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func audit(ctx context.Context, args []string) {
+	fs := commandFlags("audit")
+	olderThan := fs.String("older-than", "90d", "list the tags created longer ago than this, e.g. 90d or 720h; 0 lists every tag")
+	outDir := fs.String("out-dir", "", "write one <owner>.csv per owner into this directory")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	minAge, err := parseAge(*olderThan)
+	if err != nil {
+		fatal(err)
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+
+	now := time.Now()
+	var entries []*AuditEntry
+	incomplete := false
+	for _, reg := range regs {
+		repos, errs := getRepoInfo(ctx, reg)
+		if ctx.Err() != nil {
+			log.Println("interrupted")
+			exit(ExitCodeInterrupted)
+		}
+		warnIncomplete(errs)
+		incomplete = incomplete || len(errs) > 0
+		entries = append(entries, auditEntries(localConf, reg.name(), repos, minAge, now)...)
+	}
+	sortAuditEntries(entries)
+
+	if *outDir != "" {
+		err = writeAuditCsvs(*outDir, entries)
+	} else {
+		err = writeAuditCsv(os.Stdout, entries)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+func decodeJsonResponse(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v: %s", res.Request.URL, res.Status, strings.TrimSpace(string(buf)))
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// credentials returns what the auth provider of reg answers its challenges
+// with.
+func (reg *Registry) credentials() registryclient.CredentialFunc {
+	return reg.authProvider().Credentials(reg)
+}
+
+// registryClient returns a client for the distribution API of reg, set up
+// for what reg was found to support.
+func (reg *Registry) registryClient(ctx context.Context) *registryclient.Client {
+	caps := reg.capabilities(ctx)
+	c := registryclient.New(reg.Addr, reg.client())
+	if caps.TagPagination {
+		c.PageSize = 1000
+	}
+	c.NoHead = !caps.HeadManifest
+	c.NoReferrers = !caps.Referrers
+	return c
+}
+
+// client returns the http client used for all requests to reg.
+func (reg *Registry) client() *http.Client {
+	reg.clientOnce.Do(func() {
+		quota := newQuota(reg.name(), reg.MinRemaining)
+		base := countRequests(reg.transport())
+		base = &quotaTransport{base: base, quota: quota}
+		base = &traceTransport{base: base, registry: reg.name()}
+		base = &debugTransport{base: base, registry: reg.name()}
+		if len(injectedFaults) > 0 {
+			base = &faultTransport{base: base, faults: injectedFaults}
+		}
+		if reg.Signing != nil {
+			u, _ := neturl.Parse(reg.Addr)
+			base = newSigningTransport(base, u.Host, reg.Signing)
+		}
+		base = newRetryTransport(base, reg.requestTimeout(), reg.maxRetries())
+		if reg.RateLimit > 0 {
+			base = &rateLimitTransport{base: base, limiter: newRateLimiter(reg.RateLimit, reg.Burst)}
+		}
+		if reg.MinRemaining > 0 {
+			base = &slowDownTransport{base: base, quota: quota}
+		}
+		base = &authTransport{base: base, reg: reg, provider: reg.authProvider()}
+		reg.httpClient = &http.Client{
+			Transport: interceptTransport(reg.cacheTransport(registryclient.NewTokenTransportWithStore(base, reg.credentials(), reg.tokenStore()))),
+		}
+		if len(reg.mirrors) > 0 {
+			reg.httpClient.Transport = &mirrorTransport{reg: reg, primary: reg.httpClient.Transport}
+		}
+	})
+	return reg.httpClient
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// Built-in auth providers, named by the authType of a registry.
+const (
+	AuthAnonymous    = "anonymous"
+	AuthStatic       = "static"
+	AuthDockerConfig = "docker-config"
+	AuthToken        = "token"
+	AuthGoogle       = "gcr"
+	AuthAzure        = "acr"
+)
+
+// AuthProvider authenticates the requests to a registry. Credentials are
+// what its authentication challenges, and those of its token service, are
+// answered with; nil means anonymous access. Decorate may change every
+// request before it is sent, e.g. to add a header a gateway expects.
+type AuthProvider interface {
+	Credentials(reg *Registry) registryclient.CredentialFunc
+	Decorate(reg *Registry, req *http.Request) error
+}
+
+// CredentialProvider is an AuthProvider that only resolves credentials.
+type CredentialProvider func(reg *Registry) registryclient.CredentialFunc
+
+func (f CredentialProvider) Credentials(reg *Registry) registryclient.CredentialFunc {
+	return f(reg)
+}
+
+func (f CredentialProvider) Decorate(reg *Registry, req *http.Request) error {
+	return nil
+}
+
+var authProviders = map[string]AuthProvider{}
+
+// RegisterAuthProvider makes p the provider of registries configured with
+// authType name. It is meant to be called from init functions of files
+// compiled in for providers of an organization; registering a name twice
+// panics.
+func RegisterAuthProvider(name string, p AuthProvider) {
+	if _, ok := authProviders[name]; ok {
+		panic("auth provider registered twice: " + name)
+	}
+	authProviders[name] = p
+}
+
+func init() {
+	RegisterAuthProvider(AuthAnonymous, CredentialProvider(func(reg *Registry) registryclient.CredentialFunc {
+		return nil
+	}))
+	RegisterAuthProvider(AuthStatic, CredentialProvider(func(reg *Registry) registryclient.CredentialFunc {
+		if reg.Username == "" {
+			return nil
+		}
+		return func() (string, string, error) {
+			return reg.Username, reg.Password, nil
+		}
+	}))
+	RegisterAuthProvider(AuthDockerConfig, CredentialProvider(dockerConfigCredentials))
+	RegisterAuthProvider(AuthToken, tokenProvider{})
+	RegisterAuthProvider(AuthGoogle, CredentialProvider(func(reg *Registry) registryclient.CredentialFunc {
+		return newGoogleCredentials(reg.KeyFile).credentials
+	}))
+	RegisterAuthProvider(AuthAzure, CredentialProvider(func(reg *Registry) registryclient.CredentialFunc {
+		return newAzureCredentials(reg).credentials
+	}))
+}
+
+func authProviderNames() []string {
+	names := make([]string, 0, len(authProviders))
+	for name := range authProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authType returns the auth provider reg uses: its authType, else the
+// cloud provider of its type, else static credentials when it has a
+// username.
+func (reg *Registry) authType() string {
+	switch {
+	case reg.AuthType != "":
+		return reg.AuthType
+	case reg.Type == "gcr" || reg.Type == "acr":
+		return reg.Type
+	case reg.Username != "":
+		return AuthStatic
+	}
+	return AuthAnonymous
+}
+
+func (reg *Registry) authProvider() AuthProvider {
+	return authProviders[reg.authType()]
+}
+
+// authTransport has the auth provider of a registry decorate every request
+// to the registry.
+type authTransport struct {
+	base     http.RoundTripper
+	reg      *Registry
+	provider AuthProvider
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// only the registry is sent its credentials, not the hosts it
+	// redirects blob downloads to
+	if u, err := neturl.Parse(t.reg.Addr); err != nil || !strings.EqualFold(u.Host, req.URL.Host) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if err := t.provider.Decorate(t.reg, req); err != nil {
+		return nil, fmt.Errorf("%v: %v: %v", t.reg.name(), t.reg.authType(), err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// tokenProvider sends the token of a registry as a bearer token with every
+// request, for registries and gateways that take a long-lived token
+// without a challenge.
+type tokenProvider struct{}
+
+func (tokenProvider) Credentials(reg *Registry) registryclient.CredentialFunc {
+	return nil
+}
+
+func (tokenProvider) Decorate(reg *Registry, req *http.Request) error {
+	if reg.Token == "" {
+		return fmt.Errorf("no token configured")
+	}
+	req.Header.Set("Authorization", "Bearer "+reg.Token)
+	return nil
+}
+
+// dockerHubConfigKey is the key docker login stores Docker Hub credentials
+// under.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// dockerConfig holds the fields of ~/.docker/config.json about registry
+// credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// dockerConfigHost returns the registry host a key of the auths of the
+// docker config stands for, e.g. reg.example.org:5000 for
+// https://reg.example.org:5000/v2/.
+func dockerConfigHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := neturl.Parse(key); err == nil {
+			key = u.Host
+		}
+	}
+	key = strings.SplitN(key, "/", 2)[0]
+	switch key {
+	case "docker.io", "index.docker.io", DockerHubRegistryHost:
+		return "index.docker.io"
+	}
+	return key
+}
+
+// dockerConfigCredentials returns the credentials docker login stored for
+// the host of reg, in the docker config itself or in the credential helper
+// it names. They are looked up once; a host without credentials is
+// accessed anonymously.
+func dockerConfigCredentials(reg *Registry) registryclient.CredentialFunc {
+	var (
+		once               sync.Once
+		username, password string
+		err                error
+	)
+	return func() (string, string, error) {
+		once.Do(func() {
+			username, password, err = lookupDockerConfig(reg)
+			if err != nil {
+				err = fmt.Errorf("docker config: %v", err)
+			}
+		})
+		return username, password, err
+	}
+}
+
+func lookupDockerConfig(reg *Registry) (string, string, error) {
+	path := dockerConfigPath()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var conf dockerConfig
+	err = json.Unmarshal(b, &conf)
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %v", path, err)
+	}
+	u, err := neturl.Parse(reg.Addr)
+	if err != nil {
+		return "", "", err
+	}
+	host := dockerConfigHost(u.Host)
+	key := host
+	if host == "index.docker.io" {
+		key = dockerHubConfigKey
+	}
+
+	helper := conf.CredHelpers[host]
+	if helper == "" {
+		helper = conf.CredsStore
+	}
+	if helper != "" {
+		return runCredentialHelper(helper, key)
+	}
+	for k, entry := range conf.Auths {
+		if dockerConfigHost(k) != host {
+			continue
+		}
+		if entry.Auth == "" {
+			return entry.Username, entry.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("%v: auth of %v: %v", path, k, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("%v: auth of %v is not username:password", path, k)
+		}
+		return parts[0], parts[1], nil
+	}
+	return "", "", nil
+}
+
+// runCredentialHelper asks docker-credential-<helper> for the credentials
+// of serverURL, as docker does.
+func runCredentialHelper(helper string, serverURL string) (string, string, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%v: %v: %v", helper, err, msg)
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return "", "", fmt.Errorf("docker-credential-%v: %v", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	keyUp       = "up"
+	keyDown     = "down"
+	keyPageUp   = "pgup"
+	keyPageDown = "pgdn"
+	keyHome     = "home"
+	keyEnd      = "end"
+	keyEnter    = "enter"
+	keyBack     = "back"
+	keyErase    = "erase"
+	keyDelete   = "delete"
+	keyReload   = "reload"
+	keyQuit     = "quit"
+)
+
+const (
+	viewRegistries = iota
+	viewRepos
+	viewTags
+	viewDetail
+)
+
+// browseItem is a row of a view: a registry, repository or tag.
+type browseItem struct {
+	label string
+	key   string
+	reg   *Registry
+	tag   *TagDetail
+}
+
+// browseView is a screen of the browser: a list to filter and pick from, or
+// the lines of an inspected image.
+type browseView struct {
+	kind   int
+	title  string
+	reg    *Registry
+	repo   string
+	items  []browseItem
+	lines  []string
+	filter string
+	cursor int
+	offset int
+}
+
+// fuzzyMatch reports whether the letters of pattern appear in s in order,
+// ignoring case.
+func fuzzyMatch(pattern string, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+func (v *browseView) visible() []browseItem {
+	if v.filter == "" {
+		return v.items
+	}
+	var items []browseItem
+	for _, item := range v.items {
+		if fuzzyMatch(v.filter, item.key) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (v *browseView) rows() int {
+	if v.kind == viewDetail {
+		return len(v.lines)
+	}
+	return len(v.visible())
+}
+
+// lastLine keeps the last line logged, to show it in the status line
+// instead of writing over the screen.
+type lastLine struct {
+	line string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	if s := strings.TrimSpace(string(p)); s != "" {
+		lines := strings.Split(s, "\n")
+		l.line = lines[len(lines)-1]
+	}
+	return len(p), nil
+}
+
+type browser struct {
+	ctx    context.Context
+	out    *bufio.Writer
+	views  []*browseView
+	status string
+	logged *lastLine
+}
+
+func (b *browser) top() *browseView {
+	return b.views[len(b.views)-1]
+}
+
+func readKey() (string, error) {
+	buf := make([]byte, 32)
+	n, err := os.Stdin.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	switch s := string(buf[:n]); s {
+	case "\x1b[A", "\x1bOA", "\x10":
+		return keyUp, nil
+	case "\x1b[B", "\x1bOB", "\x0e":
+		return keyDown, nil
+	case "\x1b[5~":
+		return keyPageUp, nil
+	case "\x1b[6~":
+		return keyPageDown, nil
+	case "\x1b[H", "\x1bOH", "\x1b[1~":
+		return keyHome, nil
+	case "\x1b[F", "\x1bOF", "\x1b[4~":
+		return keyEnd, nil
+	case "\r", "\n", "\x1b[C", "\x1bOC":
+		return keyEnter, nil
+	case "\x1b", "\x1b[D", "\x1bOD":
+		return keyBack, nil
+	case "\x7f", "\x08":
+		return keyErase, nil
+	case "\x18":
+		return keyDelete, nil
+	case "\x12":
+		return keyReload, nil
+	case "\x03", "\x04":
+		return keyQuit, nil
+	default:
+		if strings.HasPrefix(s, "\x1b") || s[0] < 0x20 {
+			return "", nil
+		}
+		return s, nil
+	}
+}
+
+// termSize returns the size of the terminal, or 80x24 where it is unknown.
+func termSize() (width int, height int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		return 80, 24
+	}
+	return width, height
+}
+
+func (b *browser) render() {
+	width, height := termSize()
+	v := b.top()
+	fit := func(s string) string {
+		if utf8.RuneCountInString(s) > width {
+			return string([]rune(s)[:width-1]) + "…"
+		}
+		return s
+	}
+	fmt.Fprint(b.out, "\x1b[H\x1b[2J")
+	fmt.Fprintf(b.out, "\x1b[1m%v\x1b[0m\r\n", fit(v.title))
+	if v.kind == viewDetail {
+		fmt.Fprint(b.out, "\r\n")
+	} else {
+		fmt.Fprintf(b.out, "%v\r\n", fit(fmt.Sprintf("/ %v   (%d of %d)", v.filter, len(v.visible()), len(v.items))))
+	}
+
+	rows := height - 3
+	if v.cursor < v.offset {
+		v.offset = v.cursor
+	}
+	if v.cursor >= v.offset+rows {
+		v.offset = v.cursor - rows + 1
+	}
+	if v.kind == viewDetail {
+		for i := v.offset; i < len(v.lines) && i < v.offset+rows; i++ {
+			fmt.Fprintf(b.out, "%v\r\n", fit(v.lines[i]))
+		}
+	} else {
+		items := v.visible()
+		for i := v.offset; i < len(items) && i < v.offset+rows; i++ {
+			line := fit("  " + items[i].label)
+			if i == v.cursor {
+				line = "\x1b[7m" + line + "\x1b[0m"
+			}
+			fmt.Fprintf(b.out, "%v\r\n", line)
+		}
+	}
+
+	status := b.status
+	if status == "" {
+		status = b.logged.line
+	}
+	if status == "" {
+		status = "enter open · esc back · ^X delete · ^R reload · ^C quit · type to filter"
+	}
+	fmt.Fprintf(b.out, "\x1b[%d;1H\x1b[2m%v\x1b[0m", height, fit(status))
+	b.out.Flush()
+}
+
+// showStatus renders s in the status line right away, e.g. while loading.
+func (b *browser) showStatus(s string) {
+	b.status = s
+	b.render()
+}
+
+func registriesView() *browseView {
+	v := &browseView{kind: viewRegistries, title: "registries"}
+	for _, reg := range localConf.Registries {
+		v.items = append(v.items, browseItem{label: fmt.Sprintf("%-20v %v", reg.name(), reg.displayAddr()), key: reg.name(), reg: reg})
+	}
+	return v
+}
+
+func (b *browser) reposView(reg *Registry) (*browseView, error) {
+	b.showStatus(fmt.Sprintf("listing the repositories of %v…", reg.name()))
+	repos, err := listRepos(b.ctx, reg)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repos)
+	v := &browseView{kind: viewRepos, title: reg.name(), reg: reg}
+	for _, repo := range repos {
+		v.items = append(v.items, browseItem{label: repo, key: repo, reg: reg})
+	}
+	return v, nil
+}
+
+func (b *browser) tagsView(reg *Registry, repo string) (*browseView, error) {
+	b.showStatus(fmt.Sprintf("fetching the tags of %v…", repo))
+	result, errs := getInfoOfRepos(b.ctx, reg, []string{repo})
+	if len(errs) > 0 && len(result[repo]) == 0 {
+		return nil, fmt.Errorf("%v", errs[0])
+	}
+	tags := result[repo]
+	width := 0
+	for _, tag := range tags {
+		if len(tag.Tag) > width && len(tag.Tag) <= 40 {
+			width = len(tag.Tag)
+		}
+	}
+	v := &browseView{kind: viewTags, title: reg.name() + " › " + repo, reg: reg, repo: repo}
+	for i := range tags {
+		tag := &tags[i]
+		label := fmt.Sprintf("%-*v  %v  %9v  %v", width, tag.Tag, time.Time(tag.Created).Format(TimeOutputLayout), humanBytes(tag.Size), shortDigest(tag.Digest))
+		if len(tag.SameDigest) > 0 {
+			label += "  = " + strings.Join(tag.SameDigest, ", ")
+		}
+		v.items = append(v.items, browseItem{label: label, key: tag.Tag, reg: reg, tag: tag})
+	}
+	if len(errs) > 0 {
+		log.Printf("%d tags could not be fetched: %v", len(errs), errs[0])
+	}
+	return v, nil
+}
+
+func (b *browser) detailView(reg *Registry, repo string, tag string) (*browseView, error) {
+	b.showStatus(fmt.Sprintf("inspecting %v:%v…", repo, tag))
+	info, err := inspectImage(b.ctx, reg, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	j, err := marshalJson(info)
+	if err != nil {
+		return nil, err
+	}
+	return &browseView{kind: viewDetail, title: reg.name() + " › " + repo + ":" + tag, reg: reg, repo: repo, lines: strings.Split(string(j), "\n")}, nil
+}
+
+// open drills into the selected row of the top view.
+func (b *browser) open() error {
+	v := b.top()
+	items := v.visible()
+	if v.kind == viewDetail || len(items) == 0 {
+		return nil
+	}
+	item := items[v.cursor]
+	var next *browseView
+	var err error
+	switch v.kind {
+	case viewRegistries:
+		next, err = b.reposView(item.reg)
+	case viewRepos:
+		next, err = b.tagsView(item.reg, item.key)
+	case viewTags:
+		next, err = b.detailView(item.reg, v.repo, item.key)
+	}
+	if err != nil {
+		return err
+	}
+	b.views = append(b.views, next)
+	b.status = ""
+	return nil
+}
+
+func (b *browser) reload() error {
+	v := b.top()
+	var fresh *browseView
+	var err error
+	switch v.kind {
+	case viewRegistries:
+		return nil
+	case viewRepos:
+		fresh, err = b.reposView(v.reg)
+	case viewTags:
+		fresh, err = b.tagsView(v.reg, v.repo)
+	case viewDetail:
+		fresh, err = b.detailView(v.reg, v.repo, strings.TrimPrefix(v.title, v.reg.name()+" › "+v.repo+":"))
+	}
+	if err != nil {
+		return err
+	}
+	fresh.filter, fresh.cursor = v.filter, v.cursor
+	if n := fresh.rows(); fresh.cursor >= n {
+		fresh.cursor = n - 1
+	}
+	if fresh.cursor < 0 {
+		fresh.cursor = 0
+	}
+	b.views[len(b.views)-1] = fresh
+	b.status = ""
+	return nil
+}
+
+// delete deletes the manifest of the selected tag after asking, as that
+// removes every tag pointing at it.
+func (b *browser) delete() error {
+	v := b.top()
+	items := v.visible()
+	if v.kind != viewTags || len(items) == 0 {
+		return nil
+	}
+	tag := items[v.cursor].tag
+	if !v.reg.capabilities(b.ctx).Delete {
+		return fmt.Errorf("%v does not allow deleting manifests", v.reg.name())
+	}
+	tags := append([]string{tag.Tag}, tag.SameDigest...)
+	b.showStatus(fmt.Sprintf("delete %v@%v, tagged %v? [y/N]", v.repo, shortDigest(tag.Digest), strings.Join(tags, ", ")))
+	key, err := readKey()
+	if err != nil || key != "y" && key != "Y" {
+		b.status = ""
+		return err
+	}
+	err = deleteManifest(b.ctx, v.reg, v.repo, tag.Digest)
+	if err != nil {
+		return err
+	}
+	if err = b.reload(); err != nil {
+		return err
+	}
+	b.status = fmt.Sprintf("deleted %v@%v", v.repo, shortDigest(tag.Digest))
+	return nil
+}
+
+func (b *browser) handle(key string) (quit bool, err error) {
+	v := b.top()
+	n := v.rows()
+	_, height := termSize()
+	page := height - 3
+	b.status, b.logged.line = "", ""
+	switch key {
+	case "":
+	case keyQuit:
+		return true, nil
+	case keyUp:
+		v.cursor--
+	case keyDown:
+		v.cursor++
+	case keyPageUp:
+		v.cursor -= page
+	case keyPageDown:
+		v.cursor += page
+	case keyHome:
+		v.cursor = 0
+	case keyEnd:
+		v.cursor = n - 1
+	case keyEnter:
+		err = b.open()
+	case keyBack:
+		if len(b.views) > 1 {
+			b.views = b.views[:len(b.views)-1]
+		}
+	case keyErase:
+		if v.filter != "" {
+			_, size := utf8.DecodeLastRuneInString(v.filter)
+			v.filter = v.filter[:len(v.filter)-size]
+			v.cursor = 0
+		}
+	case keyDelete:
+		err = b.delete()
+	case keyReload:
+		err = b.reload()
+	default:
+		if v.kind != viewDetail {
+			v.filter += key
+			v.cursor, v.offset = 0, 0
+		}
+	}
+	v = b.top()
+	if n = v.rows(); v.cursor >= n {
+		v.cursor = n - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	return false, err
+}
+
+func browse(ctx context.Context, args []string) {
+	fs := commandFlags("browse")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		exit(2)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		fatal("browse needs a terminal")
+	}
+
+	progressAllowed = false
+	b := &browser{ctx: ctx, out: bufio.NewWriter(os.Stdout), logged: &lastLine{}}
+	b.views = []*browseView{registriesView()}
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fatal(err)
+	}
+	logOutput := log.Writer()
+	log.SetOutput(b.logged)
+	fmt.Fprint(b.out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(b.out, "\x1b[?25h\x1b[?1049l")
+		b.out.Flush()
+		term.Restore(int(os.Stdin.Fd()), state)
+		log.SetOutput(logOutput)
+	}()
+
+	if fs.NArg() == 1 {
+		v, err := b.reposView(resolveRegistry(fs.Arg(0)))
+		if err != nil {
+			b.status = err.Error()
+		} else {
+			b.views = append(b.views, v)
+			b.status = ""
+		}
+	}
+	for ctx.Err() == nil {
+		b.render()
+		key, err := readKey()
+		if err != nil {
+			return
+		}
+		quit, err := b.handle(key)
+		if quit {
+			return
+		}
+		if err != nil {
+			b.status = err.Error()
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var noCacheFlag = flag.Bool("no-cache", false, "neither use nor update the response cache")
+
+// maxCachedBody is the largest response body kept in the cache. Catalogs,
+// tag lists, manifests and image configs fit; layers are passed through.
+const maxCachedBody = 4 << 20
+
+// Limits of the cache unless configured otherwise.
+const (
+	defaultCacheMaxAge  = 7 * 24 * time.Hour
+	defaultCacheMaxSize = 256 << 20
+)
+
+// CacheConfig sets up the on-disk response cache, e.g. {"ttl": "10m"}.
+// Responses younger than the ttl are used without asking the registry, older
+// ones are revalidated with If-None-Match or If-Modified-Since. Manifests and
+// blobs fetched by digest never change and are used without asking while
+// the tag list of their repository does not change. Responses not fetched
+// or revalidated for maxAge are dropped, and the oldest go first when the
+// cache grows beyond maxSize, e.g. "512MiB".
+type CacheConfig struct {
+	Dir      string `json:"dir"`
+	TTL      string `json:"ttl"`
+	MaxAge   string `json:"maxAge"`
+	MaxSize  string `json:"maxSize"`
+	Disabled bool   `json:"disabled"`
+
+	ttl     time.Duration
+	maxAge  time.Duration
+	maxSize int64
+}
+
+func (c *CacheConfig) setup() (err error) {
+	if c.TTL != "" {
+		c.ttl, err = parseAge(c.TTL)
+		if err != nil {
+			return fmt.Errorf("cache: invalid ttl %q", c.TTL)
+		}
+	}
+	if c.MaxAge != "" {
+		c.maxAge, err = parseAge(c.MaxAge)
+		if err != nil || c.maxAge <= 0 {
+			return fmt.Errorf("cache: invalid maxAge %q", c.MaxAge)
+		}
+	}
+	if c.MaxSize != "" {
+		words := strings.Fields(c.MaxSize)
+		size, used, err := parseQuerySize(words)
+		if err != nil || used != len(words) || size <= 0 {
+			return fmt.Errorf("cache: invalid maxSize %q", c.MaxSize)
+		}
+		c.maxSize = size
+	}
+	return nil
+}
+
+// cacheSettings returns the settings of the response cache, or nil when
+// caching is off.
+func cacheSettings() *CacheConfig {
+	conf := CacheConfig{}
+	if localConf.Cache != nil {
+		conf = *localConf.Cache
+	}
+	if *noCacheFlag || conf.Disabled {
+		return nil
+	}
+	if conf.Dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil
+		}
+		conf.Dir = filepath.Join(base, configDirName, "responses")
+	}
+	if conf.maxAge == 0 {
+		conf.maxAge = defaultCacheMaxAge
+	}
+	if conf.maxSize == 0 {
+		conf.maxSize = defaultCacheMaxSize
+	}
+	return &conf
+}
+
+var trimCacheOnce sync.Once
+
+// trimCache drops the responses of dir stored longer than maxAge ago, then
+// the oldest while the rest is larger than maxSize. Entries are rewritten
+// whenever they are fetched or revalidated, so their modification time is
+// when they were last known to be current.
+func trimCache(dir string, maxAge time.Duration, maxSize int64) {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if time.Since(info.ModTime()) > maxAge {
+			os.Remove(path)
+			return nil
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		os.Remove(e.path)
+		total -= e.size
+	}
+}
+
+type cachedResponse struct {
+	URL        string
+	Accept     string `json:",omitempty"`
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Stored     time.Time
+}
+
+func (c *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %v", c.StatusCode, http.StatusText(c.StatusCode)),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
+
+// cacheTransport answers GET requests from the cache directory where it can
+// and keeps what the registry returns.
+type cacheTransport struct {
+	base   http.RoundTripper
+	dir    string
+	ttl    time.Duration
+	maxAge time.Duration
+	scope  string
+}
+
+// changedRepos are the repositories, by cache scope, whose tag list this run
+// fetched and found changed, or had not cached; what their manifests by
+// digest were is revalidated rather than trusted, as a changed tag list may
+// come with deleted manifests.
+var changedRepos sync.Map
+
+// immutable reports whether url addresses content by digest.
+func immutable(url string) bool {
+	return strings.Contains(url, "/manifests/sha256:") || strings.Contains(url, "/blobs/sha256:")
+}
+
+// repoOf returns the repository of a /v2/<repo>/<endpoint>/... path, or "".
+func repoOf(path string, endpoint string) string {
+	i := strings.Index(path, "/v2/")
+	j := strings.LastIndex(path, "/"+endpoint+"/")
+	if i < 0 || j <= i+4 {
+		return ""
+	}
+	return path[i+4 : j]
+}
+
+// trusted reports whether the cached response of req may be used without
+// asking the registry.
+func (t *cacheTransport) trusted(req *http.Request, cached *cachedResponse) bool {
+	if time.Since(cached.Stored) >= t.maxAge {
+		return false
+	}
+	if !immutable(req.URL.String()) {
+		return time.Since(cached.Stored) < t.ttl
+	}
+	if repo := repoOf(req.URL.Path, "manifests"); repo != "" {
+		_, changed := changedRepos.Load(t.scope + "\n" + repo)
+		return !changed
+	}
+	return true
+}
+
+func tagList(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/tags/list") && repoOf(req.URL.Path, "tags") != ""
+}
+
+// noteTags records whether the tag list of the response to req changed
+// since it was cached, if req asks for one.
+func (t *cacheTransport) noteTags(req *http.Request, cached *cachedResponse, body []byte) {
+	if !tagList(req) {
+		return
+	}
+	if cached == nil || !bytes.Equal(cached.Body, body) {
+		changedRepos.Store(t.scope+"\n"+repoOf(req.URL.Path, "tags"), true)
+	}
+}
+
+func (t *cacheTransport) path(url string) string {
+	sum := sha256.Sum256([]byte(t.scope + "\n" + url))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(t.dir, key[:2], key)
+}
+
+func (t *cacheTransport) load(url string) *cachedResponse {
+	b, err := ioutil.ReadFile(t.path(url))
+	if err != nil {
+		return nil
+	}
+	var c cachedResponse
+	if json.Unmarshal(b, &c) != nil || c.URL != url {
+		return nil
+	}
+	return &c
+}
+
+// store writes c atomically. The cache is only an optimization, so failing
+// to write it is not an error.
+func (t *cacheTransport) store(c *cachedResponse) {
+	path := t.path(c.URL)
+	if os.MkdirAll(filepath.Dir(path), 0700) != nil {
+		return
+	}
+	j, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(j)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		debugf(LogRequests, logFields{Err: err}, "caching %v: %v", c.URL, err)
+		os.Remove(tmp.Name())
+	}
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// deleting or pushing changes what the url serves
+		os.Remove(t.path(url))
+		return t.base.RoundTrip(req)
+	}
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.base.RoundTrip(req)
+	}
+	accept := req.Header.Get("Accept")
+	cached := t.load(url)
+	if cached != nil && cached.Accept != accept {
+		cached = nil
+	}
+	if cached != nil && t.trusted(req, cached) {
+		debugf(LogRequests, logFields{URL: req.URL}, "%v %v: cached", req.Method, url)
+		requestStats.cacheHit()
+		return cached.response(req), nil
+	}
+	conditional := req
+	if cached != nil {
+		etag, modified := cached.Header.Get("ETag"), cached.Header.Get("Last-Modified")
+		if etag != "" || modified != "" {
+			conditional = req.Clone(req.Context())
+			if etag != "" {
+				conditional.Header.Set("If-None-Match", etag)
+			}
+			if modified != "" {
+				conditional.Header.Set("If-Modified-Since", modified)
+			}
+		}
+	}
+
+	res, err := t.base.RoundTrip(conditional)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		cached.Stored = time.Now()
+		t.store(cached)
+		requestStats.cacheHit()
+		return cached.response(req), nil
+	}
+	if res.StatusCode == http.StatusNotFound && cached != nil {
+		// deleted, or garbage collected
+		os.Remove(t.path(url))
+	}
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+	if !immutable(url) && !tagList(req) && t.ttl == 0 && res.Header.Get("ETag") == "" && res.Header.Get("Last-Modified") == "" {
+		// would be fetched again on every use anyway; tag lists are kept
+		// to tell whether they changed
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCachedBody+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	t.noteTags(req, cached, body)
+	if len(body) > maxCachedBody {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.store(&cachedResponse{
+		URL:        url,
+		Accept:     accept,
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+		Stored:     time.Now(),
+	})
+	return res, nil
+}
+
+// cacheTransport wraps rt with the response cache unless it is turned off.
+// Entries are kept apart per registry and credentials, as registries answer
+// differently depending on who asks. The first use of the cache in a run
+// trims it to its limits.
+func (reg *Registry) cacheTransport(rt http.RoundTripper) http.RoundTripper {
+	conf := cacheSettings()
+	if conf == nil {
+		return rt
+	}
+	trimCacheOnce.Do(func() {
+		trimCache(conf.Dir, conf.maxAge, conf.maxSize)
+	})
+	return &cacheTransport{base: rt, dir: conf.Dir, ttl: conf.ttl, maxAge: conf.maxAge, scope: reg.key() + "\n" + reg.credentialsKey()}
+}
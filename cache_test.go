@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCacheRevalidatesDigestsOfChangedRepos checks that manifests fetched
+// by digest are served from the cache while the tag list of their
+// repository stays the same, and asked for again, then dropped once
+// deleted, after it changed.
+func TestCacheRevalidatesDigestsOfChangedRepos(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		tags     = `{"name":"app","tags":["v1","v2"]}`
+		deleted  bool
+		requests = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/v2/app/tags/list":
+			w.Write([]byte(tags))
+		case "/v2/app/manifests/sha256:1234":
+			if deleted {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("ETag", `"sha256:1234"`)
+			if r.Header.Get("If-None-Match") == `"sha256:1234"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte(`{"schemaVersion":2}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ct := &cacheTransport{base: http.DefaultTransport, dir: t.TempDir(), maxAge: time.Hour, scope: "test"}
+	client := &http.Client{Transport: ct}
+	get := func(path string) int {
+		t.Helper()
+		res, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[path]
+	}
+	const manifest = "/v2/app/manifests/sha256:1234"
+
+	get(manifest)
+	get(manifest)
+	if n := count(manifest); n != 1 {
+		t.Fatalf("manifest by digest fetched %d times, want 1", n)
+	}
+	// the first tag list of a run counts as changed, as nothing was cached
+	get("/v2/app/tags/list")
+	get(manifest)
+	if n := count(manifest); n != 2 {
+		t.Fatalf("manifest fetched %d times after the tag list was first fetched, want 2", n)
+	}
+
+	changedRepos.Delete("test\napp")
+	get("/v2/app/tags/list")
+	get(manifest)
+	if n := count(manifest); n != 2 {
+		t.Fatalf("manifest fetched %d times with an unchanged tag list, want 2", n)
+	}
+
+	mu.Lock()
+	tags, deleted = `{"name":"app","tags":["v2"]}`, true
+	mu.Unlock()
+	get("/v2/app/tags/list")
+	if status := get(manifest); status != http.StatusNotFound {
+		t.Fatalf("deleted manifest answered with %d from the cache", status)
+	}
+	if _, err := os.Stat(ct.path(srv.URL + manifest)); !os.IsNotExist(err) {
+		t.Errorf("deleted manifest still cached: %v", err)
+	}
+	changedRepos.Delete("test\napp")
+}
+
+func TestTrimCache(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		stamp := time.Now().Add(-age)
+		os.Chtimes(path, stamp, stamp)
+		return path
+	}
+	expired := write("expired", 10, 48*time.Hour)
+	oldest := write("oldest", 100, 3*time.Hour)
+	older := write("older", 100, 2*time.Hour)
+	newest := write("newest", 100, time.Hour)
+
+	trimCache(dir, 24*time.Hour, 250)
+	for path, kept := range map[string]bool{expired: false, oldest: false, older: true, newest: true} {
+		if _, err := os.Stat(path); (err == nil) != kept {
+			t.Errorf("%v: kept %v, want %v", filepath.Base(path), err == nil, kept)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CapabilityCatalog       = "catalog"
+	CapabilityTagPagination = "tag-pagination"
+	CapabilityDelete        = "delete"
+	CapabilityReferrers     = "referrers"
+	CapabilityHeadManifest  = "head-manifest"
+
+	// a well-formed digest no registry stores, used to probe endpoints without side effects
+	probeDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// Capabilities records which optional parts of the distribution API a
+// registry serves, so the scan can work around missing ones once instead of
+// failing on every repository.
+type Capabilities struct {
+	Catalog       bool
+	TagPagination bool
+	Delete        bool
+	Referrers     bool
+	HeadManifest  bool
+
+	// Harbor is set when the registry also serves the Harbor REST API
+	Harbor bool
+
+	// err is why the registry could not be probed, e.g. a failed login or
+	// an unreachable host; what it supports is then unknown and assumed to
+	// be the whole API, and the requests of the scan report the error
+	err error
+}
+
+func (c *Capabilities) unsupported() []string {
+	if c.err != nil {
+		return nil
+	}
+	var names []string
+	for _, f := range []struct {
+		name      string
+		supported bool
+	}{
+		{CapabilityCatalog, c.Catalog},
+		{CapabilityTagPagination, c.TagPagination},
+		{CapabilityDelete, c.Delete},
+		{CapabilityReferrers, c.Referrers},
+		{CapabilityHeadManifest, c.HeadManifest},
+	} {
+		if !f.supported {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// reprobeAfter is how long a failed probe is kept before the next use of
+// the registry probes it again, so that a registry down when a long-running
+// mode started is not worked around for the life of the process.
+const reprobeAfter = time.Minute
+
+// capabilities probes reg on first use, and again once a failed probe is
+// older than reprobeAfter. Registries with a dedicated backend are assumed
+// to support the whole API.
+func (reg *Registry) capabilities(ctx context.Context) *Capabilities {
+	reg.probeMu.Lock()
+	defer reg.probeMu.Unlock()
+	if reg.caps != nil && (reg.caps.err == nil || time.Since(reg.probedAt) < reprobeAfter) {
+		return reg.caps
+	}
+	defer phase("probe")()
+	switch reg.Type {
+	case "":
+		reg.caps = probeCapabilities(ctx, reg)
+		_, reg.caps.Harbor = harborVersion(ctx, reg)
+	default:
+		reg.caps = &Capabilities{
+			Catalog:       true,
+			TagPagination: true,
+			Delete:        true,
+			Referrers:     true,
+			HeadManifest:  true,
+			Harbor:        reg.Type == "harbor",
+		}
+	}
+	reg.probedAt = time.Now()
+	if ctx.Err() != nil {
+		// a canceled probe tells nothing about the registry
+		reg.probedAt = time.Time{}
+	}
+	if reg.DeleteEnabled != nil {
+		reg.caps.Delete = *reg.DeleteEnabled
+	}
+	if reg.caps.err != nil {
+		logEvent(LevelWarn, logFields{Registry: reg.name(), Err: reg.caps.err}, "%v", reg.caps.err)
+	}
+	// a missing catalog is reported by what lists it, not by every command
+	var unsupported []string
+	for _, name := range reg.caps.unsupported() {
+		if name != CapabilityCatalog {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) > 0 {
+		logEvent(LevelWarn, logFields{Registry: reg.name()}, "%v does not support: %v", reg.displayAddr(), strings.Join(unsupported, ", "))
+	}
+	return reg.caps
+}
+
+// probeCapabilities finds out what reg supports with read requests only.
+// Without a catalog to take a repository from, the repository endpoints are
+// assumed to be supported; tag pagination, HEAD requests and the referrers
+// API fall back to what every registry serves when they turn out not to be.
+func probeCapabilities(ctx context.Context, reg *Registry) *Capabilities {
+	// whether deletes are enabled is unknown until one is tried, unless
+	// the registry tells with an Allow header
+	c := &Capabilities{Delete: true}
+	res, err := probe(ctx, reg, http.MethodGet, fmt.Sprintf("%v/v2/_catalog?n=1", reg.Addr))
+	if err != nil {
+		c.err = fmt.Errorf("probing %v: %v", reg.displayAddr(), err)
+		return c.assumeAll()
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound, res.StatusCode == http.StatusMethodNotAllowed, res.StatusCode == http.StatusNotImplemented:
+		c.TagPagination, c.Referrers, c.HeadManifest = true, true, true
+		return c
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		// tokens without registry-wide scope may not list the catalog
+		debugf(LogRequests, logFields{Registry: reg.name()}, "probing %v: GET /v2/_catalog: %v", reg.displayAddr(), res.Status)
+		return c.assumeAll()
+	case res.StatusCode/100 != 2:
+		c.err = fmt.Errorf("probing %v: GET /v2/_catalog: %v", reg.displayAddr(), res.Status)
+		return c.assumeAll()
+	}
+	c.Catalog = true
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&catalog); err != nil || len(catalog.Repositories) == 0 {
+		// nothing to probe the repository endpoints with
+		c.TagPagination, c.Referrers, c.HeadManifest = true, true, true
+		return c
+	}
+	repo := catalog.Repositories[0]
+
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	header, err := getJson(ctx, reg, fmt.Sprintf("%v/v2/%v/tags/list?n=1", reg.Addr, repo), &list)
+	if err != nil {
+		debugf(LogRequests, logFields{Registry: reg.name(), Repo: repo, Err: err}, "probing the tags of %v: %v", repo, err)
+		return c
+	}
+	tags := list.Tags
+	c.TagPagination = header.Get("Link") != "" || len(tags) <= 1
+
+	if res, err := probe(ctx, reg, http.MethodOptions, fmt.Sprintf("%v/v2/%v/manifests/%v", reg.Addr, repo, probeDigest)); err == nil {
+		res.Body.Close()
+		if allow := res.Header.Get("Allow"); allow != "" {
+			c.Delete = strings.Contains(strings.ToUpper(allow), http.MethodDelete)
+		}
+	}
+	c.Referrers = probeStatus(ctx, reg, http.MethodGet, fmt.Sprintf("%v/v2/%v/referrers/%v", reg.Addr, repo, probeDigest)) == http.StatusOK
+	if len(tags) > 0 {
+		status := probeStatus(ctx, reg, http.MethodHead, fmt.Sprintf("%v/v2/%v/manifests/%v", reg.Addr, repo, tags[0]))
+		c.HeadManifest = status >= 200 && status < 300
+	}
+	return c
+}
+
+// assumeAll marks the API as supported where the probe could not tell.
+func (c *Capabilities) assumeAll() *Capabilities {
+	c.Catalog, c.TagPagination, c.Referrers, c.HeadManifest = true, true, true, true
+	return c
+}
+
+func probe(ctx context.Context, reg *Registry, method string, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = manifestAcceptHeader()
+	return reg.client().Do(req)
+}
+
+func probeStatus(ctx context.Context, reg *Registry, method string, url string) int {
+	res, err := probe(ctx, reg, method, url)
+	if err != nil {
+		return 0
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
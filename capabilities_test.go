@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probedRegistry serves what probeCapabilities looks at, leaving out the
+// endpoints not set.
+type probedRegistry struct {
+	repos         []string
+	noCatalog     bool
+	catalogStatus int
+	tags          []string
+	link          bool
+	noDelete      bool
+	referrers     bool
+	noHead        bool
+	methodsHit    []string
+}
+
+func (p *probedRegistry) serve(t *testing.T) *Registry {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.methodsHit = append(p.methodsHit, r.Method)
+		switch {
+		case r.URL.Path == "/v2/_catalog":
+			if p.noCatalog {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if p.catalogStatus != 0 {
+				w.WriteHeader(p.catalogStatus)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]string{"repositories": p.repos})
+		case strings.HasSuffix(r.URL.Path, "/tags/list"):
+			if p.link {
+				w.Header().Set("Link", `</v2/app/tags/list?n=1&last=a>; rel="next"`)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "app", "tags": p.tags})
+		case strings.Contains(r.URL.Path, "/referrers/"):
+			if !p.referrers {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"schemaVersion": 2, "manifests": []string{}})
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			switch {
+			case r.Method == http.MethodOptions && p.noDelete:
+				w.Header().Set("Allow", "GET, HEAD, PUT")
+			case r.Method == http.MethodOptions:
+				w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			case r.Method == http.MethodHead && p.noHead:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			case r.Method == http.MethodHead:
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return &Registry{Addr: s.URL}
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry probedRegistry
+		want     []string
+	}{
+		{"full API", probedRegistry{repos: []string{"app"}, tags: []string{"a", "b"}, link: true, referrers: true}, nil},
+		{"no catalog", probedRegistry{noCatalog: true}, []string{CapabilityCatalog}},
+		// tokens without registry-wide scope may not list the catalog
+		{"catalog unauthorized", probedRegistry{catalogStatus: http.StatusUnauthorized}, nil},
+		{"catalog forbidden", probedRegistry{catalogStatus: http.StatusForbidden}, nil},
+		{"empty catalog", probedRegistry{}, nil},
+		{"one tag needs no pages", probedRegistry{repos: []string{"app"}, tags: []string{"a"}}, []string{CapabilityReferrers}},
+		{"no pages", probedRegistry{repos: []string{"app"}, tags: []string{"a", "b"}, referrers: true}, []string{CapabilityTagPagination}},
+		{"no delete, no HEAD", probedRegistry{repos: []string{"app"}, tags: []string{"a"}, noDelete: true, noHead: true, referrers: true}, []string{CapabilityDelete, CapabilityHeadManifest}},
+	}
+	for _, tt := range tests {
+		reg := tt.registry.serve(t)
+		if got := probeCapabilities(context.Background(), reg).unsupported(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: unsupported %v, want %v", tt.name, got, tt.want)
+		}
+		for _, method := range tt.registry.methodsHit {
+			if method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions {
+				t.Errorf("%v: probed with %v", tt.name, method)
+			}
+		}
+	}
+}
+
+func TestProbeErrors(t *testing.T) {
+	noRetries := 0
+	p := &probedRegistry{catalogStatus: http.StatusInternalServerError}
+	reg := p.serve(t)
+	reg.Retries = &noRetries
+	if c := probeCapabilities(context.Background(), reg); c.err == nil || !c.Catalog || !c.HeadManifest || !c.TagPagination || !c.Referrers {
+		t.Errorf("catalog answering 500: %+v, want the error and the whole API assumed", c)
+	}
+	p = &probedRegistry{catalogStatus: http.StatusUnauthorized}
+	if c := probeCapabilities(context.Background(), p.serve(t)); c.err != nil || !c.Catalog {
+		t.Errorf("catalog answering 401: %+v, want no error and the catalog assumed", c)
+	}
+	reg = &Registry{Addr: "http://127.0.0.1:1", Retries: &noRetries}
+	if c := probeCapabilities(context.Background(), reg); c.err == nil {
+		t.Error("unreachable registry probed without an error")
+	}
+}
+
+// TestReprobeAfterError checks that a failed probe is only kept for a
+// while, as the long-running modes would otherwise keep working around a
+// registry that was down when they started.
+func TestReprobeAfterError(t *testing.T) {
+	noRetries := 0
+	p := &probedRegistry{catalogStatus: http.StatusBadGateway, repos: []string{"app"}, tags: []string{"a"}, noHead: true}
+	reg := p.serve(t)
+	reg.Retries = &noRetries
+	if c := reg.capabilities(context.Background()); c.err == nil {
+		t.Fatal("probe of a failing registry without an error")
+	}
+	p.catalogStatus = 0
+	if c := reg.capabilities(context.Background()); c.err == nil {
+		t.Error("failed probe not kept for a while")
+	}
+	reg.probedAt = time.Now().Add(-reprobeAfter)
+	if c := reg.capabilities(context.Background()); c.err != nil || c.HeadManifest {
+		t.Errorf("registry not probed again: %+v", c)
+	}
+	hits := len(p.methodsHit)
+	reg.probedAt = time.Now().Add(-reprobeAfter)
+	reg.capabilities(context.Background())
+	if len(p.methodsHit) != hits {
+		t.Error("successful probe not kept")
+	}
+}
+
+func TestDeleteEnabled(t *testing.T) {
+	p := &probedRegistry{repos: []string{"app"}, tags: []string{"a"}, noDelete: true, referrers: true}
+	reg := p.serve(t)
+	enabled := true
+	reg.DeleteEnabled = &enabled
+	if c := reg.capabilities(context.Background()); !c.Delete {
+		t.Error("deleteEnabled in the config not taken over the Allow header")
+	}
+}
+
+func TestCapabilitiesOfDedicatedBackends(t *testing.T) {
+	p := &probedRegistry{noCatalog: true}
+	reg := p.serve(t)
+	reg.Type = "dockerhub"
+	if got := reg.capabilities(context.Background()).unsupported(); got != nil {
+		t.Errorf("unsupported %v, want none", got)
+	}
+	if len(p.methodsHit) > 0 {
+		t.Errorf("probed a %v registry: %v", reg.Type, p.methodsHit)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Command is a subcommand of the tool. Commands parse their own flags, so
+// new operations can be added without looking at os.Args.
+type Command struct {
+	Name     string
+	Synopsis string
+	Help     string
+	Run      func(ctx context.Context, args []string)
+}
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{"scan", "[-watch interval] [-signatures] [-only-unsigned] [-vulns] [-head-only|-no-detail] [-exclude-empty] <alias|addr>...", "List the tags of every repository with their creation time, digest and size. A bare alias or addr is short for scan. With -watch, rescan every interval and print only what changed. With -signatures, report whether each image is signed with cosign; -only-unsigned lists just the unsigned ones. With -vulns, run the configured vulnerability scanner on each image and add its findings by severity. -head-only only learns the digest of each tag with a HEAD request, and -no-detail stops at the tag lists. Repositories whose tags were all deleted are listed without tags unless -exclude-empty.", scan},
+		{"repos", "<alias|addr>", "List the repositories of a registry.", repos},
+		{"tags", "<alias|addr> <repo>...", "List every tag of some repositories, without truncation.", tags},
+		{"search", "[-tags] [-limit 20] <term> [alias|addr...]", "Find which registries have a repository, searching every configured registry in parallel by default. Repository names match the term exactly, as a whole or by their last path element, by prefix or fuzzily; with -tags, the tags of every repository are matched as well. Prints the best -limit hits, ranked, with the newest tag of each repository and when it was created.", search},
+		{"inspect", "[-referrers] [-history] <alias|addr> <repo>:<tag>|<repo>@<digest>", "Show the manifest, config and layers of an image. With -referrers, also list the signatures, SBOMs and attestations attached to it. With -history, also list the build steps of the image; with -output table, print them as an approximate Dockerfile.", inspect},
+		{"exists", "[-digest d] <alias|addr> <repo>:<tag>|<repo>@<digest>", "Check that a tag exists with a HEAD request on its manifest and print its digest. Exits with 1 when it does not, or when it does not point at -digest, so pipelines can gate on it without parsing JSON.", exists},
+		{"verify", "<alias|addr> <repo>:<tag>|<repo>@<digest>", "Check that the registry has every config and layer blob the manifest of an image references, and every platform manifest of an index, with a HEAD request each, reporting those missing or of another size than the manifest tells. Exits with 1 when any is.", verify},
+		{"retag", "<alias|addr> <repo>:<tag>|<repo>@<digest> <new-tag>", "Point another tag of the same repository at an image by uploading its manifest under the new tag, without pulling or pushing layers.", retagCommand},
+		{"delete", "[-dry-run] <alias|addr> <repo>:<tag>|<repo>@<digest>...", "Delete manifests. Deleting a tag deletes the manifest it points at, and with it every tag pointing there.", deleteImages},
+		{"prune", "[-keep n] [-older-than age] [-match pattern] [-yes] <alias|addr>", "Delete old tags, keeping the newest of every repository and every manifest a kept tag points at. Only reports what would be deleted without -yes.", prune},
+		{"du", "<alias|addr>...", "Report storage per repository: logical size counting every tag in full, unique size counting shared layers once, and the exclusive size deleting the repository would free.", du},
+		{"gc-estimate", "[-keep n] [-older-than age] [-match pattern] [-refs file] <alias|addr>", "Estimate the space garbage collection would reclaim after deleting what prune would, or the references of -refs, per repository. Layers surviving tags still reference are not counted.", gcEstimateCommand},
+		{"stale", "[-older-than 180d] <alias|addr>...", "List repositories whose newest tag is older than -older-than, oldest first, with their owning team when owners are configured.", staleCommand},
+		{"audit", "[-older-than 90d] [-out-dir dir] <alias|addr>...", "Write a CSV of the tags created longer ago than -older-than, oldest first, with their creation time, age in days, size, digest and owning team, to send to teams for cleanup sign-off. The owner comes from the owner labels of the image, else from the owners of the config. With -out-dir, one <owner>.csv is written per owner.", audit},
+		{"k8s-usage", "[-kubeconfig file] [-context name] [-namespace ns] [-unused] <alias|addr>...", "List the tags of registries with the workloads of a Kubernetes cluster using them, from its pods, deployments, stateful sets, daemon sets and cron jobs. With -unused, list only the images nothing in the cluster references.", k8sUsage},
+		{"browse", "[alias|addr]", "Browse registries in the terminal: pick a registry, type to filter its repositories, open one to see its tags with creation time, size and digest, inspect a tag or delete it.", browse},
+		{"config", "path|list|validate|add-registry|remove-registry ...", "Show, check and edit the config file. 'config add-registry [flags] <alias> <url>' adds a registry and 'config remove-registry <alias>...' removes registries; 'config validate' reports invalid fields and duplicate aliases.", config},
+		{"analyze", "owners|cost [flags] <alias|addr>", "Report storage per owning team or its cost.", analyze},
+		{"lock", "pin|verify [flags] ...", "Pin image references to digests and verify them later.", lock},
+		{"slo", "check <alias|addr>", "Check the freshness SLOs of the config.", slo},
+		{"snapshot", "save <file> <alias|addr> | diff <old> <new>", "Save which digest every tag points at to a file, and list the tags added, removed or retagged between two saved snapshots.", snapshot},
+		{"index", "[-db file] <alias|addr>...", "Scan registries into a local SQLite database for query.", index},
+		{"query", "[-db file] [-sql] <expression>", "Query the database written by index, e.g. 'tags older than 180 days in repos matching team/*'. With -sql the expression is plain SQL.", query},
+		{"export-delta", "[-since snapshot] [-o archive] <alias|addr>", "Archive what changed since the previous export, for air-gapped mirrors.", exportDelta},
+		{"apply-delta", "<archive> <alias|addr>", "Upload an archive written by export-delta.", applyDelta},
+		{"push", "[-chunk-size mib] [-mount-from repo] <layout|tarball> <alias|addr> <repo>[:tag]", "Upload the images of an OCI image layout, as a directory or tarball, or of docker save output to a repository, under their own tags or, for a single image, the tag given. Blobs the registry has are skipped, large ones are uploaded in chunks.", push},
+		{"ping", "[alias|addr...]", "Check that registries answer GET /v2/: reachability, TLS, the authentication they ask for and whether the configured credentials pass, the API version header and latency. Pings every configured registry by default and exits with 1 if any is not ok.", pingCommand},
+		{"tls-info", "[-warn-days n] <alias|addr>...", "Report the certificate chain of registry endpoints.", tlsInfo},
+		{"listen", "[-listen addr] [-token t] [-db file] <alias|addr>...", "Scan registries once, then keep their tags up to date from the notifications they send to /events on push and delete instead of rescanning, printing every tag added, removed or retagged like scan -watch. With -db, the tags are kept in that index database too.", listenForEvents},
+		{"serve", "[-listen addr] [-cache-ttl d] [-no-ui] [-events] [-events-token t]", "Serve the configured registries over a REST API: GET /registries, /registries/<alias>/repos, /registries/<alias>/repos/<repo>/tags and /repos/<repo>/tags?registry=<alias>. Lists are cached for -cache-ttl. A web browser over the API is served at / unless -no-ui is given. With -events, registry notifications received at /events drop the cached lists of the repositories they change.", serve},
+		{"daemon", "[-listen addr] [-snapshot-dir dir] [-cache-ttl d] [-no-ui]", "Scan the registries of the schedule of the config on their cron expressions, keep a snapshot of each in -snapshot-dir, send the tags changed between scans to the configured notification sinks and serve the latest results over the REST API of serve, with the state of the schedule at /schedule. Registries not in the schedule are fetched on request as by serve.", runDaemon},
+		{"exporter", "[-listen addr] [-interval d] [-events] [-events-token t] [alias|addr...]", "Scan registries every -interval and serve Prometheus metrics on /metrics: repository and tag counts, the creation time of the newest image, scan errors, certificate expiry and freshness SLOs. Scans every configured registry by default. With -events, registry notifications received at /events update the tags between scans.", exportMetrics},
+		{"completion", "bash|zsh|fish", "Print a shell completion script to source from the shell's startup file. Registry aliases complete from the config and repositories from the catalog of the registry named before them, cached for an hour.", completion},
+		{"help", "[command]", "Show help for a command.", help},
+	}
+	flag.Usage = usage
+}
+
+func findCommand(name string) (*Command, bool) {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+func printFlags(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		name, usage := flag.UnquoteUsage(f)
+		if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+			usage += fmt.Sprintf(" (default %v)", f.DefValue)
+		}
+		fmt.Fprintf(fs.Output(), "  %v\n    \t%v\n", strings.TrimSpace("-"+f.Name+" "+name), usage)
+	})
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %v [flags] <command> [command flags] [args]\n\ncommands:\n", programName)
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-13v %v\n", cmd.Name, strings.TrimSuffix(strings.SplitN(cmd.Help, ". ", 2)[0], "."))
+	}
+	fmt.Fprintf(out, "\nflags:\n")
+	printFlags(flag.CommandLine)
+	fmt.Fprintf(out, "\nRun '%v help <command>' for help on a command.\n", programName)
+}
+
+// commandFlags returns the flag set of the named command, printing its help
+// as usage.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		cmd, _ := findCommand(name)
+		fmt.Fprintf(fs.Output(), "usage: %v %v %v\n\n%v\n", programName, cmd.Name, cmd.Synopsis, cmd.Help)
+		if hasFlags(fs) {
+			fmt.Fprintf(fs.Output(), "\nflags:\n")
+			printFlags(fs)
+		}
+	}
+	return fs
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
+
+func help(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		flag.CommandLine.SetOutput(os.Stdout)
+		usage()
+		return
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		exit(2)
+	}
+	fmt.Printf("usage: %v %v %v\n\n%v\n\nRun '%v %v -h' for its flags.\n", programName, cmd.Name, cmd.Synopsis, cmd.Help, programName, cmd.Name)
+}
+
+func repos(ctx context.Context, args []string) {
+	fs := commandFlags("repos")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	list, err := listRepos(ctx, reg)
+	if err != nil {
+		fatal(err)
+	}
+	sort.Strings(list)
+	switch *outputFlag {
+	case OutputTable:
+		for _, name := range list {
+			fmt.Println(name)
+		}
+	case OutputRefs:
+		for _, repo := range list {
+			name, err := imageName(reg, repo)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Println(name)
+		}
+	default:
+		printJson(list)
+	}
+}
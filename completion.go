@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completionTTL is how long the repositories of a registry are completed
+// from the cache before the catalog is asked again.
+const completionTTL = time.Hour
+
+const bashCompletion = `_%[1]v() {
+	local IFS=$'\n'
+	COMPREPLY=($(compgen -W "$(%[2]v completion complete "${COMP_WORDS[@]:0:COMP_CWORD+1}" 2>/dev/null)" -- "${COMP_WORDS[COMP_CWORD]}"))
+}
+complete -o default -F _%[1]v %[2]v
+`
+
+const zshCompletion = `#compdef %[2]v
+
+_%[1]v() {
+	local -a candidates
+	candidates=("${(@f)$(%[2]v completion complete "${(@)words[1,CURRENT]}" 2>/dev/null)}")
+	if [[ -n $candidates[1] ]]; then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _%[1]v %[2]v
+`
+
+const fishCompletion = `complete -c %[2]v -f -a '(%[2]v completion complete (commandline -opc) (commandline -ct) 2>/dev/null)'
+`
+
+// argKind is what a positional argument of a command is, as its synopsis
+// names it.
+type argKind struct {
+	choices  []string
+	registry bool
+	repo     bool
+	repeated bool
+}
+
+var synopsisFlag = regexp.MustCompile(`\[(-[a-z-]+)( [a-z]+)?\]`)
+
+// parseSynopsis reads the flags and positional arguments of a command from
+// its synopsis, so completion follows the commands without a list of its own:
+// "[-keep n]" is a flag with a value, "<alias|addr>..." repeated registries.
+func parseSynopsis(synopsis string) (flags map[string]bool, args []argKind) {
+	flags = make(map[string]bool)
+	for _, m := range synopsisFlag.FindAllStringSubmatch(synopsis, -1) {
+		flags[m[1]] = m[2] != ""
+	}
+	for _, word := range strings.Fields(synopsisFlag.ReplaceAllString(synopsis, "")) {
+		if word == "|" || word == "[flags]" || word == "..." {
+			break
+		}
+		kind := argKind{repeated: strings.HasSuffix(strings.TrimSuffix(word, "]"), "...")}
+		switch {
+		case strings.Contains(word, "alias|addr"):
+			kind.registry = true
+		case strings.Contains(word, "<repo>"):
+			kind.repo = true
+		case !strings.ContainsAny(word, "<["):
+			kind.choices = strings.Split(word, "|")
+		}
+		args = append(args, kind)
+	}
+	return flags, args
+}
+
+// takesValue reports whether the global flag name is followed by a value.
+func takesValue(name string) bool {
+	f := flag.CommandLine.Lookup(strings.TrimLeft(name, "-"))
+	if f == nil || strings.Contains(name, "=") {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !b.IsBoolFlag()
+}
+
+func aliases() []string {
+	var names []string
+	for _, reg := range localConf.Registries {
+		if reg.Alias != "" {
+			names = append(names, reg.Alias)
+		}
+	}
+	return names
+}
+
+// cachedRepos returns the repositories of reg, from the cache while it is
+// younger than completionTTL. A registry that does not answer is completed
+// from an older cache, if any.
+func cachedRepos(ctx context.Context, reg *Registry) []string {
+	var cached struct {
+		Repos  []string
+		Stored time.Time
+	}
+	var path string
+	if dir, err := os.UserCacheDir(); err == nil {
+		sum := sha256.Sum256([]byte(reg.key()))
+		path = filepath.Join(dir, configDirName, "completion", hex.EncodeToString(sum[:8])+".json")
+		if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &cached) == nil {
+			if time.Since(cached.Stored) < completionTTL {
+				return cached.Repos
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	repos, err := listRepos(ctx, reg)
+	if err != nil {
+		return cached.Repos
+	}
+	sort.Strings(repos)
+	cached.Repos, cached.Stored = repos, time.Now()
+	if path != "" {
+		if data, err := json.Marshal(cached); err == nil && os.MkdirAll(filepath.Dir(path), 0700) == nil {
+			ioutil.WriteFile(path, data, 0600)
+		}
+	}
+	return repos
+}
+
+// complete returns the candidates for the last of words, the command line
+// being completed starting with the program name.
+func complete(ctx context.Context, words []string) []string {
+	if len(words) < 2 {
+		return nil
+	}
+	current := words[len(words)-1]
+	words = words[1 : len(words)-1]
+	for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+		if takesValue(words[0]) {
+			if len(words) == 1 {
+				return nil
+			}
+			words = words[1:]
+		}
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		if strings.HasPrefix(current, "-") {
+			var names []string
+			flag.CommandLine.VisitAll(func(f *flag.Flag) {
+				if !hiddenFlags[f.Name] {
+					names = append(names, "-"+f.Name)
+				}
+			})
+			return names
+		}
+		return append(commandNames(), aliases()...)
+	}
+
+	// a bare alias or addr is short for scan
+	synopsis := "<alias|addr>..."
+	cmd, ok := findCommand(words[0])
+	if ok {
+		synopsis = cmd.Synopsis
+		words = words[1:]
+	}
+	flags, kinds := parseSynopsis(synopsis)
+	if ok && cmd.Name == "help" {
+		kinds = []argKind{{choices: commandNames()}}
+	}
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		if strings.HasPrefix(words[i], "-") {
+			if flags[words[i]] {
+				i++
+			}
+			continue
+		}
+		positional = append(positional, words[i])
+	}
+	if len(words) > 0 && flags[words[len(words)-1]] {
+		return nil
+	}
+	if strings.HasPrefix(current, "-") {
+		var names []string
+		for name := range flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	n := len(positional)
+	if n >= len(kinds) {
+		if !kinds[len(kinds)-1].repeated {
+			return nil
+		}
+		n = len(kinds) - 1
+	}
+	switch kind := kinds[n]; {
+	case kind.registry:
+		return aliases()
+	case kind.repo:
+		// the repository of the registry named last before it
+		for i := n - 1; i >= 0; i-- {
+			if kinds[i].registry {
+				if strings.ContainsAny(current, ":@") {
+					return nil
+				}
+				return cachedRepos(ctx, resolveRegistry(positional[i]))
+			}
+		}
+	default:
+		return kind.choices
+	}
+	return nil
+}
+
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+func completion(ctx context.Context, args []string) {
+	fs := commandFlags("completion")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	function := strings.NewReplacer("-", "_", ".", "_").Replace(programName) + "_complete"
+	switch fs.Arg(0) {
+	case "bash":
+		fmt.Printf(bashCompletion, function, programName)
+	case "zsh":
+		fmt.Printf(zshCompletion, function, programName)
+	case "fish":
+		fmt.Printf(fishCompletion, function, programName)
+	case "complete":
+		for _, candidate := range complete(ctx, fs.Args()[1:]) {
+			fmt.Println(candidate)
+		}
+	default:
+		fs.Usage()
+		exit(2)
+	}
+}
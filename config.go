@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var configFlag = flag.String("config", "", "config file to use instead of $REGMAN_CONFIG or the default")
+
+// configPath returns the config file to use: the -config flag,
+// $REGMAN_CONFIG, the file in the home directory if it exists (where
+// earlier versions kept it), or config.json in the user config directory,
+// which is $XDG_CONFIG_HOME or ~/.config on Linux, %AppData% on Windows and
+// ~/Library/Application Support on macOS. Without any of those, such as in a
+// container without $HOME, the file is looked for in the working directory.
+func configPath() string {
+	if *configFlag != "" {
+		return *configFlag
+	}
+	if path := os.Getenv("REGMAN_CONFIG"); path != "" {
+		return path
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		legacy := filepath.Join(home, filepath.FromSlash(configFileName))
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, configDirName, "config.json")
+	}
+	return filepath.Base(configFileName)
+}
+
+var registryTypes = map[string]bool{
+	"":          true,
+	"dockerhub": true,
+	"ghcr":      true,
+	"gitlab":    true,
+	"gcr":       true,
+	"acr":       true,
+	"harbor":    true,
+}
+
+// jsonError adds the line and column to the position of a JSON error.
+func jsonError(b []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+	line := 1 + bytes.Count(b[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(b[:offset], '\n') - 1
+	return fmt.Errorf("line %d, column %d: %v", line, col, err)
+}
+
+// registryProblems lists what is wrong with the registries of conf, which
+// have not been set up yet.
+func registryProblems(conf *Config) []string {
+	var problems []string
+	seen := make(map[string]int)
+	for i, reg := range conf.Registries {
+		name := fmt.Sprintf("registry #%d", i+1)
+		if reg.Alias != "" {
+			name = fmt.Sprintf("registry %v (#%d)", reg.Alias, i+1)
+		}
+		add := func(format string, args ...interface{}) {
+			problems = append(problems, name+": "+fmt.Sprintf(format, args...))
+		}
+		if reg.Alias == "" {
+			add("no alias")
+		} else if first, ok := seen[strings.ToLower(reg.Alias)]; ok {
+			add("duplicate alias, only #%d is used", first)
+		} else {
+			seen[strings.ToLower(reg.Alias)] = i + 1
+		}
+		if !registryTypes[reg.Type] {
+			add("unknown type %q", reg.Type)
+		}
+		if reg.Host == "" && reg.Addr == "" && defaultHosts[reg.Type] == "" {
+			add("no host")
+		}
+		if reg.Schema != "" && reg.Schema != "http" && reg.Schema != "https" {
+			add("schema must be http or https, not %q", reg.Schema)
+		}
+		if reg.Port < 0 || reg.Port > 65535 {
+			add("port %d out of range", reg.Port)
+		}
+		if reg.RateLimit < 0 {
+			add("negative rateLimit")
+		}
+		if reg.MinRemaining < 0 {
+			add("negative minRemaining")
+		}
+		if reg.Retries != nil && *reg.Retries < 0 {
+			add("negative retries")
+		}
+		if err := reg.setup(); err != nil {
+			add("%v", err)
+		}
+	}
+	return problems
+}
+
+func validateConfig(path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var conf Config
+	err = decodeConfig(path, b, &conf)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := registryProblems(&conf)
+	if conf.Cache != nil {
+		if err := conf.Cache.setup(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if conf.Scanner != nil {
+		if err := conf.Scanner.setup(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, n := range conf.Notifications {
+		if err := n.setup(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, e := range conf.Schedule {
+		if err := e.setup(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, h := range conf.Hooks {
+		if err := h.setup(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	problems = append(problems, scheduleProblems(&conf)...)
+	return problems
+}
+
+// rawConfig is the config file as written, so that editing it keeps the
+// fields and sections it does not touch.
+type rawConfig struct {
+	fields     map[string]json.RawMessage
+	registries []map[string]interface{}
+}
+
+func readRawConfig(path string) (*rawConfig, error) {
+	if format := configFormat(path); format != ConfigFormatJson {
+		return nil, fmt.Errorf("%v: only JSON configs can be edited, edit this %v file by hand", path, format)
+	}
+	c := &rawConfig{fields: make(map[string]json.RawMessage)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &c.fields)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, jsonError(b, err))
+	}
+	if raw, ok := c.fields["registries"]; ok {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		err = d.Decode(&c.registries)
+		if err != nil {
+			return nil, fmt.Errorf("%v: registries: %v", path, err)
+		}
+	}
+	return c, nil
+}
+
+// write replaces the file at path, keeping its permissions.
+func (c *rawConfig) write(path string) error {
+	registries, err := json.Marshal(c.registries)
+	if err != nil {
+		return err
+	}
+	c.fields["registries"] = registries
+	b, err := json.MarshalIndent(c.fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(b, '\n'))
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *rawConfig) indexOf(alias string) int {
+	for i, reg := range c.registries {
+		if a, _ := reg["alias"].(string); strings.EqualFold(a, alias) {
+			return i
+		}
+	}
+	return -1
+}
+
+// registryEntry turns a registry url such as https://reg.example.org:5000/team
+// into the fields of a config entry.
+func registryEntry(alias string, addr string) (map[string]interface{}, error) {
+	if strings.HasPrefix(addr, "unix://") {
+		return map[string]interface{}{"alias": alias, "addr": addr}, nil
+	}
+	schema := "https"
+	if i := strings.Index(addr, "://"); i >= 0 {
+		schema, addr = addr[:i], addr[i+3:]
+	}
+	host, path := addr, ""
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		host, path = addr[:i], strings.Trim(addr[i:], "/")
+	}
+	entry := map[string]interface{}{"alias": alias, "schema": schema}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %q", addr)
+		}
+		host = h
+		entry["port"] = port
+	}
+	entry["host"] = host
+	if path != "" {
+		entry["path"] = path
+	}
+	return entry, nil
+}
+
+func configAddRegistry(args []string) {
+	fs := commandFlags("config")
+	typ := fs.String("type", "", "registry type: dockerhub, ghcr, gitlab, gcr, acr or harbor")
+	username := fs.String("username", "", "username to log in with")
+	password := fs.String("password", "", "password or token to log in with")
+	namespace := fs.String("namespace", "", "namespace, organization or group to list repositories of")
+	prefix := fs.String("prefix", "", "only list the repositories under this prefix, e.g. team-a/")
+	insecure := fs.Bool("insecure", false, "skip verifying the TLS certificate")
+	replace := fs.Bool("replace", false, "replace a registry with the same alias")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	entry, err := registryEntry(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	for k, v := range map[string]string{"type": *typ, "username": *username, "password": *password, "namespace": *namespace, "prefix": *prefix} {
+		if v != "" {
+			entry[k] = v
+		}
+	}
+	if *insecure {
+		entry["tls"] = map[string]interface{}{"insecure": true}
+	}
+
+	// check the entry the way it will be loaded
+	var reg Registry
+	b, _ := json.Marshal(entry)
+	err = json.Unmarshal(b, &reg)
+	if err == nil {
+		if problems := registryProblems(&Config{Registries: []*Registry{&reg}}); len(problems) > 0 {
+			err = fmt.Errorf("%v", strings.Join(problems, "; "))
+		}
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	c, err := readRawConfig(configFilePath)
+	if err != nil {
+		fatal(err)
+	}
+	i := c.indexOf(fs.Arg(0))
+	switch {
+	case i >= 0 && !*replace:
+		fatalf("registry %v already exists, use -replace to replace it", fs.Arg(0))
+	case i >= 0:
+		c.registries[i] = entry
+	default:
+		c.registries = append(c.registries, entry)
+	}
+	err = c.write(configFilePath)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func configRemoveRegistry(args []string) {
+	if len(args) == 0 {
+		commandFlags("config").Usage()
+		exit(2)
+	}
+	c, err := readRawConfig(configFilePath)
+	if err != nil {
+		fatal(err)
+	}
+	for _, alias := range args {
+		i := c.indexOf(alias)
+		if i < 0 {
+			fatalf("no registry %v in %v", alias, configFilePath)
+		}
+		// duplicates go too
+		for ; i >= 0; i = c.indexOf(alias) {
+			c.registries = append(c.registries[:i], c.registries[i+1:]...)
+		}
+	}
+	err = c.write(configFilePath)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+type RegistryEntry struct {
+	Alias string
+	Type  string `json:",omitempty"`
+	Addr  string
+}
+
+func configList() {
+	if configErr != nil {
+		fatal(configErr)
+	}
+	entries := make([]*RegistryEntry, 0, len(localConf.Registries))
+	for _, reg := range localConf.Registries {
+		entries = append(entries, &RegistryEntry{Alias: reg.Alias, Type: reg.Type, Addr: reg.displayAddr()})
+	}
+	if *outputFlag == OutputTable {
+		for _, e := range entries {
+			typ := e.Type
+			if typ == "" {
+				typ = "-"
+			}
+			fmt.Printf("%-16v %-10v %v\n", e.Alias, typ, e.Addr)
+		}
+		return
+	}
+	printJson(entries)
+}
+
+func configValidate() {
+	problems := validateConfig(configFilePath)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		exit(1)
+	}
+	fmt.Printf("%v: ok\n", configFilePath)
+}
+
+func config(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		commandFlags("config").Usage()
+		exit(2)
+	}
+	switch args[0] {
+	case "path":
+		fmt.Println(configFilePath)
+	case "list":
+		configList()
+	case "validate":
+		configValidate()
+	case "add-registry":
+		configAddRegistry(args[1:])
+	case "remove-registry":
+		configRemoveRegistry(args[1:])
+	default:
+		fatalf("config: unknown command %q", args[0])
+	}
+}
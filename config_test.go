@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"ok", `{"registries": [{"alias": "reg01", "host": "reg.example.org"}, {"alias": "hub", "type": "dockerhub"}]}`, nil},
+		{"syntax error", "{\n  \"registries\": [\n    {\"alias\": \"reg01\",}\n  ]\n}", []string{"line 3, column 23: invalid character '}' looking for beginning of object key string"}},
+		{"type error", "{\"registries\": [\n  {\"alias\": \"reg01\", \"port\": \"5000\"}]}", []string{"line 2, column 35: json: cannot unmarshal string into Go struct field"}},
+		{"problems", `{"registries": [
+			{"alias": "reg01", "host": "a.example.org", "schema": "ftp", "port": 70000},
+			{"alias": "REG01", "host": "b.example.org", "rateLimit": -1},
+			{"host": "c.example.org", "type": "quay"},
+			{"alias": "nohost", "timeout": "soon"}]}`, []string{
+			"registry reg01 (#1): schema must be http or https, not \"ftp\"",
+			"registry reg01 (#1): port 70000 out of range",
+			"registry REG01 (#2): duplicate alias, only #1 is used",
+			"registry REG01 (#2): negative rateLimit",
+			"registry #3: no alias",
+			"registry #3: unknown type \"quay\"",
+			"registry nohost (#4): no host",
+			"registry nohost (#4): time: invalid duration \"soon\"",
+		}},
+	}
+	for _, tt := range tests {
+		got := validateConfig(writeConfigFile(t, "config.json", tt.content))
+		// the wording of encoding/json varies between Go versions
+		for i := range got {
+			if i < len(tt.want) && strings.HasPrefix(got[i], tt.want[i]) {
+				got[i] = tt.want[i]
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v:\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRegistryEntry(t *testing.T) {
+	tests := []struct {
+		addr string
+		want map[string]interface{}
+	}{
+		{"reg.example.org", map[string]interface{}{"schema": "https", "host": "reg.example.org"}},
+		{"http://reg.example.org:5000", map[string]interface{}{"schema": "http", "host": "reg.example.org", "port": 5000}},
+		{"https://gw.example.org/team/", map[string]interface{}{"schema": "https", "host": "gw.example.org", "path": "team"}},
+		{"[::1]:5000/a/b", map[string]interface{}{"schema": "https", "host": "::1", "port": 5000, "path": "a/b"}},
+	}
+	for _, tt := range tests {
+		got, err := registryEntry("reg01", tt.addr)
+		if err != nil {
+			t.Errorf("%v: %v", tt.addr, err)
+			continue
+		}
+		tt.want["alias"] = "reg01"
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if _, err := registryEntry("reg01", "reg.example.org:http"); err == nil {
+		t.Error("accepted a port that is not a number")
+	}
+}
+
+func TestRawConfigKeepsFields(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{
+  "registries": [{"alias": "reg01", "host": "a.example.org", "port": 5000, "rateLimit": 2.5, "custom": {"x": 1}}],
+  "slo": {"maxAge": "30d"}
+}`)
+	c, err := readRawConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := registryEntry("reg02", "b.example.org")
+	c.registries = append(c.registries, entry)
+	if c.indexOf("REG01") != 0 || c.indexOf("reg02") != 1 || c.indexOf("reg03") != -1 {
+		t.Errorf("indexOf does not find registries by alias")
+	}
+	if err := c.write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	var written map[string]interface{}
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"registries": []interface{}{
+			map[string]interface{}{"alias": "reg01", "host": "a.example.org", "port": 5000.0, "rateLimit": 2.5, "custom": map[string]interface{}{"x": 1.0}},
+			map[string]interface{}{"alias": "reg02", "schema": "https", "host": "b.example.org"},
+		},
+		"slo": map[string]interface{}{"maxAge": "30d"},
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written\n%s\nwant\n%v", b, want)
+	}
+	if !strings.Contains(string(b), `"port": 5000,`) {
+		t.Errorf("numbers not kept as written:\n%s", b)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdg"))
+	t.Setenv("REGMAN_CONFIG", "")
+
+	want := filepath.Join(home, "xdg", configDirName, "config.json")
+	if got := configPath(); got != want {
+		t.Errorf("without a config: %v, want %v", got, want)
+	}
+	legacy := filepath.Join(home, filepath.FromSlash(configFileName))
+	if err := os.MkdirAll(filepath.Dir(legacy), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(legacy, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := configPath(); got != legacy {
+		t.Errorf("with a config in the home directory: %v, want %v", got, legacy)
+	}
+	t.Setenv("REGMAN_CONFIG", "/etc/regman.json")
+	if got := configPath(); got != "/etc/regman.json" {
+		t.Errorf("with $REGMAN_CONFIG: %v", got)
+	}
+	defer func(saved string) { *configFlag = saved }(*configFlag)
+	*configFlag = "flag.json"
+	if got := configPath(); got != "flag.json" {
+		t.Errorf("with -config: %v", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFormatJson = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// configFormat tells the format of a config file by its extension; anything
+// but .yaml, .yml and .toml is JSON.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	}
+	return ConfigFormatJson
+}
+
+// decodeConfig decodes the config file read from path into v. YAML and TOML
+// are converted to JSON first, so that the json field names of the config
+// types hold for every format.
+func decodeConfig(path string, b []byte, v interface{}) error {
+	var m interface{}
+	switch configFormat(path) {
+	case ConfigFormatYAML:
+		err := yaml.Unmarshal(b, &m)
+		if err != nil {
+			return err
+		}
+	case ConfigFormatTOML:
+		_, err := toml.Decode(string(b), &m)
+		if err != nil {
+			return err
+		}
+	default:
+		err := json.Unmarshal(b, v)
+		if err != nil {
+			return jsonError(b, err)
+		}
+		return nil
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("cannot convert to JSON: %v", err)
+	}
+	return json.Unmarshal(j, v)
+}
+
+// defaultTOMLConfig is the default config for a .toml config file; JSON
+// files, and YAML files since YAML reads JSON, get the JSON one.
+const defaultTOMLConfig = `[[registries]]
+alias = "local"
+host = "127.0.0.1"
+port = 5001
+schema = "http"
+
+[[registries]]
+alias = "reg01"
+host = "reg01.example.org"
+port = 443
+schema = "https"
+
+[[registries]]
+alias = "reg01-http"
+host = "reg01.example.org"
+port = 55001
+schema = "http"
+`
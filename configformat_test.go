@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"registries": [{"alias": "reg01", "host": "reg.example.org", "port": 5000, "retries": 2, "rateLimit": 1.5, "tls": {"insecure": true}}]}`,
+		"config.yaml": `
+registries:
+  - alias: reg01
+    host: reg.example.org
+    port: 5000
+    retries: 2
+    rateLimit: 1.5
+    tls:
+      insecure: true
+`,
+		"config.TOML": `
+[[registries]]
+alias = "reg01"
+host = "reg.example.org"
+port = 5000
+retries = 2
+rateLimit = 1.5
+tls = { insecure = true }
+`,
+	}
+	var want *Registry
+	for name, content := range files {
+		var conf Config
+		if err := decodeConfig(name, []byte(content), &conf); err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if len(conf.Registries) != 1 {
+			t.Errorf("%v: %d registries", name, len(conf.Registries))
+			continue
+		}
+		reg := conf.Registries[0]
+		if reg.Retries == nil || *reg.Retries != 2 || reg.TLS == nil || !reg.TLS.Insecure {
+			t.Errorf("%v: decoded %+v", name, reg)
+		}
+		if want == nil {
+			want = reg
+		} else if reg.Alias != want.Alias || reg.Host != want.Host || reg.Port != want.Port || reg.RateLimit != want.RateLimit {
+			t.Errorf("%v: decoded %+v, want %+v", name, reg, want)
+		}
+	}
+}
+
+func TestDefaultTOMLConfig(t *testing.T) {
+	var conf Config
+	if err := decodeConfig("config.toml", []byte(defaultTOMLConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	var aliases []string
+	for _, reg := range conf.Registries {
+		aliases = append(aliases, reg.Alias)
+	}
+	if want := []string{"local", "reg01", "reg01-http"}; !reflect.DeepEqual(aliases, want) {
+		t.Errorf("registries %v, want %v", aliases, want)
+	}
+	if problems := registryProblems(&conf); problems != nil {
+		t.Errorf("default config has problems: %v", problems)
+	}
+}
+
+func TestValidateConfigFormats(t *testing.T) {
+	got := validateConfig(writeConfigFile(t, "config.yml", "registries:\n  - host: reg.example.org\n"))
+	if want := []string{"registry #1: no alias"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("yaml: %q, want %q", got, want)
+	}
+	got = validateConfig(writeConfigFile(t, "config.toml", "[[registries]]\nalias = \n"))
+	if len(got) != 1 || !strings.Contains(got[0], "line 2") {
+		t.Errorf("toml syntax error: %q", got)
+	}
+}
+
+func TestEditOnlyJSONConfigs(t *testing.T) {
+	_, err := readRawConfig(writeConfigFile(t, "config.yaml", "registries: []\n"))
+	if err == nil || !strings.Contains(err.Error(), "only JSON configs can be edited") {
+		t.Errorf("error %v, want yaml configs refused", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const bytesPerGB = 1 << 30
+
+// Pricing is the storage price charged by a cloud registry (ECR, GAR, ACR).
+type Pricing struct {
+	PerGBMonth float64 `json:"perGBMonth"`
+	Currency   string  `json:"currency"`
+}
+
+type CostEntry struct {
+	Name        string
+	UniqueBytes int64
+	MonthlyCost float64
+	Currency    string
+}
+
+// uniqueBytes sums the sizes of the distinct blobs referenced by tags,
+// so layers shared between tags of a repo are only counted once.
+func uniqueBytes(tags []TagDetail) int64 {
+	seen := make(map[string]bool)
+	var total int64
+	for _, tag := range tags {
+		for _, b := range tag.Blobs {
+			if seen[b.Digest] {
+				continue
+			}
+			seen[b.Digest] = true
+			total += b.Size
+		}
+	}
+	return total
+}
+
+func (conf *Config) pricingOf(reg *Registry) (*Pricing, bool) {
+	if reg.Pricing != nil {
+		return reg.Pricing, true
+	}
+	if conf.Pricing != nil {
+		return conf.Pricing, true
+	}
+	return nil, false
+}
+
+func costEntries(conf *Config, pricing *Pricing, repos map[string][]TagDetail, byTeam bool) []*CostEntry {
+	entries := make(map[string]*CostEntry)
+	for repo, tags := range repos {
+		byName := map[string][]TagDetail{repo: tags}
+		if byTeam {
+			byName = conf.teamTags(repo, tags)
+		}
+		for name, tags := range byName {
+			e, ok := entries[name]
+			if !ok {
+				e = &CostEntry{Name: name, Currency: pricing.Currency}
+				entries[name] = e
+			}
+			e.UniqueBytes += uniqueBytes(tags)
+		}
+	}
+
+	result := make([]*CostEntry, 0, len(entries))
+	for _, e := range entries {
+		e.MonthlyCost = float64(e.UniqueBytes) / bytesPerGB * pricing.PerGBMonth
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MonthlyCost != result[j].MonthlyCost {
+			return result[i].MonthlyCost > result[j].MonthlyCost
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func writeCostCsv(entries []*CostEntry) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"name", "unique_bytes", "monthly_cost", "currency"})
+	for _, e := range entries {
+		w.Write([]string{
+			e.Name,
+			fmt.Sprint(e.UniqueBytes),
+			fmt.Sprintf("%.2f", e.MonthlyCost),
+			e.Currency,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func analyzeCost(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("analyze cost", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or csv")
+	by := fs.String("by", "repo", "attribute cost by repo or team")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fatal("registry alias or addr not defined")
+	}
+	if *by != "repo" && *by != "team" {
+		fatalf("analyze cost: unknown grouping %q", *by)
+	}
+
+	reg := resolveRegistry(fs.Arg(0))
+	pricing, ok := localConf.pricingOf(reg)
+	if !ok {
+		fatalf("analyze cost: no pricing configured for %v", reg.Addr)
+	}
+	repos, errs := getRepoInfo(ctx, reg)
+	warnIncomplete(errs)
+	entries := costEntries(localConf, pricing, repos, *by == "team")
+
+	switch *format {
+	case "json":
+		printJson(entries)
+	case "csv":
+		err := writeCostCsv(entries)
+		if err != nil {
+			fatal(err)
+		}
+	default:
+		fatalf("analyze cost: unknown format %q", *format)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want []string
+	}{
+		{"*/15 * * * *", "2024-06-03 10:07", []string{"2024-06-03 10:15", "2024-06-03 10:30", "2024-06-03 10:45", "2024-06-03 11:00"}},
+		{"0 9-17/4 * * 1-5", "2024-06-07 14:00", []string{"2024-06-07 17:00", "2024-06-10 09:00", "2024-06-10 13:00"}},
+		{"30 2 * * 7", "2024-06-03 00:00", []string{"2024-06-09 02:30", "2024-06-16 02:30"}},
+		// day of month or day of week, as in cron
+		{"0 0 1 * 1", "2024-06-01 00:00", []string{"2024-06-03 00:00", "2024-06-10 00:00", "2024-06-17 00:00", "2024-06-24 00:00", "2024-07-01 00:00", "2024-07-08 00:00"}},
+		{"0 0 29 2 *", "2024-03-01 00:00", []string{"2028-02-29 00:00"}},
+		{"5,10 0 * * *", "2024-12-31 23:59", []string{"2025-01-01 00:05", "2025-01-01 00:10", "2025-01-02 00:05"}},
+		{"@monthly", "2024-01-31 12:00", []string{"2024-02-01 00:00", "2024-03-01 00:00"}},
+		{"@weekly", "2024-06-03 00:00", []string{"2024-06-09 00:00"}},
+		{"@every 90m", "2024-06-03 10:07", []string{"2024-06-03 11:37", "2024-06-03 13:07"}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%v: %v", tt.expr, err)
+			continue
+		}
+		var got []string
+		for next := at(tt.from); len(got) < len(tt.want); {
+			next = c.next(next)
+			got = append(got, next.Format("2006-01-02 15:04"))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v from %v: %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextKeepsLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	c, _ := parseCron("0 3 * * *")
+	next := c.next(time.Date(2024, 6, 3, 4, 0, 0, 0, loc))
+	if want := time.Date(2024, 6, 4, 3, 0, 0, 0, loc); !next.Equal(want) || next.Location() != loc {
+		t.Errorf("next %v, want %v", next, want)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{"* * * *", "want minute, hour, day of month, month and day of week"},
+		{"60 * * * *", `"60" is out of range 0-59`},
+		{"* * 0 * *", `"0" is out of range 1-31`},
+		{"* * * * 8", `"8" is out of range 0-7`},
+		{"5-1 * * * *", `"5-1" is out of range`},
+		{"*/0 * * * *", `invalid step in "*/0"`},
+		{"a * * * *", `invalid value "a"`},
+		{"0 0 31 2 *", "never runs"},
+		{"@every 10s", "at least a minute"},
+		{"@every soon", "at least a minute"},
+		{"@often", "want minute, hour"},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error %v, want %v", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestScheduleProblems(t *testing.T) {
+	conf := &Config{
+		Registries: []*Registry{{Alias: "prod"}, {Alias: "staging"}},
+		Schedule: []*ScheduleEntry{
+			{Registry: "prod", Cron: "@hourly"},
+			{Registry: "PROD", Cron: "@daily"},
+			{Registry: "qa", Cron: "@daily"},
+			{Registry: "staging", Cron: "@daily"},
+		},
+	}
+	want := []string{"schedule: registry PROD is scheduled twice", "schedule: no registry qa"}
+	if got := scheduleProblems(conf); !reflect.DeepEqual(got, want) {
+		t.Errorf("problems %q, want %q", got, want)
+	}
+	if err := (&ScheduleEntry{Cron: "@daily"}).setup(); err == nil {
+		t.Error("entry without a registry accepted")
+	}
+	if err := (&ScheduleEntry{Registry: "prod", Cron: "daily"}).setup(); err == nil || !strings.Contains(err.Error(), "schedule prod:") {
+		t.Errorf("error %v, want the invalid cron of prod", err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduleEntry has the daemon scan a configured registry on a cron
+// schedule, e.g. {"registry": "prod", "cron": "*/30 * * * *"}.
+type ScheduleEntry struct {
+	Registry string `json:"registry"`
+	Cron     string `json:"cron"`
+
+	cron *cronSchedule
+}
+
+func (e *ScheduleEntry) setup() (err error) {
+	if e.Registry == "" {
+		return fmt.Errorf("schedule: registry not defined")
+	}
+	e.cron, err = parseCron(e.Cron)
+	if err != nil {
+		return fmt.Errorf("schedule %v: %v", e.Registry, err)
+	}
+	return nil
+}
+
+// scheduleProblems reports schedule entries naming a registry that is not
+// configured, or one scheduled already.
+func scheduleProblems(conf *Config) []string {
+	var problems []string
+	seen := make(map[*Registry]bool)
+	for _, e := range conf.Schedule {
+		reg, ok := conf.findRegistry(e.Registry)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("schedule: no registry %v", e.Registry))
+		case seen[reg]:
+			problems = append(problems, fmt.Sprintf("schedule: registry %v is scheduled twice", e.Registry))
+		}
+		seen[reg] = true
+	}
+	return problems
+}
+
+// ScheduleStatus is how the scans of one registry of the schedule went, as
+// served on /schedule.
+type ScheduleStatus struct {
+	Registry string
+	Cron     string
+	Next     *JsonTime `json:",omitempty"`
+	Running  bool
+	// LastScan is when the latest scan that could read the registry
+	// finished.
+	LastScan *JsonTime `json:",omitempty"`
+	Repos    int
+	Tags     int
+	// Changes are the tags added, removed or retagged by the latest scan.
+	Changes int
+	Errors  int
+	// Error is why the latest scan could not read the registry.
+	Error string `json:",omitempty"`
+	// SLOs are the freshness SLOs of the config as of the latest scan.
+	SLOs []*SLOResult `json:",omitempty"`
+	// Queue is the order the repositories are rescanned in, the most
+	// urgent first.
+	Queue []ScanItem
+}
+
+// scheduledScan is the latest scan of a registry of the schedule.
+type scheduledScan struct {
+	entry    *ScheduleEntry
+	reg      *Registry
+	repos    map[string][]TagDetail
+	errs     []*ScanError
+	snapshot *Snapshot
+	status   ScheduleStatus
+	queue    *ScanQueue
+	// slos are the statuses of the freshness SLOs by pattern and
+	// repository, to alert on those that change
+	slos map[string]string
+	// wake has the repositories events reported as changed rescanned
+	// without waiting for the schedule.
+	wake chan struct{}
+}
+
+// daemon scans the registries of the schedule of the config when it says
+// so, the repositories of each in the order of its ScanQueue, keeps a snapshot of each on disk to notify the tags changed between
+// scans, even across restarts, and serves the latest results over the REST
+// API of serve.
+type daemon struct {
+	dir string
+
+	mu    sync.Mutex
+	scans []*scheduledScan
+}
+
+func (d *daemon) snapshotPath(reg *Registry) string {
+	return filepath.Join(d.dir, unsafeFileChars.ReplaceAllString(reg.Alias, "_")+".json")
+}
+
+func (d *daemon) find(reg *Registry) *scheduledScan {
+	for _, sc := range d.scans {
+		if sc.reg == reg {
+			return sc
+		}
+	}
+	return nil
+}
+
+// latest returns the results of the latest scan of reg, if it is
+// scheduled and was scanned.
+func (d *daemon) latest(reg *Registry) (map[string][]TagDetail, []*ScanError, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sc := d.find(reg)
+	if sc == nil || sc.repos == nil {
+		return nil, nil, false
+	}
+	return sc.repos, sc.errs, true
+}
+
+func (d *daemon) schedule(r *http.Request) (interface{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]ScheduleStatus, 0, len(d.scans))
+	for _, sc := range d.scans {
+		status := sc.status
+		status.Queue = sc.queue.list()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Registry < statuses[j].Registry
+	})
+	return statuses, nil
+}
+
+// scan rescans the repositories of the registry of sc its queue has due,
+// up to priority most, diffs them against the previous snapshot, notifies
+// the changes and writes the new snapshot. With catalog it lists the
+// catalog first, to queue new repositories and drop deleted ones.
+// Repositories that were not due or failed keep their previous tags, so
+// that a flaky request is not reported as deleted tags, and a scan that
+// cannot read the catalog changes nothing.
+func (d *daemon) scan(ctx context.Context, sc *scheduledScan, catalog bool, most int) {
+	reg := sc.reg
+	d.mu.Lock()
+	sc.status.Running = true
+	prev, prevRepos, prevErrs := sc.snapshot, sc.repos, sc.errs
+	d.mu.Unlock()
+
+	var listed map[string]bool
+	if catalog {
+		names, err := listRepos(ctx, reg)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: scheduled scan failed: %v", reg.name(), err)
+			d.mu.Lock()
+			sc.status.Running = false
+			sc.status.Error = err.Error()
+			d.mu.Unlock()
+			return
+		}
+		listed = make(map[string]bool, len(names))
+		for _, repo := range names {
+			listed[repo] = true
+		}
+		sc.queue.add(time.Now(), names...)
+		for repo := range prevRepos {
+			if !listed[repo] {
+				sc.queue.remove(repo)
+			}
+		}
+		if prev != nil {
+			for repo := range prev.Repositories {
+				if !listed[repo] {
+					sc.queue.remove(repo)
+				}
+			}
+		}
+	}
+	due := sc.queue.due(time.Now(), most)
+	scanned, errs := make(map[string][]TagDetail), []*ScanError(nil)
+	if len(due) > 0 {
+		scanned, errs = getInfoOfRepos(ctx, reg, due)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	finished := time.Now()
+	failed := make(map[string]bool)
+	for _, e := range errs {
+		failed[e.Repo] = true
+	}
+	rescanned := make(map[string]bool)
+	for _, repo := range due {
+		rescanned[repo] = !failed[repo]
+	}
+	// what was not rescanned is kept, unless the catalog no longer lists it
+	kept := func(repo string) bool {
+		return !rescanned[repo] && (listed == nil || listed[repo])
+	}
+	repos := make(map[string][]TagDetail)
+	for repo, tags := range scanned {
+		repos[repo] = tags
+	}
+	for repo, tags := range prevRepos {
+		if _, ok := repos[repo]; !ok && kept(repo) {
+			repos[repo] = tags
+		}
+	}
+	for _, e := range prevErrs {
+		if _, ok := rescanned[e.Repo]; !ok && kept(e.Repo) {
+			errs = append(errs, e)
+		}
+	}
+	next := newSnapshot(reg.name(), repos)
+	if prev != nil {
+		for repo, r := range prev.Repositories {
+			if kept(repo) {
+				next.Repositories[repo] = r
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sc.status.Running = false
+	sc.status.Errors = len(errs)
+	sc.status.Error = ""
+	for _, e := range errs {
+		if failed[e.Repo] {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Repo: e.Repo, Tag: e.Tag, Err: errors.New(e.Error)}, "%v: incomplete scan: %v", reg.name(), e)
+		}
+	}
+
+	var changes []*TagChange
+	changed := make(map[string]bool)
+	if prev != nil {
+		changes = diffSnapshots(prev, next)
+		for _, change := range changes {
+			change.Registry = reg.name()
+			changed[change.Repo] = true
+		}
+	}
+	for repo, ok := range rescanned {
+		// failed repositories are retried with the active ones
+		sc.queue.done(repo, changed[repo] || !ok, finished)
+	}
+	var sloChanges []*SLOResult
+	if len(localConf.SLOs) > 0 {
+		results, err := checkSLOs(localConf.SLOs, repos, finished)
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: %v", reg.name(), err)
+		} else {
+			sloChanges, sc.slos = changedSLOs(sc.slos, results)
+			sc.status.SLOs = results
+		}
+	}
+	tags := 0
+	for _, t := range repos {
+		tags += len(t)
+	}
+	scanTime := JsonTime(finished)
+	sc.repos, sc.errs, sc.snapshot = repos, errs, next
+	sc.status.LastScan = &scanTime
+	sc.status.Repos, sc.status.Tags, sc.status.Changes = len(repos), tags, len(changes)
+	log.Printf("%v: scanned %d of %d repositories, %d tags, %d changes", reg.name(), len(due), len(repos), tags, len(changes))
+
+	if err := writeSnapshot(d.snapshotPath(reg), next); err != nil {
+		logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: %v", reg.name(), err)
+	}
+	// notifications and hooks run after the results are served, and may
+	// take a while
+	report := &Report{Repositories: repos, Errors: errs, registry: reg.name(), reg: reg}
+	go func() {
+		if len(changes) > 0 {
+			notify(ctx, reg, changes, scanTime)
+		}
+		if len(sloChanges) > 0 {
+			notifySLOs(ctx, reg, sloChanges, scanTime)
+		}
+		runHooks(ctx, reg, &HookEvent{Event: HookScanComplete, Time: scanTime, Report: report})
+	}()
+}
+
+// run scans the registry of sc once, then whenever its schedule says, until
+// ctx is done, and rescans the repositories events report as changed in
+// between. A scan still running when the next is due delays it.
+func (d *daemon) run(ctx context.Context, sc *scheduledScan) {
+	d.scan(ctx, sc, true, ScanPriorityStable)
+	for ctx.Err() == nil {
+		next := sc.entry.cron.next(time.Now())
+		jsonNext := JsonTime(next)
+		d.mu.Lock()
+		sc.status.Next = &jsonNext
+		d.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.wake:
+			d.scan(ctx, sc, false, ScanPriorityChanged)
+		case <-time.After(time.Until(next)):
+			d.scan(ctx, sc, true, ScanPriorityStable)
+		}
+	}
+}
+
+// event queues the repository of ev for a rescan of the registry it was
+// posted for, ahead of the schedule.
+func (d *daemon) event(ctx context.Context, reg *Registry, ev *RegistryEvent) {
+	sc := d.find(reg)
+	if sc == nil {
+		return
+	}
+	sc.queue.notify(ev.Target.Repository, time.Now())
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// defaultSnapshotDir is where the daemon keeps its snapshots unless told
+// otherwise.
+func defaultSnapshotDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "snapshots"
+	}
+	return filepath.Join(dir, configDirName, "snapshots")
+}
+
+func runDaemon(ctx context.Context, args []string) {
+	fs := commandFlags("daemon")
+	listen := fs.String("listen", defaultListen, "address to serve the REST API on; anyone who can reach it can list what the configured credentials can")
+	dir := fs.String("snapshot-dir", defaultSnapshotDir(), "directory to keep the snapshot of every scheduled registry in")
+	ttl := fs.Duration("cache-ttl", time.Minute, "how long the lists of registries that are not scheduled are served before they are fetched again")
+	noUI := fs.Bool("no-ui", false, "serve only the REST API, not the web browser at /")
+	stable := fs.Duration("stable-interval", 6*time.Hour, "how often repositories that came back unchanged from 3 scans in a row are rescanned, rather than on every scheduled scan")
+	eventsToken := fs.String("events-token", "", "bearer token registries have to send with their notifications to /events")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		exit(2)
+	}
+	if len(localConf.Schedule) == 0 {
+		fatal("daemon: the config has no schedule")
+	}
+	if err := eventsListenProblem(*listen, *eventsToken); err != nil {
+		fatal(err)
+	}
+	if problems := scheduleProblems(localConf); len(problems) > 0 {
+		fatal(problems[0])
+	}
+	err := os.MkdirAll(*dir, 0755)
+	if err != nil {
+		fatal(err)
+	}
+
+	d := &daemon{dir: *dir}
+	for _, e := range localConf.Schedule {
+		reg, _ := localConf.findRegistry(e.Registry)
+		sc := &scheduledScan{
+			entry:  e,
+			reg:    reg,
+			status: ScheduleStatus{Registry: reg.Alias, Cron: e.Cron},
+			// the repositories that are not stable are rescanned on every
+			// scheduled scan
+			queue: newScanQueue(0, *stable),
+			wake:  make(chan struct{}, 1),
+		}
+		// diff the first scan against the snapshot of the previous run
+		prev, err := readSnapshot(d.snapshotPath(reg))
+		switch {
+		case err == nil:
+			sc.snapshot = prev
+		case !os.IsNotExist(err):
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: %v", reg.name(), err)
+		}
+		d.scans = append(d.scans, sc)
+	}
+	for _, sc := range d.scans {
+		go d.run(ctx, sc)
+	}
+
+	s := newServer(ctx, *ttl)
+	s.ui = !*noUI
+	s.latest = d.latest
+	mux := http.NewServeMux()
+	mux.Handle("/schedule", handle(d.schedule))
+	var regs []*Registry
+	for _, sc := range d.scans {
+		regs = append(regs, sc.reg)
+	}
+	mux.Handle("/events", eventsHandler(ctx, regs, *eventsToken, d.event))
+	mux.Handle("/", s.handler())
+	log.Printf("scanning %d registries on schedule, serving on %v", len(d.scans), *listen)
+	err = listenAndServe(ctx, *listen, mux)
+	if err != nil {
+		fatal(err)
+	}
+}
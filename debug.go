@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LogRequests logs every request sent with its status and duration, and
+	// every retry.
+	LogRequests = 1
+	// LogHeaders also logs the headers of every request and response, with
+	// credentials redacted.
+	LogHeaders = 2
+)
+
+// verbosity is the value of -v: -v counts up by one, -v=2 sets the level.
+type verbosity int
+
+func (v *verbosity) String() string   { return strconv.Itoa(int(*v)) }
+func (v *verbosity) IsBoolFlag() bool { return true }
+
+func (v *verbosity) Set(s string) error {
+	if b, err := strconv.ParseBool(s); err == nil {
+		if b {
+			*v++
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("want a level from 0 to %d", LogHeaders)
+	}
+	*v = verbosity(n)
+	return nil
+}
+
+// debugFlag is -debug, short for the highest level of -v.
+type debugFlag struct{}
+
+func (debugFlag) String() string   { return "false" }
+func (debugFlag) IsBoolFlag() bool { return true }
+
+func (debugFlag) Set(s string) error {
+	debug, err := strconv.ParseBool(s)
+	if debug {
+		logLevel = LogHeaders
+	}
+	return err
+}
+
+var logLevel verbosity
+
+func init() {
+	flag.Var(&logLevel, "v", "log every request with its status, duration and retries; -v -v or -v=2 also logs headers, with credentials redacted")
+	flag.Var(debugFlag{}, "debug", "same as -v=2")
+}
+
+// debugf logs at the given -v level.
+func debugf(level verbosity, fields logFields, format string, args ...interface{}) {
+	if logLevel >= level {
+		emit(2, LevelDebug, fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// secretHeaders are redacted when headers are logged. Only the scheme of an
+// Authorization header is kept.
+var secretHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Amz-Security-Token": true,
+}
+
+func redactedHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if secretHeaders[http.CanonicalHeaderKey(name)] {
+				scheme := strings.SplitN(value, " ", 2)[0]
+				if scheme == value {
+					value = "<redacted>"
+				} else {
+					value = scheme + " <redacted>"
+				}
+			}
+			fmt.Fprintf(&b, "\n    %v: %v", name, value)
+		}
+	}
+	return b.String()
+}
+
+// debugTransport logs every request sent to a registry at -v, below the
+// retries so that each attempt is seen.
+type debugTransport struct {
+	base     http.RoundTripper
+	registry string
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if logLevel < LogRequests {
+		return t.base.RoundTrip(req)
+	}
+	fields := logFields{Registry: t.registry, URL: req.URL}
+	if logLevel >= LogHeaders {
+		debugf(LogHeaders, fields, "> %v %v%v", req.Method, req.URL, redactedHeaders(req.Header))
+	}
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	fields.Duration = time.Since(start)
+	if err != nil {
+		fields.Err = err
+		debugf(LogRequests, fields, "%v %v: %v (%v)", req.Method, req.URL, err, fields.Duration.Round(time.Millisecond))
+		return res, err
+	}
+	fields.Status = res.StatusCode
+	debugf(LogRequests, fields, "%v %v: %v (%v)", req.Method, req.URL, res.Status, fields.Duration.Round(time.Millisecond))
+	if logLevel >= LogHeaders {
+		debugf(LogHeaders, fields, "< %v%v", res.Status, redactedHeaders(res.Header))
+	}
+	return res, err
+}
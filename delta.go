@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const deltaIndexName = "index.json"
+
+// DeltaIndex describes a delta archive: the tags to (re)point and, for every
+// blob in the archive, the repositories that need it.
+type DeltaIndex struct {
+	Registry  string
+	Manifests []*DeltaManifest
+	Blobs     map[string]*DeltaBlob
+}
+
+type DeltaManifest struct {
+	Repo      string
+	Tag       string
+	Digest    string
+	MediaType string
+}
+
+type DeltaBlob struct {
+	Size  int64
+	Repos []string
+}
+
+func manifestEntryName(digest string) string {
+	return "manifests/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func blobEntryName(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func openBlob(ctx context.Context, reg *Registry, repo string, digest string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%v/v2/%v/blobs/%v", reg.Addr, reg.repository(repo), digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %v: %v", url, res.Status)
+	}
+	return res.Body, nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+func writeDelta(ctx context.Context, path string, reg *Registry, index *DeltaIndex, manifests map[string][]byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	j, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = writeTarEntry(tw, deltaIndexName, int64(len(j)), bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	for digest, body := range manifests {
+		err = writeTarEntry(tw, manifestEntryName(digest), int64(len(body)), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+	}
+	for digest, blob := range index.Blobs {
+		body, err := openBlob(ctx, reg, blob.Repos[0], digest)
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, blobEntryName(digest), blob.Size, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("blob %v: %v", digest, err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func exportDelta(ctx context.Context, args []string) {
+	fs := commandFlags("export-delta")
+	since := fs.String("since", "", "snapshot written by the previous export; everything is exported without it")
+	output := fs.String("o", "delta.tar.gz", "archive to write")
+	snapshotOut := fs.String("snapshot-out", "", "snapshot to write for the next export (default <archive>.snapshot.json)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	if *snapshotOut == "" {
+		*snapshotOut = *output + ".snapshot.json"
+	}
+
+	prev := &Snapshot{Repositories: make(map[string]*SnapshotRepo)}
+	if *since != "" {
+		var err error
+		prev, err = readSnapshot(*since)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	reg := resolveRegistry(fs.Arg(0))
+	repos, errs := getRepoInfo(ctx, reg)
+	warnIncomplete(errs)
+	index := &DeltaIndex{Registry: fs.Arg(0), Blobs: make(map[string]*DeltaBlob)}
+	manifests := make(map[string][]byte)
+	mediaTypes := make(map[string]string)
+	for _, repo := range sortedRepos(repos) {
+		prevRepo, known := prev.Repositories[repo]
+		for _, tag := range repos[repo] {
+			if known && prevRepo.Tags[tag.Tag] == tag.Digest {
+				continue
+			}
+			if tag.Blobs == nil {
+				log.Printf("%v:%v: schema1 manifests cannot be exported", repo, tag.Tag)
+				continue
+			}
+			if _, ok := manifests[tag.Digest]; !ok {
+				m, err := reg.registryClient(ctx).Manifest(ctx, reg.repository(repo), tag.Digest)
+				if err != nil {
+					fatal(err)
+				}
+				manifests[tag.Digest], mediaTypes[tag.Digest] = m.Raw, m.MediaType
+			}
+			index.Manifests = append(index.Manifests, &DeltaManifest{
+				Repo:      repo,
+				Tag:       tag.Tag,
+				Digest:    tag.Digest,
+				MediaType: mediaTypes[tag.Digest],
+			})
+			for _, b := range tag.Blobs {
+				if known && prevRepo.hasBlob(b.Digest) {
+					continue
+				}
+				blob, ok := index.Blobs[b.Digest]
+				if !ok {
+					blob = &DeltaBlob{Size: b.Size}
+					index.Blobs[b.Digest] = blob
+				}
+				if len(blob.Repos) == 0 || blob.Repos[len(blob.Repos)-1] != repo {
+					blob.Repos = append(blob.Repos, repo)
+				}
+			}
+		}
+	}
+
+	err := writeDelta(ctx, *output, reg, index, manifests)
+	if err != nil {
+		fatal(err)
+	}
+	err = writeSnapshot(*snapshotOut, newSnapshot(fs.Arg(0), repos))
+	if err != nil {
+		fatal(err)
+	}
+	log.Printf("exported %d tags and %d blobs to %v", len(index.Manifests), len(index.Blobs), *output)
+}
+
+// applyBlob uploads the blob to every repository that needs it, mounting it
+// from the first repository that has it where possible.
+func applyBlob(ctx context.Context, reg *Registry, digest string, blob *DeltaBlob, r io.Reader) error {
+	tmp, err := ioutil.TempFile("", "delta-blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	from := ""
+	for _, repo := range blob.Repos {
+		exists, err := blobExists(ctx, reg, repo, digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			err = uploadBlob(ctx, reg, repo, digest, tmp, size, from, 0)
+			if err != nil {
+				return err
+			}
+		}
+		from = repo
+	}
+	return nil
+}
+
+func applyDelta(ctx context.Context, args []string) {
+	fs := commandFlags("apply-delta")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	reg := resolveRegistry(fs.Arg(1))
+	tr := tar.NewReader(r)
+	var index *DeltaIndex
+	manifests := make(map[string][]byte)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatal(err)
+		}
+
+		switch {
+		case h.Name == deltaIndexName:
+			b, err := ioutil.ReadAll(tr)
+			if err == nil {
+				err = json.Unmarshal(b, &index)
+			}
+			if err != nil {
+				fatal(err)
+			}
+		case index == nil:
+			fatalf("%v: %v must be the first entry", fs.Arg(0), deltaIndexName)
+		case strings.HasPrefix(h.Name, "manifests/"):
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				fatal(err)
+			}
+			manifests[strings.Replace(strings.TrimPrefix(h.Name, "manifests/"), "/", ":", 1)] = b
+		case strings.HasPrefix(h.Name, "blobs/"):
+			digest := strings.Replace(strings.TrimPrefix(h.Name, "blobs/"), "/", ":", 1)
+			blob, ok := index.Blobs[digest]
+			if !ok {
+				log.Printf("%v: blob %v is not in the index", fs.Arg(0), digest)
+				continue
+			}
+			err = applyBlob(ctx, reg, digest, blob, tr)
+			if err != nil {
+				fatal(err)
+			}
+		}
+	}
+	if index == nil {
+		fatalf("%v: no %v", fs.Arg(0), deltaIndexName)
+	}
+
+	for _, m := range index.Manifests {
+		err = putManifest(ctx, reg, m.Repo, m.Tag, m.MediaType, manifests[m.Digest])
+		if err != nil {
+			fatal(err)
+		}
+	}
+	log.Printf("applied %d tags and %d blobs", len(index.Manifests), len(index.Blobs))
+}
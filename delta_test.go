@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blobRegistry stores blobs and manifests by repository and takes uploads
+// and cross-repository mounts, as export-delta reads and apply-delta writes.
+type blobRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte // repo + "@" + digest
+	manifests map[string][]byte // repo + ":" + tag
+	mounts    int
+	uploads   int
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (b *blobRegistry) serve(t *testing.T) *Registry {
+	b.blobs = make(map[string][]byte)
+	b.manifests = make(map[string][]byte)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		switch {
+		case strings.HasSuffix(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+			repo := strings.TrimSuffix(path, "/blobs/uploads/")
+			if from, digest := r.URL.Query().Get("from"), r.URL.Query().Get("mount"); from != "" {
+				if blob, ok := b.blobs[from+"@"+digest]; ok {
+					b.blobs[repo+"@"+digest] = blob
+					b.mounts++
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+			}
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+		case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPut:
+			repo := path[:strings.Index(path, "/blobs/uploads/")]
+			body, _ := ioutil.ReadAll(r.Body)
+			digest := r.URL.Query().Get("digest")
+			if digestOf(body) != digest {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b.blobs[repo+"@"+digest] = body
+			b.uploads++
+			w.WriteHeader(http.StatusCreated)
+		case strings.Contains(path, "/blobs/"):
+			i := strings.Index(path, "/blobs/")
+			blob, ok := b.blobs[path[:i]+"@"+path[i+len("/blobs/"):]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				w.Write(blob)
+			}
+		case strings.Contains(path, "/manifests/") && r.Method == http.MethodPut:
+			i := strings.Index(path, "/manifests/")
+			b.manifests[path[:i]+":"+path[i+len("/manifests/"):]], _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return &Registry{Addr: s.URL}
+}
+
+func (b *blobRegistry) add(repo string, content string) string {
+	digest := digestOf([]byte(content))
+	b.blobs[repo+"@"+digest] = []byte(content)
+	return digest
+}
+
+// readDelta returns the entries of a delta archive by name.
+func readDelta(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	entries := make(map[string][]byte)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, h.Name)
+		entries[h.Name], _ = ioutil.ReadAll(tr)
+	}
+	if len(names) == 0 || names[0] != deltaIndexName {
+		t.Fatalf("%v is not the first entry of %v", deltaIndexName, names)
+	}
+	return entries
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	src := &blobRegistry{}
+	srcReg := src.serve(t)
+	shared := src.add("team/a", "shared layer")
+	src.add("team/b", "shared layer")
+	config := src.add("team/b", "config of b")
+	manifest := []byte(`{"schemaVersion":2}`)
+	index := &DeltaIndex{
+		Registry: "src",
+		Manifests: []*DeltaManifest{
+			{Repo: "team/b", Tag: "v1", Digest: digestOf(manifest), MediaType: "application/vnd.oci.image.manifest.v1+json"},
+		},
+		Blobs: map[string]*DeltaBlob{
+			shared: {Size: int64(len("shared layer")), Repos: []string{"team/a", "team/b"}},
+			config: {Size: int64(len("config of b")), Repos: []string{"team/b"}},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "delta.tar.gz")
+	err := writeDelta(context.Background(), path, srcReg, index, map[string][]byte{digestOf(manifest): manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readDelta(t, path)
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{blobEntryName(shared), blobEntryName(config), deltaIndexName, manifestEntryName(digestOf(manifest))}
+	sort.Strings(want)
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("entries %v, want %v", names, want)
+	}
+	var written DeltaIndex
+	if err := json.Unmarshal(entries[deltaIndexName], &written); err != nil || !reflect.DeepEqual(&written, index) {
+		t.Errorf("index %+v, want %+v (%v)", written, index, err)
+	}
+
+	dst := &blobRegistry{}
+	dstReg := dst.serve(t)
+	for digest, blob := range index.Blobs {
+		err = applyBlob(context.Background(), dstReg, digest, blob, strings.NewReader(string(entries[blobEntryName(digest)])))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range index.Manifests {
+		err = putManifest(context.Background(), dstReg, m.Repo, m.Tag, m.MediaType, entries[manifestEntryName(m.Digest)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"team/a@" + shared, "team/b@" + shared, "team/b@" + config} {
+		if string(dst.blobs[key]) != string(src.blobs[key]) {
+			t.Errorf("%v not applied", key)
+		}
+	}
+	if dst.uploads != 2 || dst.mounts != 1 {
+		t.Errorf("%d uploads and %d mounts, want the shared layer uploaded once and mounted once", dst.uploads, dst.mounts)
+	}
+	if string(dst.manifests["team/b:v1"]) != string(manifest) {
+		t.Errorf("manifest of team/b:v1 %q", dst.manifests["team/b:v1"])
+	}
+
+	// applying again finds every blob in place
+	for digest, blob := range index.Blobs {
+		if err := applyBlob(context.Background(), dstReg, digest, blob, strings.NewReader(string(entries[blobEntryName(digest)]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dst.uploads != 2 || dst.mounts != 1 {
+		t.Errorf("blobs the registry has were uploaded again")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// How much of every tag a scan fetches.
+const (
+	// DetailFull fetches the manifest and image config of every tag.
+	DetailFull = iota
+	// DetailDigest only learns the digest of every tag, with a HEAD
+	// request on its manifest.
+	DetailDigest
+	// DetailNone stops at the tag lists.
+	DetailNone
+)
+
+// scanDetail is how much of every tag scans fetch; only scan lowers it, as
+// the other commands need the sizes and creation times.
+var scanDetail = DetailFull
+
+// fetchDigestOfTag resolves the digest repo:tag points at, leaving its
+// creation time and size unknown. Tags deleted since they were listed are
+// left out.
+func fetchDigestOfTag(ctx context.Context, reg *Registry, repo string, tag string, data chan<- ScanResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	digest, found, err := reg.registryClient(ctx).Digest(ctx, reg.repository(repo), tag)
+	if err != nil {
+		reportError(ctx, data, repo, tag, err)
+		return
+	}
+	if !found {
+		return
+	}
+	send(ctx, data, &ManifestInfo{Repo: repo, Tag: &registryclient.Tag{Name: tag, Digest: digest}})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	DockerHubRegistryHost = "registry-1.docker.io"
+	DockerHubAPI          = "https://hub.docker.com/v2"
+	DockerHubOfficialRepo = "library"
+)
+
+// repository returns the name repo is served under. Docker Hub keeps official
+// images such as alpine under the implicit library/ namespace.
+func (reg *Registry) repository(repo string) string {
+	if reg.Type == "dockerhub" && !strings.Contains(repo, "/") {
+		return DockerHubOfficialRepo + "/" + repo
+	}
+	return repo
+}
+
+// listDockerHubRepos lists the repositories of the configured namespace with
+// the Hub API, since Docker Hub does not serve /v2/_catalog.
+func listDockerHubRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	namespace := reg.Namespace
+	if namespace == "" {
+		namespace = reg.Username
+	}
+	if namespace == "" {
+		namespace = DockerHubOfficialRepo
+	}
+
+	var jwt string
+	if reg.Username != "" {
+		var err error
+		jwt, err = dockerHubLogin(ctx, reg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var repos []string
+	next := fmt.Sprintf("%v/repositories/%v/?page_size=100", DockerHubAPI, namespace)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if jwt != "" {
+			req.Header.Set("Authorization", "JWT "+jwt)
+		}
+		res, err := reg.client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"results"`
+		}
+		err = decodeJsonResponse(res, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Results {
+			repos = append(repos, r.Namespace+"/"+r.Name)
+		}
+		next = page.Next
+	}
+	return repos, nil
+}
+
+// dockerHubLogin returns the JWT the Hub API takes for the credentials of
+// reg, asking through its client like the registry requests.
+func dockerHubLogin(ctx context.Context, reg *Registry) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": reg.Username, "password": reg.Password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, DockerHubAPI+"/users/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	err = decodeJsonResponse(res, &login)
+	return login.Token, err
+}
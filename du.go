@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// DiskUsage reports the storage of a registry. Logical sizes count every
+// tag in full, unique sizes count each blob once, and the exclusive size of
+// a repository is what deleting it and collecting garbage would free.
+type DiskUsage struct {
+	Registry     string
+	Tags         int
+	LogicalBytes int64
+	UniqueBytes  int64
+	Repositories []*RepoUsage
+}
+
+type RepoUsage struct {
+	Repo           string
+	Tags           int
+	Manifests      int
+	LogicalBytes   int64
+	UniqueBytes    int64
+	ExclusiveBytes int64
+}
+
+func diskUsage(registry string, repos map[string][]TagDetail) *DiskUsage {
+	du := &DiskUsage{Registry: registry, Repositories: []*RepoUsage{}}
+	// the repositories referencing each blob
+	users := make(map[string]map[string]bool)
+	sizes := make(map[string]int64)
+	for repo, tags := range repos {
+		for _, tag := range tags {
+			for _, b := range tag.Blobs {
+				if users[b.Digest] == nil {
+					users[b.Digest] = make(map[string]bool)
+				}
+				users[b.Digest][repo] = true
+				sizes[b.Digest] = b.Size
+			}
+		}
+	}
+	for _, size := range sizes {
+		du.UniqueBytes += size
+	}
+
+	for repo, tags := range repos {
+		u := &RepoUsage{Repo: repo, Tags: len(tags), UniqueBytes: uniqueBytes(tags)}
+		manifests := make(map[string]bool)
+		counted := make(map[string]bool)
+		for _, tag := range tags {
+			manifests[tag.Digest] = true
+			u.LogicalBytes += tag.Size
+			for _, b := range tag.Blobs {
+				if !counted[b.Digest] && len(users[b.Digest]) == 1 {
+					u.ExclusiveBytes += b.Size
+				}
+				counted[b.Digest] = true
+			}
+		}
+		u.Manifests = len(manifests)
+		du.Tags += u.Tags
+		du.LogicalBytes += u.LogicalBytes
+		du.Repositories = append(du.Repositories, u)
+	}
+	sort.Slice(du.Repositories, func(i, j int) bool {
+		a, b := du.Repositories[i], du.Repositories[j]
+		if a.UniqueBytes != b.UniqueBytes {
+			return a.UniqueBytes > b.UniqueBytes
+		}
+		return a.Repo < b.Repo
+	})
+	return du
+}
+
+func writeDiskUsageTable(usages []*DiskUsage) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REGISTRY\tREPOSITORY\tTAGS\tLOGICAL\tUNIQUE\tEXCLUSIVE")
+	for _, du := range usages {
+		for _, u := range du.Repositories {
+			fmt.Fprintf(w, "%v\t%v\t%d\t%v\t%v\t%v\n", du.Registry, u.Repo, u.Tags, humanBytes(u.LogicalBytes), humanBytes(u.UniqueBytes), humanBytes(u.ExclusiveBytes))
+		}
+		fmt.Fprintf(w, "%v\t(total)\t%d\t%v\t%v\t\n", du.Registry, du.Tags, humanBytes(du.LogicalBytes), humanBytes(du.UniqueBytes))
+	}
+	w.Flush()
+}
+
+func du(ctx context.Context, args []string) {
+	fs := commandFlags("du")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+	var usages []*DiskUsage
+	incomplete := false
+	for _, reg := range regs {
+		repos, errs := getRepoInfo(ctx, reg)
+		if ctx.Err() != nil {
+			log.Println("interrupted")
+			exit(ExitCodeInterrupted)
+		}
+		warnIncomplete(errs)
+		incomplete = incomplete || len(errs) > 0
+		usages = append(usages, diskUsage(reg.name(), repos))
+	}
+	if *outputFlag == OutputTable {
+		writeDiskUsageTable(usages)
+	} else if len(usages) == 1 {
+		printJson(usages[0])
+	} else {
+		printJson(usages)
+	}
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
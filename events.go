@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEventsBody is the largest notification envelope accepted.
+const maxEventsBody = 10 << 20
+
+// eventQueueSize is how many events wait for their manifests to be fetched
+// before the registry posting them is held up.
+const eventQueueSize = 1024
+
+// Registry notification actions.
+const (
+	EventPush   = "push"
+	EventDelete = "delete"
+)
+
+// EventEnvelope is what the distribution registry posts to its notification
+// endpoints, with the content type application/vnd.docker.distribution.events.v1+json.
+type EventEnvelope struct {
+	Events []*RegistryEvent `json:"events"`
+}
+
+// RegistryEvent is a push, pull or delete of a manifest or blob.
+type RegistryEvent struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    struct {
+		MediaType  string `json:"mediaType"`
+		Digest     string `json:"digest"`
+		Repository string `json:"repository"`
+		URL        string `json:"url"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+	Request struct {
+		Host string `json:"host"`
+	} `json:"request"`
+}
+
+// manifest reports whether the event is about a manifest rather than a blob.
+// Deletes of a manifest carry neither its url nor its media type.
+func (ev *RegistryEvent) manifest() bool {
+	if ev.Target.Tag != "" || strings.Contains(ev.Target.URL, "/manifests/") {
+		return true
+	}
+	return ev.Action == EventDelete && !strings.Contains(ev.Target.URL, "/blobs/")
+}
+
+// eventRegistry finds which of regs an event was posted for: the one named
+// by ?registry= on the endpoint url, or the one whose host the event names
+// and whose prefix its repository lies under, or the only one.
+func eventRegistry(r *http.Request, regs []*Registry, ev *RegistryEvent) *Registry {
+	if alias := r.URL.Query().Get("registry"); alias != "" {
+		for _, reg := range regs {
+			if (reg.Alias == alias || reg.name() == alias) && reg.inScope(ev.Target.Repository) {
+				return reg
+			}
+		}
+		return nil
+	}
+	hosts := []string{ev.Request.Host}
+	if u, err := url.Parse(ev.Target.URL); err == nil {
+		hosts = append(hosts, u.Host)
+	}
+	for _, reg := range regs {
+		u, err := url.Parse(reg.Addr)
+		if err != nil || !reg.inScope(ev.Target.Repository) {
+			continue
+		}
+		for _, host := range hosts {
+			if host != "" && strings.EqualFold(host, u.Host) {
+				return reg
+			}
+		}
+	}
+	if len(regs) == 1 && regs[0].inScope(ev.Target.Repository) {
+		return regs[0]
+	}
+	return nil
+}
+
+// tagUpdate is what an event changes in the tags of a repository: a tag
+// pushed, with its manifest fetched, or a manifest or tag deleted.
+type tagUpdate struct {
+	repo    string
+	pushed  *TagDetail
+	deleted string
+	tag     string
+}
+
+// eventUpdate fetches what a push of a tag points at; other events need
+// nothing from the registry. It returns nil for events that change no tag.
+func eventUpdate(ctx context.Context, reg *Registry, ev *RegistryEvent) (*tagUpdate, error) {
+	if !ev.manifest() {
+		return nil, nil
+	}
+	repo := ev.Target.Repository
+	switch ev.Action {
+	case EventPush:
+		if ev.Target.Tag == "" {
+			// pushed by digest, e.g. the images of an index
+			return nil, nil
+		}
+		t, err := reg.registryClient(ctx).Tag(ctx, reg.repository(repo), ev.Target.Tag)
+		if err != nil {
+			return nil, err
+		}
+		detail := newTagDetail(ev.Target.Tag, t)
+		return &tagUpdate{repo: repo, pushed: &detail}, nil
+	case EventDelete:
+		return &tagUpdate{repo: repo, deleted: ev.Target.Digest, tag: ev.Target.Tag}, nil
+	}
+	return nil, nil
+}
+
+// apply changes the tags of repos by u and returns the tags added, removed
+// or retagged. A repository keeps its place when its last tag is removed.
+func (u *tagUpdate) apply(repos map[string][]TagDetail) []*TagChange {
+	var changes []*TagChange
+	var kept []TagDetail
+	for _, tag := range repos[u.repo] {
+		switch {
+		case u.pushed != nil && tag.Tag == u.pushed.Tag:
+			if tag.Digest != u.pushed.Digest {
+				changes = append(changes, &TagChange{Repo: u.repo, Tag: tag.Tag, Change: TagRetagged, Digest: u.pushed.Digest, PreviousDigest: tag.Digest})
+			}
+			continue
+		case u.pushed == nil && ((u.tag != "" && tag.Tag == u.tag) || (u.tag == "" && tag.Digest == u.deleted)):
+			changes = append(changes, &TagChange{Repo: u.repo, Tag: tag.Tag, Change: TagRemoved, PreviousDigest: tag.Digest})
+			continue
+		}
+		tag.SameDigest = nil
+		kept = append(kept, tag)
+	}
+	if u.pushed != nil {
+		if len(changes) == 0 && !hasTag(repos[u.repo], u.pushed.Tag) {
+			changes = append(changes, &TagChange{Repo: u.repo, Tag: u.pushed.Tag, Change: TagAdded, Digest: u.pushed.Digest})
+		}
+		kept = append(kept, *u.pushed)
+	}
+	if len(kept) == 0 {
+		// the catalog still lists a repository whose tags were all
+		// deleted, and so does a full scan
+		if _, ok := repos[u.repo]; ok {
+			repos[u.repo] = []TagDetail{}
+		}
+		return changes
+	}
+	updated := markSharedDigests(sortTagsByCreated(map[string][]TagDetail{u.repo: kept}))
+	repos[u.repo] = updated[u.repo]
+	return changes
+}
+
+func hasTag(tags []TagDetail, name string) bool {
+	for _, tag := range tags {
+		if tag.Tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsListenProblem tells why receiving notifications on listen with
+// token is unsafe: anyone who can reach a port on another interface could
+// post events changing the tags, and have the tool fetch the manifests they
+// name.
+func eventsListenProblem(listen string, token string) error {
+	if token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("receiving notifications on %v needs a token, as anyone who can reach it could post them", listen)
+}
+
+// queuedEvent is an event waiting to be applied.
+type queuedEvent struct {
+	reg *Registry
+	ev  *RegistryEvent
+}
+
+// eventsHandler accepts the notifications of regs and hands their events to
+// apply one at a time, in the order received. It answers right away, as the
+// registry gives up on slow endpoints and sends again. With a token, the
+// registry has to send it as a bearer token, set in the headers of its
+// endpoint config.
+func eventsHandler(ctx context.Context, regs []*Registry, token string, apply func(ctx context.Context, reg *Registry, ev *RegistryEvent)) http.Handler {
+	queue := make(chan *queuedEvent, eventQueueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case q := <-queue:
+				apply(ctx, q.reg, q.ev)
+			}
+		}
+	}()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJsonResponse(w, http.StatusMethodNotAllowed, map[string]string{"Error": "only POST is supported"})
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeJsonResponse(w, http.StatusUnauthorized, map[string]string{"Error": "invalid token"})
+			return
+		}
+		var envelope EventEnvelope
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventsBody)).Decode(&envelope); err != nil {
+			writeJsonResponse(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+			return
+		}
+		for _, ev := range envelope.Events {
+			if !ev.manifest() || (ev.Action != EventPush && ev.Action != EventDelete) {
+				continue
+			}
+			reg := eventRegistry(r, regs, ev)
+			if reg == nil {
+				// answering with an error would only have the registry send it again
+				logEvent(LevelWarn, logFields{Repo: ev.Target.Repository}, "event %v from %v: no registry of %v matches", ev.ID, ev.Request.Host, r.URL)
+				continue
+			}
+			select {
+			case queue <- &queuedEvent{reg: reg, ev: ev}:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func listenForEvents(ctx context.Context, args []string) {
+	fs := commandFlags("listen")
+	listen := fs.String("listen", "localhost:5050", "address to receive notifications on, at /events; other hosts than this one need -token")
+	token := fs.String("token", "", "bearer token the registry has to send")
+	dbPath := fs.String("db", "", "also keep the tags in this index database, as index does, for query")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	if err := eventsListenProblem(*listen, *token); err != nil {
+		fatal(err)
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+
+	var db *sql.DB
+	if *dbPath != "" {
+		var err error
+		db, err = openIndex(*dbPath)
+		if err != nil {
+			fatal(err)
+		}
+		defer db.Close()
+	}
+
+	// the tags of every registry, scanned once and then kept up to date
+	var mu sync.Mutex
+	inventory := make(map[*Registry]map[string][]TagDetail)
+	for _, reg := range regs {
+		repos, errs := getRepoInfo(ctx, reg)
+		if ctx.Err() != nil {
+			return
+		}
+		for _, e := range errs {
+			if e.Repo == "" {
+				fatalf("%v: %v", reg.name(), e)
+			}
+		}
+		warnIncomplete(errs)
+		if db != nil {
+			if err := writeIndex(ctx, db, reg, repos, errs); err != nil {
+				fatal(err)
+			}
+		}
+		inventory[reg] = repos
+		log.Printf("listening for %v: %d repositories", reg.name(), len(repos))
+	}
+
+	apply := func(ctx context.Context, reg *Registry, ev *RegistryEvent) {
+		u, err := eventUpdate(ctx, reg, ev)
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Repo: ev.Target.Repository, Tag: ev.Target.Tag, Err: err}, "%v: event %v: %v", reg.name(), ev.ID, err)
+			return
+		}
+		if u == nil {
+			return
+		}
+		mu.Lock()
+		changes := u.apply(inventory[reg])
+		tags := inventory[reg][u.repo]
+		mu.Unlock()
+		if db != nil && len(changes) > 0 {
+			if err := writeIndexRepo(ctx, db, reg, u.repo, tags); err != nil {
+				logEvent(LevelWarn, logFields{Registry: reg.name(), Repo: u.repo, Err: err}, "%v: indexing %v: %v", reg.name(), u.repo, err)
+			}
+		}
+		now := JsonTime(time.Now())
+		for _, change := range changes {
+			change.Registry = reg.name()
+			printWatchEvent(&WatchEvent{Time: now, TagChange: change})
+		}
+		if len(changes) > 0 {
+			notify(ctx, reg, changes, now)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/events", eventsHandler(ctx, regs, *token, apply))
+	err := listenAndServe(ctx, *listen, mux)
+	if err != nil {
+		fatal(err)
+	}
+}
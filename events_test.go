@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventManifest(t *testing.T) {
+	tests := []struct {
+		action, tag, url string
+		want             bool
+	}{
+		{EventPush, "v1", "https://reg.example.org/v2/app/manifests/sha256:aa", true},
+		{EventPush, "", "https://reg.example.org/v2/app/manifests/sha256:aa", true},
+		{EventPush, "", "https://reg.example.org/v2/app/blobs/sha256:bb", false},
+		{EventDelete, "", "", true},
+		{EventDelete, "", "https://reg.example.org/v2/app/blobs/sha256:bb", false},
+		{"pull", "", "", false},
+	}
+	for _, tt := range tests {
+		ev := &RegistryEvent{Action: tt.action}
+		ev.Target.Tag, ev.Target.URL = tt.tag, tt.url
+		if got := ev.manifest(); got != tt.want {
+			t.Errorf("%v %q %v: manifest %v, want %v", tt.action, tt.tag, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestEventRegistry(t *testing.T) {
+	a := &Registry{Alias: "a", Addr: "https://a.example.org"}
+	b := &Registry{Alias: "b", Addr: "https://b.example.org:5000"}
+	regs := []*Registry{a, b}
+	tests := []struct {
+		endpoint, host, url string
+		want                *Registry
+	}{
+		{"/events?registry=b", "a.example.org", "", b},
+		{"/events?registry=c", "", "", nil},
+		{"/events", "A.example.org", "", a},
+		{"/events", "", "https://b.example.org:5000/v2/app/manifests/sha256:aa", b},
+		{"/events", "c.example.org", "", nil},
+	}
+	for _, tt := range tests {
+		ev := &RegistryEvent{}
+		ev.Request.Host, ev.Target.URL = tt.host, tt.url
+		r := httptest.NewRequest("POST", tt.endpoint, nil)
+		if got := eventRegistry(r, regs, ev); got != tt.want {
+			t.Errorf("%v from %q: %v, want %v", tt.endpoint, tt.host, got, tt.want)
+		}
+	}
+	if got := eventRegistry(httptest.NewRequest("POST", "/events", nil), []*Registry{a}, &RegistryEvent{}); got != a {
+		t.Errorf("the only registry not chosen: %v", got)
+	}
+}
+
+func tagAt(tag string, digest string, day int) TagDetail {
+	return TagDetail{Tag: tag, Digest: digest, Created: JsonTime(time.Date(2024, 6, day, 0, 0, 0, 0, time.UTC))}
+}
+
+func TestTagUpdateApply(t *testing.T) {
+	pushed := tagAt("v3", "sha256:cc", 3)
+	retagged := tagAt("v1", "sha256:cc", 3)
+	tests := []struct {
+		name    string
+		update  tagUpdate
+		changes []*TagChange
+		tags    []string
+	}{
+		{"push", tagUpdate{repo: "app", pushed: &pushed},
+			[]*TagChange{{Repo: "app", Tag: "v3", Change: TagAdded, Digest: "sha256:cc"}},
+			[]string{"v3", "latest", "v2", "v1"}},
+		{"retag", tagUpdate{repo: "app", pushed: &retagged},
+			[]*TagChange{{Repo: "app", Tag: "v1", Change: TagRetagged, Digest: "sha256:cc", PreviousDigest: "sha256:aa"}},
+			[]string{"v1", "latest", "v2"}},
+		{"delete tag", tagUpdate{repo: "app", tag: "latest", deleted: "sha256:bb"},
+			[]*TagChange{{Repo: "app", Tag: "latest", Change: TagRemoved, PreviousDigest: "sha256:bb"}},
+			[]string{"v2", "v1"}},
+		{"delete manifest", tagUpdate{repo: "app", deleted: "sha256:bb"},
+			[]*TagChange{
+				{Repo: "app", Tag: "v2", Change: TagRemoved, PreviousDigest: "sha256:bb"},
+				{Repo: "app", Tag: "latest", Change: TagRemoved, PreviousDigest: "sha256:bb"},
+			},
+			[]string{"v1"}},
+		{"other repository", tagUpdate{repo: "web", deleted: "sha256:bb"}, nil, []string{"v2", "latest", "v1"}},
+	}
+	for _, tt := range tests {
+		repos := markSharedDigests(map[string][]TagDetail{
+			"app": {tagAt("v2", "sha256:bb", 2), tagAt("latest", "sha256:bb", 2), tagAt("v1", "sha256:aa", 1)},
+		})
+		changes := tt.update.apply(repos)
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%v: changes %+v, want %+v", tt.name, changes, tt.changes)
+		}
+		var tags []string
+		for _, tag := range repos["app"] {
+			tags = append(tags, tag.Tag)
+			if tag.Digest == "sha256:bb" && (len(tag.SameDigest) == 0) != (tt.name == "delete tag") {
+				t.Errorf("%v: %v shares its digest with %v", tt.name, tag.Tag, tag.SameDigest)
+			}
+		}
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%v: tags %v, want %v", tt.name, tags, tt.tags)
+		}
+		if _, ok := repos["web"]; ok {
+			t.Errorf("%v: added repository web", tt.name)
+		}
+	}
+}
+
+// TestTagUpdateApplyLastTag checks that removing the last tag of a
+// repository keeps it without tags, as a full scan lists it.
+func TestTagUpdateApplyLastTag(t *testing.T) {
+	repos := map[string][]TagDetail{"app": {tagAt("v1", "sha256:aa", 1)}}
+	u := tagUpdate{repo: "app", tag: "v1", deleted: "sha256:aa"}
+	if changes := u.apply(repos); len(changes) != 1 || changes[0].Change != TagRemoved {
+		t.Errorf("changes %+v, want v1 removed", changes)
+	}
+	if tags, ok := repos["app"]; !ok || tags == nil || len(tags) != 0 {
+		t.Errorf("repository app: %v, %v, want kept without tags", tags, ok)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg := &Registry{Alias: "a", Addr: "https://a.example.org"}
+	applied := make(chan *RegistryEvent, 10)
+	h := eventsHandler(ctx, []*Registry{reg}, "s3cret", func(ctx context.Context, r *Registry, ev *RegistryEvent) {
+		if r != reg {
+			t.Errorf("event applied to %v", r)
+		}
+		applied <- ev
+	})
+	post := func(method string, auth string, body string) int {
+		r := httptest.NewRequest(method, "/events", strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	events := `{"events": [
+		{"id": "1", "action": "push", "target": {"repository": "app", "tag": "v1", "url": "https://a.example.org/v2/app/manifests/sha256:aa"}},
+		{"id": "2", "action": "pull", "target": {"repository": "app", "tag": "v1"}},
+		{"id": "3", "action": "push", "target": {"repository": "app", "url": "https://a.example.org/v2/app/blobs/sha256:bb"}},
+		{"id": "4", "action": "delete", "target": {"repository": "app", "digest": "sha256:aa"}}
+	]}`
+	tests := []struct {
+		method, auth, body string
+		want               int
+	}{
+		{"GET", "Bearer s3cret", "", http.StatusMethodNotAllowed},
+		{"POST", "", events, http.StatusUnauthorized},
+		{"POST", "Bearer other", events, http.StatusUnauthorized},
+		{"POST", "Bearer s3cret", "{", http.StatusBadRequest},
+		{"POST", "Bearer s3cret", events, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := post(tt.method, tt.auth, tt.body); got != tt.want {
+			t.Errorf("%v with %q: %v, want %v", tt.method, tt.auth, got, tt.want)
+		}
+	}
+	var ids []string
+	for len(ids) < 2 {
+		select {
+		case ev := <-applied:
+			ids = append(ids, ev.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("applied %v, want the push and delete of manifests", ids)
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "4"}) {
+		t.Errorf("applied %v, want 1 and 4 in order", ids)
+	}
+}
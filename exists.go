@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// exists checks that a tag is there with a HEAD request on its manifest, for
+// pipelines that gate on it by exit code: 0 when it is there (and points at
+// -digest, if given), 1 when it is not, and ExitCodeIncomplete when the
+// registry could not tell, so that an outage is not taken for a missing tag.
+func exists(ctx context.Context, args []string) {
+	fs := commandFlags("exists")
+	digest := fs.String("digest", "", "also require the tag to point at this digest")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	repo, ref := parseReference(fs.Arg(1))
+	actual, found, err := reg.registryClient(ctx).Digest(ctx, reg.repository(repo), ref)
+	if err != nil {
+		log.Printf("checking %v: %v", fs.Arg(1), err)
+		exit(ExitCodeIncomplete)
+	}
+	if !found {
+		log.Printf("%v not found", fs.Arg(1))
+		exit(1)
+	}
+	if *digest != "" && actual != *digest {
+		log.Printf("%v points at %v, not %v", fs.Arg(1), actual, *digest)
+		exit(1)
+	}
+	fmt.Println(actual)
+}
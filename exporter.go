@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exporterListen is where the exporter listens unless told otherwise, on
+// every interface for Prometheus to scrape, but not on 9100 taken by the
+// node_exporter running on many of the same hosts.
+const exporterListen = ":9495"
+
+// registryMetrics is the outcome of the latest scan of one registry.
+type registryMetrics struct {
+	repos    map[string][]TagDetail
+	errors   int
+	duration time.Duration
+	finished time.Time
+	tls      *TLSInfo
+	slos     []*SLOResult
+}
+
+// exporter scans registries periodically and serves what it found in the
+// Prometheus text format.
+type exporter struct {
+	regs     []*Registry
+	interval time.Duration
+
+	// events has the notifications of the registries received at /events
+	ctx         context.Context
+	events      bool
+	eventsToken string
+
+	mu     sync.Mutex
+	latest map[string]*registryMetrics
+	scans  map[string]int
+	errors map[string]int
+}
+
+func newExporter(regs []*Registry, interval time.Duration) *exporter {
+	return &exporter{
+		regs:     regs,
+		interval: interval,
+		latest:   make(map[string]*registryMetrics),
+		scans:    make(map[string]int),
+		errors:   make(map[string]int),
+	}
+}
+
+func (e *exporter) scan(ctx context.Context, reg *Registry) {
+	start := time.Now()
+	repos, errs := getRepoInfo(ctx, reg)
+	if ctx.Err() != nil {
+		return
+	}
+	m := &registryMetrics{repos: repos, errors: len(errs), duration: time.Since(start), finished: time.Now()}
+	if _, _, ok := tlsAddress(reg); ok {
+		info, err := inspectTLS(ctx, reg, reg.name(), 0, m.finished)
+		if err != nil {
+			log.Printf("%v: tls: %v", reg.name(), err)
+			m.errors++
+		}
+		m.tls = info
+	}
+	if len(localConf.SLOs) > 0 {
+		slos, err := checkSLOs(localConf.SLOs, repos, m.finished)
+		if err != nil {
+			log.Printf("%v: slo: %v", reg.name(), err)
+		}
+		m.slos = slos
+	}
+	for _, err := range errs {
+		log.Printf("%v: %v", reg.name(), err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scans[reg.name()]++
+	e.errors[reg.name()] += m.errors
+	if m.errors > 0 && len(repos) == 0 && e.latest[reg.name()] != nil {
+		// keep the previous counts when the registry could not be read at all
+		e.latest[reg.name()].errors = m.errors
+		return
+	}
+	e.latest[reg.name()] = m
+}
+
+// run scans every registry once per interval until ctx is done.
+func (e *exporter) run(ctx context.Context) {
+	for {
+		for _, reg := range e.regs {
+			e.scan(ctx, reg)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%v="%v"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return "{" + b.String() + "}"
+}
+
+// metricWriter writes one metric family at a time, leaving out families
+// without samples.
+type metricWriter struct {
+	w       io.Writer
+	samples []string
+}
+
+func (mw *metricWriter) sample(labels string, value float64) {
+	mw.samples = append(mw.samples, labels+" "+strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (mw *metricWriter) flush(name string, typ string, help string) {
+	if len(mw.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(mw.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	for _, sample := range mw.samples {
+		fmt.Fprintf(mw.w, "%v%v\n", name, sample)
+	}
+	mw.samples = mw.samples[:0]
+}
+
+func (e *exporter) writeMetrics(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.scans))
+	for name := range e.scans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mw := &metricWriter{w: w}
+	for _, name := range names {
+		mw.sample(labels("registry", name), float64(e.scans[name]))
+	}
+	mw.flush("registry_scans_total", "counter", "Scans of the registry.")
+	for _, name := range names {
+		mw.sample(labels("registry", name), float64(e.errors[name]))
+	}
+	mw.flush("registry_scrape_errors_total", "counter", "Requests that failed while scanning the registry.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			mw.sample(labels("registry", name), float64(m.errors))
+		}
+	}
+	mw.flush("registry_last_scan_errors", "gauge", "Requests that failed in the latest scan of the registry.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			mw.sample(labels("registry", name), float64(m.finished.Unix()))
+		}
+	}
+	mw.flush("registry_last_scan_timestamp_seconds", "gauge", "When the latest scan that could read the registry finished.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			mw.sample(labels("registry", name), m.duration.Seconds())
+		}
+	}
+	mw.flush("registry_scan_duration_seconds", "gauge", "How long the latest scan of the registry took.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			mw.sample(labels("registry", name), float64(len(m.repos)))
+		}
+	}
+	mw.flush("registry_repo_count", "gauge", "Repositories listed by the registry, with tags or not.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			for _, repo := range sortedRepos(m.repos) {
+				mw.sample(labels("registry", name, "repo", repo), float64(len(m.repos[repo])))
+			}
+		}
+	}
+	mw.flush("registry_tag_count", "gauge", "Tags of the repository.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			for _, repo := range sortedRepos(m.repos) {
+				if tags := m.repos[repo]; len(tags) > 0 {
+					mw.sample(labels("registry", name, "repo", repo), float64(time.Time(tags[0].Created).Unix()))
+				}
+			}
+		}
+	}
+	mw.flush("registry_image_created_timestamp", "gauge", "Creation time of the newest image of the repository.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			for _, repo := range sortedRepos(m.repos) {
+				var size int64
+				for _, tag := range m.repos[repo] {
+					size += tag.Size
+				}
+				mw.sample(labels("registry", name, "repo", repo), float64(size))
+			}
+		}
+	}
+	mw.flush("registry_tag_size_bytes", "gauge", "Summed size of the tags of the repository, shared layers counted once per tag.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil && m.tls != nil && len(m.tls.Chain) > 0 {
+			mw.sample(labels("registry", name), float64(time.Time(m.tls.Chain[0].NotAfter).Unix()))
+		}
+	}
+	mw.flush("registry_tls_cert_expiry_timestamp_seconds", "gauge", "Expiry of the certificate the registry serves.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil && m.tls != nil {
+			mw.sample(labels("registry", name), float64(len(m.tls.Problems)))
+		}
+	}
+	mw.flush("registry_tls_problems", "gauge", "Problems found with the certificate chain of the registry, as reported by tls-info.")
+	for _, name := range names {
+		if m := e.latest[name]; m != nil {
+			for _, r := range m.slos {
+				violated := 0.0
+				if r.Status != SLOStatusOK {
+					violated = 1
+				}
+				mw.sample(labels("registry", name, "pattern", r.Pattern, "repo", r.Repo), violated)
+			}
+		}
+	}
+	mw.flush("registry_slo_violated", "gauge", "1 if the freshness SLO is violated for the repository, or if no repository matches its pattern.")
+}
+
+// apply updates the latest scan of reg with the tags an event changed,
+// until the next scan.
+func (e *exporter) apply(ctx context.Context, reg *Registry, ev *RegistryEvent) {
+	u, err := eventUpdate(ctx, reg, ev)
+	if err != nil {
+		logEvent(LevelWarn, logFields{Registry: reg.name(), Repo: ev.Target.Repository, Tag: ev.Target.Tag, Err: err}, "%v: event %v: %v", reg.name(), ev.ID, err)
+		return
+	}
+	if u == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if m := e.latest[reg.name()]; m != nil {
+		u.apply(m.repos)
+	}
+}
+
+func (e *exporter) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		e.writeMetrics(w)
+	})
+	if e.events {
+		mux.Handle("/events", eventsHandler(e.ctx, e.regs, e.eventsToken, e.apply))
+	}
+	return mux
+}
+
+func exportMetrics(ctx context.Context, args []string) {
+	fs := commandFlags("exporter")
+	listen := fs.String("listen", exporterListen, "address to serve /metrics on")
+	interval := fs.Duration("interval", 5*time.Minute, "time between scans of every registry")
+	events := fs.Bool("events", false, "receive the notifications of the registries at /events and update the tags they change between scans")
+	eventsToken := fs.String("events-token", "", "bearer token the registries have to send with their notifications")
+	fs.Parse(args)
+
+	var regs []*Registry
+	if fs.NArg() == 0 {
+		regs = localConf.Registries
+	}
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+	if len(regs) == 0 {
+		fs.Usage()
+		exit(2)
+	}
+
+	if *events {
+		if err := eventsListenProblem(*listen, *eventsToken); err != nil {
+			fatal(err)
+		}
+	}
+	e := newExporter(regs, *interval)
+	e.ctx, e.events, e.eventsToken = ctx, *events, *eventsToken
+	go e.run(ctx)
+	log.Printf("exporting metrics of %d registries on %v", len(regs), *listen)
+	err := listenAndServe(ctx, *listen, e.handler())
+	if err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Fault types understood by -inject-fault.
+const (
+	FaultTimeout  = "timeout"
+	FaultReset    = "reset"
+	FaultTruncate = "truncate"
+	FaultDelay    = "delay"
+	Fault429      = "429"
+	Fault500      = "500"
+	Fault503      = "503"
+)
+
+// Fault makes a share of the requests fail the way a flaky registry would.
+type Fault struct {
+	Type  string
+	Rate  float64
+	Delay time.Duration
+}
+
+type faultList []*Fault
+
+var injectedFaults faultList
+
+// hiddenFlags are left out of the usage message; they exist for testing the
+// tool itself rather than for everyday use.
+var hiddenFlags = map[string]bool{"inject-fault": true}
+
+func init() {
+	flag.Var(&injectedFaults, "inject-fault", "fail a share of requests: rate=0.05,type=timeout|reset|truncate|delay|429|500|503[,delay=2s]")
+}
+
+func (l *faultList) String() string {
+	var specs []string
+	for _, f := range *l {
+		specs = append(specs, fmt.Sprintf("rate=%v,type=%v,delay=%v", f.Rate, f.Type, f.Delay))
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *faultList) Set(spec string) error {
+	f := &Fault{Delay: time.Second}
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid fault %q", kv)
+		}
+		var err error
+		switch parts[0] {
+		case "rate":
+			f.Rate, err = strconv.ParseFloat(parts[1], 64)
+		case "type":
+			f.Type = parts[1]
+		case "delay":
+			f.Delay, err = time.ParseDuration(parts[1])
+		default:
+			err = fmt.Errorf("unknown fault option %q", parts[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch f.Type {
+	case FaultTimeout, FaultReset, FaultTruncate, FaultDelay, Fault429, Fault500, Fault503:
+	default:
+		return fmt.Errorf("unknown fault type %q", f.Type)
+	}
+	if f.Rate <= 0 || f.Rate > 1 {
+		return fmt.Errorf("fault rate must be in (0, 1], got %v", f.Rate)
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+// faultTransport injects the configured faults below the retry layer, so
+// that retries and partial results can be exercised.
+type faultTransport struct {
+	base   http.RoundTripper
+	faults faultList
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for _, f := range t.faults {
+		if rand.Float64() < f.Rate {
+			return f.inject(t.base, req)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (f *Fault) inject(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	switch f.Type {
+	case FaultTimeout:
+		// hang until the attempt times out, as an unresponsive registry would
+		ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+		defer cancel()
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: ctx.Err()}
+	case FaultReset:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	case FaultDelay:
+		select {
+		case <-time.After(f.Delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return base.RoundTrip(req)
+	case FaultTruncate:
+		res, err := base.RoundTrip(req)
+		if err != nil {
+			return res, err
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errReader{io.ErrUnexpectedEOF}))
+		return res, nil
+	}
+	status, _ := strconv.Atoi(f.Type)
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %v", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader("injected fault\n")),
+		Request:    req,
+	}, nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
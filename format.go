@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Formatter writes what a command found to stdout in one output format. The
+// result of a scan is a *Report, or a map[string]*Report of the reports of
+// several registries by name; other commands hand over their own results,
+// which formats that only know reports print as JSON.
+type Formatter interface {
+	Write(result interface{}) error
+}
+
+// FormatterFunc is a function used as a Formatter.
+type FormatterFunc func(result interface{}) error
+
+func (f FormatterFunc) Write(result interface{}) error {
+	return f(result)
+}
+
+var formatters = make(map[string]Formatter)
+
+// RegisterFormatter makes f the formatter of -output name. It is meant to be
+// called from init functions and panics if name is taken.
+func RegisterFormatter(name string, f Formatter) {
+	if _, ok := formatters[name]; ok {
+		panic(fmt.Sprintf("output format %q registered twice", name))
+	}
+	formatters[name] = f
+}
+
+func init() {
+	RegisterFormatter(OutputJson, FormatterFunc(func(result interface{}) error {
+		j, err := marshalJson(versionedOutput(result))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(j))
+		return err
+	}))
+	RegisterFormatter(OutputTable, reportFormatter(func(i int, name string, report *Report) {
+		if i > 0 {
+			fmt.Println()
+		}
+		if i >= 0 {
+			fmt.Printf("== %v ==\n", name)
+		}
+		writeTable(os.Stdout, name, report.Repositories, *maxRowsFlag)
+	}))
+	RegisterFormatter(OutputRefs, reportFormatter(func(i int, name string, report *Report) {
+		writeRefs(os.Stdout, report.reg, report.Repositories)
+	}))
+	RegisterFormatter(OutputTree, reportFormatter(func(i int, name string, report *Report) {
+		if i > 0 {
+			fmt.Println()
+		}
+		writeTree(os.Stdout, name, report.Repositories, time.Now())
+	}))
+}
+
+// reportFormatter is a Formatter writing every report of a result with
+// write, in the order of their registry names, and the warnings of
+// incomplete ones. write is passed the index of the report among several,
+// or -1 for a single one. Other results are printed as JSON.
+func reportFormatter(write func(i int, name string, report *Report)) Formatter {
+	return FormatterFunc(func(result interface{}) error {
+		switch o := result.(type) {
+		case *Report:
+			write(-1, o.registry, o)
+			warnIncomplete(o.Errors)
+		case map[string]*Report:
+			names := make([]string, 0, len(o))
+			for name := range o {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for i, name := range names {
+				write(i, name, o[name])
+				warnIncomplete(o[name].Errors)
+			}
+		default:
+			printJson(result)
+		}
+		return nil
+	})
+}
+
+// checkOutputFormat fails on an -output no formatter is registered for,
+// before anything is scanned.
+func checkOutputFormat() {
+	if _, ok := formatters[*outputFlag]; !ok {
+		fatalf("unknown output format %q", *outputFlag)
+	}
+}
+
+// printOutput writes a report, or reports grouped by registry, with the
+// formatter of -output. Only the table is ever truncated.
+func printOutput(output interface{}) {
+	defer phase("output")()
+	if err := formatters[*outputFlag].Write(output); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient/registrytest"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// testRegistry serves a few repositories covering what the formatters
+// print: several tags of a repository, one shared by two tags, an OCI
+// image, a Helm chart, an owner label and a repository without tags.
+func testRegistry(t *testing.T) (*registrytest.Server, *Registry) {
+	s := registrytest.NewServer()
+	t.Cleanup(s.Close)
+	s.AddImage("team-a/app", "v1", registrytest.Image{Created: date("2024-01-02"), Layers: []int64{1024, 2048}})
+	v2 := registrytest.Image{Created: date("2024-03-01"), Layers: []int64{1024, 4096}}
+	s.AddImage("team-a/app", "v2", v2)
+	s.AddImage("team-a/app", "latest", v2)
+	s.AddImage("base/alpine", "3.19", registrytest.Image{Schema: registrytest.OCI, Created: date("2023-12-01"), Layers: []int64{3000}})
+	s.AddImage("team-b/svc", "1.0", registrytest.Image{Created: date("2023-06-15"), Layers: []int64{512}, Labels: map[string]string{"team": "payments"}})
+	s.AddImage("charts/web", "0.1.0", registrytest.Image{Created: date("2024-02-10"), Layers: []int64{700}, ArtifactType: "application/vnd.cncf.helm.config.v1+json"})
+	s.AddRepo("team-c/empty")
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(config, []byte(`{
+		"registries": [{"alias": "test", "addr": "`+s.URL+`"}],
+		"owners": [{"prefix": "team-a/", "team": "team-a"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := readConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := localConf
+	localConf = conf
+	t.Cleanup(func() { localConf = prev })
+	return s, conf.Registries[0]
+}
+
+func scanTestRegistry(t *testing.T) *Report {
+	_, reg := testRegistry(t)
+	report := scanReport(context.Background(), reg)
+	if len(report.Errors) > 0 {
+		t.Fatalf("scan failed: %v", report.Errors)
+	}
+	return report
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+// withFlags sets flags of the output for the duration of a test.
+func withFlags(t *testing.T, output string, schema int, report bool) {
+	prevOutput, prevSchema, prevReport := *outputFlag, *outputSchemaFlag, reportOutput
+	*outputFlag, *outputSchemaFlag, reportOutput = output, schema, report
+	t.Cleanup(func() {
+		*outputFlag, *outputSchemaFlag, reportOutput = prevOutput, prevSchema, prevReport
+	})
+}
+
+func writeOutput(t *testing.T, result interface{}) []byte {
+	t.Helper()
+	return captureStdout(t, func() {
+		if err := formatters[*outputFlag].Write(result); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTableFormatter(t *testing.T) {
+	report := scanTestRegistry(t)
+	withFlags(t, OutputTable, OutputSchemaV1, false)
+	registrytest.Golden(t, "scan.table", writeOutput(t, report))
+}
+
+func TestJsonFormatter(t *testing.T) {
+	report := scanTestRegistry(t)
+	withFlags(t, OutputJson, OutputSchemaV1, false)
+	got := writeOutput(t, report)
+	registrytest.Golden(t, "scan.json", got)
+
+	// the first releases printed the same bytes
+	var repos map[string][]struct {
+		Tag     string
+		Created JsonTime
+	}
+	if err := json.Unmarshal(got, &repos); err != nil {
+		t.Fatal(err)
+	}
+	first, err := json.MarshalIndent(repos, "", "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(first, '\n'), got) {
+		t.Errorf("schema 1 differs from the map of the first releases:\n%s", first)
+	}
+}
+
+// TestJsonFormatterErrors checks that schema 1 keeps the errors of an
+// incomplete scan next to the repositories.
+func TestJsonFormatterErrors(t *testing.T) {
+	s, reg := testRegistry(t)
+	s.Fail("/v2/team-b/svc/manifests/", http.StatusForbidden, -1)
+	report := scanReport(context.Background(), reg)
+	withFlags(t, OutputJson, OutputSchemaV1, false)
+	var got struct {
+		App    []TagV1 `json:"team-a/app"`
+		Errors []*ScanError
+	}
+	if err := json.Unmarshal(writeOutput(t, report), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.App) != 3 || len(got.Errors) != 1 || got.Errors[0].Repo != "team-b/svc" || got.Errors[0].Tag != "1.0" {
+		t.Errorf("output %+v, want the tags of team-a/app and the error of team-b/svc:1.0", got)
+	}
+}
+
+func TestJsonFormatterReport(t *testing.T) {
+	report := scanTestRegistry(t)
+	withFlags(t, OutputJson, OutputSchemaV1, true)
+	registrytest.Golden(t, "scan-report.json", writeOutput(t, report))
+}
+
+func TestJsonFormatterSeveral(t *testing.T) {
+	report := scanTestRegistry(t)
+	withFlags(t, OutputJson, OutputSchemaV1, false)
+	registrytest.Golden(t, "scan-several.json", writeOutput(t, map[string]*Report{"a": report, "b": report}))
+}
+
+func TestAuditCsv(t *testing.T) {
+	report := scanTestRegistry(t)
+	entries := auditEntries(localConf, report.registry, report.Repositories, 90*24*time.Hour, date("2024-06-01"))
+	sortAuditEntries(entries)
+	var b bytes.Buffer
+	if err := writeAuditCsv(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	registrytest.Golden(t, "audit.csv", b.Bytes())
+}
+
+func TestCostCsv(t *testing.T) {
+	report := scanTestRegistry(t)
+	entries := costEntries(localConf, &Pricing{PerGBMonth: 100000, Currency: "USD"}, report.Repositories, true)
+	got := captureStdout(t, func() {
+		if err := writeCostCsv(entries); err != nil {
+			t.Fatal(err)
+		}
+	})
+	registrytest.Golden(t, "cost.csv", got)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// GCEstimate is what garbage collection would free after deleting some
+// manifests. A blob is only freed when no surviving tag, in any repository
+// of the registry, still references it.
+//
+// LogicalBytes counts the deleted manifests in full, ReclaimableBytes the
+// blobs freed, each once, and RetainedBytes the blobs of deleted manifests
+// that surviving tags keep. The reclaimable size of a repository counts the
+// blobs only its own deletions free; blobs freed by deletions in several
+// repositories only count in the total.
+type GCEstimate struct {
+	Registry         string
+	Manifests        int
+	Tags             int
+	LogicalBytes     int64
+	ReclaimableBytes int64
+	RetainedBytes    int64
+	Repositories     []*RepoReclaim
+}
+
+type RepoReclaim struct {
+	Repo             string
+	Manifests        int
+	Tags             int
+	LogicalBytes     int64
+	ReclaimableBytes int64
+}
+
+// gcEstimate estimates what deleting the manifests of deleted out of repos,
+// along with every tag pointing at them, would free.
+func gcEstimate(registry string, repos map[string][]TagDetail, deleted []*PruneResult) *GCEstimate {
+	gone := make(map[string]map[string]bool)
+	for _, r := range deleted {
+		if gone[r.Repo] == nil {
+			gone[r.Repo] = make(map[string]bool)
+		}
+		gone[r.Repo][r.Digest] = true
+	}
+
+	// the blobs surviving tags reference, and the repositories whose
+	// deletions reference each of the others
+	kept := make(map[string]bool)
+	users := make(map[string]map[string]bool)
+	sizes := make(map[string]int64)
+	unknown := 0
+	for repo, tags := range repos {
+		for _, tag := range tags {
+			if !gone[repo][tag.Digest] {
+				for _, b := range tag.Blobs {
+					kept[b.Digest] = true
+				}
+				continue
+			}
+			if tag.Blobs == nil {
+				unknown++
+			}
+			for _, b := range tag.Blobs {
+				if users[b.Digest] == nil {
+					users[b.Digest] = make(map[string]bool)
+				}
+				users[b.Digest][repo] = true
+				sizes[b.Digest] = b.Size
+			}
+		}
+	}
+	if unknown > 0 {
+		logEvent(LevelWarn, logFields{Registry: registry}, "%v: the layers of %d schema1 tags are unknown, what deleting them frees is not counted", registry, unknown)
+	}
+
+	e := &GCEstimate{Registry: registry, Repositories: []*RepoReclaim{}}
+	for digest, size := range sizes {
+		if kept[digest] {
+			e.RetainedBytes += size
+		} else {
+			e.ReclaimableBytes += size
+		}
+	}
+	byRepo := make(map[string]*RepoReclaim)
+	for _, r := range deleted {
+		u, ok := byRepo[r.Repo]
+		if !ok {
+			u = &RepoReclaim{Repo: r.Repo}
+			byRepo[r.Repo] = u
+			e.Repositories = append(e.Repositories, u)
+		}
+		u.Manifests++
+		u.Tags += len(r.Tags)
+		u.LogicalBytes += r.Size
+		e.Manifests++
+		e.Tags += len(r.Tags)
+		e.LogicalBytes += r.Size
+	}
+	for digest, size := range sizes {
+		if kept[digest] || len(users[digest]) != 1 {
+			continue
+		}
+		for repo := range users[digest] {
+			byRepo[repo].ReclaimableBytes += size
+		}
+	}
+	sort.Slice(e.Repositories, func(i, j int) bool {
+		a, b := e.Repositories[i], e.Repositories[j]
+		if a.ReclaimableBytes != b.ReclaimableBytes {
+			return a.ReclaimableBytes > b.ReclaimableBytes
+		}
+		return a.Repo < b.Repo
+	})
+	return e
+}
+
+// readRefs reads image references, one per line, from file, or from stdin
+// for "-". Blank lines and lines starting with # are skipped.
+func readRefs(file string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var refs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		refs = append(refs, line)
+	}
+	return refs, scanner.Err()
+}
+
+// selectRefs returns the manifests refs point at in repos, with every tag
+// pointing there, as deleting by tag deletes the manifest.
+func selectRefs(repos map[string][]TagDetail, refs []string) ([]*PruneResult, error) {
+	var results []*PruneResult
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		repo, reference := parseReference(ref)
+		digest := ""
+		for _, tag := range repos[repo] {
+			if tag.Tag == reference || tag.Digest == reference {
+				digest = tag.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, fmt.Errorf("%v not found", ref)
+		}
+		if seen[repo+"@"+digest] {
+			continue
+		}
+		seen[repo+"@"+digest] = true
+		r := &PruneResult{Repo: repo, Digest: digest, Status: PruneWouldDelete}
+		for _, tag := range repos[repo] {
+			if tag.Digest == digest {
+				r.Tags = append(r.Tags, tag.Tag)
+				r.Size = tag.Size
+			}
+		}
+		sort.Strings(r.Tags)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func writeGCEstimateTable(e *GCEstimate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tMANIFESTS\tTAGS\tLOGICAL\tRECLAIMABLE")
+	for _, u := range e.Repositories {
+		fmt.Fprintf(w, "%v\t%d\t%d\t%v\t%v\n", u.Repo, u.Manifests, u.Tags, humanBytes(u.LogicalBytes), humanBytes(u.ReclaimableBytes))
+	}
+	fmt.Fprintf(w, "(total)\t%d\t%d\t%v\t%v\n", e.Manifests, e.Tags, humanBytes(e.LogicalBytes), humanBytes(e.ReclaimableBytes))
+	w.Flush()
+	fmt.Printf("%v stay referenced by surviving tags\n", humanBytes(e.RetainedBytes))
+}
+
+func gcEstimateCommand(ctx context.Context, args []string) {
+	fs := commandFlags("gc-estimate")
+	rules := addPruneRules(fs)
+	refsFile := fs.String("refs", "", "estimate deleting the `file` of references, one repo:tag or repo@digest per line or - for stdin, instead of what the prune rules select")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		exit(2)
+	}
+	rules.check()
+	var refs []string
+	if *refsFile != "" {
+		var err error
+		if refs, err = readRefs(*refsFile); err != nil {
+			fatal(err)
+		}
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	// references as -q prints them name the registry too
+	host := strings.TrimPrefix(strings.TrimPrefix(reg.Addr, "https://"), "http://") + "/"
+	for i, ref := range refs {
+		refs[i] = strings.TrimPrefix(ref, host)
+	}
+	repos, errs := getRepoInfo(ctx, reg)
+	if ctx.Err() != nil {
+		log.Println("interrupted")
+		exit(ExitCodeInterrupted)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Println(e)
+		}
+		fatalf("not estimating %v: the scan is incomplete, so tags keeping layers may be missing", reg.name())
+	}
+	var deleted []*PruneResult
+	var err error
+	if *refsFile != "" {
+		deleted, err = selectRefs(repos, refs)
+	} else {
+		deleted, err = rules.candidates(repos)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	estimate := gcEstimate(reg.name(), repos, deleted)
+	if *outputFlag == OutputTable {
+		writeGCEstimateTable(estimate)
+	} else {
+		printJson(estimate)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleScope            = "https://www.googleapis.com/auth/cloud-platform"
+	googleTokenURL         = "https://oauth2.googleapis.com/token"
+	googleMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// gcr.io and pkg.dev accept any google access token as the password of this user
+	gcrUsername = "oauth2accesstoken"
+)
+
+// googleKeyFile holds the fields of a service account key or of the
+// authorized_user file `gcloud auth application-default login` writes.
+type googleKeyFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// googleCredentials resolves Application Default Credentials: an explicit key
+// file, then GOOGLE_APPLICATION_CREDENTIALS, then the gcloud ADC file and
+// finally the GCE metadata server.
+type googleCredentials struct {
+	keyFile string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newGoogleCredentials(keyFile string) *googleCredentials {
+	return &googleCredentials{keyFile: keyFile}
+}
+
+func (g *googleCredentials) credentials() (string, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expiry) {
+		return gcrUsername, g.token, nil
+	}
+	token, expiresIn, err := g.accessToken()
+	if err != nil {
+		return "", "", fmt.Errorf("gcr: %v", err)
+	}
+	g.token = token
+	g.expiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return gcrUsername, g.token, nil
+}
+
+func (g *googleCredentials) accessToken() (string, int, error) {
+	path := g.keyFile
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		adc := filepath.Join(os.Getenv("HOME"), ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(adc); err == nil {
+			path = adc
+		}
+	}
+	if path == "" {
+		return googleMetadataToken()
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	var key googleKeyFile
+	err = json.Unmarshal(b, &key)
+	if err != nil {
+		return "", 0, fmt.Errorf("%v: %v", path, err)
+	}
+	switch key.Type {
+	case "service_account":
+		return googleServiceAccountToken(&key)
+	case "authorized_user":
+		return postForGoogleToken(googleTokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {key.ClientID},
+			"client_secret": {key.ClientSecret},
+			"refresh_token": {key.RefreshToken},
+		})
+	}
+	return "", 0, fmt.Errorf("%v: unsupported credentials type %q", path, key.Type)
+}
+
+func googleServiceAccountToken(key *googleKeyFile) (string, int, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", 0, fmt.Errorf("service account %v: no private key", key.ClientEmail)
+	}
+	var pk *rsa.PrivateKey
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		if pk, ok = parsed.(*rsa.PrivateKey); !ok {
+			return "", 0, fmt.Errorf("service account %v: private key is not RSA", key.ClientEmail)
+		}
+	} else if pk, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", 0, fmt.Errorf("service account %v: %v", key.ClientEmail, err)
+	}
+
+	tokenURI := key.TokenURI
+	if tokenURI == "" {
+		tokenURI = googleTokenURL
+	}
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": googleScope,
+		"aud":   tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, pk, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return postForGoogleToken(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	})
+}
+
+func googleMetadataToken() (string, int, error) {
+	req, err := http.NewRequest(http.MethodGet, googleMetadataTokenURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return doForGoogleToken(req)
+}
+
+func postForGoogleToken(tokenURL string, form url.Values) (string, int, error) {
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doForGoogleToken(req)
+}
+
+func doForGoogleToken(req *http.Request) (string, int, error) {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = decodeJsonResponse(res, &body)
+	return body.AccessToken, body.ExpiresIn, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+const (
+	GitHubRegistryHost = "ghcr.io"
+	GitHubAPI          = "https://api.github.com"
+	GitLabRegistryHost = "registry.gitlab.com"
+	GitLabAPI          = "https://gitlab.com/api/v4"
+)
+
+func (reg *Registry) api(fallback string) string {
+	if reg.API != "" {
+		return strings.TrimSuffix(reg.API, "/")
+	}
+	return fallback
+}
+
+// listGitHubRepos lists the container packages of the configured
+// organization or user, as ghcr.io serves no catalog.
+func listGitHubRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	owner := reg.Namespace
+	if owner == "" {
+		owner = reg.Username
+	}
+	if owner == "" {
+		return nil, fmt.Errorf("ghcr: namespace or username required to list packages")
+	}
+
+	repos, err := listGitHubPackages(ctx, reg, fmt.Sprintf("%v/orgs/%v/packages?package_type=container&per_page=100", reg.api(GitHubAPI), owner))
+	if err != nil {
+		// not an organization, try the user of that name
+		repos, err = listGitHubPackages(ctx, reg, fmt.Sprintf("%v/users/%v/packages?package_type=container&per_page=100", reg.api(GitHubAPI), owner))
+	}
+	return repos, err
+}
+
+func listGitHubPackages(ctx context.Context, reg *Registry, url string) ([]string, error) {
+	var repos []string
+	for url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if reg.Password != "" {
+			req.Header.Set("Authorization", "Bearer "+reg.Password)
+		}
+		var page []struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		}
+		url, err = getJsonPage(reg.client(), req, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			repos = append(repos, strings.ToLower(p.Owner.Login+"/"+p.Name))
+		}
+	}
+	return repos, nil
+}
+
+// listGitLabRepos lists the registry repositories of the configured group
+// through the GitLab API, as the GitLab registry only serves its catalog to
+// administrators.
+func listGitLabRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	if reg.Namespace == "" {
+		return nil, fmt.Errorf("gitlab: namespace (group path) required to list repositories")
+	}
+
+	var repos []string
+	url := fmt.Sprintf("%v/groups/%v/registry/repositories?per_page=100", reg.api(GitLabAPI), neturl.PathEscape(reg.Namespace))
+	for url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if reg.Password != "" {
+			req.Header.Set("PRIVATE-TOKEN", reg.Password)
+		}
+		var page []struct {
+			Path string `json:"path"`
+		}
+		url, err = getJsonPage(reg.client(), req, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			repos = append(repos, r.Path)
+		}
+	}
+	return repos, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+)
+
+const HarborAPI = "/api/v2.0"
+
+type HarborInfo struct {
+	Version  string
+	Projects []*HarborProject
+}
+
+type HarborProject struct {
+	ID           int `json:"-"`
+	Name         string
+	RepoCount    int
+	QuotaUsed    int64
+	QuotaHard    int64
+	Repositories []*HarborRepository
+}
+
+type HarborRepository struct {
+	Name          string
+	ArtifactCount int
+	PullCount     int
+}
+
+// harborGet decodes the Harbor API response of path into v and returns the
+// url of the next page, if any.
+func harborGet(ctx context.Context, reg *Registry, url string, v interface{}) (next string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if reg.Username != "" {
+		req.SetBasicAuth(reg.Username, reg.Password)
+	}
+	return getJsonPage(reg.client(), req, v)
+}
+
+func harborVersion(ctx context.Context, reg *Registry) (string, bool) {
+	var info struct {
+		HarborVersion string `json:"harbor_version"`
+	}
+	_, err := harborGet(ctx, reg, reg.Addr+HarborAPI+"/systeminfo", &info)
+	if err != nil || info.HarborVersion == "" {
+		return "", false
+	}
+	return info.HarborVersion, true
+}
+
+func harborProjects(ctx context.Context, reg *Registry) ([]*HarborProject, error) {
+	var projects []*HarborProject
+	url := reg.Addr + HarborAPI + "/projects?page_size=100"
+	for url != "" {
+		var page []struct {
+			ProjectID int    `json:"project_id"`
+			Name      string `json:"name"`
+			RepoCount int    `json:"repo_count"`
+		}
+		next, err := harborGet(ctx, reg, url, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			project := &HarborProject{ID: p.ProjectID, Name: p.Name, RepoCount: p.RepoCount}
+			project.Repositories, err = harborRepositories(ctx, reg, p.Name)
+			if err != nil {
+				return nil, err
+			}
+			projects = append(projects, project)
+		}
+		url = next
+	}
+	return projects, nil
+}
+
+func harborQuota(ctx context.Context, reg *Registry, project *HarborProject) error {
+	var quotas []struct {
+		Hard map[string]int64 `json:"hard"`
+		Used map[string]int64 `json:"used"`
+	}
+	_, err := harborGet(ctx, reg, fmt.Sprintf("%v%v/quotas?reference=project&reference_id=%v", reg.Addr, HarborAPI, project.ID), &quotas)
+	if err != nil {
+		return err
+	}
+	if len(quotas) > 0 {
+		project.QuotaUsed = quotas[0].Used["storage"]
+		project.QuotaHard = quotas[0].Hard["storage"]
+		requestStats.quota(reg.name(), project.Name, project.QuotaUsed, project.QuotaHard)
+	}
+	return nil
+}
+
+func harborRepositories(ctx context.Context, reg *Registry, project string) ([]*HarborRepository, error) {
+	var repos []*HarborRepository
+	url := fmt.Sprintf("%v%v/projects/%v/repositories?page_size=100", reg.Addr, HarborAPI, neturl.PathEscape(project))
+	for url != "" {
+		var page []struct {
+			Name          string `json:"name"`
+			ArtifactCount int    `json:"artifact_count"`
+			PullCount     int    `json:"pull_count"`
+		}
+		next, err := harborGet(ctx, reg, url, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			repos = append(repos, &HarborRepository{
+				Name:          r.Name,
+				ArtifactCount: r.ArtifactCount,
+				PullCount:     r.PullCount,
+			})
+		}
+		url = next
+	}
+	return repos, nil
+}
+
+// listHarborRepos lists repositories through the Harbor API, which unlike
+// /v2/_catalog does not need admin rights. The projects listed are kept for
+// harborInfo of the same scan.
+func listHarborRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	projects, err := harborProjects(ctx, reg)
+	if err != nil {
+		return nil, err
+	}
+	reg.harborMu.Lock()
+	reg.listedProjects = projects
+	reg.harborMu.Unlock()
+	var repos []string
+	for _, p := range projects {
+		for _, r := range p.Repositories {
+			repos = append(repos, r.Name)
+		}
+	}
+	return repos, nil
+}
+
+// takeListedProjects returns the projects listHarborRepos listed since it
+// was last called, if any.
+func (reg *Registry) takeListedProjects() []*HarborProject {
+	reg.harborMu.Lock()
+	defer reg.harborMu.Unlock()
+	projects := reg.listedProjects
+	reg.listedProjects = nil
+	return projects
+}
+
+// harborInfo returns the version and projects of a Harbor registry, reusing
+// the projects its scan listed.
+func harborInfo(ctx context.Context, reg *Registry) *HarborInfo {
+	projects := reg.takeListedProjects()
+	version, ok := harborVersion(ctx, reg)
+	if !ok {
+		return nil
+	}
+	if projects == nil {
+		var err error
+		projects, err = harborProjects(ctx, reg)
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: listing the Harbor projects: %v", reg.name(), err)
+			return nil
+		}
+	}
+	for _, p := range projects {
+		err := harborQuota(ctx, reg, p)
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: quota of project %v: %v", reg.name(), p.Name, err)
+		}
+	}
+	return &HarborInfo{Version: version, Projects: projects}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HistoryStep is a step of the build of an image, with the layer it made,
+// if any.
+type HistoryStep struct {
+	Created     *JsonTime `json:",omitempty"`
+	CreatedBy   string
+	Instruction string
+	Comment     string `json:",omitempty"`
+	EmptyLayer  bool   `json:",omitempty"`
+	Layer       *Blob  `json:",omitempty"`
+}
+
+// historySteps pairs the build history of an image with its layers: every
+// step but those only changing the config made the next layer.
+func historySteps(info *ImageInfo) []*HistoryStep {
+	steps := []*HistoryStep{}
+	layer := 0
+	for _, h := range info.history {
+		step := &HistoryStep{
+			CreatedBy:   h.CreatedBy,
+			Instruction: dockerfileInstruction(h.CreatedBy),
+			Comment:     h.Comment,
+			EmptyLayer:  h.EmptyLayer,
+			Layer:       h.Layer,
+		}
+		if !h.Created.IsZero() {
+			created := JsonTime(h.Created)
+			step.Created = &created
+		}
+		if !h.EmptyLayer && step.Layer == nil && layer < len(info.Layers) {
+			step.Layer = &info.Layers[layer]
+			layer++
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+var (
+	// nopPrefix marks instructions of the classic builder that only
+	// changed the config: /bin/sh -c #(nop)  CMD ["sh"]
+	nopPrefix = regexp.MustCompile(`^/bin/sh -c #\(nop\)\s*`)
+	// shellPrefix is how the classic builder recorded RUN.
+	shellPrefix = regexp.MustCompile(`^(\|\d+ .*?)?/bin/(ba)?sh -c\s+`)
+)
+
+// dockerfileInstruction turns the created_by of a history entry back into
+// the Dockerfile instruction that probably produced it. BuildKit records
+// the instruction with a comment; the classic builder records the shell
+// command run, or the instruction after #(nop).
+func dockerfileInstruction(createdBy string) string {
+	s := strings.TrimSpace(createdBy)
+	s = strings.TrimSpace(strings.TrimSuffix(s, "# buildkit"))
+	switch {
+	case s == "":
+		return ""
+	case nopPrefix.MatchString(s):
+		return strings.TrimSpace(nopPrefix.ReplaceAllString(s, ""))
+	case strings.HasPrefix(s, "RUN "):
+		// BuildKit: RUN /bin/sh -c apk add curl
+		return "RUN " + shellPrefix.ReplaceAllString(strings.TrimPrefix(s, "RUN "), "")
+	case shellPrefix.MatchString(s):
+		return "RUN " + shellPrefix.ReplaceAllString(s, "")
+	}
+	return s
+}
+
+// writeDockerfile writes the history of an image as an approximate
+// Dockerfile, with the time and layer size of every step as a comment.
+func writeDockerfile(w io.Writer, info *ImageInfo) {
+	fmt.Fprintf(w, "# %v:%v %v\n", info.Repo, info.Reference, info.Digest)
+	if len(info.History) == 0 {
+		fmt.Fprintln(w, "# no history recorded")
+		return
+	}
+	for _, step := range info.History {
+		var notes []string
+		if step.Created != nil {
+			notes = append(notes, time.Time(*step.Created).Format(TimeOutputLayout))
+		}
+		if step.Layer != nil {
+			notes = append(notes, humanBytes(step.Layer.Size))
+		}
+		if step.Comment != "" {
+			notes = append(notes, step.Comment)
+		}
+		fmt.Fprintln(w)
+		if len(notes) > 0 {
+			fmt.Fprintf(w, "# %v\n", strings.Join(notes, ", "))
+		}
+		if step.Instruction == "" {
+			fmt.Fprintln(w, "# no command recorded")
+			continue
+		}
+		fmt.Fprintln(w, step.Instruction)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Events hooks run on.
+const (
+	// HookScanComplete runs after scan, or the daemon, scanned a registry.
+	HookScanComplete = "scan-complete"
+	// HookTagAdded runs on the tags added that watching a registry found,
+	// as notifications are sent.
+	HookTagAdded = "tag-added"
+	// HookPruneExecuted runs after prune -yes deleted manifests.
+	HookPruneExecuted = "prune-executed"
+)
+
+const defaultHookTimeout = time.Minute
+
+// HookConfig runs a command on an event, with the event as JSON on its
+// standard input, e.g. {"event": "tag-added", "command": "./open-ticket",
+// "args": ["--queue", "ops"]}, to integrate with anything that can be
+// scripted. Registries (aliases or names) narrow the registries it runs
+// for, empty means all. Timeout bounds each run of the command.
+type HookConfig struct {
+	Event      string   `json:"event"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Registries []string `json:"registries"`
+	Timeout    string   `json:"timeout"`
+
+	timeout time.Duration
+}
+
+func (h *HookConfig) setup() (err error) {
+	switch h.Event {
+	case HookScanComplete, HookTagAdded, HookPruneExecuted:
+	default:
+		return fmt.Errorf("hooks: unknown event %q, want %v, %v or %v", h.Event, HookScanComplete, HookTagAdded, HookPruneExecuted)
+	}
+	if h.Command == "" {
+		return fmt.Errorf("hooks: %v: command not defined", h.Event)
+	}
+	h.timeout = defaultHookTimeout
+	if h.Timeout != "" {
+		h.timeout, err = time.ParseDuration(h.Timeout)
+		if err != nil || h.timeout <= 0 {
+			return fmt.Errorf("hooks: %v: invalid timeout %q", h.Event, h.Timeout)
+		}
+	}
+	return nil
+}
+
+func (h *HookConfig) String() string {
+	return h.Event + " hook " + h.Command
+}
+
+// HookEvent is what a hook reads on its standard input; only the field of
+// its event is set.
+type HookEvent struct {
+	Event    string
+	Registry string
+	Time     JsonTime
+	// Report is the result of the scan, for scan-complete.
+	Report *Report `json:",omitempty"`
+	// Changes are the tags added, for tag-added.
+	Changes []*TagChange `json:",omitempty"`
+	// Pruned are the manifests prune deleted, or failed to, for
+	// prune-executed.
+	Pruned []*PruneResult `json:",omitempty"`
+}
+
+// run runs the command of the hook with event on its standard input. Its
+// output goes to stderr, leaving stdout to the results of the tool.
+func (h *HookConfig) run(ctx context.Context, event *HookEvent) error {
+	j, err := marshalJson(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Env = append(os.Environ(), "HOOK_EVENT="+event.Event, "HOOK_REGISTRY="+event.Registry)
+	cmd.Stdin = bytes.NewReader(j)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%v: timed out after %v", h, h.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", h, err)
+	}
+	return nil
+}
+
+// runHooks runs every hook of the event that wants reg, one after the
+// other. Failures are logged; what the tool was doing goes on.
+func runHooks(ctx context.Context, reg *Registry, event *HookEvent) {
+	event.Registry = reg.name()
+	if time.Time(event.Time).IsZero() {
+		event.Time = JsonTime(time.Now())
+	}
+	for _, h := range localConf.Hooks {
+		if h.Event != event.Event {
+			continue
+		}
+		if len(h.Registries) > 0 && !contains(h.Registries, reg.Alias) && !contains(h.Registries, reg.name()) {
+			continue
+		}
+		if err := h.run(ctx, event); err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: %v", reg.name(), err)
+			continue
+		}
+		debugf(LogRequests, logFields{Registry: reg.name()}, "%v: ran %v", reg.name(), h)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const indexSchema = `
+CREATE TABLE IF NOT EXISTS registries (
+	name    TEXT PRIMARY KEY,
+	addr    TEXT NOT NULL,
+	indexed INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tags (
+	registry TEXT NOT NULL,
+	repo     TEXT NOT NULL,
+	tag      TEXT NOT NULL,
+	digest   TEXT NOT NULL,
+	created  INTEGER NOT NULL,
+	size     INTEGER NOT NULL,
+	PRIMARY KEY (registry, repo, tag)
+);
+CREATE INDEX IF NOT EXISTS tags_digest ON tags (digest);
+CREATE INDEX IF NOT EXISTS tags_created ON tags (created);
+`
+
+// defaultIndexPath is where index and query keep the database unless told
+// otherwise.
+func defaultIndexPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "index.db"
+	}
+	return filepath.Join(dir, configDirName, "index.db")
+}
+
+func openIndex(path string) (*sql.DB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(indexSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return db, nil
+}
+
+// writeIndex replaces the tags of reg in db with a scan. Repositories that
+// failed to scan keep their previous rows.
+func writeIndex(ctx context.Context, db *sql.DB, reg *Registry, repos map[string][]TagDetail, errs []*ScanError) error {
+	failed := make(map[string]bool)
+	for _, e := range errs {
+		failed[e.Repo] = true
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT repo FROM tags WHERE registry = ?`, reg.name())
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var repo string
+		err = rows.Scan(&repo)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !failed[repo] {
+			stale = append(stale, repo)
+		}
+	}
+	rows.Close()
+	for _, repo := range stale {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tags WHERE registry = ? AND repo = ?`, reg.name(), repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO tags (registry, repo, tag, digest, created, size) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for repo, tags := range repos {
+		for _, tag := range tags {
+			_, err = insert.ExecContext(ctx, reg.name(), repo, tag.Tag, tag.Digest, time.Time(tag.Created).Unix(), tag.Size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO registries (name, addr, indexed) VALUES (?, ?, ?)`, reg.name(), reg.displayAddr(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeIndexRepo replaces the tags of a repository of reg in db, removing
+// them when tags is empty.
+func writeIndexRepo(ctx context.Context, db *sql.DB, reg *Registry, repo string, tags []TagDetail) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tags WHERE registry = ? AND repo = ?`, reg.name(), repo)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.ExecContext(ctx, `INSERT INTO tags (registry, repo, tag, digest, created, size) VALUES (?, ?, ?, ?, ?, ?)`, reg.name(), repo, tag.Tag, tag.Digest, time.Time(tag.Created).Unix(), tag.Size)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO registries (name, addr, indexed) VALUES (?, ?, ?)`, reg.name(), reg.displayAddr(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func index(ctx context.Context, args []string) {
+	fs := commandFlags("index")
+	dbPath := fs.String("db", defaultIndexPath(), "database file")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+	db, err := openIndex(*dbPath)
+	if err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	incomplete := false
+	for _, reg := range regs {
+		repos, errs := getRepoInfo(ctx, reg)
+		if ctx.Err() != nil {
+			log.Println("interrupted, the index keeps the registries written so far")
+			exit(ExitCodeInterrupted)
+		}
+		warnIncomplete(errs)
+		if len(errs) > 0 && errs[0].Repo == "" {
+			log.Printf("%v: not indexed, its catalog could not be read", reg.name())
+			incomplete = true
+			continue
+		}
+		err = writeIndex(ctx, db, reg, repos, errs)
+		if err != nil {
+			fatal(err)
+		}
+		tags := 0
+		for _, t := range repos {
+			tags += len(t)
+		}
+		log.Printf("%v: indexed %d repositories, %d tags in %v", reg.name(), len(repos), tags, *dbPath)
+		incomplete = incomplete || len(errs) > 0
+	}
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
+
+// IndexedTag is a row of the tags table.
+type IndexedTag struct {
+	Registry string
+	Repo     string
+	Tag      string
+	Digest   string
+	Created  JsonTime
+	Size     int64
+}
+
+// IndexedRepo summarizes the tags of a repository.
+type IndexedRepo struct {
+	Registry string
+	Repo     string
+	Tags     int
+	Newest   JsonTime
+	Size     int64
+}
+
+// indexQuery is a parsed query: what to list and the conditions on it.
+type indexQuery struct {
+	subject string
+	where   []string
+	args    []interface{}
+}
+
+var ageUnits = map[string]time.Duration{
+	"hour": time.Hour, "hours": time.Hour, "h": time.Hour,
+	"day": 24 * time.Hour, "days": 24 * time.Hour, "d": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour, "w": 7 * 24 * time.Hour,
+}
+
+var sizeUnits = map[string]int64{
+	"b": 1, "kb": 1000, "mb": 1000 * 1000, "gb": 1000 * 1000 * 1000,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+}
+
+// splitQuantity splits 180d, 500MB or "180 days" into a number and a unit,
+// and returns how many words it took.
+func splitQuantity(words []string, isUnit func(string) bool) (float64, string, int, error) {
+	if len(words) == 0 {
+		return 0, "", 0, fmt.Errorf("a quantity is missing at the end")
+	}
+	w := strings.ToLower(words[0])
+	i := strings.IndexFunc(w, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	num, unit, used := w, "", 1
+	if i >= 0 {
+		num, unit = w[:i], w[i:]
+	} else if len(words) > 1 && isUnit(strings.ToLower(words[1])) {
+		unit, used = strings.ToLower(words[1]), 2
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("%q is not a number", words[0])
+	}
+	return n, unit, used, nil
+}
+
+func parseQueryAge(words []string) (time.Duration, int, error) {
+	n, unit, used, err := splitQuantity(words, func(u string) bool { _, ok := ageUnits[u]; return ok })
+	if err != nil {
+		return 0, 0, err
+	}
+	if unit == "" {
+		return 0, 0, fmt.Errorf("age %v needs a unit: hours, days or weeks", words[0])
+	}
+	d, ok := ageUnits[unit]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown age unit %q, use hours, days or weeks", unit)
+	}
+	return time.Duration(n * float64(d)), used, nil
+}
+
+func parseQuerySize(words []string) (int64, int, error) {
+	n, unit, used, err := splitQuantity(words, func(u string) bool { _, ok := sizeUnits[u]; return ok })
+	if err != nil {
+		return 0, 0, err
+	}
+	if unit == "" {
+		unit = "b"
+	}
+	m, ok := sizeUnits[unit]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown size unit %q, use B, KB, MB, GB, KiB, MiB or GiB", unit)
+	}
+	return int64(n * float64(m)), used, nil
+}
+
+// parseQuery parses expressions like
+//
+//	tags older than 180 days in repos matching team/*
+//	tags named v1.* with digest sha256:ab12 in registry prod
+//	repos larger than 1GiB and newer than 2 weeks
+//
+// into SQL conditions on the tags table. Patterns are SQLite globs, so * also
+// matches slashes.
+func parseQuery(expr string, now time.Time) (*indexQuery, error) {
+	words := strings.Fields(expr)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty query, start with tags or repos")
+	}
+	q := &indexQuery{subject: strings.ToLower(words[0])}
+	if q.subject != "tags" && q.subject != "repos" {
+		return nil, fmt.Errorf("a query starts with tags or repos, not %q", words[0])
+	}
+	// column the age and size conditions apply to
+	created, size := "created", "size"
+	if q.subject == "repos" {
+		created, size = "newest", "total"
+	}
+	rest := words[1:]
+	expect := func(phrase ...string) bool {
+		if len(rest) < len(phrase) {
+			return false
+		}
+		for i, w := range phrase {
+			if strings.ToLower(rest[i]) != w {
+				return false
+			}
+		}
+		rest = rest[len(phrase):]
+		return true
+	}
+	match := func(cond string, what string) error {
+		if len(rest) == 0 {
+			return fmt.Errorf("%v is missing at the end", what)
+		}
+		q.where = append(q.where, cond)
+		q.args = append(q.args, rest[0])
+		rest = rest[1:]
+		return nil
+	}
+	for len(rest) > 0 {
+		if expect("and") {
+			continue
+		}
+		ageCond := func(op string) error {
+			d, used, err := parseQueryAge(rest)
+			if err != nil {
+				return err
+			}
+			rest = rest[used:]
+			q.where = append(q.where, created+" "+op+" ?")
+			q.args = append(q.args, now.Add(-d).Unix())
+			return nil
+		}
+		sizeCond := func(op string) error {
+			n, used, err := parseQuerySize(rest)
+			if err != nil {
+				return err
+			}
+			rest = rest[used:]
+			q.where = append(q.where, size+" "+op+" ?")
+			q.args = append(q.args, n)
+			return nil
+		}
+		var err error
+		switch {
+		case expect("older", "than"):
+			err = ageCond("<")
+		case expect("newer", "than"):
+			err = ageCond(">=")
+		case expect("larger", "than"):
+			err = sizeCond(">")
+		case expect("smaller", "than"):
+			err = sizeCond("<")
+		case expect("in", "repos", "matching"):
+			err = match("repo GLOB ?", "a repository pattern")
+		case expect("in", "repo"):
+			err = match("repo = ?", "a repository")
+		case expect("in", "registry"):
+			err = match("registry = ?", "a registry")
+		case q.subject == "tags" && expect("named"):
+			err = match("tag GLOB ?", "a tag pattern")
+		case expect("with", "digest"):
+			err = match("digest LIKE ? || '%'", "a digest")
+		default:
+			return nil, fmt.Errorf("cannot make sense of %q", strings.Join(rest, " "))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *indexQuery) sql() string {
+	where := ""
+	if len(q.where) > 0 {
+		where = " WHERE " + strings.Join(q.where, " AND ")
+	}
+	if q.subject == "repos" {
+		return `SELECT registry, repo, tags, newest, total FROM (
+	SELECT registry, repo, count(*) AS tags, max(created) AS newest, sum(size) AS total
+	FROM tags GROUP BY registry, repo)` + where + ` ORDER BY registry, repo`
+	}
+	return `SELECT registry, repo, tag, digest, created, size FROM tags` + where + ` ORDER BY registry, repo, created DESC, tag`
+}
+
+func runIndexQuery(ctx context.Context, db *sql.DB, q *indexQuery) (interface{}, error) {
+	rows, err := db.QueryContext(ctx, q.sql(), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if q.subject == "repos" {
+		repos := []*IndexedRepo{}
+		for rows.Next() {
+			r := &IndexedRepo{}
+			var newest int64
+			err = rows.Scan(&r.Registry, &r.Repo, &r.Tags, &newest, &r.Size)
+			if err != nil {
+				return nil, err
+			}
+			r.Newest = JsonTime(time.Unix(newest, 0).UTC())
+			repos = append(repos, r)
+		}
+		return repos, rows.Err()
+	}
+	tags := []*IndexedTag{}
+	for rows.Next() {
+		t := &IndexedTag{}
+		var created int64
+		err = rows.Scan(&t.Registry, &t.Repo, &t.Tag, &t.Digest, &created, &t.Size)
+		if err != nil {
+			return nil, err
+		}
+		t.Created = JsonTime(time.Unix(created, 0).UTC())
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// runRawQuery runs any SQL and returns its rows as column-value maps.
+func runRawQuery(ctx context.Context, db *sql.DB, query string) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[col] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func printIndexed(result interface{}) {
+	if *outputFlag != OutputTable {
+		printJson(result)
+		return
+	}
+	switch rows := result.(type) {
+	case []*IndexedTag:
+		for _, t := range rows {
+			fmt.Printf("%v  %v:%v  %v  %v  %v\n", t.Registry, t.Repo, t.Tag, time.Time(t.Created).Format(TimeOutputLayout), humanBytes(t.Size), shortDigest(t.Digest))
+		}
+	case []*IndexedRepo:
+		for _, r := range rows {
+			fmt.Printf("%v  %v  %d tags  newest %v  %v\n", r.Registry, r.Repo, r.Tags, time.Time(r.Newest).Format(TimeOutputLayout), humanBytes(r.Size))
+		}
+	default:
+		printJson(result)
+	}
+}
+
+func query(ctx context.Context, args []string) {
+	fs := commandFlags("query")
+	dbPath := fs.String("db", defaultIndexPath(), "database written by index")
+	raw := fs.Bool("sql", false, "run the arguments as SQL against the tags and registries tables")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	if _, err := os.Stat(*dbPath); err != nil {
+		fatalf("%v, run index first", err)
+	}
+	db, err := openIndex(*dbPath)
+	if err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	expr := strings.Join(fs.Args(), " ")
+	if *raw {
+		rows, err := runRawQuery(ctx, db, expr)
+		if err != nil {
+			fatal(err)
+		}
+		printJson(rows)
+		return
+	}
+	q, err := parseQuery(expr, time.Now())
+	if err != nil {
+		fatalf("query: %v", err)
+	}
+	result, err := runIndexQuery(ctx, db, q)
+	if err != nil {
+		fatal(err)
+	}
+	printIndexed(result)
+}
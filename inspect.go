@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// ImageInfo describes one manifest: its layers and what its config says
+// about the image, the platform manifests of an index, or the blobs and
+// annotations of an artifact such as a Helm chart.
+type ImageInfo struct {
+	Repo         string
+	Reference    string
+	Digest       string
+	MediaType    string
+	ArtifactType string    `json:",omitempty"`
+	Created      *JsonTime `json:",omitempty"`
+	Size         int64
+	Platform     string              `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	Annotations  map[string]string   `json:",omitempty"`
+	Config       *Blob               `json:",omitempty"`
+	Layers       []Blob              `json:",omitempty"`
+	Manifests    []*PlatformManifest `json:",omitempty"`
+	Referrers    []*Referrer         `json:",omitempty"`
+	History      []*HistoryStep      `json:",omitempty"`
+
+	history []registryclient.HistoryEntry
+}
+
+type PlatformManifest struct {
+	Platform  string
+	Digest    string
+	MediaType string
+	Size      int64
+}
+
+// Referrer is an artifact attached to an image: a signature, SBOM or
+// attestation whose manifest names the image as its subject.
+type Referrer struct {
+	ArtifactType string
+	Digest       string
+	MediaType    string
+	Size         int64
+	Annotations  map[string]string `json:",omitempty"`
+}
+
+func referrers(ctx context.Context, reg *Registry, repo string, digest string) ([]*Referrer, error) {
+	descriptors, err := reg.registryClient(ctx).Referrers(ctx, reg.repository(repo), digest)
+	if err != nil {
+		return nil, err
+	}
+	result := []*Referrer{}
+	for _, d := range descriptors {
+		result = append(result, &Referrer{
+			ArtifactType: d.ArtifactType,
+			Digest:       d.Digest,
+			MediaType:    d.MediaType,
+			Size:         d.Size,
+			Annotations:  d.Annotations,
+		})
+	}
+	return result, nil
+}
+
+// parseReference splits repo:tag or repo@digest, defaulting to the latest tag.
+func parseReference(ref string) (repo string, reference string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return splitRef(ref)
+}
+
+func inspectImage(ctx context.Context, reg *Registry, repo string, ref string) (*ImageInfo, error) {
+	c := reg.registryClient(ctx)
+	accept := append([]string{registryclient.MediaTypeManifestList, registryclient.MediaTypeOCIIndex}, registryclient.ImageManifestTypes...)
+	m, err := c.Manifest(ctx, reg.repository(repo), ref, accept...)
+	if err != nil {
+		return nil, err
+	}
+	info := &ImageInfo{Repo: repo, Reference: ref, Digest: m.Digest, MediaType: m.MediaType, ArtifactType: m.ArtifactType}
+
+	switch {
+	case m.IsIndex():
+		for _, d := range m.Manifests {
+			info.Manifests = append(info.Manifests, &PlatformManifest{
+				Platform:  d.Platform.String(),
+				Digest:    d.Digest,
+				MediaType: d.MediaType,
+				Size:      d.Size,
+			})
+		}
+	case m.IsArtifact():
+		// the config of an artifact, if any, is not an image config
+		info.Config, info.Layers = m.Config, m.Layers
+		for _, b := range m.Blobs() {
+			info.Size += b.Size
+		}
+		info.Annotations = m.Annotations
+		if created := m.AnnotatedCreated(); !created.IsZero() {
+			jsonCreated := JsonTime(created)
+			info.Created = &jsonCreated
+		}
+	case m.Config == nil:
+		if !m.Created.IsZero() {
+			created := JsonTime(m.Created)
+			info.Created = &created
+		}
+		info.Platform = m.Architecture
+		info.history = m.History
+	default:
+		info.Config, info.Layers = m.Config, m.Layers
+		for _, b := range m.Blobs() {
+			info.Size += b.Size
+		}
+		config, err := c.Config(ctx, reg.repository(repo), m.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !config.Created.IsZero() {
+			created := JsonTime(config.Created)
+			info.Created = &created
+		}
+		info.Platform = config.Platform().String()
+		info.Labels = config.Labels
+		info.history = config.History
+	}
+	return info, nil
+}
+
+func inspect(ctx context.Context, args []string) {
+	fs := commandFlags("inspect")
+	withReferrers := fs.Bool("referrers", false, "also list the signatures, SBOMs and attestations attached to the image")
+	withHistory := fs.Bool("history", false, "list the build steps of the image with the size of their layers; -output table prints them as an approximate Dockerfile")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	repo, ref := parseReference(fs.Arg(1))
+	info, err := inspectImage(ctx, reg, repo, ref)
+	if err != nil {
+		fatal(err)
+	}
+	if *withReferrers {
+		info.Referrers, err = referrers(ctx, reg, repo, info.Digest)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *withHistory {
+		if info.Manifests != nil {
+			fatalf("%v is an index; inspect one of its platform manifests by digest", fs.Arg(1))
+		}
+		info.History = historySteps(info)
+		if *outputFlag == OutputTable {
+			writeDockerfile(os.Stdout, info)
+			return
+		}
+	}
+	printJson(info)
+}
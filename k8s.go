@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeConfig is the part of a kubeconfig file needed to reach the API
+// server of a context.
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster kubeCluster
+	}
+	Users []struct {
+		Name string
+		User kubeUser
+	}
+	Contexts []struct {
+		Name    string
+		Context kubeContext
+	}
+}
+
+type kubeCluster struct {
+	Server                   string
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	ProxyURL                 string `yaml:"proxy-url"`
+}
+
+type kubeUser struct {
+	Token                 string
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Username              string
+	Password              string
+	Exec                  *kubeExec
+}
+
+// kubeExec runs a credential plugin, as cloud providers configure, for a
+// token.
+type kubeExec struct {
+	APIVersion string `yaml:"apiVersion"`
+	Command    string
+	Args       []string
+	Env        []struct {
+		Name  string
+		Value string
+	}
+}
+
+type kubeContext struct {
+	Cluster string
+	User    string
+}
+
+const inClusterDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeconfigPaths returns the files of $KUBECONFIG, or ~/.kube/config.
+func kubeconfigPaths() []string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".kube", "config")}
+}
+
+// loadKubeconfig merges the given kubeconfig files the way kubectl does:
+// the first file setting a name or the current context wins. Relative file
+// paths in a file are relative to it.
+func loadKubeconfig(paths []string) (*kubeConfig, error) {
+	merged := &kubeConfig{}
+	found := false
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var conf kubeConfig
+		if err := yaml.Unmarshal(b, &conf); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		found = true
+		dir := filepath.Dir(path)
+		resolve := func(file *string) {
+			if *file != "" && !filepath.IsAbs(*file) {
+				*file = filepath.Join(dir, *file)
+			}
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = conf.CurrentContext
+		}
+		for _, c := range conf.Clusters {
+			resolve(&c.Cluster.CertificateAuthority)
+			merged.Clusters = append(merged.Clusters, c)
+		}
+		for _, u := range conf.Users {
+			resolve(&u.User.TokenFile)
+			resolve(&u.User.ClientCertificate)
+			resolve(&u.User.ClientKey)
+			merged.Users = append(merged.Users, u)
+		}
+		merged.Contexts = append(merged.Contexts, conf.Contexts...)
+	}
+	if !found {
+		return nil, nil
+	}
+	return merged, nil
+}
+
+// kubeClient lists objects from the API server of a cluster.
+type kubeClient struct {
+	server string
+	client *http.Client
+	user   kubeUser
+
+	mu    sync.Mutex
+	token string
+}
+
+// newKubeClient connects to the cluster of context, or of the current
+// context when empty, of the kubeconfig files. Without any, it connects to
+// the cluster it runs in with its service account.
+func newKubeClient(paths []string, context string) (*kubeClient, error) {
+	conf, err := loadKubeconfig(paths)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+			return nil, fmt.Errorf("no kubeconfig found at %v and not running in a cluster", strings.Join(paths, string(filepath.ListSeparator)))
+		}
+		return inClusterClient()
+	}
+	if context == "" {
+		context = conf.CurrentContext
+	}
+	if context == "" {
+		return nil, fmt.Errorf("no current context in the kubeconfig, pick one with -context")
+	}
+	var kctx *kubeContext
+	for _, c := range conf.Contexts {
+		if c.Name == context {
+			kctx = &c.Context
+			break
+		}
+	}
+	if kctx == nil {
+		return nil, fmt.Errorf("context %q not found in the kubeconfig", context)
+	}
+	var cluster *kubeCluster
+	for _, c := range conf.Clusters {
+		if c.Name == kctx.Cluster {
+			cluster = &c.Cluster
+			break
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("cluster %q of context %q not found in the kubeconfig", kctx.Cluster, context)
+	}
+	var user kubeUser
+	for _, u := range conf.Users {
+		if u.Name == kctx.User {
+			user = u.User
+			break
+		}
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+	ca, err := fileOrData(cluster.CertificateAuthority, cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("context %q: no certificates found in the certificate authority", context)
+		}
+		tlsConf.RootCAs = pool
+	}
+	cert, err := fileOrData(user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fileOrData(user.ClientKey, user.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil || key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("context %q: %v", context, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{pair}
+	}
+	var proxy *url.URL
+	if cluster.ProxyURL != "" {
+		if proxy, err = parseProxy(cluster.ProxyURL); err != nil {
+			return nil, err
+		}
+	}
+	return &kubeClient{
+		server: strings.TrimSuffix(cluster.Server, "/"),
+		client: &http.Client{Transport: newTransport(tlsConf, proxy), Timeout: *timeoutFlag},
+		user:   user,
+	}, nil
+}
+
+func inClusterClient() (*kubeClient, error) {
+	ca, err := ioutil.ReadFile(filepath.Join(inClusterDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")),
+		client: &http.Client{Transport: newTransport(&tls.Config{RootCAs: pool}, nil), Timeout: *timeoutFlag},
+		user:   kubeUser{TokenFile: filepath.Join(inClusterDir, "token")},
+	}, nil
+}
+
+// fileOrData returns the PEM of a kubeconfig field set either as a file or
+// inline as base64, or nil if neither is.
+func fileOrData(file string, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// bearerToken returns the token to authenticate with, running the exec
+// plugin once per run.
+func (k *kubeClient) bearerToken(ctx context.Context) (string, error) {
+	switch {
+	case k.user.Token != "":
+		return k.user.Token, nil
+	case k.user.TokenFile != "":
+		// service account tokens are rotated, read it every time
+		b, err := ioutil.ReadFile(k.user.TokenFile)
+		return strings.TrimSpace(string(b)), err
+	case k.user.Exec != nil:
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.token == "" {
+			token, err := execCredential(ctx, k.user.Exec)
+			if err != nil {
+				return "", err
+			}
+			k.token = token
+		}
+		return k.token, nil
+	}
+	return "", nil
+}
+
+// execCredential runs a client-go credential plugin and returns the token of
+// the ExecCredential it prints.
+func execCredential(ctx context.Context, e *kubeExec) (string, error) {
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range e.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	info, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": e.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+string(info))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %v: %v", e.Command, err, msg)
+		}
+		return "", fmt.Errorf("%v: %v", e.Command, err)
+	}
+	var cred struct {
+		Status struct {
+			Token string
+		}
+	}
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", fmt.Errorf("%v: %v", e.Command, err)
+	}
+	if cred.Status.Token == "" {
+		return "", fmt.Errorf("%v: no token in the credential, only token plugins are supported", e.Command)
+	}
+	return cred.Status.Token, nil
+}
+
+// kubeList is a page of a list of objects.
+type kubeList struct {
+	Metadata struct {
+		Continue string
+	}
+	Items []*kubeObject
+}
+
+// kubeObject holds the images of a pod or of the pod template of a
+// workload.
+type kubeObject struct {
+	Metadata struct {
+		Name            string
+		Namespace       string
+		Labels          map[string]string
+		OwnerReferences []struct {
+			Kind       string
+			Name       string
+			Controller bool
+		}
+	}
+	Spec struct {
+		kubePodSpec
+		Template    *struct{ Spec kubePodSpec }
+		JobTemplate *struct {
+			Spec struct {
+				Template struct{ Spec kubePodSpec }
+			}
+		}
+	}
+	Status struct {
+		ContainerStatuses     []kubeContainerStatus
+		InitContainerStatuses []kubeContainerStatus
+	}
+}
+
+type kubePodSpec struct {
+	Containers          []kubeContainer
+	InitContainers      []kubeContainer
+	EphemeralContainers []kubeContainer
+}
+
+type kubeContainer struct {
+	Image string
+}
+
+type kubeContainerStatus struct {
+	Image   string
+	ImageID string
+}
+
+func (s *kubePodSpec) images() []string {
+	var images []string
+	for _, containers := range [][]kubeContainer{s.InitContainers, s.Containers, s.EphemeralContainers} {
+		for _, c := range containers {
+			images = append(images, c.Image)
+		}
+	}
+	return images
+}
+
+// list lists every object of a kind, in every namespace when namespace is
+// empty, a page at a time.
+func (k *kubeClient) list(ctx context.Context, group string, resource string, namespace string) ([]*kubeObject, error) {
+	prefix := "/api/v1"
+	if group != "" {
+		prefix = "/apis/" + group
+	}
+	if namespace != "" {
+		prefix += "/namespaces/" + url.PathEscape(namespace)
+	}
+	var objects []*kubeObject
+	cont := ""
+	for {
+		query := url.Values{"limit": {"500"}}
+		if cont != "" {
+			query.Set("continue", cont)
+		}
+		var page kubeList
+		if err := k.get(ctx, prefix+"/"+resource+"?"+query.Encode(), &page); err != nil {
+			return nil, fmt.Errorf("listing %v: %v", resource, err)
+		}
+		objects = append(objects, page.Items...)
+		if cont = page.Metadata.Continue; cont == "" {
+			return objects, nil
+		}
+	}
+}
+
+func (k *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	token, err := k.bearerToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if k.user.Username != "" {
+		req.SetBasicAuth(k.user.Username, k.user.Password)
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var status struct{ Message string }
+		if json.NewDecoder(res.Body).Decode(&status) == nil && status.Message != "" {
+			return fmt.Errorf("%v: %v", res.Status, status.Message)
+		}
+		return fmt.Errorf("%v", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// kubeWorkloads are the kinds whose pod templates reference images, besides
+// the pods running. Templates count even when scaled to zero or suspended.
+var kubeWorkloads = []struct {
+	kind     string
+	group    string
+	resource string
+}{
+	{"pod", "", "pods"},
+	{"deployment", "apps/v1", "deployments"},
+	{"statefulset", "apps/v1", "statefulsets"},
+	{"daemonset", "apps/v1", "daemonsets"},
+	{"cronjob", "batch/v1", "cronjobs"},
+}
+
+// workloadOf names the workload running a pod, e.g. deployment/web for a
+// pod of one of its replica sets, or the pod itself if nothing controls it.
+func workloadOf(pod *kubeObject) string {
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if !owner.Controller {
+			continue
+		}
+		kind := strings.ToLower(owner.Kind)
+		if hash := pod.Metadata.Labels["pod-template-hash"]; kind == "replicaset" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "deployment/" + strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return kind + "/" + owner.Name
+	}
+	return "pod/" + pod.Metadata.Name
+}
+
+// imageRef is an image reference of a cluster, its name normalized to
+// compare with the names of a registry.
+type imageRef struct {
+	name   string
+	tag    string
+	digest string
+}
+
+// normalizeImageName expands a short Docker Hub name like nginx to
+// docker.io/library/nginx and spells every Docker Hub host docker.io.
+func normalizeImageName(name string) string {
+	domain, rest := "", name
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		domain, rest = name[:i], name[i+1:]
+	}
+	switch domain {
+	case "", "index.docker.io", DockerHubRegistryHost:
+		domain = "docker.io"
+	}
+	if domain == "docker.io" && !strings.Contains(rest, "/") {
+		rest = DockerHubOfficialRepo + "/" + rest
+	}
+	return domain + "/" + rest
+}
+
+// parseImageRef parses an image of a container spec, or the image ID of a
+// container status like docker-pullable://nginx@sha256:….
+func parseImageRef(image string) (imageRef, bool) {
+	if i := strings.Index(image, "://"); i >= 0 {
+		image = image[i+len("://"):]
+	}
+	var ref imageRef
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, ref.digest = image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, ref.tag = image[:i], image[i+1:]
+	}
+	if image == "" || strings.HasPrefix(image, "sha256") {
+		return ref, false
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	ref.name = normalizeImageName(image)
+	return ref, true
+}
+
+// clusterUsage indexes the workloads using each image by tag and by digest.
+type clusterUsage struct {
+	byTag    map[string]map[string]bool
+	byDigest map[string]map[string]bool
+}
+
+func (u *clusterUsage) add(image string, user string) {
+	ref, ok := parseImageRef(image)
+	if !ok {
+		return
+	}
+	add := func(index map[string]map[string]bool, key string) {
+		if index[key] == nil {
+			index[key] = make(map[string]bool)
+		}
+		index[key][user] = true
+	}
+	if ref.tag != "" {
+		add(u.byTag, ref.name+":"+ref.tag)
+	}
+	if ref.digest != "" {
+		add(u.byDigest, ref.name+"@"+ref.digest)
+	}
+}
+
+// usersOf returns the workloads using the tag of the image named name,
+// sorted.
+func (u *clusterUsage) usersOf(name string, tag TagDetail) []string {
+	users := make(map[string]bool)
+	for user := range u.byTag[name+":"+tag.Tag] {
+		users[user] = true
+	}
+	for user := range u.byDigest[name+"@"+tag.Digest] {
+		users[user] = true
+	}
+	var sorted []string
+	for user := range users {
+		sorted = append(sorted, user)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// clusterImages lists the images the pods and workloads of namespace, or of
+// every namespace, reference, with the image IDs pods report so digests
+// match too.
+func clusterImages(ctx context.Context, k *kubeClient, namespace string) (*clusterUsage, error) {
+	u := &clusterUsage{byTag: make(map[string]map[string]bool), byDigest: make(map[string]map[string]bool)}
+	for _, w := range kubeWorkloads {
+		objects, err := k.list(ctx, w.group, w.resource, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			user := o.Metadata.Namespace + "/" + w.kind + "/" + o.Metadata.Name
+			spec := &o.Spec.kubePodSpec
+			switch {
+			case w.kind == "pod":
+				user = o.Metadata.Namespace + "/" + workloadOf(o)
+				for _, s := range append(o.Status.InitContainerStatuses, o.Status.ContainerStatuses...) {
+					u.add(s.ImageID, user)
+				}
+			case o.Spec.Template != nil:
+				spec = &o.Spec.Template.Spec
+			case o.Spec.JobTemplate != nil:
+				spec = &o.Spec.JobTemplate.Spec.Template.Spec
+			}
+			for _, image := range spec.images() {
+				u.add(image, user)
+			}
+		}
+	}
+	return u, nil
+}
+
+// markInUse sets InUseBy on the tags of repos from the cluster usage.
+func markInUse(reg *Registry, repos map[string][]TagDetail, u *clusterUsage) {
+	for repo, tags := range repos {
+		name, err := imageName(reg, repo)
+		if err != nil {
+			fatal(err)
+		}
+		name = normalizeImageName(name)
+		for i := range tags {
+			tags[i].InUseBy = u.usersOf(name, tags[i])
+		}
+	}
+}
+
+// onlyUnused keeps the images of repos nothing uses. Signatures and other
+// artifacts are left out, as pods never run them.
+func onlyUnused(repos map[string][]TagDetail) map[string][]TagDetail {
+	result := make(map[string][]TagDetail)
+	for repo, tags := range repos {
+		var unused []TagDetail
+		for _, tag := range tags {
+			if len(tag.InUseBy) == 0 && tag.ArtifactType == "" && !isArtifactTag(tag.Tag) {
+				unused = append(unused, tag)
+			}
+		}
+		if len(unused) > 0 {
+			result[repo] = unused
+		}
+	}
+	return result
+}
+
+func k8sUsage(ctx context.Context, args []string) {
+	fs := commandFlags("k8s-usage")
+	kubeconfig := fs.String("kubeconfig", "", "kubeconfig `file` of the cluster, by default $KUBECONFIG or ~/.kube/config")
+	kubeContext := fs.String("context", "", "kubeconfig context of the cluster, by default the current one")
+	namespace := fs.String("namespace", "", "only look at this namespace, by default all of them")
+	unused := fs.Bool("unused", false, "only list the images nothing in the cluster references")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	paths := kubeconfigPaths()
+	if *kubeconfig != "" {
+		paths = []string{*kubeconfig}
+	}
+	k, err := newKubeClient(paths, *kubeContext)
+	if err != nil {
+		fatal(err)
+	}
+	usage, err := clusterImages(ctx, k, *namespace)
+	if err != nil {
+		fatalf("%v: %v", k.server, err)
+	}
+
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+	var output interface{}
+	reports := make(map[string]*Report)
+	incomplete := false
+	for _, reg := range regs {
+		report := scanReport(ctx, reg)
+		if ctx.Err() != nil {
+			log.Println("interrupted")
+			exit(ExitCodeInterrupted)
+		}
+		incomplete = incomplete || len(report.Errors) > 0
+		markInUse(reg, report.Repositories, usage)
+		if *unused {
+			report.Repositories = onlyUnused(report.Repositories)
+		}
+		reports[reg.name()] = report
+		output = report
+	}
+	if len(regs) > 1 {
+		output = reports
+	}
+	printOutput(output)
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
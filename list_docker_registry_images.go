@@ -1,25 +1,38 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
 )
 const(
 	TimeOutputLayout = "2006-01-02 15:04:05"
-	DataTypeRepoList = "rs"
-	DataTypeTagList = "ts"
-	DataTypeTagDetail = "td"
+
+	// exit codes besides 1 on errors and 2 on usage errors
+	ExitCodeMissing = 3
+	ExitCodeIncomplete = 4
+	ExitCodeSLOViolation = 5
+	ExitCodeDrift = 6
+	ExitCodeInterrupted = 130
 )
 
 type JsonTime time.Time
@@ -33,32 +46,156 @@ func (t JsonTime)MarshalJSON() ([]byte, error) {
 	return []byte(stamp), nil
 }
 
+func (t *JsonTime) UnmarshalJSON(b []byte) error {
+	parsed, err := time.Parse(fmt.Sprintf("\"%s\"", TimeOutputLayout), string(b))
+	if err != nil {
+		return err
+	}
+	*t = JsonTime(parsed)
+	return nil
+}
+
 func (t JsonTime) After(u JsonTime) bool {
 	return (time.Time)(t).After((time.Time)(u))
 }
 
+// Report is what scanning a registry found. Its JSON is only printed with
+// scan -report; scans print the tags keyed by repository by default.
+type Report struct {
+	Repositories RepoTags
+	Unsupported []string `json:",omitempty"`
+	Harbor *HarborInfo `json:",omitempty"`
+	ServedBy map[string][]string `json:",omitempty"`
+	Errors []*ScanError `json:",omitempty"`
+
+	registry string
+	reg *Registry
+	started time.Time
+	finished time.Time
+	interrupted bool
+}
+
+// ScanError records a catalog, repository or tag that could not be fetched,
+// leaving the report incomplete.
+type ScanError struct {
+	Repo string `json:",omitempty"`
+	Tag string `json:",omitempty"`
+	Error string
+}
+
+type Blob = registryclient.Blob
+
 type TagDetail struct {
 	Tag string
 	Created JsonTime
+	Digest string
+	Size int64
+	// MediaType is set for tags of an index, whose Created, Size and
+	// labels are those of its linux/amd64 or first image
+	MediaType string `json:",omitempty"`
+	ArtifactType string `json:",omitempty"`
+	SameDigest []string `json:",omitempty"`
+	Signed *bool `json:",omitempty"`
+	Vulnerabilities *VulnSummary `json:",omitempty"`
+	InUseBy []string `json:",omitempty"`
+	Blobs []Blob `json:"-"`
+	Labels map[string]string `json:"-"`
+}
+
+// ScanResult is what a fetcher of a scan hands to its collector: a
+// *RepoList, *TagList, *ManifestInfo or *FetchError.
+type ScanResult interface {
+	scanResult()
 }
 
-type PayLoad struct {
-	Type string
+// RepoList is the catalog of a registry.
+type RepoList struct {
+	Repos []string
+}
+
+// TagList is the tags of a repository, empty when all were deleted.
+type TagList struct {
+	Repo string
+	Tags []string
+}
+
+// ManifestInfo is what a tag points at. Scans without details only fill in
+// its digest.
+type ManifestInfo struct {
+	Repo string
+	Tag *registryclient.Tag
+}
+
+// FetchError is a catalog, tag list or manifest that could not be fetched.
+type FetchError struct {
 	Repo string
 	Tag string
-	Target interface{}
+	Err error
 }
 
+func (*RepoList) scanResult() {}
+func (*TagList) scanResult() {}
+func (*ManifestInfo) scanResult() {}
+func (*FetchError) scanResult() {}
+
 type Config struct {
-	Registries []*Registry `json: "registries"`
+	Registries []*Registry `json:"registries"`
+	Owners     []*Owner    `json:"owners"`
+	OwnerLabels []string   `json:"ownerLabels"`
+	Pricing    *Pricing    `json:"pricing"`
+	SLOs       []*FreshnessSLO `json:"slos"`
+	Cache      *CacheConfig `json:"cache"`
+	Scanner    *ScannerConfig `json:"scanner"`
+	Notifications []*NotifierConfig `json:"notifications"`
+	Schedule   []*ScheduleEntry `json:"schedule"`
+	Hooks      []*HookConfig `json:"hooks"`
 }
 
 type Registry struct {
-	Alias string 		`json: "alias"`
-	Host string 		`json: "host"`
-	Port int			`json: "port"`
-	Schema string		`json: "schema"`
-	Addr string			`json: "addr"`
+	Alias string 		`json:"alias"`
+	Host string 		`json:"host"`
+	Port int			`json:"port"`
+	Schema string		`json:"schema"`
+	Addr string			`json:"addr"`
+	Type string			`json:"type"`
+	KeyFile string		`json:"keyFile"`
+	Namespace string	`json:"namespace"`
+	API string			`json:"api"`
+	Username string		`json:"username"`
+	Password string		`json:"password"`
+	AuthType string		`json:"authType"`
+	Token string		`json:"token"`
+	Signing *Signing	`json:"signing"`
+	TLS *TLSConfig		`json:"tls"`
+	Path string			`json:"path"`
+	Prefix string		`json:"prefix"`
+	Mirrors []string	`json:"mirrors"`
+	Proxy string		`json:"proxy"`
+	Timeout string		`json:"timeout"`
+	Retries *int		`json:"retries"`
+	RateLimit float64	`json:"rateLimit"`
+	Burst int			`json:"burst"`
+	DeleteEnabled *bool	`json:"deleteEnabled"`
+	MinRemaining int	`json:"minRemaining"`
+
+	tlsConfig *tls.Config
+	proxyURL *neturl.URL
+	socket string
+	timeout time.Duration
+	probeMu sync.Mutex
+	caps *Capabilities
+	probedAt time.Time
+	Pricing *Pricing	`json:"pricing"`
+
+	clientOnce sync.Once
+	httpClient *http.Client
+
+	mirrors []*mirror
+	servedMu sync.Mutex
+	servedBy map[string]map[string]bool
+
+	harborMu sync.Mutex
+	listedProjects []*HarborProject
 }
 
 func (conf *Config) findRegistry(alias string) (*Registry, bool) {
@@ -70,12 +207,19 @@ func (conf *Config) findRegistry(alias string) (*Registry, bool) {
 	return nil, false
 }
 
-func getForMap(url string) (m map[string]interface{}, err error) {
-	res, err := httpClient.Get(url)
+// getJson decodes the JSON response to a GET of url into v, and returns the
+// headers of the response.
+func getJson(ctx context.Context, reg *Registry, url string, v interface{}) (resHeader http.Header, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	res, err := reg.client().Do(req)
 	if err != nil {
 		return
 	}
 	defer res.Body.Close()
+	resHeader = res.Header
 
 	buf, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -83,47 +227,58 @@ func getForMap(url string) (m map[string]interface{}, err error) {
 			return
 		}
 	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err = fmt.Errorf("GET %v: %v: %s", url, res.Status, strings.TrimSpace(string(buf)))
+		return
+	}
+	err = json.Unmarshal(buf, v)
+	return
+}
 
-	err = json.Unmarshal(buf, &m)
+// getJsonPage decodes the JSON response of req into v and returns the url of
+// the next page announced in the Link header, if any.
+func getJsonPage(client *http.Client, req *http.Request, v interface{}) (next string, err error) {
+	res, err := client.Do(req)
 	if err != nil {
 		return
 	}
+	next = registryclient.NextLink(req.URL.String(), res.Header)
+	err = decodeJsonResponse(res, v)
 	return
 }
 
+func marshalJson(obj interface{}) ([]byte, error) {
+	return json.MarshalIndent(&obj, "", "   ")
+}
+
 func printJson(obj interface{}) {
-	j, err := json.MarshalIndent(&obj, "", "   ")
+	j, err := marshalJson(obj)
 	if err != nil {
-		log.Fatalln(err)
+		fatalln(err)
 	}
 	fmt.Println(string(j))
 }
 
 
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+var defaultHosts = map[string]string{
+	"dockerhub": DockerHubRegistryHost,
+	"ghcr":      GitHubRegistryHost,
+	"gitlab":    GitLabRegistryHost,
+}
+
 var (
 	httpClient *http.Client
 	localConf  *Config
 	configFilePath string
+	// configErr is only fatal to commands that use the config; config validate reports it
+	configErr error
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile)
 	httpClient = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{ InsecureSkipVerify: true },
-			DialContext: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 5 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout: 5 * time.Second,
-			IdleConnTimeout:     5 * time.Second,
-		},
-	}
-	configFilePath = fmt.Sprintf("%v/.docker_registry_config.json", os.Getenv("HOME"))
-	err := loadConfig(configFilePath)
-	if err != nil {
-		log.Fatal(err)
+		Transport: newTransport(nil, nil),
 	}
 }
 
@@ -144,13 +299,20 @@ func initConfig(path string) (err error) {
       "schema": "https"
     },
     {
-      "alias": "reg01",
+      "alias": "reg01-http",
       "host": "reg01.example.org",
       "port": 55001,
       "schema": "http"
     }
   ]
 }`)
+	if configFormat(path) == ConfigFormatTOML {
+		defaultConfig = []byte(defaultTOMLConfig)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
 	err = ioutil.WriteFile(path, defaultConfig, 0644)
 	return
 }
@@ -159,160 +321,558 @@ func loadConfig(path string) (err error) {
 	_, err = os.Stat(path)
 	if os.IsNotExist(err) {
 		err = initConfig(path)
+		if err != nil {
+			return
+		}
 	}
+	localConf, err = readConfig(path)
+	return
+}
 
-	f, _ := os.Open(path)
-	b, err := ioutil.ReadAll(f)
+// readConfig parses the config file at path and sets up its registries.
+func readConfig(path string) (conf *Config, err error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(b, &localConf)
+	err = decodeConfig(path, b, &conf)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("%v: %v", path, err)
 	}
-	for _, reg := range localConf.Registries {
-		reg.Addr = fmt.Sprintf("%v://%v:%v", reg.Schema, reg.Host, reg.Port)
+	if conf == nil {
+		conf = &Config{}
+	}
+	for _, reg := range conf.Registries {
+		err = reg.setup()
+		if err != nil {
+			return nil, fmt.Errorf("registry %v: %v", reg.Alias, err)
+		}
+	}
+	if conf.Cache != nil {
+		err = conf.Cache.setup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Scanner != nil {
+		err = conf.Scanner.setup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range conf.Notifications {
+		err = n.setup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range conf.Schedule {
+		err = e.setup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range conf.Hooks {
+		err = h.setup()
+		if err != nil {
+			return nil, err
+		}
 	}
 	return
 }
 
-func fetchRepos(addr string, data chan<- *PayLoad, wg *sync.WaitGroup) {
+// setup derives the address and transport settings of a configured registry.
+func (reg *Registry) setup() (err error) {
+	if reg.Addr != "" {
+		// a base url or unix socket instead of host and port
+		reg.Addr, reg.socket, err = parseAddr(reg.Addr)
+		if err != nil {
+			return
+		}
+		u, _ := neturl.Parse(reg.Addr)
+		reg.Schema, reg.Host = u.Scheme, u.Hostname()
+		reg.Port, _ = strconv.Atoi(u.Port())
+	} else {
+		if reg.Host == "" {
+			reg.Host = defaultHosts[reg.Type]
+		}
+		if reg.Schema == "" {
+			reg.Schema = "https"
+		}
+		reg.Addr = fmt.Sprintf("%v://%v", reg.Schema, reg.Host)
+		if reg.Port != 0 {
+			reg.Addr = fmt.Sprintf("%v:%v", reg.Addr, reg.Port)
+		}
+	}
+	if path := strings.Trim(reg.Path, "/"); path != "" {
+		reg.Addr = fmt.Sprintf("%v/%v", reg.Addr, path)
+	}
+	if prefix := strings.Trim(reg.Prefix, "/"); prefix != "" {
+		// team-a scopes to team-a/app, not to team-ab/app
+		reg.Prefix = prefix + "/"
+	}
+	if reg.TLS != nil {
+		reg.tlsConfig, err = reg.TLS.build()
+		if err != nil {
+			return
+		}
+	}
+	if reg.Proxy != "" {
+		reg.proxyURL, err = parseProxy(reg.Proxy)
+		if err != nil {
+			return
+		}
+	}
+	if reg.Timeout != "" {
+		reg.timeout, err = time.ParseDuration(reg.Timeout)
+		if err != nil {
+			return
+		}
+	}
+	if _, ok := authProviders[reg.authType()]; !ok {
+		return fmt.Errorf("unknown authType %q, want one of %v", reg.AuthType, strings.Join(authProviderNames(), ", "))
+	}
+	err = reg.setupMirrors()
+	return
+}
+
+// listRepos lists the repositories of reg, only those under its prefix if
+// it is scoped to one.
+func listRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	repos, err := listAllRepos(ctx, reg)
+	if err != nil || reg.Prefix == "" {
+		return repos, err
+	}
+	var scoped []string
+	for _, repo := range repos {
+		if reg.inScope(repo) {
+			scoped = append(scoped, repo)
+		}
+	}
+	return scoped, nil
+}
+
+func listAllRepos(ctx context.Context, reg *Registry) ([]string, error) {
+	switch reg.Type {
+	case "dockerhub":
+		return listDockerHubRepos(ctx, reg)
+	case "harbor":
+		return listHarborRepos(ctx, reg)
+	case "ghcr":
+		return listGitHubRepos(ctx, reg)
+	case "gitlab":
+		return listGitLabRepos(ctx, reg)
+	}
+	if !reg.capabilities(ctx).Catalog {
+		return nil, fmt.Errorf("%v does not serve /v2/_catalog", reg.Addr)
+	}
+	return reg.registryClient(ctx).Catalog(ctx)
+}
+
+func listTags(ctx context.Context, reg *Registry, repo string) ([]string, error) {
+	return reg.registryClient(ctx).Tags(ctx, reg.repository(repo))
+}
+
+// send hands result to the collector unless the scan has been cancelled,
+// and reports whether it did. The collector stops reading once cancelled, so
+// senders never block on data after that.
+func send(ctx context.Context, data chan<- ScanResult, result ScanResult) bool {
+	select {
+	case data <- result:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reportError hands a failed fetch to the collector, unless it only failed
+// because the scan was cancelled.
+func reportError(ctx context.Context, data chan<- ScanResult, repo string, tag string, err error) {
+	if ctx.Err() == nil {
+		send(ctx, data, &FetchError{Repo: repo, Tag: tag, Err: err})
+	}
+}
+
+func fetchRepos(ctx context.Context, reg *Registry, data chan<- ScanResult, wg *sync.WaitGroup) {
 	defer wg.Done()
-	m, err := getForMap(fmt.Sprintf("%v/v2/_catalog", addr))
+	repos, err := listRepos(ctx, reg)
 	if err != nil {
-		log.Println(err)
+		reportError(ctx, data, "", "", err)
 		return
 	}
-	repos := m["repositories"].([]interface{})
-	data <- &PayLoad{
-		Type:  	DataTypeRepoList,
-		Target: repos,
-	}
+	// counted before the collector starts them, so that the scan does not
+	// look done in between, and uncounted if it never will
 	wg.Add(len(repos))
+	if !send(ctx, data, &RepoList{Repos: repos}) {
+		wg.Add(-len(repos))
+	}
 }
 
-func fetchTags(addr string, repo string, data chan<- *PayLoad, wg *sync.WaitGroup) {
+func fetchTags(ctx context.Context, reg *Registry, repo string, data chan<- ScanResult, wg *sync.WaitGroup) {
 	defer wg.Done()
-	m, err := getForMap(fmt.Sprintf("%v/v2/%v/tags/list", addr, repo))
+	tags, err := listTags(ctx, reg, repo)
 	if err != nil {
-		log.Println(err)
+		reportError(ctx, data, repo, "", err)
 		return
 	}
-	tags := m["tags"].([]interface{})
-	data <- &PayLoad{
-		Type:   DataTypeTagList,
-		Repo:   repo,
-		Target: tags,
-	}
 	wg.Add(len(tags))
+	if !send(ctx, data, &TagList{Repo: repo, Tags: tags}) {
+		wg.Add(-len(tags))
+	}
 }
 
-func fetchDetailOfTag(addr string, repo string, tag string, data chan<- *PayLoad, wg *sync.WaitGroup) {
+func fetchDetailOfTag(ctx context.Context, reg *Registry, repo string, tag string, data chan<- ScanResult, wg *sync.WaitGroup) {
 	defer wg.Done()
-	m, err := getForMap(fmt.Sprintf("%v/v2/%v/manifests/%v", addr, repo, tag))
+	detail, err := reg.registryClient(ctx).Tag(ctx, reg.repository(repo), tag)
 	if err != nil {
-		log.Println(err)
+		reportError(ctx, data, repo, tag, err)
 		return
 	}
-	r := make(map[string]interface{})
-
-	var h []time.Time
-	for _, item := range m["history"].([]interface{}){
-		i := item.(map[string]interface{})
-		str := i["v1Compatibility"].(string)
-		var msg map[string]interface{}
-		err = json.Unmarshal([]byte(str), &msg)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	send(ctx, data, &ManifestInfo{Repo: repo, Tag: detail})
+}
 
-		created, _ := time.Parse(time.RFC3339Nano, msg["created"].(string))
-		h = append(h, created)
+func newTagDetail(tag string, target *registryclient.Tag) TagDetail {
+	detail := TagDetail{
+		Tag: tag,
+		Created: JsonTime(target.Created),
+		Digest: target.Digest,
+		Size: target.Size,
+		ArtifactType: target.ArtifactType,
+		Blobs: target.Blobs,
+		Labels: target.Labels,
+	}
+	if target.IsIndex() {
+		detail.MediaType = target.MediaType
 	}
+	return detail
+}
 
-	// TODO show the creation time of most recent modification(layer), u may implement differently
-	sort.Slice(h, func(i, j int) bool {
-		return h[i].Before(h[j])
-	})
-	r["created"] = h[len(h) - 1]
+func manifestAcceptHeader() http.Header {
+	accept := http.Header{}
+	accept.Set("Accept", strings.Join(registryclient.ImageManifestTypes, ", "))
+	return accept
+}
 
-	data <- &PayLoad{
-		Type: DataTypeTagDetail,
-		Repo: repo,
-		Tag: tag,
-		Target: r,
-	}
+func getRepoInfo(ctx context.Context, reg *Registry) (map[string] []TagDetail, []*ScanError) {
+	return getInfoOfRepos(ctx, reg, nil)
 }
 
-func getRepoInfo(reg *Registry) map[string] []TagDetail {
+// getInfoOfRepos scans the given repositories, or the whole catalog when repos is nil.
+func getInfoOfRepos(ctx context.Context, reg *Registry, repos []string) (map[string] []TagDetail, []*ScanError) {
 	result := make(map[string] []TagDetail)
+	var errs []*ScanError
 	var wg sync.WaitGroup
-	data := make(chan *PayLoad)
+	data := make(chan ScanResult)
 	done := make(chan struct{})
-
-	wg.Add(1)
-	go fetchRepos(reg.Addr, data, &wg)
+	ctx, span := tracer.Start(ctx, "scan " + reg.name())
+	defer span.End()
+	reg.capabilities(ctx)
+	defer phase("scan")()
+	progress := startProgress(reg.name())
+	defer progress.stop()
+
+	if repos == nil {
+		wg.Add(1)
+		go fetchRepos(ctx, reg, data, &wg)
+	} else {
+		progress.count(&RepoList{Repos: repos})
+		wg.Add(len(repos))
+		for _, repo := range repos {
+			go fetchTags(ctx, reg, repo, data, &wg)
+		}
+	}
 
 	go func() {
 		wg.Wait()
-		done <- struct{}{}
+		close(done)
 	}()
 
 	for {
 		select {
 
-		case payload := <- data:
-			switch payload.Type {
-			case DataTypeRepoList:
-				for _, repo := range payload.Target.([]interface{}) {
-					go fetchTags(reg.Addr, repo.(string), data, &wg)
+		case r := <- data:
+			progress.count(r)
+			switch r := r.(type) {
+			case *RepoList:
+				for _, repo := range r.Repos {
+					go fetchTags(ctx, reg, repo, data, &wg)
 				}
-				break
-			case DataTypeTagList:
-				for _, tag := range payload.Target.([]interface{}) {
-					go fetchDetailOfTag(reg.Addr, payload.Repo, tag.(string), data, &wg)
+			case *TagList:
+				if len(r.Tags) == 0 {
+					// every tag was deleted, but the catalog still lists the repository
+					result[r.Repo] = []TagDetail{}
 				}
-				break
-			case DataTypeTagDetail:
-				target := payload.Target.(map[string]interface{})
-				_, exits := result[payload.Repo]
-				if !exits {
-					result[payload.Repo] = make([]TagDetail, 0)
+				for _, tag := range r.Tags {
+					switch scanDetail {
+					case DetailNone:
+						result[r.Repo] = append(result[r.Repo], TagDetail{Tag: tag})
+						progress.count(&ManifestInfo{Repo: r.Repo, Tag: &registryclient.Tag{Name: tag}})
+						wg.Done()
+					case DetailDigest:
+						go fetchDigestOfTag(ctx, reg, r.Repo, tag, data, &wg)
+					default:
+						go fetchDetailOfTag(ctx, reg, r.Repo, tag, data, &wg)
+					}
 				}
-				result[payload.Repo] = append(result[payload.Repo], TagDetail{
-					payload.Tag,
-					NewJsonTime(target["created"]),
+			case *ManifestInfo:
+				result[r.Repo] = append(result[r.Repo], newTagDetail(r.Tag.Name, r.Tag))
+			case *FetchError:
+				errs = append(errs, &ScanError{
+					Repo: r.Repo,
+					Tag: r.Tag,
+					Error: r.Err.Error(),
 				})
-				break
 			}
 
 		case <- done:
 			close(data)
-			for _, tags := range result {
-				sort.Slice(tags, func(i, j int) bool {
-					return tags[i].Created.After(tags[j].Created) // print tags desc by Created
-				})
+			return markSharedDigests(sortTagsByCreated(result)), sortScanErrors(errs)
+
+		case <- ctx.Done():
+			// return what has been gathered; the fetchers give up on their
+			// own, and done is closed once they all did
+			return markSharedDigests(sortTagsByCreated(result)), sortScanErrors(errs)
+		}
+	}
+}
+
+func sortScanErrors(errs []*ScanError) []*ScanError {
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Repo != errs[j].Repo {
+			return errs[i].Repo < errs[j].Repo
+		}
+		if errs[i].Tag != errs[j].Tag {
+			return errs[i].Tag < errs[j].Tag
+		}
+		return errs[i].Error < errs[j].Error
+	})
+	return errs
+}
+
+// reportOutput makes the JSON of scans the whole reports, with the
+// unsupported endpoints, Harbor projects and mirrors, rather than only the
+// tags keyed by repository and the errors; scan -report sets it.
+var reportOutput bool
+
+// warnIncomplete logs the errors of a scan whose results are used as they are.
+func warnIncomplete(errs []*ScanError) {
+	for _, e := range errs {
+		logEvent(LevelWarn, logFields{Repo: e.Repo, Tag: e.Tag, Err: errors.New(e.Error)}, "incomplete scan: %v", e)
+	}
+}
+
+func (e *ScanError) String() string {
+	switch {
+	case e.Tag != "":
+		return fmt.Sprintf("%v:%v: %v", e.Repo, e.Tag, e.Error)
+	case e.Repo != "":
+		return fmt.Sprintf("%v: %v", e.Repo, e.Error)
+	}
+	return e.Error
+}
+
+func sortTagsByCreated(result map[string] []TagDetail) map[string] []TagDetail {
+	for _, tags := range result {
+		sort.Slice(tags, func(i, j int) bool {
+			if !time.Time(tags[i].Created).Equal(time.Time(tags[j].Created)) {
+				return tags[i].Created.After(tags[j].Created) // print tags desc by Created
+			}
+			return tags[i].Tag < tags[j].Tag
+		})
+	}
+	return result
+}
+
+// markSharedDigests lists, on every tag, the other tags of its repository
+// pointing at the same manifest, e.g. latest and v1.4.2.
+func markSharedDigests(result map[string] []TagDetail) map[string] []TagDetail {
+	for _, tags := range result {
+		byDigest := make(map[string][]string)
+		for _, tag := range tags {
+			byDigest[tag.Digest] = append(byDigest[tag.Digest], tag.Tag)
+		}
+		// digests are unknown when scanning without details
+		delete(byDigest, "")
+		for i, tag := range tags {
+			for _, other := range byDigest[tag.Digest] {
+				if other != tag.Tag {
+					tags[i].SameDigest = append(tags[i].SameDigest, other)
+				}
 			}
-			return result
 		}
 	}
+	return result
 }
 
-func main()  {
-	if len(os.Args) == 1 {
-		log.Fatal("registry alias or addr not defined")
+// withoutEmpty drops the repositories without tags from repos.
+func withoutEmpty(repos map[string] []TagDetail) map[string] []TagDetail {
+	for repo, tags := range repos {
+		if len(tags) == 0 {
+			delete(repos, repo)
+		}
+	}
+	return repos
+}
+
+func sortedRepos(repos map[string] []TagDetail) []string {
+	names := make([]string, 0, len(repos))
+	for repo := range repos {
+		names = append(names, repo)
 	}
-	connectString := os.Args[1]
+	sort.Strings(names)
+	return names
+}
+
+func resolveRegistry(connectString string) *Registry {
 	reg, ok := localConf.findRegistry(connectString)
 	if !ok {
-		if !strings.HasPrefix(connectString, "http") {
-			connectString = fmt.Sprintf("http://%v", connectString)
+		reg, ok = localConf.findRegistryByAddr(connectString)
+	}
+	if !ok {
+		addr, socket, err := parseAddr(connectString)
+		if err != nil {
+			fatal(err)
 		}
-		reg = &Registry{ Addr: connectString }
+		reg = &Registry{ Addr: addr, socket: socket }
+	}
+	return reg
+}
+
+func main()  {
+	flag.Parse()
+	setupLogging()
+	checkOutputFormat()
+	checkOutputSchema()
+	configFilePath = configPath()
+	configErr = loadConfig(configFilePath)
+	if localConf == nil {
+		localConf = &Config{}
+	}
+	args := startRecording(flag.Args())
+	redirectOutput()
+	defer finish()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(args) == 0 {
+		flag.Usage()
+		exit(2)
+	}
+	ctx = startTracing(ctx, args)
+	httpClient.Timeout = *timeoutFlag
+	if len(injectedFaults) > 0 {
+		log.Printf("injecting faults: %v", &injectedFaults)
+	}
+	if configErr != nil && args[0] != "config" && args[0] != "help" {
+		fatal(configErr)
+	}
+	if cmd, ok := findCommand(args[0]); ok {
+		cmd.Run(ctx, args[1:])
+		return
+	}
+	// a bare alias or addr is short for scan
+	scan(ctx, args)
+}
+
+func scan(ctx context.Context, args []string) {
+	fs := commandFlags("scan")
+	watchInterval := fs.Duration("watch", 0, "rescan every interval and print only the tags added, removed or retagged since the previous scan")
+	signatures := fs.Bool("signatures", false, "report whether every image is signed with cosign")
+	unsigned := fs.Bool("only-unsigned", false, "only list the images without a cosign signature; implies -signatures")
+	vulns := fs.Bool("vulns", false, "run the configured vulnerability scanner on every image and add the counts by severity")
+	headOnly := fs.Bool("head-only", false, "only learn the digest of every tag, with a HEAD request on its manifest, leaving its creation time and size out")
+	noDetail := fs.Bool("no-detail", false, "only list the tags, without fetching their manifests")
+	excludeEmpty := fs.Bool("exclude-empty", false, "leave out the repositories without tags, whose tags were all deleted")
+	fs.BoolVar(&reportOutput, "report", false, "print the JSON of the whole report of every registry, {\"Repositories\": ..., \"Unsupported\": ..., \"Errors\": ...}, instead of only the tags keyed by repository")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	switch {
+	case *headOnly && *noDetail:
+		fatal("-head-only and -no-detail exclude each other")
+	case *noDetail && (*signatures || *unsigned || *vulns):
+		fatal("-signatures, -only-unsigned and -vulns need the digests -no-detail skips")
+	case *headOnly:
+		scanDetail = DetailDigest
+	case *noDetail:
+		scanDetail = DetailNone
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+	if *watchInterval > 0 {
+		watch(ctx, regs, *watchInterval)
+		return
+	}
+	scanOne := func(reg *Registry) *Report {
+		report := scanReport(ctx, reg)
+		if (*signatures || *unsigned) && ctx.Err() == nil {
+			report.Errors = append(report.Errors, checkSignatures(ctx, reg, report.Repositories)...)
+		}
+		if *unsigned {
+			report.Repositories = onlyUnsigned(report.Repositories)
+		}
+		if *vulns && ctx.Err() == nil {
+			report.Errors = append(report.Errors, scanVulnerabilities(ctx, reg, report.Repositories)...)
+		}
+		if *excludeEmpty {
+			report.Repositories = withoutEmpty(report.Repositories)
+		}
+		report.finished, report.interrupted = time.Now(), ctx.Err() != nil
+		if !report.interrupted {
+			runHooks(ctx, reg, &HookEvent{Event: HookScanComplete, Time: JsonTime(report.finished), Report: report})
+		}
+		return report
+	}
+	var output interface{}
+	incomplete := false
+	if len(regs) == 1 {
+		report := scanOne(regs[0])
+		incomplete = len(report.Errors) > 0
+		output = report
+	} else {
+		// several logical registries, e.g. all those behind one host
+		reports := make(map[string]*Report)
+		for _, reg := range regs {
+			report := scanOne(reg)
+			incomplete = incomplete || len(report.Errors) > 0
+			reports[reg.name()] = report
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		output = reports
+	}
+	if ctx.Err() != nil {
+		log.Println("interrupted, printing the results gathered so far")
+		printOutput(output)
+		exit(ExitCodeInterrupted)
+	}
+	printOutput(output)
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
+
+func scanReport(ctx context.Context, reg *Registry) *Report {
+	reg.takeServedBy()
+	started := time.Now()
+	repos, errs := getRepoInfo(ctx, reg)
+	report := &Report{
+		Repositories: repos,
+		Unsupported: reg.capabilities(ctx).unsupported(),
+		ServedBy: reg.takeServedBy(),
+		Errors: errs,
+		registry: reg.name(),
+		reg: reg,
+		started: started,
+	}
+	if ctx.Err() == nil && reg.capabilities(ctx).Harbor {
+		report.Harbor = harborInfo(ctx, reg)
 	}
-	r := getRepoInfo(reg)
-	printJson(r)
+	return report
 }
 
 
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	LockStatusOK      = "ok"
+	LockStatusDrifted = "drifted"
+	LockStatusMissing = "missing"
+)
+
+// LockFile pins image references of one registry to manifest digests. It
+// is written by lock pin; other tools pinning images can write the same
+// JSON for lock verify to check.
+type LockFile struct {
+	Registry string       `json:"registry"`
+	Images   []*LockEntry `json:"images"`
+}
+
+type LockEntry struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+type LockResult struct {
+	Repo     string
+	Tag      string
+	Status   string
+	Expected string
+	Actual   string `json:",omitempty"`
+}
+
+// splitRef splits repo:tag, defaulting the tag to latest.
+func splitRef(ref string) (repo string, tag string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, "latest"
+	}
+	return ref[:i], ref[i+1:]
+}
+
+func readLockFile(path string) (*LockFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lf LockFile
+	err = json.Unmarshal(b, &lf)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &lf, nil
+}
+
+func lockPin(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("lock pin", flag.ExitOnError)
+	output := fs.String("o", "", "write the lockfile to this path instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fatal("usage: lock pin [-o lockfile] <alias|addr> <repo:tag>...")
+	}
+
+	reg := resolveRegistry(fs.Arg(0))
+	lf := &LockFile{Registry: fs.Arg(0)}
+	for _, ref := range fs.Args()[1:] {
+		repo, tag := splitRef(ref)
+		digest, found, err := reg.registryClient(ctx).Digest(ctx, reg.repository(repo), tag)
+		if err != nil {
+			fatal(err)
+		}
+		if !found {
+			fatalf("%v:%v not found", repo, tag)
+		}
+		lf.Images = append(lf.Images, &LockEntry{Repo: repo, Tag: tag, Digest: digest})
+	}
+
+	if *output == "" {
+		printJson(lf)
+		return
+	}
+	j, err := marshalJson(lf)
+	if err != nil {
+		fatal(err)
+	}
+	err = ioutil.WriteFile(*output, j, 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func lockVerify(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("lock verify", flag.ExitOnError)
+	registry := fs.String("registry", "", "verify against this alias or addr instead of the one in the lockfile")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fatal("usage: lock verify [-registry alias|addr] <lockfile>")
+	}
+	lf, err := readLockFile(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	if *registry != "" {
+		lf.Registry = *registry
+	}
+	if lf.Registry == "" {
+		fatal("lockfile names no registry")
+	}
+
+	reg := resolveRegistry(lf.Registry)
+	exitCode := 0
+	results := make([]*LockResult, 0, len(lf.Images))
+	for _, entry := range lf.Images {
+		digest, found, err := reg.registryClient(ctx).Digest(ctx, reg.repository(entry.Repo), entry.Tag)
+		if err != nil {
+			fatal(err)
+		}
+		r := &LockResult{
+			Repo:     entry.Repo,
+			Tag:      entry.Tag,
+			Status:   LockStatusOK,
+			Expected: entry.Digest,
+			Actual:   digest,
+		}
+		switch {
+		case !found:
+			r.Status = LockStatusMissing
+			exitCode = ExitCodeMissing
+		case digest != entry.Digest:
+			r.Status = LockStatusDrifted
+			if exitCode == 0 {
+				exitCode = ExitCodeDrift
+			}
+		}
+		results = append(results, r)
+	}
+	printJson(results)
+	exit(exitCode)
+}
+
+func lock(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		fatal("lock: pin or verify expected")
+	}
+	switch args[0] {
+	case "pin":
+		lockPin(ctx, args[1:])
+	case "verify":
+		lockVerify(ctx, args[1:])
+	default:
+		fatalf("lock: unknown command %q", args[0])
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+var logFormatFlag = flag.String("log-format", LogFormatText, "format of what is logged to stderr: text, or json for one record per line")
+
+// logFields are what a log record is about, as separate fields of the
+// record in JSON logs.
+type logFields struct {
+	Registry string
+	Repo     string
+	Tag      string
+	URL      *url.URL
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// logRecord is a line of JSON logs. Duration is in seconds.
+type logRecord struct {
+	Time     string  `json:"time"`
+	Level    string  `json:"level"`
+	Msg      string  `json:"msg"`
+	Registry string  `json:"registry,omitempty"`
+	Repo     string  `json:"repo,omitempty"`
+	Tag      string  `json:"tag,omitempty"`
+	URL      string  `json:"url,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Source   string  `json:"source,omitempty"`
+}
+
+// jsonLog writes log records as JSON lines. Lines logged with the log
+// package become records with just a message, at the error level when
+// logged by log.Fatal.
+type jsonLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+var (
+	jsonLogger   *jsonLog
+	sourcePrefix = regexp.MustCompile(`^([\w.-]+\.go:\d+): `)
+)
+
+func (l *jsonLog) write(r *logRecord) {
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	j, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(j, '\n'))
+}
+
+func (l *jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	r := &logRecord{Level: LevelInfo, Msg: msg}
+	if m := sourcePrefix.FindStringSubmatch(msg); m != nil {
+		r.Source, r.Msg = m[1], msg[len(m[0]):]
+	}
+	if loggedFatal() {
+		r.Level = LevelError
+	}
+	l.write(r)
+	return len(p), nil
+}
+
+// loggedFatal reports whether the line being logged comes from log.Fatal
+// or log.Panic, which exit right after writing it.
+func loggedFatal() bool {
+	pc := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "log.Fatal") || strings.HasPrefix(frame.Function, "log.Panic") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// fatal logs like log.Fatal, but ends the run through exit, so that the
+// atExit hooks still run: a failed run writes its -record file and leaves
+// no temporary -output-file behind.
+func fatal(v ...interface{}) {
+	emit(2, LevelError, logFields{}, fmt.Sprint(v...))
+	exit(1)
+}
+
+// fatalf is fatal with a format, like log.Fatalf.
+func fatalf(format string, v ...interface{}) {
+	emit(2, LevelError, logFields{}, fmt.Sprintf(format, v...))
+	exit(1)
+}
+
+// fatalln is fatal with the spacing of log.Fatalln.
+func fatalln(v ...interface{}) {
+	emit(2, LevelError, logFields{}, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	exit(1)
+}
+
+// setupLogging switches log output to JSON records for -log-format json.
+func setupLogging() {
+	switch *logFormatFlag {
+	case LogFormatText:
+	case LogFormatJson:
+		jsonLogger = &jsonLog{out: os.Stderr}
+		log.SetFlags(log.Lshortfile)
+		log.SetOutput(jsonLogger)
+	default:
+		fatalf("unknown log format %q", *logFormatFlag)
+	}
+}
+
+// logEvent logs a message about what fields name, as fields of its own in
+// JSON logs and as just the message otherwise.
+func logEvent(level string, fields logFields, format string, args ...interface{}) {
+	emit(2, level, fields, fmt.Sprintf(format, args...))
+}
+
+// emit logs msg for the caller depth frames up.
+func emit(depth int, level string, fields logFields, msg string) {
+	if jsonLogger == nil {
+		log.Output(depth+1, msg)
+		return
+	}
+	r := &logRecord{
+		Level:    level,
+		Msg:      msg,
+		Registry: fields.Registry,
+		Repo:     fields.Repo,
+		Tag:      fields.Tag,
+		Status:   fields.Status,
+		Duration: fields.Duration.Seconds(),
+	}
+	if fields.URL != nil {
+		r.URL = fields.URL.String()
+		if r.Repo == "" {
+			r.Repo, r.Tag = refOfURL(fields.URL)
+		}
+	}
+	if fields.Err != nil {
+		r.Error = fields.Err.Error()
+	}
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		r.Source = fmt.Sprintf("%v:%d", file[strings.LastIndex(file, "/")+1:], line)
+	}
+	jsonLogger.write(r)
+}
+
+// refOfURL returns the repository a distribution API url is about and, for
+// a manifest, the tag or digest.
+func refOfURL(u *url.URL) (repo string, ref string) {
+	path := u.Path
+	i := strings.Index(path, "/v2/")
+	if i < 0 {
+		return "", ""
+	}
+	path = path[i+len("/v2/"):]
+	for _, endpoint := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if j := strings.LastIndex(path, endpoint); j > 0 {
+			if endpoint == "/manifests/" {
+				ref = path[j+len(endpoint):]
+			}
+			return path[:j], ref
+		}
+	}
+	return "", ""
+}
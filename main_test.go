@@ -0,0 +1,9 @@
+package main
+
+func init() {
+	// tests neither read nor write the caches of the user, and run without
+	// a config unless they set one
+	*noCacheFlag = true
+	*noTokenCacheFlag = true
+	localConf = &Config{}
+}
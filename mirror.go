@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorDownFor is how long a mirror that could not be reached is skipped.
+const mirrorDownFor = time.Minute
+
+// mirror is a registry serving the content of another, such as a
+// pull-through cache, with a client of its own so that it gets its own
+// tokens.
+type mirror struct {
+	reg *Registry
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (m *mirror) down() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Now().Before(m.downUntil)
+}
+
+func (m *mirror) markDown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downUntil = time.Now().Add(mirrorDownFor)
+}
+
+// setupMirrors turns the mirror addresses of reg into registries sharing
+// its credentials and connection settings.
+func (reg *Registry) setupMirrors() error {
+	reg.mirrors = nil
+	for _, addr := range reg.Mirrors {
+		m := &Registry{
+			Addr:         addr,
+			Type:         reg.Type,
+			KeyFile:      reg.KeyFile,
+			Username:     reg.Username,
+			Password:     reg.Password,
+			AuthType:     reg.AuthType,
+			Token:        reg.Token,
+			TLS:          reg.TLS,
+			Proxy:        reg.Proxy,
+			Timeout:      reg.Timeout,
+			Retries:      reg.Retries,
+			RateLimit:    reg.RateLimit,
+			Burst:        reg.Burst,
+			MinRemaining: reg.MinRemaining,
+		}
+		if err := m.setup(); err != nil {
+			return err
+		}
+		reg.mirrors = append(reg.mirrors, &mirror{reg: m})
+	}
+	return nil
+}
+
+// mirrorTransport sends the reads of a registry to its mirrors first, in
+// order, and to the registry itself when none of them answers with
+// success. The catalog is always read from the registry, as a pull-through
+// cache only lists what it happened to cache.
+type mirrorTransport struct {
+	reg     *Registry
+	primary http.RoundTripper
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.String(), t.reg.Addr)
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || path == req.URL.String() || strings.HasPrefix(path, "/v2/_catalog") {
+		return t.primary.RoundTrip(req)
+	}
+	repo := repoOfPath(path)
+	for _, m := range t.reg.mirrors {
+		if m.down() {
+			continue
+		}
+		mreq, err := http.NewRequestWithContext(req.Context(), req.Method, m.reg.Addr+path, nil)
+		if err != nil {
+			continue
+		}
+		mreq.Header = req.Header.Clone()
+		res, err := m.reg.client().Do(mreq)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			m.markDown()
+			logEvent(LevelWarn, logFields{Registry: t.reg.name(), Repo: repo, Err: err}, "%v: mirror %v failed, skipping it for %v: %v", t.reg.name(), m.reg.displayAddr(), mirrorDownFor, err)
+			continue
+		}
+		if res.StatusCode < 400 {
+			t.reg.served(repo, m.reg.displayAddr())
+			return res, nil
+		}
+		debugf(LogRequests, logFields{Registry: t.reg.name(), Repo: repo}, "%v: mirror %v answered %v, falling back", t.reg.name(), m.reg.displayAddr(), res.Status)
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	res, err := t.primary.RoundTrip(req)
+	if err == nil && res.StatusCode < 400 {
+		t.reg.served(repo, t.reg.displayAddr())
+	}
+	return res, err
+}
+
+// repoOfPath returns the repository a request path such as
+// /v2/team-a/app/manifests/v1 is about, or "" for other endpoints.
+func repoOfPath(path string) string {
+	path = strings.TrimPrefix(path, "/v2/")
+	for _, sep := range []string{"/tags/", "/manifests/", "/blobs/", "/referrers/"} {
+		if i := strings.LastIndex(path, sep); i > 0 {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+// served notes that endpoint answered a read of repo.
+func (reg *Registry) served(repo string, endpoint string) {
+	if repo == "" || len(reg.mirrors) == 0 {
+		return
+	}
+	reg.servedMu.Lock()
+	defer reg.servedMu.Unlock()
+	if reg.servedBy == nil {
+		reg.servedBy = make(map[string]map[string]bool)
+	}
+	if reg.servedBy[repo] == nil {
+		reg.servedBy[repo] = make(map[string]bool)
+	}
+	reg.servedBy[repo][endpoint] = true
+}
+
+// takeServedBy returns the endpoints that answered the reads of every
+// repository since it was last called, or nil without mirrors.
+func (reg *Registry) takeServedBy() map[string][]string {
+	reg.servedMu.Lock()
+	defer reg.servedMu.Unlock()
+	if len(reg.mirrors) == 0 {
+		return nil
+	}
+	result := make(map[string][]string, len(reg.servedBy))
+	for repo, endpoints := range reg.servedBy {
+		for endpoint := range endpoints {
+			result[repo] = append(result[repo], endpoint)
+		}
+		sort.Strings(result[repo])
+	}
+	reg.servedBy = nil
+	return result
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+)
+
+// NotifySLO in the changes of a sink has it sent the freshness SLOs the
+// daemon found violated or recovered.
+const NotifySLO = "slo"
+
+// slackMaxLines is how many changes a Slack message lists before summing
+// up the rest.
+const slackMaxLines = 20
+
+// notifyAttempts is how often a notification is sent before giving up.
+const notifyAttempts = 3
+
+// NotifierConfig is a sink the tag changes found while watching are sent
+// to, e.g. {"type": "slack", "url": "https://hooks.slack.com/services/…"}.
+// Registries (aliases or names), Repos (patterns like team-a/*) and
+// Changes (added, removed or retagged) narrow what is sent; empty means
+// everything. Headers are added to webhook requests, e.g. for a token.
+type NotifierConfig struct {
+	Type       string            `json:"type"`
+	URL        string            `json:"url"`
+	Registries []string          `json:"registries"`
+	Repos      []string          `json:"repos"`
+	Changes    []string          `json:"changes"`
+	Headers    map[string]string `json:"headers"`
+}
+
+func (n *NotifierConfig) setup() error {
+	switch n.Type {
+	case "":
+		n.Type = NotifierWebhook
+	case NotifierWebhook, NotifierSlack:
+	default:
+		return fmt.Errorf("notifications: unknown type %q, want %v or %v", n.Type, NotifierWebhook, NotifierSlack)
+	}
+	u, err := url.Parse(n.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("notifications: invalid url %q", n.URL)
+	}
+	for _, pattern := range n.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("notifications: repos pattern %q: %v", pattern, err)
+		}
+	}
+	for _, change := range n.Changes {
+		switch change {
+		case TagAdded, TagRemoved, TagRetagged, NotifySLO:
+		default:
+			return fmt.Errorf("notifications: unknown change %q, want %v, %v, %v or %v", change, TagAdded, TagRemoved, TagRetagged, NotifySLO)
+		}
+	}
+	return nil
+}
+
+// String names the sink in logs without the url, which for Slack is the
+// secret.
+func (n *NotifierConfig) String() string {
+	u, err := url.Parse(n.URL)
+	if err != nil {
+		return n.Type
+	}
+	return n.Type + " " + u.Host
+}
+
+// wants reports whether the sink is sent change, found on registry.
+func (n *NotifierConfig) wants(reg *Registry, change *TagChange) bool {
+	return n.wantsKind(reg, change.Change, change.Repo)
+}
+
+// wantsSLO reports whether the sink is sent the SLO result r of registry.
+func (n *NotifierConfig) wantsSLO(reg *Registry, r *SLOResult) bool {
+	return n.wantsKind(reg, NotifySLO, r.Repo)
+}
+
+func (n *NotifierConfig) wantsKind(reg *Registry, kind string, repo string) bool {
+	if len(n.Registries) > 0 && !contains(n.Registries, reg.Alias) && !contains(n.Registries, reg.name()) {
+		return false
+	}
+	if len(n.Changes) > 0 && !contains(n.Changes, kind) {
+		return false
+	}
+	// patterns that match no repository are about no repository in
+	// particular
+	if len(n.Repos) == 0 || repo == "" {
+		return true
+	}
+	for _, pattern := range n.Repos {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification is the body of a webhook: the changes of a registry found by
+// one pass, or the freshness SLOs a scan of the daemon found violated or
+// recovered.
+type Notification struct {
+	Registry string
+	Time     JsonTime
+	Changes  []*TagChange `json:",omitempty"`
+	SLOs     []*SLOResult `json:",omitempty"`
+}
+
+// slackMessage formats the changes as the text of a Slack incoming webhook.
+func slackMessage(n *Notification) map[string]string {
+	var b strings.Builder
+	if len(n.SLOs) > 0 {
+		fmt.Fprintf(&b, "*%v*: %d freshness SLOs changed\n", n.Registry, len(n.SLOs))
+		for i, r := range n.SLOs {
+			if i == slackMaxLines {
+				fmt.Fprintf(&b, "… and %d more\n", len(n.SLOs)-i)
+				break
+			}
+			fmt.Fprintf(&b, "`%v`\n", r)
+		}
+		return map[string]string{"text": b.String()}
+	}
+	fmt.Fprintf(&b, "*%v*: %d tag changes\n", n.Registry, len(n.Changes))
+	for i, c := range n.Changes {
+		if i == slackMaxLines {
+			fmt.Fprintf(&b, "… and %d more\n", len(n.Changes)-i)
+			break
+		}
+		fmt.Fprintf(&b, "`%v`\n", c)
+	}
+	return map[string]string{"text": b.String()}
+}
+
+// send posts the changes to the sink, retrying failed attempts.
+func (n *NotifierConfig) send(ctx context.Context, notification *Notification) error {
+	var body interface{} = notification
+	if n.Type == NotifierSlack {
+		body = slackMessage(notification)
+	}
+	j, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, j)
+		if err == nil || attempt == notifyAttempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func (n *NotifierConfig) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range n.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		// the error names the url
+		return fmt.Errorf("%v: %v", n, errors.Unwrap(err))
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %v", n, res.Status)
+	}
+	return nil
+}
+
+// notify sends the changes found on reg to every configured sink wanting
+// some of them, and runs the tag-added hooks on the tags added. Failures are
+// logged, watching goes on.
+func notify(ctx context.Context, reg *Registry, changes []*TagChange, now JsonTime) {
+	for _, n := range localConf.Notifications {
+		var wanted []*TagChange
+		for _, c := range changes {
+			if n.wants(reg, c) {
+				wanted = append(wanted, c)
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		err := n.send(ctx, &Notification{Registry: reg.name(), Time: now, Changes: wanted})
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: notification of %d changes failed: %v", reg.name(), len(wanted), err)
+			continue
+		}
+		debugf(LogRequests, logFields{Registry: reg.name()}, "%v: sent %d changes to %v", reg.name(), len(wanted), n)
+	}
+	var added []*TagChange
+	for _, c := range changes {
+		if c.Change == TagAdded {
+			added = append(added, c)
+		}
+	}
+	if len(added) > 0 {
+		runHooks(ctx, reg, &HookEvent{Event: HookTagAdded, Time: now, Changes: added})
+	}
+}
+
+// notifySLOs sends the SLO results of reg that changed status to every
+// configured sink wanting some of them. Failures are logged.
+func notifySLOs(ctx context.Context, reg *Registry, results []*SLOResult, now JsonTime) {
+	for _, n := range localConf.Notifications {
+		var wanted []*SLOResult
+		for _, r := range results {
+			if n.wantsSLO(reg, r) {
+				wanted = append(wanted, r)
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		err := n.send(ctx, &Notification{Registry: reg.name(), Time: now, SLOs: wanted})
+		if err != nil {
+			logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: notification of %d SLOs failed: %v", reg.name(), len(wanted), err)
+			continue
+		}
+		debugf(LogRequests, logFields{Registry: reg.name()}, "%v: sent %d SLOs to %v", reg.name(), len(wanted), n)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	SortAlpha       = "alpha"
+	SortTagCount    = "tag-count"
+	SortNewestFirst = "newest-first"
+)
+
+// sortOrder is the value of -sort-repos, checked when the flag is parsed
+// rather than after a scan.
+type sortOrder string
+
+func (s *sortOrder) String() string { return string(*s) }
+
+func (s *sortOrder) Set(value string) error {
+	switch value {
+	case SortAlpha, SortTagCount, SortNewestFirst:
+		*s = sortOrder(value)
+		return nil
+	}
+	return fmt.Errorf("want %v, %v or %v", SortAlpha, SortTagCount, SortNewestFirst)
+}
+
+var sortReposFlag = sortOrder(SortAlpha)
+
+func init() {
+	flag.Var(&sortReposFlag, "sort-repos", "`order` of repositories in the output: alpha, tag-count (most tags first) or newest-first (by their newest tag)")
+}
+
+func newestTag(tags []TagDetail) time.Time {
+	var newest time.Time
+	for _, tag := range tags {
+		if t := time.Time(tag.Created); t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+// outputRepos returns the repositories of repos in the -sort-repos order,
+// ties broken by name so that runs over the same tags print the same output.
+func outputRepos(repos map[string][]TagDetail) []string {
+	names := sortedRepos(repos)
+	switch sortReposFlag {
+	case SortTagCount:
+		sort.SliceStable(names, func(i, j int) bool {
+			return len(repos[names[i]]) > len(repos[names[j]])
+		})
+	case SortNewestFirst:
+		newest := make(map[string]time.Time, len(names))
+		for _, repo := range names {
+			newest[repo] = newestTag(repos[repo])
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			return newest[names[i]].After(newest[names[j]])
+		})
+	}
+	return names
+}
+
+// RepoTags are the tags of every repository of a report. They marshal to a
+// JSON object keyed by repository in the -sort-repos order, where a plain map
+// would always be alphabetical.
+type RepoTags map[string][]TagDetail
+
+func (r RepoTags) MarshalJSON() ([]byte, error) {
+	return marshalRepos(r, func(tags []TagDetail) interface{} { return tags })
+}
+
+// marshalRepos marshals repos to a JSON object keyed by repository in the
+// -sort-repos order, with the value tagsOf returns for the tags of each.
+func marshalRepos(repos RepoTags, tagsOf func(tags []TagDetail) interface{}) ([]byte, error) {
+	if repos == nil {
+		return []byte("null"), nil
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, repo := range outputRepos(repos) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(repo)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := json.Marshal(tagsOf(repos[repo]))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(tags)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
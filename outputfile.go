@@ -0,0 +1,83 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var outputFileFlag = flag.String("output-file", "", "write the output to this file, gzipped if it ends in .gz; it is only replaced once the run ends without failing")
+
+func init() {
+	flag.StringVar(outputFileFlag, "o", "", "same as -output-file")
+}
+
+// redirectOutput points stdout at a temporary file next to -output-file and
+// has it replace the file when the run ends. A run that fails or is
+// interrupted leaves the file as it was rather than half written.
+func redirectOutput() {
+	path := *outputFileFlag
+	if path == "" {
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = f
+	atExit = append(atExit, func() {
+		os.Stdout = stdout
+		if exitCode != 0 && exitCode != ExitCodeIncomplete {
+			f.Close()
+			os.Remove(f.Name())
+			return
+		}
+		if err := commitOutput(f, path); err != nil {
+			log.Printf("writing %v: %v", path, err)
+		}
+	})
+}
+
+// commitOutput compresses the output written to f if path ends in .gz and
+// renames it to path, removing the temporary files if that fails.
+func commitOutput(f *os.File, path string) (err error) {
+	if strings.HasSuffix(path, ".gz") {
+		plain := f
+		defer os.Remove(plain.Name())
+		defer plain.Close()
+		f, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+		if err != nil {
+			return err
+		}
+		if _, err = plain.Seek(0, io.SeekStart); err == nil {
+			w := gzip.NewWriter(f)
+			if _, err = io.Copy(w, plain); err == nil {
+				err = w.Close()
+			}
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	if err = f.Chmod(0644); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const UnownedTeam = "unowned"
+
+// Owner maps a repository namespace or name prefix to the team responsible for it.
+type Owner struct {
+	Prefix string `json:"prefix"`
+	Team   string `json:"team"`
+	Email  string `json:"email"`
+}
+
+type OwnerReport struct {
+	Team         string
+	Email        string
+	RepoCount    int
+	TagCount     int
+	UniqueBytes  int64
+	Repositories RepoTags
+	// SLOViolations are the freshness SLOs violated by repositories of the
+	// team.
+	SLOViolations []*SLOResult `json:",omitempty"`
+}
+
+// findOwner returns the owner with the longest prefix matching repo.
+func (conf *Config) findOwner(repo string) *Owner {
+	var found *Owner
+	for _, owner := range conf.Owners {
+		if !strings.HasPrefix(repo, owner.Prefix) {
+			continue
+		}
+		if found == nil || len(owner.Prefix) > len(found.Prefix) {
+			found = owner
+		}
+	}
+	return found
+}
+
+// defaultOwnerLabels are the image labels naming the owner of an image
+// when the config does not list others.
+var defaultOwnerLabels = []string{"team", "owner"}
+
+// ownerOf returns the team owning an image of repo: the first owner label
+// set on the image, else the team of the longest matching prefix, else
+// UnownedTeam.
+func (conf *Config) ownerOf(repo string, labels map[string]string) string {
+	keys := conf.OwnerLabels
+	if keys == nil {
+		keys = defaultOwnerLabels
+	}
+	for _, key := range keys {
+		if v := strings.TrimSpace(labels[key]); v != "" {
+			return v
+		}
+	}
+	if owner := conf.findOwner(repo); owner != nil {
+		return owner.Team
+	}
+	return UnownedTeam
+}
+
+// teamTags splits the tags of repo by the team owning each, as ownerOf
+// tells. A repository without tags goes to the team of its prefix.
+func (conf *Config) teamTags(repo string, tags []TagDetail) map[string][]TagDetail {
+	if len(tags) == 0 {
+		return map[string][]TagDetail{conf.ownerOf(repo, nil): nil}
+	}
+	byTeam := make(map[string][]TagDetail)
+	for _, tag := range tags {
+		team := conf.ownerOf(repo, tag.Labels)
+		byTeam[team] = append(byTeam[team], tag)
+	}
+	return byTeam
+}
+
+// teamEmail returns the email of the first owner entry of team, if any.
+func (conf *Config) teamEmail(team string) string {
+	for _, owner := range conf.Owners {
+		if owner.Team == team && owner.Email != "" {
+			return owner.Email
+		}
+	}
+	return ""
+}
+
+// ownerReports attributes the repositories and tags of repos to teams tag
+// by tag, like audit, and every violated SLO of slos to the team owning
+// the newest tag of its repository.
+func ownerReports(conf *Config, repos map[string][]TagDetail, slos []*SLOResult) map[string]*OwnerReport {
+	reports := make(map[string]*OwnerReport)
+	report := func(team string) *OwnerReport {
+		r, ok := reports[team]
+		if !ok {
+			r = &OwnerReport{
+				Team:         team,
+				Email:        conf.teamEmail(team),
+				Repositories: make(map[string][]TagDetail),
+			}
+			reports[team] = r
+		}
+		return r
+	}
+	for repo, tags := range repos {
+		for team, owned := range conf.teamTags(repo, tags) {
+			r := report(team)
+			r.RepoCount++
+			r.TagCount += len(owned)
+			r.UniqueBytes += uniqueBytes(owned)
+			r.Repositories[repo] = owned
+		}
+	}
+	for _, slo := range slos {
+		if slo.Status != SLOStatusViolated {
+			continue
+		}
+		var labels map[string]string
+		if tags := repos[slo.Repo]; len(tags) > 0 {
+			labels = tags[0].Labels
+		}
+		r := report(conf.ownerOf(slo.Repo, labels))
+		r.SLOViolations = append(r.SLOViolations, slo)
+	}
+	return reports
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// teamFileNames returns the file name of every team, its name with unsafe
+// characters replaced and ext appended. Teams whose names end up the same,
+// ignoring case, get a hash of their name appended, so none overwrites
+// another.
+func teamFileNames(teams []string, ext string) map[string]string {
+	bases := make(map[string]string, len(teams))
+	seen := make(map[string]int)
+	for _, team := range teams {
+		base := unsafeFileChars.ReplaceAllString(team, "_")
+		bases[team] = base
+		seen[strings.ToLower(base)]++
+	}
+	names := make(map[string]string, len(teams))
+	for team, base := range bases {
+		if seen[strings.ToLower(base)] > 1 {
+			sum := sha256.Sum256([]byte(team))
+			base += "-" + hex.EncodeToString(sum[:4])
+		}
+		names[team] = base + ext
+	}
+	return names
+}
+
+func writeOwnerReports(dir string, reports map[string]*OwnerReport) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	teams := make([]string, 0, len(reports))
+	for team := range reports {
+		teams = append(teams, team)
+	}
+	names := teamFileNames(teams, ".json")
+	for team, r := range reports {
+		j, err := marshalJson(r)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, names[team]), j, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func analyzeOwners(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("analyze owners", flag.ExitOnError)
+	outDir := fs.String("out-dir", "", "write one report file per team into this directory")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fatal("registry alias or addr not defined")
+	}
+
+	repos, errs := getRepoInfo(ctx, resolveRegistry(fs.Arg(0)))
+	warnIncomplete(errs)
+	slos, err := checkSLOs(localConf.SLOs, repos, time.Now())
+	if err != nil {
+		fatal(err)
+	}
+	reports := ownerReports(localConf, repos, slos)
+	if *outDir != "" {
+		err := writeOwnerReports(*outDir, reports)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	teams := make([]*OwnerReport, 0, len(reports))
+	for _, r := range reports {
+		teams = append(teams, r)
+	}
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].Team < teams[j].Team
+	})
+	printJson(teams)
+}
+
+func analyze(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		fatal("analyze: report name not defined")
+	}
+	switch args[0] {
+	case "owners":
+		analyzeOwners(ctx, args[1:])
+	case "cost":
+		analyzeCost(ctx, args[1:])
+	default:
+		fatalf("analyze: unknown report %q", args[0])
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestTeamFileNames(t *testing.T) {
+	names := teamFileNames([]string{"team-a", "team/b", "team_b", "Team_B", "unowned"}, ".json")
+	if names["team-a"] != "team-a.json" || names["unowned"] != "unowned.json" {
+		t.Errorf("safe names changed: %v", names)
+	}
+	seen := make(map[string]string)
+	for team, name := range names {
+		if other, ok := seen[name]; ok {
+			t.Errorf("%q and %q both write %v", team, other, name)
+		}
+		seen[name] = team
+	}
+}
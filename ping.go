@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PingStatusOK           = "ok"
+	PingStatusUnauthorized = "unauthorized"
+	PingStatusError        = "error"
+	PingStatusTLSError     = "tls-error"
+	PingStatusUnreachable  = "unreachable"
+)
+
+// PingResult is the outcome of GET /v2/ on a registry.
+type PingResult struct {
+	Registry      string
+	Address       string
+	Status        string
+	HTTPStatus    int    `json:",omitempty"`
+	LatencyMs     int64  `json:",omitempty"`
+	APIVersion    string `json:",omitempty"`
+	Auth          string `json:",omitempty"`
+	TLSVersion    string `json:",omitempty"`
+	CertExpiresIn *int   `json:",omitempty"`
+	Error         string `json:",omitempty"`
+}
+
+// authScheme describes the challenge of a 401, e.g. "bearer https://auth.docker.io/token".
+func authScheme(header http.Header) string {
+	challenge := header.Get("WWW-Authenticate")
+	if challenge == "" {
+		return "unknown"
+	}
+	scheme := strings.ToLower(strings.Fields(challenge)[0])
+	if i := strings.Index(challenge, `realm="`); i >= 0 && scheme == "bearer" {
+		realm := challenge[i+len(`realm="`):]
+		if j := strings.Index(realm, `"`); j >= 0 {
+			return scheme + " " + realm[:j]
+		}
+	}
+	return scheme
+}
+
+// ping sends GET /v2/ to reg without authentication, retries or the cache,
+// so that the bare answer of the registry is seen. When it asks for
+// credentials, the request is repeated with the configured ones.
+func ping(ctx context.Context, reg *Registry, now time.Time) *PingResult {
+	result := &PingResult{Registry: reg.name(), Address: reg.displayAddr()}
+	url := reg.Addr + "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Status, result.Error = PingStatusError, err.Error()
+		return result
+	}
+	client := &http.Client{Transport: interceptTransport(reg.transport()), Timeout: reg.requestTimeout()}
+	start := time.Now()
+	res, err := client.Do(req)
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &certErr):
+		result.Status, result.Error = PingStatusTLSError, err.Error()
+		return result
+	case err != nil:
+		result.Status, result.Error = PingStatusUnreachable, err.Error()
+		return result
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.HTTPStatus = res.StatusCode
+	result.APIVersion = res.Header.Get("Docker-Distribution-API-Version")
+	if res.TLS != nil {
+		result.TLSVersion = tlsVersions[res.TLS.Version]
+		if len(res.TLS.PeerCertificates) > 0 {
+			days := daysUntil(res.TLS.PeerCertificates[0].NotAfter, now)
+			result.CertExpiresIn = &days
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		result.Auth = "none"
+		result.Status = PingStatusOK
+	case http.StatusUnauthorized:
+		result.Auth = authScheme(res.Header)
+		req, _ = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		res, err = reg.client().Do(req)
+		if err != nil {
+			result.Status, result.Error = PingStatusUnauthorized, err.Error()
+			return result
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			result.Status, result.Error = PingStatusUnauthorized, fmt.Sprintf("%v with credentials", res.Status)
+			return result
+		}
+		result.Status = PingStatusOK
+	default:
+		result.Status, result.Error = PingStatusError, res.Status
+	}
+	return result
+}
+
+func pingCommand(ctx context.Context, args []string) {
+	fs := commandFlags("ping")
+	fs.Parse(args)
+	regs := localConf.Registries
+	if fs.NArg() > 0 {
+		regs = nil
+		for _, arg := range fs.Args() {
+			regs = append(regs, resolveRegistries(arg)...)
+		}
+	}
+	if len(regs) == 0 {
+		fs.Usage()
+		exit(2)
+	}
+
+	results := make([]*PingResult, len(regs))
+	var wg sync.WaitGroup
+	now := time.Now()
+	for i, reg := range regs {
+		wg.Add(1)
+		go func(i int, reg *Registry) {
+			defer wg.Done()
+			results[i] = ping(ctx, reg, now)
+		}(i, reg)
+	}
+	wg.Wait()
+
+	failed := false
+	for _, r := range results {
+		failed = failed || r.Status != PingStatusOK
+	}
+	if *outputFlag == OutputTable {
+		for _, r := range results {
+			detail := r.Error
+			if detail == "" {
+				detail = fmt.Sprintf("%dms auth=%v", r.LatencyMs, r.Auth)
+				if r.CertExpiresIn != nil {
+					detail += fmt.Sprintf(" cert=%dd", *r.CertExpiresIn)
+				}
+			}
+			fmt.Printf("%-16v %-12v %v  %v\n", r.Registry, r.Status, r.Address, detail)
+		}
+	} else {
+		printJson(results)
+	}
+	if failed {
+		exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+var noProgressFlag = flag.Bool("no-progress", false, "do not show the progress of scans on a terminal")
+
+// progressTick is how often the progress line is redrawn.
+const progressTick = 200 * time.Millisecond
+
+// progressShown is set while a progress line is on the terminal; scans
+// running alongside it, as in serve, go without one.
+var progressShown int32
+
+// progressAllowed is false while something else draws on the terminal, as
+// browse does.
+var progressAllowed = true
+
+// scanProgress counts what a scan found so far and keeps it on a line of
+// stderr: repositories listed, manifests resolved out of the tags listed,
+// and errors.
+type scanProgress struct {
+	registry  string
+	repos     int64
+	tags      int64
+	manifests int64
+	errors    int64
+
+	logOutput io.Writer
+	stopOnce  sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// clearLine erases the progress line before each log line, which the next
+// tick draws again below it.
+type clearLine struct {
+	w io.Writer
+}
+
+func (c *clearLine) Write(p []byte) (int, error) {
+	io.WriteString(c.w, "\r\x1b[K")
+	return c.w.Write(p)
+}
+
+// startProgress shows the progress of a scan of registry when stderr is a
+// terminal, or returns nil.
+func startProgress(registry string) *scanProgress {
+	if *noProgressFlag || !progressAllowed || jsonLogger != nil || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&progressShown, 0, 1) {
+		return nil
+	}
+	p := &scanProgress{
+		registry:  registry,
+		logOutput: log.Writer(),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	log.SetOutput(&clearLine{w: p.logOutput})
+	go p.run()
+	return p
+}
+
+func (p *scanProgress) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(progressTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Fprintf(os.Stderr, "\r\x1b[K%v: %d repositories, %d/%d manifests, %d errors",
+				p.registry, atomic.LoadInt64(&p.repos), atomic.LoadInt64(&p.manifests), atomic.LoadInt64(&p.tags), atomic.LoadInt64(&p.errors))
+		case <-p.done:
+			fmt.Fprint(os.Stderr, "\r\x1b[K")
+			return
+		}
+	}
+}
+
+// count adds what r brings to the counters.
+func (p *scanProgress) count(r ScanResult) {
+	if p == nil {
+		return
+	}
+	switch r := r.(type) {
+	case *RepoList:
+		atomic.AddInt64(&p.repos, int64(len(r.Repos)))
+	case *TagList:
+		atomic.AddInt64(&p.tags, int64(len(r.Tags)))
+	case *ManifestInfo:
+		atomic.AddInt64(&p.manifests, 1)
+	case *FetchError:
+		atomic.AddInt64(&p.errors, 1)
+	}
+}
+
+// stop erases the progress line.
+func (p *scanProgress) stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() {
+		close(p.done)
+		<-p.stopped
+		log.SetOutput(p.logOutput)
+		atomic.StoreInt32(&progressShown, 0)
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PruneWouldDelete = "would-delete"
+	PruneDeleted     = "deleted"
+	PruneFailed      = "failed"
+)
+
+// PruneResult is a manifest that was, or would be, deleted along with every
+// tag pointing at it.
+type PruneResult struct {
+	Repo   string
+	Digest string
+	Tags   []string
+	Size   int64 `json:",omitempty"`
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// deleteManifest deletes the manifest of repo at digest. Registries only
+// delete by digest, which removes every tag pointing there.
+func deleteManifest(ctx context.Context, reg *Registry, repo string, digest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%v/v2/%v/manifests/%v", reg.Addr, reg.repository(repo), digest), nil)
+	if err != nil {
+		return err
+	}
+	return expectStatus(reg, req, http.StatusAccepted)
+}
+
+func checkDeletable(ctx context.Context, reg *Registry) {
+	if !reg.capabilities(ctx).Delete {
+		fatalf("%v does not allow deleting manifests", reg.name())
+	}
+}
+
+func deleteImages(ctx context.Context, args []string) {
+	fs := commandFlags("delete")
+	dryRun := fs.Bool("dry-run", false, "only show what would be deleted")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	if !*dryRun {
+		checkDeletable(ctx, reg)
+	}
+	var results []*PruneResult
+	failed := false
+	for _, ref := range fs.Args()[1:] {
+		repo, reference := parseReference(ref)
+		result := &PruneResult{Repo: repo, Digest: reference, Status: PruneWouldDelete}
+		results = append(results, result)
+		if !strings.Contains(reference, ":") {
+			digest, found, err := reg.registryClient(ctx).Digest(ctx, reg.repository(repo), reference)
+			if err == nil && !found {
+				err = fmt.Errorf("%v:%v not found", repo, reference)
+			}
+			if err != nil {
+				result.Status, result.Error, failed = PruneFailed, err.Error(), true
+				continue
+			}
+			result.Digest, result.Tags = digest, []string{reference}
+		}
+		if *dryRun {
+			continue
+		}
+		if err := deleteManifest(ctx, reg, repo, result.Digest); err != nil {
+			result.Status, result.Error, failed = PruneFailed, err.Error(), true
+			continue
+		}
+		result.Status = PruneDeleted
+	}
+	printJson(results)
+	if failed {
+		exit(1)
+	}
+}
+
+// pruneCandidates returns the manifests of repos that only tags beyond the
+// newest keep, created before cutoff and matching pattern, point at. The tags
+// of each repository must be sorted newest first.
+func pruneCandidates(repos map[string][]TagDetail, keep int, cutoff time.Time, pattern string) ([]*PruneResult, error) {
+	var results []*PruneResult
+	for _, repo := range sortedRepos(repos) {
+		kept := make(map[string]bool)
+		byDigest := make(map[string]*PruneResult)
+		var order []string
+		for i, tag := range repos[repo] {
+			match := true
+			if pattern != "" {
+				var err error
+				match, err = path.Match(pattern, tag.Tag)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if i < keep || !match || !time.Time(tag.Created).Before(cutoff) {
+				kept[tag.Digest] = true
+				continue
+			}
+			r, ok := byDigest[tag.Digest]
+			if !ok {
+				r = &PruneResult{Repo: repo, Digest: tag.Digest, Size: tag.Size, Status: PruneWouldDelete}
+				byDigest[tag.Digest] = r
+				order = append(order, tag.Digest)
+			}
+			r.Tags = append(r.Tags, tag.Tag)
+		}
+		for _, digest := range order {
+			if !kept[digest] {
+				sort.Strings(byDigest[digest].Tags)
+				results = append(results, byDigest[digest])
+			}
+		}
+	}
+	return results, nil
+}
+
+// pruneRules are the flags selecting what prune deletes, shared by the
+// commands estimating what pruning would free.
+type pruneRules struct {
+	keep      *int
+	olderThan *string
+	match     *string
+}
+
+func addPruneRules(fs *flag.FlagSet) *pruneRules {
+	return &pruneRules{
+		keep:      fs.Int("keep", 10, "newest tags of every repository to keep"),
+		olderThan: fs.String("older-than", "0s", "only delete tags older than this, such as 30d"),
+		match:     fs.String("match", "", "only delete tags matching this pattern, such as 'pr-*'"),
+	}
+}
+
+// check fails on an invalid age or pattern before anything is scanned.
+func (r *pruneRules) check() {
+	if _, err := parseAge(*r.olderThan); err != nil {
+		fatal(err)
+	}
+	if _, err := path.Match(*r.match, ""); err != nil {
+		fatalf("-match: %v", err)
+	}
+}
+
+func (r *pruneRules) candidates(repos map[string][]TagDetail) ([]*PruneResult, error) {
+	age, err := parseAge(*r.olderThan)
+	if err != nil {
+		return nil, err
+	}
+	return pruneCandidates(repos, *r.keep, time.Now().Add(-age), *r.match)
+}
+
+func prune(ctx context.Context, args []string) {
+	fs := commandFlags("prune")
+	rules := addPruneRules(fs)
+	yes := fs.Bool("yes", false, "delete instead of reporting what would be deleted")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		exit(2)
+	}
+	rules.check()
+	reg := resolveRegistry(fs.Arg(0))
+	if *yes {
+		checkDeletable(ctx, reg)
+	}
+	repos, errs := getRepoInfo(ctx, reg)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Println(e)
+		}
+		fatalf("not pruning %v: the scan is incomplete", reg.name())
+	}
+	results, err := rules.candidates(repos)
+	if err != nil {
+		fatal(err)
+	}
+	failed := false
+	if *yes {
+		for _, r := range results {
+			if err := deleteManifest(ctx, reg, r.Repo, r.Digest); err != nil {
+				r.Status, r.Error, failed = PruneFailed, err.Error(), true
+				continue
+			}
+			r.Status = PruneDeleted
+		}
+		if len(results) > 0 {
+			runHooks(ctx, reg, &HookEvent{Event: HookPruneExecuted, Pruned: results})
+		}
+	}
+	printJson(results)
+	if failed {
+		exit(1)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+const (
+	ociIndexFile       = "index.json"
+	dockerManifestFile = "manifest.json"
+	annotationRefName  = "org.opencontainers.image.ref.name"
+
+	mediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// imageLayout is an OCI image layout, as a directory or in a tarball, or a
+// tarball written by docker save.
+type imageLayout struct {
+	open func(name string) (*io.SectionReader, error)
+	// manifests are those made up for docker save output, by digest
+	manifests map[string][]byte
+	// blobs names the files of blobs not stored under blobs/<alg>/<hex>
+	blobs map[string]string
+	// images are the manifests the layout lists, with their tags
+	images []*layoutImage
+
+	files []*os.File
+}
+
+type layoutImage struct {
+	Tag        string
+	Descriptor registryclient.Descriptor
+}
+
+func (l *imageLayout) Close() {
+	for _, f := range l.files {
+		f.Close()
+	}
+}
+
+func (l *imageLayout) blob(digest string) (*io.SectionReader, error) {
+	name, ok := l.blobs[digest]
+	if !ok {
+		name = "blobs/" + strings.Replace(digest, ":", "/", 1)
+	}
+	r, err := l.open(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("blob %v is not in the layout", digest)
+	}
+	return r, err
+}
+
+func (l *imageLayout) manifest(digest string) ([]byte, error) {
+	if b, ok := l.manifests[digest]; ok {
+		return b, nil
+	}
+	r, err := l.blob(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (l *imageLayout) readJson(name string, v interface{}) error {
+	r, err := l.open(name)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+// openLayout opens the layout at p: a directory, or a tarball, compressed
+// with gzip or not, which is indexed so that its files are read in place.
+func openLayout(p string) (*imageLayout, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	l := &imageLayout{manifests: make(map[string][]byte), blobs: make(map[string]string)}
+	if info.IsDir() {
+		l.open = func(name string) (*io.SectionReader, error) {
+			f, err := os.Open(filepath.Join(p, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+			l.files = append(l.files, f)
+			info, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return io.NewSectionReader(f, 0, info.Size()), nil
+		}
+	} else {
+		f, err := openTarball(p)
+		if err != nil {
+			return nil, err
+		}
+		l.files = append(l.files, f)
+		entries, err := indexTarball(f)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+		l.open = func(name string) (*io.SectionReader, error) {
+			r, ok := entries[name]
+			if !ok {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+			}
+			return io.NewSectionReader(r, 0, r.Size()), nil
+		}
+	}
+
+	err = l.readImages()
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("%v: %v", p, err)
+	}
+	return l, nil
+}
+
+// openTarball opens the tarball at p, decompressing it to a temporary file
+// first if it is compressed, as files are read from it out of order.
+func openTarball(p string) (*os.File, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	magic, _ := bufio.NewReader(f).Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		_, err = f.Seek(0, io.SeekStart)
+		return f, err
+	}
+	defer f.Close()
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "push-")
+	if err != nil {
+		return nil, err
+	}
+	// the file stays readable until closed
+	os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, gz)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// indexTarball returns where each regular file of the tarball f is stored.
+// tar.Reader reads no further than the header of the current entry, so the
+// position of f is where its content starts.
+func indexTarball(f *os.File) (map[string]*io.SectionReader, error) {
+	entries := make(map[string]*io.SectionReader)
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		entries[path.Clean(h.Name)] = io.NewSectionReader(f, offset, h.Size)
+	}
+}
+
+// readImages lists the manifests of the layout: those of index.json, or
+// manifests made up for the images of docker save output.
+func (l *imageLayout) readImages() error {
+	var index struct {
+		Manifests []registryclient.Descriptor `json:"manifests"`
+	}
+	err := l.readJson(ociIndexFile, &index)
+	if err == nil {
+		for _, d := range index.Manifests {
+			l.images = append(l.images, &layoutImage{Tag: refTag(d.Annotations[annotationRefName]), Descriptor: d})
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	var saved []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	err = l.readJson(dockerManifestFile, &saved)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("neither an OCI image layout nor docker save output")
+	}
+	if err != nil {
+		return err
+	}
+	for _, image := range saved {
+		d, err := l.dockerSaveManifest(image.Config, image.Layers)
+		if err != nil {
+			return err
+		}
+		if len(image.RepoTags) == 0 {
+			l.images = append(l.images, &layoutImage{Descriptor: d})
+		}
+		for _, t := range image.RepoTags {
+			l.images = append(l.images, &layoutImage{Tag: refTag(t), Descriptor: d})
+		}
+	}
+	return nil
+}
+
+// dockerSaveManifest makes up an OCI manifest for an image of docker save
+// output. Its layers are uncompressed, so their digests are the diff ids of
+// the config.
+func (l *imageLayout) dockerSaveManifest(configName string, layerNames []string) (registryclient.Descriptor, error) {
+	var d registryclient.Descriptor
+	r, err := l.open(configName)
+	if err != nil {
+		return d, err
+	}
+	config, err := ioutil.ReadAll(r)
+	if err != nil {
+		return d, err
+	}
+	var v struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err = json.Unmarshal(config, &v); err != nil {
+		return d, fmt.Errorf("%v: %v", configName, err)
+	}
+	if len(v.RootFS.DiffIDs) != len(layerNames) {
+		return d, fmt.Errorf("%v: %d diff ids for %d layers", configName, len(v.RootFS.DiffIDs), len(layerNames))
+	}
+
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	l.blobs[configDigest] = configName
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     registryclient.MediaTypeOCIManifest,
+		"config": registryclient.Descriptor{
+			MediaType: registryclient.MediaTypeOCIImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+	}
+	var layers []registryclient.Descriptor
+	for i, name := range layerNames {
+		r, err := l.open(name)
+		if err != nil {
+			return d, err
+		}
+		l.blobs[v.RootFS.DiffIDs[i]] = name
+		layers = append(layers, registryclient.Descriptor{MediaType: mediaTypeOCILayer, Digest: v.RootFS.DiffIDs[i], Size: r.Size()})
+	}
+	manifest["layers"] = layers
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return d, err
+	}
+	d = registryclient.Descriptor{
+		MediaType: registryclient.MediaTypeOCIManifest,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(raw)),
+		Size:      int64(len(raw)),
+	}
+	l.manifests[d.Digest] = raw
+	return d, nil
+}
+
+// refTag returns the tag of a reference such as registry.example.org/app:1.0,
+// or the reference itself when it is a bare tag.
+func refTag(ref string) string {
+	if i := strings.LastIndex(ref, ":"); i >= 0 && !strings.Contains(ref[i:], "/") {
+		return ref[i+1:]
+	}
+	if strings.Contains(ref, "/") {
+		return ""
+	}
+	return ref
+}
+
+// PushResult is a manifest pushed from a layout, with how many of its blobs
+// were uploaded or mounted, and how many the registry already had.
+type PushResult struct {
+	Repo     string
+	Tag      string `json:",omitempty"`
+	Digest   string
+	Uploaded int
+	Existing int
+}
+
+type pusher struct {
+	reg       *Registry
+	layout    *imageLayout
+	repo      string
+	mountFrom string
+	chunkSize int64
+}
+
+// push uploads the manifest d under ref, after the blobs it refers to, or
+// the manifests of an index.
+func (p *pusher) push(ctx context.Context, d registryclient.Descriptor, ref string, result *PushResult) error {
+	raw, err := p.layout.manifest(d.Digest)
+	if err != nil {
+		return err
+	}
+	var m struct {
+		MediaType string                      `json:"mediaType"`
+		Config    *registryclient.Descriptor  `json:"config"`
+		Layers    []registryclient.Descriptor `json:"layers"`
+		Blobs     []registryclient.Descriptor `json:"blobs"`
+		Manifests []registryclient.Descriptor `json:"manifests"`
+	}
+	if err = json.Unmarshal(raw, &m); err != nil {
+		return fmt.Errorf("manifest %v: %v", d.Digest, err)
+	}
+	mediaType := d.MediaType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+
+	for _, child := range m.Manifests {
+		err = p.push(ctx, child, child.Digest, result)
+		if err != nil {
+			return err
+		}
+	}
+	blobs := append(m.Layers, m.Blobs...)
+	if m.Config != nil {
+		blobs = append([]registryclient.Descriptor{*m.Config}, blobs...)
+	}
+	for _, b := range blobs {
+		exists, err := blobExists(ctx, p.reg, p.repo, b.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			result.Existing++
+			continue
+		}
+		r, err := p.layout.blob(b.Digest)
+		if err != nil {
+			return err
+		}
+		err = uploadBlob(ctx, p.reg, p.repo, b.Digest, r, r.Size(), p.mountFrom, p.chunkSize)
+		if err != nil {
+			return err
+		}
+		result.Uploaded++
+	}
+	return putManifest(ctx, p.reg, p.repo, ref, mediaType, raw)
+}
+
+func push(ctx context.Context, args []string) {
+	fs := commandFlags("push")
+	chunkSize := fs.Int64("chunk-size", 64, "upload blobs larger than this many MiB in chunks of that size, 0 to upload each in one request")
+	mountFrom := fs.String("mount-from", "", "mount blobs from this repository of the registry where it has them instead of uploading")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		exit(2)
+	}
+	layout, err := openLayout(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer layout.Close()
+	reg := resolveRegistry(fs.Arg(1))
+	repo, tag := fs.Arg(2), ""
+	if i := strings.LastIndex(repo, ":"); i >= 0 && !strings.Contains(repo[i:], "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+
+	images := layout.images
+	if tag != "" {
+		// one image, pushed under the tag given
+		var chosen *layoutImage
+		for _, image := range images {
+			if len(images) == 1 || image.Tag == tag {
+				chosen = image
+			}
+		}
+		if chosen == nil {
+			fatalf("%v has %d images and none is tagged %v", fs.Arg(0), len(images), tag)
+		}
+		images = []*layoutImage{{Tag: tag, Descriptor: chosen.Descriptor}}
+	}
+	if len(images) == 0 {
+		fatalf("%v has no images", fs.Arg(0))
+	}
+
+	p := &pusher{reg: reg, layout: layout, repo: repo, mountFrom: *mountFrom, chunkSize: *chunkSize << 20}
+	var results []*PushResult
+	for _, image := range images {
+		ref := image.Tag
+		if ref == "" {
+			ref = image.Descriptor.Digest
+		}
+		result := &PushResult{Repo: repo, Tag: image.Tag, Digest: image.Descriptor.Digest}
+		err = p.push(ctx, image.Descriptor, ref, result)
+		if err != nil {
+			fatal(err)
+		}
+		results = append(results, result)
+	}
+	printJson(results)
+}
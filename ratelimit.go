@@ -0,0 +1,245 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second, holding
+// at most burst tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it may be used.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+	l.mu.Unlock()
+}
+
+// rateLimitTransport holds requests to the rate of its limiter. Like
+// slowDownTransport it wraps the retries, so that waiting for a token does
+// not count against the timeout of an attempt, and the retries of a
+// request, already spaced by their backoff, take no token of their own.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.limiter.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			t.limiter.cancel()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// rateLimitHeaders is what a response told about the rate limit of a
+// registry: Docker Hub sends RateLimit-Limit: 100;w=21600 and
+// RateLimit-Remaining: 76;w=21600, others X-RateLimit-* headers, and some a
+// reset time too.
+type rateLimitHeaders struct {
+	limit, remaining int
+	window           time.Duration
+	reset            time.Time
+}
+
+// parseRateLimitHeaders parses the rate limit headers of h, if it has any.
+func parseRateLimitHeaders(h http.Header, now time.Time) (rateLimitHeaders, bool) {
+	var r rateLimitHeaders
+	remaining, ok := rateLimitHeader(h, "Remaining")
+	if !ok {
+		return r, false
+	}
+	r.remaining, r.window = remaining.n, remaining.window
+	if limit, ok := rateLimitHeader(h, "Limit"); ok {
+		r.limit = limit.n
+		if r.window == 0 {
+			r.window = limit.window
+		}
+	}
+	// the reset is in seconds from now, or a unix time as GitHub sends it
+	if reset, ok := rateLimitHeader(h, "Reset"); ok && reset.n >= 0 {
+		if reset.n > 1e9 {
+			r.reset = time.Unix(int64(reset.n), 0)
+		} else {
+			r.reset = now.Add(time.Duration(reset.n) * time.Second)
+		}
+	}
+	return r, true
+}
+
+type rateLimitValue struct {
+	n      int
+	window time.Duration
+}
+
+// rateLimitHeader parses RateLimit-<name>, or X-RateLimit-<name>, as a
+// number followed by optional parameters, of which w is the window in
+// seconds.
+func rateLimitHeader(h http.Header, name string) (rateLimitValue, bool) {
+	var v rateLimitValue
+	value := h.Get("RateLimit-" + name)
+	if value == "" {
+		value = h.Get("X-RateLimit-" + name)
+	}
+	if value == "" {
+		return v, false
+	}
+	parts := strings.Split(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return v, false
+	}
+	v.n = n
+	for _, param := range parts[1:] {
+		if w := strings.TrimPrefix(strings.TrimSpace(param), "w="); w != strings.TrimSpace(param) {
+			if seconds, err := strconv.Atoi(w); err == nil {
+				v.window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return v, true
+}
+
+// quota is what the responses of a registry told about its rate limit.
+// Once fewer than minRemaining requests remain, requests are sent one at a
+// time, spread over what is left of the window, so that a scan does not use
+// up the quota and lock out everyone else sharing it until the window
+// resets.
+type quota struct {
+	registry     string
+	minRemaining int
+
+	// turn is held by the request in flight while slowed
+	turn chan struct{}
+
+	mu       sync.Mutex
+	slowed   bool
+	interval time.Duration
+	next     time.Time
+}
+
+func newQuota(registry string, minRemaining int) *quota {
+	return &quota{registry: registry, minRemaining: minRemaining, turn: make(chan struct{}, 1)}
+}
+
+// observe slows the requests down once fewer than minRemaining remain, to
+// as many as remain over the rest of the window, or the whole window when
+// the registry does not tell when it resets.
+func (q *quota) observe(limits rateLimitHeaders, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if limits.remaining >= q.minRemaining {
+		q.slowed = false
+		return
+	}
+	span := limits.window
+	if !limits.reset.IsZero() {
+		span = limits.reset.Sub(now)
+	}
+	q.interval = 0
+	if span > 0 {
+		q.interval = span / time.Duration(limits.remaining+1)
+	}
+	if !q.slowed {
+		logEvent(LevelWarn, logFields{Registry: q.registry}, "%v: %d requests of the rate limit remain, sending one every %v", q.registry, limits.remaining, q.interval.Round(time.Second))
+	}
+	q.slowed = true
+	q.next = now.Add(q.interval)
+}
+
+// quotaTransport records the rate limit headers of every response, retries
+// included, in the stats of the run and its quota.
+type quotaTransport struct {
+	base  http.RoundTripper
+	quota *quota
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	limits, ok := parseRateLimitHeaders(res.Header, now)
+	requestStats.rateLimit(t.quota.registry, limits, ok, res.StatusCode == http.StatusTooManyRequests)
+	if ok && t.quota.minRemaining > 0 {
+		t.quota.observe(limits, now)
+	}
+	return res, nil
+}
+
+// slowDownTransport holds requests back while their quota is slowed. It
+// wraps the retries, so that waiting for a turn does not count against the
+// timeout of an attempt.
+type slowDownTransport struct {
+	base  http.RoundTripper
+	quota *quota
+}
+
+func (t *slowDownTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := t.quota
+	q.mu.Lock()
+	slowed := q.slowed
+	q.mu.Unlock()
+	if !slowed {
+		return t.base.RoundTrip(req)
+	}
+	ctx := req.Context()
+	select {
+	case q.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-q.turn }()
+	q.mu.Lock()
+	wait := time.Until(q.next)
+	q.mu.Unlock()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	requestStats.slowedDown(q.registry)
+	return t.base.RoundTrip(req)
+}
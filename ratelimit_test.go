@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := newRateLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("request %d of the burst waits %v", i, wait)
+		}
+	}
+	// the bucket is empty: the next tokens come every 100ms
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if wait := l.reserve(); wait < want-10*time.Millisecond || wait > want {
+			t.Errorf("request %d waits %v, want about %v", i+3, wait, want)
+		}
+	}
+	l.cancel()
+	l.cancel()
+	if wait := l.reserve(); wait > 100*time.Millisecond {
+		t.Errorf("canceled reservations not given back: waits %v", wait)
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	for _, tt := range []struct {
+		rate float64
+		want float64
+	}{{0.5, 1}, {1, 1}, {2.5, 3}} {
+		if l := newRateLimiter(tt.rate, 0); l.burst != tt.want {
+			t.Errorf("burst of rate %v = %v, want %v", tt.rate, l.burst, tt.want)
+		}
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var sent []time.Time
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, time.Now())
+		return okResponse(req)
+	})
+	transport := &rateLimitTransport{base: base, limiter: newRateLimiter(20, 1)}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// one request right away, then one every 50ms
+	if elapsed := sent[len(sent)-1].Sub(start); elapsed < 190*time.Millisecond {
+		t.Errorf("5 requests at 20/s sent within %v", elapsed)
+	}
+}
+
+func TestRateLimitTransportCanceled(t *testing.T) {
+	transport := &rateLimitTransport{base: roundTripFunc(okResponse), limiter: newRateLimiter(0.1, 1)}
+	req, _ := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+	transport.RoundTrip(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := transport.RoundTrip(req.WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the wait to end with the context", err)
+	}
+	if wait := transport.limiter.reserve(); wait > 10*time.Second {
+		t.Errorf("the canceled request kept its token: next waits %v", wait)
+	}
+}
+
+// TestRateLimitOutsideRetries checks that waiting for the limiter does not
+// use up the timeout of an attempt, and that retries take no tokens.
+func TestRateLimitOutsideRetries(t *testing.T) {
+	f := &flakyServer{statuses: []int{503}, header: http.Header{"Retry-After": {"0"}}}
+	s := f.serve(t)
+	retries := 1
+	reg := &Registry{Addr: s.URL, RateLimit: 5, Burst: 1, Retries: &retries, timeout: 100 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		res, err := reg.client().Get(s.URL + "/v2/")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("request %d: %v", i, res.Status)
+		}
+	}
+	if len(f.bodies) != 4 {
+		t.Errorf("%d requests sent, want 3 and a retry", len(f.bodies))
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+var (
+	recordFlag = flag.String("record", "", "write every request and response of the run to this file, for -replay")
+	replayFlag = flag.String("replay", "", "answer requests from a file written by -record instead of the registries")
+)
+
+// recordedHeaders are the response headers kept in a recording; the rest,
+// cookies in particular, are left out.
+var recordedHeaders = []string{
+	"Content-Type",
+	"Docker-Content-Digest",
+	"Docker-Distribution-Api-Version",
+	"ETag",
+	"Last-Modified",
+	"Link",
+	"Location",
+}
+
+// Recording lists the exact requests a run made and what the registries
+// answered, along with the tool version and config they were made with, so
+// that the run can be audited and replayed to the same output.
+type Recording struct {
+	Version    string
+	ConfigHash string
+	Args       []string
+	Created    JsonTime
+	Exchanges  []*Exchange
+}
+
+type Exchange struct {
+	Method string
+	URL    string
+	Accept string      `json:",omitempty"`
+	Status int         `json:",omitempty"`
+	Header http.Header `json:",omitempty"`
+	Digest string      `json:",omitempty"`
+	ETag   string      `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+	Body   []byte      `json:",omitempty"`
+}
+
+func (e *Exchange) key() string {
+	return e.Method + " " + e.URL + " " + e.Accept
+}
+
+var (
+	recording  *Recording
+	recordMu   sync.Mutex
+	recordOnce sync.Once
+	replaying  *replayTransport
+)
+
+func toolVersion() string {
+	if version == "dev" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return version
+}
+
+func configHash() string {
+	b, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+// startRecording sets up -record or -replay. When replaying without
+// arguments, those of the recorded run are used.
+func startRecording(args []string) []string {
+	switch {
+	case *recordFlag != "" && *replayFlag != "":
+		fatal("-record and -replay cannot be combined")
+	case *recordFlag != "":
+		recording = &Recording{
+			Version:    toolVersion(),
+			ConfigHash: configHash(),
+			Args:       args,
+			Created:    JsonTime(time.Now()),
+		}
+	case *replayFlag != "":
+		rec, err := readRecording(*replayFlag)
+		if err != nil {
+			fatal(err)
+		}
+		if rec.Version != toolVersion() {
+			log.Printf("replaying a recording made by version %v with %v", rec.Version, toolVersion())
+		}
+		if rec.ConfigHash != configHash() {
+			log.Printf("replaying a recording made with a different config")
+		}
+		replaying = newReplayTransport(rec)
+		if len(args) == 0 {
+			args = rec.Args
+		}
+	}
+	httpClient.Transport = interceptTransport(httpClient.Transport)
+	return args
+}
+
+// interceptTransport records the exchanges of rt, or replaces rt by the
+// replay, as requested.
+func interceptTransport(rt http.RoundTripper) http.RoundTripper {
+	switch {
+	case replaying != nil:
+		return replaying
+	case recording != nil:
+		return &recordTransport{base: rt}
+	}
+	return rt
+}
+
+// finishRecording writes the recording, if any, once.
+func finishRecording() {
+	recordOnce.Do(func() {
+		if recording == nil {
+			return
+		}
+		recordMu.Lock()
+		defer recordMu.Unlock()
+		sort.SliceStable(recording.Exchanges, func(i, j int) bool {
+			return recording.Exchanges[i].key() < recording.Exchanges[j].key()
+		})
+		j, err := marshalJson(recording)
+		if err == nil {
+			err = ioutil.WriteFile(*recordFlag, j, 0600)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// atExit are run in order when the run ends, by exit or by returning from main.
+var (
+	atExit   = []func(){finishRecording}
+	exitOnce sync.Once
+)
+
+func finish() {
+	exitOnce.Do(func() {
+		for _, f := range atExit {
+			f()
+		}
+	})
+}
+
+// exitCode is the code the run ends with, for atExit to look at.
+var exitCode int
+
+// exit ends the run with code, writing the recording first.
+func exit(code int) {
+	exitCode = code
+	finish()
+	os.Exit(code)
+}
+
+func readRecording(path string) (*Recording, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &rec, nil
+}
+
+type recordTransport struct {
+	base http.RoundTripper
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := &Exchange{Method: req.Method, URL: req.URL.String(), Accept: req.Header.Get("Accept")}
+	defer func() {
+		recordMu.Lock()
+		recording.Exchanges = append(recording.Exchanges, ex)
+		recordMu.Unlock()
+	}()
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		ex.Error = err.Error()
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		ex.Error = err.Error()
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	ex.Status = res.StatusCode
+	ex.Header = http.Header{}
+	for _, k := range recordedHeaders {
+		if v, ok := res.Header[http.CanonicalHeaderKey(k)]; ok {
+			ex.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	ex.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	ex.ETag = res.Header.Get("ETag")
+	ex.Body = body
+	return res, nil
+}
+
+// replayTransport answers each request with the next recorded exchange for
+// it, checking that the recorded body still matches its digest.
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+}
+
+func newReplayTransport(rec *Recording) *replayTransport {
+	t := &replayTransport{exchanges: make(map[string][]*Exchange)}
+	for _, ex := range rec.Exchanges {
+		t.exchanges[ex.key()] = append(t.exchanges[ex.key()], ex)
+	}
+	return t
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := (&Exchange{Method: req.Method, URL: req.URL.String(), Accept: req.Header.Get("Accept")}).key()
+	t.mu.Lock()
+	queue := t.exchanges[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%v %v was not recorded", req.Method, req.URL)
+	}
+	ex := queue[0]
+	if len(queue) > 1 {
+		t.exchanges[key] = queue[1:]
+	}
+	t.mu.Unlock()
+
+	if ex.Error != "" {
+		return nil, errors.New(ex.Error)
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(ex.Body)); digest != ex.Digest {
+		return nil, fmt.Errorf("recorded response of %v %v does not match its digest %v", req.Method, req.URL, ex.Digest)
+	}
+	header := http.Header{}
+	for k, v := range ex.Header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %v", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: int64(len(ex.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,285 @@
+package registryclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialFunc returns the username and password presented to a registry
+// or its token service. Empty credentials mean anonymous access.
+type CredentialFunc func() (username string, password string, err error)
+
+type bearerToken struct {
+	token  string
+	expiry time.Time
+}
+
+// TokenStore keeps bearer tokens beyond the life of a transport, e.g. on
+// disk so that later runs skip the challenge round trips. Tokens are loaded
+// and stored by the scope they were issued for.
+type TokenStore interface {
+	Load(scope string) (token string, expiry time.Time, ok bool)
+	Store(scope string, token string, expiry time.Time)
+}
+
+// tokenTransport answers the registry's WWW-Authenticate challenges, either
+// with basic auth or with a bearer token obtained from the challenge realm.
+// Tokens are cached per scope so only the first request of a scope pays for
+// the challenge round trip.
+type tokenTransport struct {
+	base        http.RoundTripper
+	credentials CredentialFunc
+	store       TokenStore
+
+	mu     sync.Mutex
+	basic  bool
+	tokens map[string]bearerToken
+}
+
+// NewTokenTransport returns a transport answering the authentication
+// challenges of registries with the given credentials, which may be nil for
+// anonymous access.
+func NewTokenTransport(base http.RoundTripper, credentials CredentialFunc) http.RoundTripper {
+	return NewTokenTransportWithStore(base, credentials, nil)
+}
+
+// NewTokenTransportWithStore is NewTokenTransport with the tokens also
+// looked up in and added to store, which may be nil.
+func NewTokenTransportWithStore(base http.RoundTripper, credentials CredentialFunc, store TokenStore) http.RoundTripper {
+	return &tokenTransport{
+		base:        base,
+		credentials: credentials,
+		store:       store,
+		tokens:      make(map[string]bearerToken),
+	}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope := scopeOf(req)
+	authorized, err := t.authorize(req, scope)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.base.RoundTrip(authorized)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	scheme, params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		t.mu.Lock()
+		t.basic = true
+		t.mu.Unlock()
+	case "bearer":
+		token, err := t.fetchToken(req.Context(), params)
+		if err != nil {
+			return res, nil
+		}
+		t.mu.Lock()
+		t.tokens[scope] = token
+		t.mu.Unlock()
+		if t.store != nil {
+			t.store.Store(scope, token.token, token.expiry)
+		}
+	default:
+		return res, nil
+	}
+
+	retry, err := Rewind(req)
+	if err != nil {
+		return res, nil
+	}
+	res.Body.Close()
+	retry, err = t.authorize(retry, scope)
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(retry)
+}
+
+func (t *tokenTransport) authorize(req *http.Request, scope string) (*http.Request, error) {
+	if redirectedAway(req) {
+		return req, nil
+	}
+	t.mu.Lock()
+	basic := t.basic
+	token, ok := t.tokens[scope]
+	t.mu.Unlock()
+	if !ok && !basic && t.store != nil {
+		token.token, token.expiry, ok = t.store.Load(scope)
+		if ok {
+			t.mu.Lock()
+			t.tokens[scope] = token
+			t.mu.Unlock()
+		}
+	}
+
+	if ok && time.Now().Before(token.expiry) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token.token)
+	} else if basic && t.credentials != nil {
+		username, password, err := t.credentials()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(username, password)
+	}
+	return req, nil
+}
+
+// redirectedAway reports whether req follows a redirect to another host
+// than the registry the first request went to, such as the S3 bucket or CDN
+// serving its blobs. The credentials of the registry are not sent there: it
+// would leak them, and presigned urls reject another Authorization header.
+func redirectedAway(req *http.Request) bool {
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	return first != req && !strings.EqualFold(first.URL.Host, req.URL.Host)
+}
+
+func (t *tokenTransport) fetchToken(ctx context.Context, params map[string]string) (token bearerToken, err error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return token, fmt.Errorf("bearer challenge without realm")
+	}
+	q := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return
+	}
+	if t.credentials != nil {
+		username, password, err := t.credentials()
+		if err != nil {
+			return token, err
+		}
+		if username != "" || password != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("token request to %v: %v: %s", realm, res.Status, strings.TrimSpace(string(buf)))
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(buf, &body)
+	if err != nil {
+		return
+	}
+	token.token = body.Token
+	if token.token == "" {
+		token.token = body.AccessToken
+	}
+	if body.ExpiresIn == 0 {
+		body.ExpiresIn = 60
+	}
+	// leave some slack so a token does not expire in flight
+	token.expiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - 10*time.Second)
+	return
+}
+
+// scopeOf derives the token scope a request needs, which is also the key
+// tokens are cached under.
+func scopeOf(req *http.Request) string {
+	p := req.URL.Path
+	if i := strings.Index(p, "/v2/"); i >= 0 {
+		// registries may be served below a path prefix
+		p = p[i+len("/v2/"):]
+	}
+	if p == "_catalog" {
+		return "registry:catalog:*"
+	}
+	actions := "pull"
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions {
+		actions = "pull,push"
+	}
+	for _, sep := range []string{"/tags/", "/manifests/", "/blobs/", "/referrers/"} {
+		if i := strings.LastIndex(p, sep); i > 0 {
+			return fmt.Sprintf("repository:%v:%v", p[:i], actions)
+		}
+	}
+	return ""
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// Bearer realm="https://auth.example.org/token",service="registry",scope="repository:a/b:pull"
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[key] = value
+	}
+	return
+}
+
+// Rewind returns a copy of req that can be sent again.
+func Rewind(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot resend %v %v", req.Method, req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
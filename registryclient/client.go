@@ -0,0 +1,199 @@
+// Package registryclient walks a registry that serves the docker
+// distribution API: its catalog, the tags of its repositories and their
+// manifests and image configs.
+//
+//	c := registryclient.New("https://registry.example.org", nil)
+//	repos, err := c.Catalog(ctx)
+//	...
+//	repo, err := c.Repo(ctx, repos[0])
+package registryclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+const (
+	MediaTypeManifestV1   = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeManifestV2   = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	// MediaTypeOCIArtifact is the artifact manifest of OCI 1.1 release
+	// candidates, still served by registries that stored some.
+	MediaTypeOCIArtifact = "application/vnd.oci.artifact.manifest.v1+json"
+
+	MediaTypeImageConfig    = "application/vnd.docker.container.image.v1+json"
+	MediaTypeOCIImageConfig = "application/vnd.oci.image.config.v1+json"
+)
+
+// ImageManifestTypes are the manifest types accepted unless told otherwise:
+// those of a single image or artifact.
+var ImageManifestTypes = []string{MediaTypeManifestV2, MediaTypeOCIManifest, MediaTypeManifestV1, MediaTypeOCIArtifact}
+
+// IndexManifestTypes are the types of manifests listing the manifests of
+// several platforms.
+var IndexManifestTypes = []string{MediaTypeManifestList, MediaTypeOCIIndex}
+
+// tagManifestTypes are the manifest types a tag may point at. Registries
+// answer a tag of an index with another manifest, or not at all, unless the
+// index types are accepted.
+var tagManifestTypes = append(append([]string(nil), IndexManifestTypes...), ImageManifestTypes...)
+
+// Client talks to one registry. Its fields may be changed until it is first
+// used; it is safe for concurrent use after that.
+type Client struct {
+	// Addr is the base URL of the registry, such as
+	// https://registry.example.org:5000. It may include a path for
+	// registries served below one.
+	Addr string
+
+	// HTTPClient sends the requests. It is expected to authenticate them,
+	// as a client using NewTokenTransport does.
+	HTTPClient *http.Client
+
+	// PageSize is the number of tags asked for per page of Tags, or 0 to
+	// leave it to the registry, for registries that do not paginate.
+	PageSize int
+
+	// NoHead makes Digest GET manifests, for registries that do not answer
+	// HEAD requests on them.
+	NoHead bool
+
+	// NoReferrers makes Referrers only look for the fallback tag, for
+	// registries known not to serve the referrers API.
+	NoReferrers bool
+}
+
+// New returns a client for the registry at addr. With a nil httpClient,
+// requests go out through http.DefaultTransport answering token challenges
+// anonymously.
+func New(addr string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Transport: NewTokenTransport(http.DefaultTransport, nil)}
+	}
+	return &Client{Addr: strings.TrimSuffix(addr, "/"), HTTPClient: httpClient}
+}
+
+// StatusError is returned for a response with an unexpected status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v: %v: %v", e.Method, e.URL, e.Status, e.Body)
+}
+
+func (c *Client) url(format string, args ...interface{}) string {
+	return c.Addr + fmt.Sprintf(format, args...)
+}
+
+// do sends req and returns the body of a 2xx response.
+func (c *Client) do(req *http.Request) (*http.Response, []byte, error) {
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res, body, &StatusError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	if err != nil {
+		return res, nil, err
+	}
+	return res, body, nil
+}
+
+// getJson decodes the response to a GET of url into v and returns the url of
+// the next page, if any.
+func (c *Client) getJson(ctx context.Context, url string, v interface{}) (next string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	res, body, err := c.do(req)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return "", fmt.Errorf("GET %v: %v", url, err)
+	}
+	return NextLink(url, res.Header), nil
+}
+
+// Catalog lists the repositories of the registry, following pagination.
+// Most registries only serve the catalog to administrators.
+func (c *Client) Catalog(ctx context.Context) ([]string, error) {
+	var repos []string
+	for url := c.url("/v2/_catalog"); url != ""; {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		var err error
+		url, err = c.getJson(ctx, url, &page)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, page.Repositories...)
+	}
+	return repos, nil
+}
+
+// Tags lists the tags of repo, following pagination.
+func (c *Client) Tags(ctx context.Context, repo string) ([]string, error) {
+	url := c.url("/v2/%v/tags/list", repo)
+	if c.PageSize > 0 {
+		url += fmt.Sprintf("?n=%d", c.PageSize)
+	}
+	var tags []string
+	for url != "" {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		var err error
+		url, err = c.getJson(ctx, url, &page)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+	}
+	return tags, nil
+}
+
+// NextLink resolves the rel="next" Link header against the requested url.
+func NextLink(current string, header http.Header) string {
+	link := header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	base, err := neturl.Parse(current)
+	if err != nil {
+		return ""
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return next.String()
+}
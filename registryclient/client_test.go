@@ -0,0 +1,199 @@
+package registryclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient/registrytest"
+)
+
+var created = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestCatalogAndTagsPaginate(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.PageSize = 2
+	for _, repo := range []string{"team-a/app", "team-a/web", "team-b/api"} {
+		for _, tag := range []string{"v1", "v2", "v3"} {
+			s.AddImage(repo, tag, registrytest.Image{Created: created, Layers: []int64{10}})
+		}
+	}
+	s.AddRepo("team-b/old")
+	ctx := context.Background()
+	c := registryclient.New(s.URL, nil)
+
+	repos, err := c.Catalog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"team-a/app", "team-a/web", "team-b/api", "team-b/old"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("catalog %v, want %v", repos, want)
+	}
+	if n := s.Requests()["GET /v2/_catalog"]; n != 2 {
+		t.Errorf("catalog read in %d pages, want 2", n)
+	}
+
+	c.PageSize = 1
+	tags, err := c.Tags(ctx, "team-a/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+	if want := []string{"v1", "v2", "v3"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags %v, want %v", tags, want)
+	}
+	if n := s.Requests()["GET /v2/team-a/app/tags/list"]; n != 3 {
+		t.Errorf("tags read in %d pages, want 3", n)
+	}
+	if tags, err := c.Tags(ctx, "team-b/old"); err != nil || len(tags) != 0 {
+		t.Errorf("tags of a repository without tags: %v, %v", tags, err)
+	}
+}
+
+func TestTagOfEverySchema(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	const chart = "application/vnd.cncf.helm.config.v1+json"
+	images := map[string]registrytest.Image{
+		"schema2":  {Schema: registrytest.Schema2, Created: created, Layers: []int64{100, 20}},
+		"oci":      {Schema: registrytest.OCI, Created: created, Layers: []int64{100, 20}},
+		"schema1":  {Schema: registrytest.Schema1, Created: created, Layers: []int64{100, 20}},
+		"artifact": {Schema: registrytest.OCI, Layers: []int64{5}, ArtifactType: chart},
+	}
+	digests := make(map[string]string)
+	for tag, img := range images {
+		digests[tag] = s.AddImage("app", tag, img)
+	}
+	c := registryclient.New(s.URL, nil)
+	for tag, img := range images {
+		got, err := c.Tag(context.Background(), "app", tag)
+		if err != nil {
+			t.Errorf("%v: %v", tag, err)
+			continue
+		}
+		if got.Name != tag || got.Digest != digests[tag] {
+			t.Errorf("%v: tag %v@%v, want %v@%v", tag, got.Name, got.Digest, tag, digests[tag])
+		}
+		if !got.Created.Equal(img.Created) {
+			t.Errorf("%v: created %v, want %v", tag, got.Created, img.Created)
+		}
+		if img.ArtifactType != got.ArtifactType {
+			t.Errorf("%v: artifact type %q, want %q", tag, got.ArtifactType, img.ArtifactType)
+		}
+		var layers int64
+		for _, size := range img.Layers {
+			layers += size
+		}
+		if img.Schema != registrytest.Schema1 && (len(got.Blobs) != len(img.Layers)+1 || got.Size <= layers) {
+			t.Errorf("%v: %d blobs of %d bytes, want the config and %d layers", tag, len(got.Blobs), got.Size, len(img.Layers))
+		}
+	}
+}
+
+func TestTagOfIndex(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	armCreated := created.Add(time.Hour)
+	for _, tc := range []struct {
+		schema    int
+		mediaType string
+	}{
+		{registrytest.Schema2, registryclient.MediaTypeManifestList},
+		{registrytest.OCI, registryclient.MediaTypeOCIIndex},
+	} {
+		tag := tc.mediaType
+		digest := s.AddIndex("app", "multi", registrytest.Image{Schema: tc.schema, Created: armCreated, Architecture: "arm64", Layers: []int64{50}},
+			registrytest.Image{Schema: tc.schema, Created: created, Layers: []int64{100, 20}, Labels: map[string]string{"team": "a"}})
+		c := registryclient.New(s.URL, nil)
+		got, err := c.Tag(context.Background(), "app", "multi")
+		if err != nil {
+			t.Errorf("%v: %v", tag, err)
+			continue
+		}
+		if got.Digest != digest || got.MediaType != tc.mediaType {
+			t.Errorf("%v: %v of type %v, want the index %v", tag, got.Digest, got.MediaType, digest)
+		}
+		if !got.Created.Equal(created) || got.Labels["team"] != "a" || len(got.Blobs) != 3 {
+			t.Errorf("%v: created %v, labels %v, %d blobs, want those of linux/amd64", tag, got.Created, got.Labels, len(got.Blobs))
+		}
+		if d, found, err := c.Digest(context.Background(), "app", "multi"); err != nil || !found || d != digest {
+			t.Errorf("%v: digest %v, %v, %v, want the index %v", tag, d, found, err, digest)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	digest := s.AddImage("app", "v1", registrytest.Image{Created: created})
+	c := registryclient.New(s.URL, nil)
+	for _, noHead := range []bool{false, true} {
+		c.NoHead = noHead
+		got, found, err := c.Digest(context.Background(), "app", "v1")
+		if err != nil || !found || got != digest {
+			t.Errorf("NoHead %v: %v, %v, %v, want %v", noHead, got, found, err, digest)
+		}
+		if _, found, err := c.Digest(context.Background(), "app", "v2"); err != nil || found {
+			t.Errorf("NoHead %v: missing tag found: %v, %v", noHead, found, err)
+		}
+	}
+	if s.Requests()["HEAD /v2/app/manifests/v1"] != 1 || s.Requests()["GET /v2/app/manifests/v1"] != 1 {
+		t.Errorf("requests %v, want one HEAD and one GET of the manifest", s.Requests())
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.AddImage("team-a/app", "v1", registrytest.Image{Created: created})
+	s.RequireToken("ci", "s3cret")
+
+	anonymous := registryclient.New(s.URL, nil)
+	_, err := anonymous.Tags(context.Background(), "team-a/app")
+	var statusErr *registryclient.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous client: %v, want 401", err)
+	}
+
+	before := s.Requests()["GET /token"]
+	credentials := func() (string, string, error) { return "ci", "s3cret", nil }
+	c := registryclient.New(s.URL, &http.Client{Transport: registryclient.NewTokenTransport(http.DefaultTransport, credentials)})
+	repo, err := c.Repo(context.Background(), "team-a/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.Tags) != 1 || repo.Tags[0].Name != "v1" {
+		t.Errorf("repo %+v", repo)
+	}
+	if n := s.Requests()["GET /token"] - before; n != 1 {
+		t.Errorf("%d tokens fetched, want one for the repository", n)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.AddImage("app", "v1", registrytest.Image{Created: created})
+	s.AddImage("app", "v2", registrytest.Image{Created: created.Add(time.Hour)})
+	s.Fail("/v2/app/manifests/v2", http.StatusInternalServerError, 1)
+
+	c := registryclient.New(s.URL, nil)
+	repo, err := c.Repo(context.Background(), "app")
+	var statusErr *registryclient.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("error %v, want the injected 500", err)
+	}
+	if repo == nil || len(repo.Tags) != 1 || repo.Tags[0].Name != "v1" {
+		t.Errorf("repo %+v, want the tag that could be fetched", repo)
+	}
+	// the failure was injected once
+	if _, err := c.Tag(context.Background(), "app", "v2"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,465 @@
+package registryclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Blob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Descriptor is an entry of a manifest list or OCI index. ArtifactType and
+// Annotations are set on the entries returned by Referrers.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Platform     *Platform         `json:"platform,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *Platform) String() string {
+	if p == nil || p.OS == "" && p.Architecture == "" {
+		return ""
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Manifest is a manifest as served, along with what was decoded from it:
+// the config and layers of a schema2 or OCI image, the manifests of an
+// index, or the creation time of a schema1 image.
+type Manifest struct {
+	MediaType string
+	Digest    string
+	Raw       []byte
+
+	Config    *Blob
+	Layers    []Blob
+	Manifests []Descriptor
+
+	// ArtifactType is set for manifests of something else than a container
+	// image, such as a Helm chart: the artifactType of the manifest, or else
+	// the media type of its config.
+	ArtifactType string
+	Annotations  map[string]string
+
+	// Created and Architecture are only known from schema1 manifests
+	// without fetching the config.
+	Created      time.Time
+	Architecture string
+	// History is the build history of a schema1 image, oldest first, with
+	// the blob of each layer; schema2 and OCI images keep it in their config.
+	History []HistoryEntry
+}
+
+// HistoryEntry is a step of the build of an image: the command that made a
+// layer, or only changed the config when EmptyLayer is set. Layer is only
+// known for schema1 images, whose history is in the manifest.
+type HistoryEntry struct {
+	Created    time.Time
+	CreatedBy  string
+	Comment    string
+	EmptyLayer bool
+	Layer      *Blob
+}
+
+// IsIndex reports whether m lists the manifests of several platforms.
+func (m *Manifest) IsIndex() bool {
+	return m.Manifests != nil
+}
+
+// IsArtifact reports whether m is the manifest of something else than a
+// container image.
+func (m *Manifest) IsArtifact() bool {
+	return m.ArtifactType != ""
+}
+
+// Blobs returns the config blob followed by the layers, or the blobs of an
+// artifact manifest without a config.
+func (m *Manifest) Blobs() []Blob {
+	if m.Config == nil {
+		return m.Layers
+	}
+	return append([]Blob{*m.Config}, m.Layers...)
+}
+
+// AnnotatedCreated returns when the annotations of m say it was created, if
+// they do.
+func (m *Manifest) AnnotatedCreated() time.Time {
+	created, _ := time.Parse(time.RFC3339Nano, m.Annotations["org.opencontainers.image.created"])
+	return created
+}
+
+// Manifest fetches the manifest of repo at ref, a tag or digest, accepting
+// the given media types, ImageManifestTypes by default.
+func (c *Client) Manifest(ctx context.Context, repo string, ref string, accept ...string) (*Manifest, error) {
+	if len(accept) == 0 {
+		accept = ImageManifestTypes
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/v2/%v/manifests/%v", repo, ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	res, body, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		MediaType: res.Header.Get("Content-Type"),
+		Digest:    res.Header.Get("Docker-Content-Digest"),
+		Raw:       body,
+	}
+	if m.Digest == "" {
+		m.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	err = m.decode()
+	if err != nil {
+		return nil, fmt.Errorf("%v@%v: %v", repo, m.Digest, err)
+	}
+	return m, nil
+}
+
+func (m *Manifest) decode() error {
+	var v struct {
+		MediaType    string `json:"mediaType"`
+		ArtifactType string `json:"artifactType"`
+		Architecture string `json:"architecture"`
+		Config       *struct {
+			MediaType string `json:"mediaType"`
+			Blob
+		} `json:"config"`
+		Layers      []Blob            `json:"layers"`
+		Blobs       []Blob            `json:"blobs"`
+		Manifests   []Descriptor      `json:"manifests"`
+		Annotations map[string]string `json:"annotations"`
+		History     []struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		} `json:"history"`
+		FSLayers []struct {
+			BlobSum string `json:"blobSum"`
+		} `json:"fsLayers"`
+	}
+	err := json.Unmarshal(m.Raw, &v)
+	if err != nil {
+		return err
+	}
+	if m.MediaType == "" {
+		m.MediaType = v.MediaType
+	}
+	m.ArtifactType, m.Annotations = v.ArtifactType, v.Annotations
+	switch {
+	case v.Manifests != nil:
+		m.Manifests = v.Manifests
+	case v.Config != nil:
+		m.Config, m.Layers = &v.Config.Blob, v.Layers
+		switch v.Config.MediaType {
+		case "", MediaTypeImageConfig, MediaTypeOCIImageConfig:
+		default:
+			if m.ArtifactType == "" {
+				m.ArtifactType = v.Config.MediaType
+			}
+		}
+	case v.Blobs != nil || m.MediaType == MediaTypeOCIArtifact:
+		m.Layers = v.Blobs
+		if m.ArtifactType == "" {
+			m.ArtifactType = m.MediaType
+		}
+	case v.History != nil:
+		m.Architecture = v.Architecture
+		// the newest layer tells when the image was built; the history
+		// and layers are listed newest first
+		for i := len(v.History) - 1; i >= 0; i-- {
+			var layer struct {
+				Created         string `json:"created"`
+				Comment         string `json:"comment"`
+				Throwaway       bool   `json:"throwaway"`
+				Size            int64  `json:"Size"`
+				ContainerConfig struct {
+					Cmd []string `json:"Cmd"`
+				} `json:"container_config"`
+			}
+			err = json.Unmarshal([]byte(v.History[i].V1Compatibility), &layer)
+			if err != nil {
+				return err
+			}
+			created, _ := time.Parse(time.RFC3339Nano, layer.Created)
+			if created.After(m.Created) {
+				m.Created = created
+			}
+			entry := HistoryEntry{
+				Created:    created,
+				CreatedBy:  strings.Join(layer.ContainerConfig.Cmd, " "),
+				Comment:    layer.Comment,
+				EmptyLayer: layer.Throwaway,
+			}
+			if !layer.Throwaway && i < len(v.FSLayers) {
+				entry.Layer = &Blob{Digest: v.FSLayers[i].BlobSum, Size: layer.Size}
+			}
+			m.History = append(m.History, entry)
+		}
+	default:
+		return fmt.Errorf("manifest has neither history, config nor manifests")
+	}
+	return nil
+}
+
+// Digest resolves the digest repo at ref currently points at; found is false
+// when the registry does not know ref.
+func (c *Client) Digest(ctx context.Context, repo string, ref string) (digest string, found bool, err error) {
+	method := http.MethodHead
+	if c.NoHead {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url("/v2/%v/manifests/%v", repo, ref), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", strings.Join(tagManifestTypes, ", "))
+	res, _, err := c.do(req)
+	if err, ok := err.(*StatusError); ok && err.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return res.Header.Get("Docker-Content-Digest"), true, nil
+}
+
+// BlobSize returns the size the registry reports for the blob of repo with
+// the given digest, with a HEAD request; found is false when the registry
+// does not have it.
+func (c *Client) BlobSize(ctx context.Context, repo string, digest string) (size int64, found bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url("/v2/%v/blobs/%v", repo, digest), nil)
+	if err != nil {
+		return
+	}
+	res, _, err := c.do(req)
+	if err, ok := err.(*StatusError); ok && err.StatusCode == http.StatusNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return res.ContentLength, true, nil
+}
+
+// ImageConfig is what an image config blob tells about the image.
+type ImageConfig struct {
+	Created      time.Time
+	Architecture string
+	OS           string
+	Variant      string
+	Labels       map[string]string
+	// History is the build history, oldest first.
+	History []HistoryEntry
+}
+
+func (c *ImageConfig) Platform() *Platform {
+	return &Platform{Architecture: c.Architecture, OS: c.OS, Variant: c.Variant}
+}
+
+// Config fetches the image config blob of repo with the given digest.
+func (c *Client) Config(ctx context.Context, repo string, digest string) (*ImageConfig, error) {
+	var v struct {
+		Created      string `json:"created"`
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+		Config       struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+		History []struct {
+			Created    string `json:"created"`
+			CreatedBy  string `json:"created_by"`
+			Comment    string `json:"comment"`
+			EmptyLayer bool   `json:"empty_layer"`
+		} `json:"history"`
+	}
+	_, err := c.getJson(ctx, c.url("/v2/%v/blobs/%v", repo, digest), &v)
+	if err != nil {
+		return nil, err
+	}
+	created, _ := time.Parse(time.RFC3339Nano, v.Created)
+	config := &ImageConfig{
+		Created:      created,
+		Architecture: v.Architecture,
+		OS:           v.OS,
+		Variant:      v.Variant,
+		Labels:       v.Config.Labels,
+	}
+	for _, h := range v.History {
+		created, _ := time.Parse(time.RFC3339Nano, h.Created)
+		config.History = append(config.History, HistoryEntry{Created: created, CreatedBy: h.CreatedBy, Comment: h.Comment, EmptyLayer: h.EmptyLayer})
+	}
+	return config, nil
+}
+
+// Tag is a tag of a repository and the image it points at.
+type Tag struct {
+	Name      string
+	Digest    string
+	MediaType string
+	Created   time.Time
+	// Size is the sum of the sizes of the config and layer blobs; for an
+	// index, of those of its main platform
+	Size int64
+	// Blobs are the config blob followed by the layers, unknown for schema1
+	Blobs []Blob
+	// ArtifactType is set for tags of something else than a container image
+	ArtifactType string
+	// Labels are the labels of the image config, unknown for schema1
+	Labels map[string]string
+}
+
+// IsIndex reports whether t is a tag of an index.
+func (t *Tag) IsIndex() bool {
+	for _, mediaType := range IndexManifestTypes {
+		if t.MediaType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag fetches the manifest repo:tag points at, and its config to learn when
+// the image was created. Artifacts have no image config; their creation time
+// is taken from the annotations of the manifest, if there. A tag of an index
+// keeps the digest and media type of the index, and takes the rest from the
+// image of its main platform.
+func (c *Client) Tag(ctx context.Context, repo string, tag string) (*Tag, error) {
+	m, err := c.Manifest(ctx, repo, tag, tagManifestTypes...)
+	if err != nil {
+		return nil, err
+	}
+	if !m.IsIndex() {
+		return c.image(ctx, repo, tag, m)
+	}
+	t := &Tag{Name: tag, Digest: m.Digest, MediaType: m.MediaType}
+	d := mainPlatform(m.Manifests)
+	if d == nil {
+		return t, nil
+	}
+	pm, err := c.Manifest(ctx, repo, d.Digest, d.MediaType)
+	if err != nil {
+		return nil, fmt.Errorf("%v of %v: %v", d.Platform.String(), m.Digest, err)
+	}
+	image, err := c.image(ctx, repo, tag, pm)
+	if err != nil {
+		return nil, err
+	}
+	t.Created, t.Size, t.Blobs, t.ArtifactType, t.Labels = image.Created, image.Size, image.Blobs, image.ArtifactType, image.Labels
+	return t, nil
+}
+
+// image is the tag of the image or artifact manifest m.
+func (c *Client) image(ctx context.Context, repo string, tag string, m *Manifest) (*Tag, error) {
+	t := &Tag{Name: tag, Digest: m.Digest, MediaType: m.MediaType, Created: m.Created, Blobs: m.Blobs(), ArtifactType: m.ArtifactType}
+	for _, b := range t.Blobs {
+		t.Size += b.Size
+	}
+	if m.IsArtifact() {
+		t.Created = m.AnnotatedCreated()
+		return t, nil
+	}
+	if m.Config == nil {
+		return t, nil
+	}
+	config, err := c.Config(ctx, repo, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	t.Created = config.Created
+	t.Labels = config.Labels
+	return t, nil
+}
+
+// unknownPlatform reports whether p is the unknown/unknown platform
+// BuildKit lists the attestations of an index under.
+func unknownPlatform(p *Platform) bool {
+	return p != nil && p.OS == "unknown" && p.Architecture == "unknown"
+}
+
+// mainPlatform returns the manifest of an index to report the index by:
+// linux/amd64 if there, or else the first image that is not an
+// attestation.
+func mainPlatform(manifests []Descriptor) *Descriptor {
+	var first *Descriptor
+	for i := range manifests {
+		d := &manifests[i]
+		if unknownPlatform(d.Platform) {
+			continue
+		}
+		if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == "amd64" && d.Platform.Variant == "" {
+			return d
+		}
+		if first == nil {
+			first = d
+		}
+	}
+	return first
+}
+
+// Repo is a repository with its tags, newest first.
+type Repo struct {
+	Name string
+	Tags []*Tag
+}
+
+// Repo lists the tags of repo and fetches them concurrently. Tags that could
+// not be fetched are left out, and the first such failure is returned along
+// with the rest.
+func (c *Client) Repo(ctx context.Context, name string) (*Repo, error) {
+	tags, err := c.Tags(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repo{Name: name}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for _, tag := range tags {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			t, err := c.Tag(ctx, name, tag)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%v:%v: %w", name, tag, err)
+				}
+				return
+			}
+			repo.Tags = append(repo.Tags, t)
+		}(tag)
+	}
+	wg.Wait()
+	sort.Slice(repo.Tags, func(i, j int) bool {
+		if !repo.Tags[i].Created.Equal(repo.Tags[j].Created) {
+			return repo.Tags[i].Created.After(repo.Tags[j].Created)
+		}
+		return repo.Tags[i].Name < repo.Tags[j].Name
+	})
+	return repo, firstErr
+}
@@ -0,0 +1,55 @@
+package registryclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// ReferrersTag is the tag under which clients of registries without the
+// referrers API keep the index of what refers to digest, e.g. sha256-1234….
+func ReferrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// Referrers lists the manifests whose subject is the manifest of repo with
+// the given digest: signatures, SBOMs, provenance and other attestations.
+// Registries that do not serve the referrers API are asked for the index
+// tagged ReferrersTag(digest) instead, as the OCI distribution spec has
+// clients do.
+func (c *Client) Referrers(ctx context.Context, repo string, digest string) ([]Descriptor, error) {
+	if !c.NoReferrers {
+		referrers, err := c.referrersAPI(ctx, repo, digest)
+		if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != http.StatusNotFound {
+			return referrers, err
+		}
+	}
+	m, err := c.Manifest(ctx, repo, ReferrersTag(digest), MediaTypeOCIIndex)
+	if err, ok := err.(*StatusError); ok && err.StatusCode == http.StatusNotFound {
+		return []Descriptor{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Manifests == nil {
+		return []Descriptor{}, nil
+	}
+	return m.Manifests, nil
+}
+
+func (c *Client) referrersAPI(ctx context.Context, repo string, digest string) ([]Descriptor, error) {
+	url := c.url("/v2/%v/referrers/%v", repo, digest)
+	referrers := []Descriptor{}
+	for url != "" {
+		var page struct {
+			Manifests []Descriptor `json:"manifests"`
+		}
+		var err error
+		url, err = c.getJson(ctx, url, &page)
+		if err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, page.Manifests...)
+	}
+	return referrers, nil
+}
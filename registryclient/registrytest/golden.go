@@ -0,0 +1,33 @@
+package registrytest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Golden compares got with the file testdata/name of the package under
+// test, and fails t where they differ. With REGISTRYTEST_UPDATE=1 in the
+// environment it writes got to the file instead, to record new output.
+func Golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if os.Getenv("REGISTRYTEST_UPDATE") == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run with REGISTRYTEST_UPDATE=1 to write it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %v:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
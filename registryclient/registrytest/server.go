@@ -0,0 +1,564 @@
+// Package registrytest serves a fake distribution registry with fixed
+// content, for tests of code walking registries:
+//
+//	s := registrytest.NewServer()
+//	defer s.Close()
+//	s.AddImage("team-a/app", "v1", registrytest.Image{Created: created, Layers: []int64{1024}})
+//	s.RequireToken("ci", "secret")
+//	c := registryclient.New(s.URL, &http.Client{
+//		Transport: registryclient.NewTokenTransport(http.DefaultTransport, credentials),
+//	})
+//
+// It serves the catalog and tag lists with pagination, schema1, schema2 and
+// OCI manifests and their blobs, deletes and pushes of manifests, and
+// answers with errors where told to.
+package registrytest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// Manifest schemas of the images a Server serves.
+const (
+	Schema2 = iota
+	OCI
+	Schema1
+)
+
+// Image is an image to serve. Its manifest and config are generated from
+// it, so the same Image always has the same digest.
+type Image struct {
+	Schema       int
+	Created      time.Time
+	Architecture string
+	// Layers are the sizes of the layers; their digests are made up.
+	Layers []int64
+	// ArtifactType makes the image an artifact, such as a Helm chart, with
+	// this as the media type of its config.
+	ArtifactType string
+	// History are the created_by commands of the layers, in order.
+	History []string
+	// Labels are the labels of the image config.
+	Labels map[string]string
+}
+
+type manifest struct {
+	mediaType string
+	raw       []byte
+}
+
+type failure struct {
+	prefix string
+	status int
+	times  int
+}
+
+// Server is a fake registry. Its methods may be called while it serves.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is the most repositories or tags served per page, unless a
+	// request asks for fewer; 0 serves all of them at once.
+	PageSize int
+
+	mu        sync.Mutex
+	repos     map[string]map[string]string // repo → tag → digest
+	manifests map[string]map[string]*manifest
+	blobs     map[string][]byte
+	layers    map[string]int64 // digest → size, served as zeros
+	username  string
+	password  string
+	tokens    map[string]string // token → scope
+	failures  []*failure
+	requests  map[string]int
+}
+
+// NewServer starts a Server without any repository. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		repos:     make(map[string]map[string]string),
+		manifests: make(map[string]map[string]*manifest),
+		blobs:     make(map[string][]byte),
+		layers:    make(map[string]int64),
+		tokens:    make(map[string]string),
+		requests:  make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddImage serves img as repo:tag and returns its digest. Adding a tag
+// again points it at the new image.
+func (s *Server) AddImage(repo string, tag string, img Image) string {
+	created := img.Created.UTC().Format(time.RFC3339Nano)
+	var history []map[string]string
+	for _, createdBy := range img.History {
+		history = append(history, map[string]string{"created": created, "created_by": createdBy})
+	}
+	config, _ := json.Marshal(map[string]interface{}{
+		"created":      created,
+		"architecture": architecture(img),
+		"os":           "linux",
+		"history":      history,
+		"config":       map[string]interface{}{"Labels": img.Labels},
+	})
+	configDigest := digestOf(config)
+	var layers []registryclient.Blob
+	for i, size := range img.Layers {
+		layers = append(layers, registryclient.Blob{
+			Digest: digestOf([]byte(fmt.Sprintf("%v:%v:%d:%d", repo, created, i, size))),
+			Size:   size,
+		})
+	}
+
+	var m manifest
+	switch img.Schema {
+	case Schema1:
+		m.mediaType = registryclient.MediaTypeManifestV1
+		// schema1 lists the layers and their history newest first
+		var v1History, fsLayers []map[string]string
+		for i := len(layers) - 1; i >= 0; i-- {
+			v1, _ := json.Marshal(map[string]interface{}{
+				"created":          created,
+				"Size":             layers[i].Size,
+				"container_config": map[string]interface{}{"Cmd": v1Command(img, i)},
+			})
+			v1History = append(v1History, map[string]string{"v1Compatibility": string(v1)})
+			fsLayers = append(fsLayers, map[string]string{"blobSum": layers[i].Digest})
+		}
+		m.raw, _ = json.MarshalIndent(map[string]interface{}{
+			"schemaVersion": 1,
+			"name":          repo,
+			"tag":           tag,
+			"architecture":  architecture(img),
+			"fsLayers":      fsLayers,
+			"history":       v1History,
+		}, "", "   ")
+	default:
+		m.mediaType = registryclient.MediaTypeManifestV2
+		configType := registryclient.MediaTypeImageConfig
+		if img.Schema == OCI {
+			m.mediaType = registryclient.MediaTypeOCIManifest
+			configType = registryclient.MediaTypeOCIImageConfig
+		}
+		if img.ArtifactType != "" {
+			configType = img.ArtifactType
+		}
+		m.raw, _ = json.MarshalIndent(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     m.mediaType,
+			"config":        map[string]interface{}{"mediaType": configType, "digest": configDigest, "size": len(config)},
+			"layers":        layers,
+		}, "", "   ")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[configDigest] = config
+	for _, l := range layers {
+		s.layers[l.Digest] = l.Size
+	}
+	return s.put(repo, tag, &m)
+}
+
+// AddIndex serves an index of the given platform images as repo:tag and
+// returns its digest. The index is an OCI index if the first image is an
+// OCI image, and a Docker manifest list otherwise; its images are untagged.
+func (s *Server) AddIndex(repo string, tag string, platforms ...Image) string {
+	m := manifest{mediaType: registryclient.MediaTypeManifestList}
+	if len(platforms) > 0 && platforms[0].Schema == OCI {
+		m.mediaType = registryclient.MediaTypeOCIIndex
+	}
+	var manifests []registryclient.Descriptor
+	for _, img := range platforms {
+		digest := s.AddImage(repo, "", img)
+		s.mu.Lock()
+		image := s.manifests[repo][digest]
+		s.mu.Unlock()
+		manifests = append(manifests, registryclient.Descriptor{
+			MediaType: image.mediaType,
+			Digest:    digest,
+			Size:      int64(len(image.raw)),
+			Platform:  &registryclient.Platform{Architecture: architecture(img), OS: "linux"},
+		})
+	}
+	m.raw, _ = json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     m.mediaType,
+		"manifests":     manifests,
+	}, "", "   ")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(repo, tag, &m)
+}
+
+// v1Command is the command that made layer i, as schema1 records it: the
+// shell invocation of created_by split off the command it runs.
+func v1Command(img Image, i int) []string {
+	if i >= len(img.History) {
+		return nil
+	}
+	if cmd := strings.TrimPrefix(img.History[i], "/bin/sh -c "); cmd != img.History[i] {
+		return []string{"/bin/sh", "-c", cmd}
+	}
+	return []string{img.History[i]}
+}
+
+// accepts reports whether r accepts a manifest of the given type. Like
+// distribution, only indexes are held back from clients that do not ask for
+// them.
+func accepts(r *http.Request, mediaType string) bool {
+	if mediaType != registryclient.MediaTypeManifestList && mediaType != registryclient.MediaTypeOCIIndex {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func architecture(img Image) string {
+	if img.Architecture == "" {
+		return "amd64"
+	}
+	return img.Architecture
+}
+
+func digestOf(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+// put stores m in repo under its digest and tag, if not empty.
+func (s *Server) put(repo string, tag string, m *manifest) string {
+	digest := digestOf(m.raw)
+	if s.repos[repo] == nil {
+		s.repos[repo] = make(map[string]string)
+		s.manifests[repo] = make(map[string]*manifest)
+	}
+	s.manifests[repo][digest] = m
+	if tag != "" {
+		s.repos[repo][tag] = digest
+	}
+	return digest
+}
+
+// AddRepo lists repo in the catalog without any tag, as registries do once
+// every tag of a repository was deleted.
+func (s *Server) AddRepo(repo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repos[repo] == nil {
+		s.repos[repo] = make(map[string]string)
+		s.manifests[repo] = make(map[string]*manifest)
+	}
+}
+
+// RemoveBlob stops serving the config or layer blob with the given digest,
+// as after a garbage collection that went wrong, while manifests still
+// reference it.
+func (s *Server) RemoveBlob(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, digest)
+	delete(s.layers, digest)
+}
+
+// SetLayerSize serves the layer blob with the given digest with another
+// size than its manifests tell, as after a botched storage migration.
+func (s *Server) SetLayerSize(digest string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.layers[digest] = size
+}
+
+// RequireToken has every request but those for tokens authenticate with a
+// bearer token, which /token hands out for the given credentials.
+func (s *Server) RequireToken(username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+// Fail answers the next times requests whose path starts with prefix, such
+// as /v2/team-a/app/manifests/, with status; times < 0 fails all of them.
+func (s *Server) Fail(prefix string, status int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{prefix: prefix, status: status, times: times})
+}
+
+// Requests returns how many requests were made, by method and path, e.g.
+// "GET /v2/_catalog".
+func (s *Server) Requests() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.requests))
+	for k, v := range s.requests {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method+" "+r.URL.Path]++
+
+	for _, f := range s.failures {
+		if f.times != 0 && strings.HasPrefix(r.URL.Path, f.prefix) {
+			f.times--
+			writeError(w, f.status, "UNKNOWN", "injected failure")
+			return
+		}
+	}
+	if r.URL.Path == "/token" {
+		s.serveToken(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if s.username != "" && !s.authorized(r, path) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v/token",service="registrytest",scope="%v"`, s.URL, scopeOf(r.Method, path)))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	switch {
+	case path == "":
+		w.Write([]byte("{}"))
+	case path == "_catalog":
+		names := make([]string, 0, len(s.repos))
+		for repo := range s.repos {
+			names = append(names, repo)
+		}
+		s.writePage(w, r, "repositories", names, nil)
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags, ok := s.repos[repo]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+		// a repository whose tags were all deleted lists them as null
+		var names []string
+		for tag := range tags {
+			names = append(names, tag)
+		}
+		s.writePage(w, r, "tags", names, map[string]interface{}{"name": repo})
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		s.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		digest := path[i+len("/blobs/"):]
+		if blob, ok := s.blobs[digest]; ok {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			if r.Method != http.MethodHead {
+				w.Write(blob)
+			}
+			return
+		}
+		size, ok := s.layers[digest]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		if r.Method != http.MethodHead {
+			io.CopyN(w, zeros{}, size)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repo string, ref string) {
+	digest := ref
+	if !strings.HasPrefix(ref, "sha256:") {
+		digest = s.repos[repo][ref]
+	}
+	m, ok := s.manifests[repo][digest]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !ok || !accepts(r, m.mediaType) {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.raw)))
+		if r.Method == http.MethodGet {
+			w.Write(m.raw)
+		}
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		tag := ""
+		if !strings.HasPrefix(ref, "sha256:") {
+			tag = ref
+		}
+		digest = s.put(repo, tag, &manifest{mediaType: r.Header.Get("Content-Type"), raw: body})
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		// deleting a manifest deletes every tag pointing at it
+		delete(s.manifests[repo], digest)
+		for tag, d := range s.repos[repo] {
+			if d == digest {
+				delete(s.repos[repo], tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writePage writes the page of names asked for with ?n= and ?last=, and a
+// Link header to the next page, if any.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, key string, names []string, extra map[string]interface{}) {
+	sort.Strings(names)
+	if last := r.URL.Query().Get("last"); last != "" {
+		i := sort.SearchStrings(names, last)
+		if i < len(names) && names[i] == last {
+			i++
+		}
+		names = names[i:]
+	}
+	n := s.PageSize
+	if asked, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && asked > 0 && (n == 0 || asked < n) {
+		n = asked
+	}
+	if n > 0 && len(names) > n {
+		names = names[:n]
+		w.Header().Set("Link", fmt.Sprintf(`<%v?n=%d&last=%v>; rel="next"`, r.URL.Path, n, names[n-1]))
+	}
+	page := map[string]interface{}{key: names}
+	for k, v := range extra {
+		page[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// serveToken hands out a token for the scope asked for to clients with the
+// right credentials.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != s.username || password != s.password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	token := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v:%d", scope, len(s.tokens))))
+	s.tokens[token] = scope
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_in": 300, "issued_at": time.Now().UTC().Format(time.RFC3339)})
+}
+
+// authorized reports whether r carries a token for the scope of path.
+func (s *Server) authorized(r *http.Request, path string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	scope, ok := s.tokens[token]
+	if !ok {
+		return false
+	}
+	want := scopeOf(r.Method, path)
+	if want == "" || scope == want {
+		return true
+	}
+	// a token for pull,push also allows pulls
+	i, j := strings.LastIndex(scope, ":"), strings.LastIndex(want, ":")
+	if i < 0 || j < 0 || scope[:i] != want[:j] {
+		return false
+	}
+	granted := strings.Split(scope[i+1:], ",")
+	for _, action := range strings.Split(want[j+1:], ",") {
+		if !contains(granted, action) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeOf is the token scope a request for path needs, or "" for the base
+// endpoint.
+func scopeOf(method string, path string) string {
+	if path == "" {
+		return ""
+	}
+	if path == "_catalog" {
+		return "registry:catalog:*"
+	}
+	repo := path
+	for _, sep := range []string{"/tags/", "/manifests/", "/blobs/", "/referrers/"} {
+		if i := strings.LastIndex(path, sep); i >= 0 {
+			repo = path[:i]
+			break
+		}
+	}
+	switch method {
+	case http.MethodPut:
+		return "repository:" + repo + ":pull,push"
+	case http.MethodDelete:
+		return "repository:" + repo + ":delete"
+	}
+	return "repository:" + repo + ":pull"
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+)
+
+// addrKey normalizes a registry address for comparison: no scheme, no
+// default port and no trailing slash.
+func addrKey(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	host, path := addr, ""
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		host, path = addr[:i], addr[i:]
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ":443"), ":80")
+	return strings.ToLower(host) + path
+}
+
+// underPath reports whether key equals prefix or lies below it.
+func underPath(key string, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// findRegistryByAddr returns the configured registry with the longest addr
+// that addr lies under, so that registries served under different paths of
+// one host (such as the docker repositories of an Artifactory instance) are
+// told apart.
+func (conf *Config) findRegistryByAddr(addr string) (*Registry, bool) {
+	key := addrKey(addr)
+	var best *Registry
+	for _, reg := range conf.Registries {
+		regKey := reg.key()
+		if underPath(key, regKey) && (best == nil || len(regKey) > len(best.key())) {
+			best = reg
+		}
+	}
+	return best, best != nil
+}
+
+// registriesUnder returns the configured registries served at or below addr.
+func (conf *Config) registriesUnder(addr string) []*Registry {
+	key := addrKey(addr)
+	var regs []*Registry
+	for _, reg := range conf.Registries {
+		if underPath(reg.key(), key) {
+			regs = append(regs, reg)
+		}
+	}
+	return regs
+}
+
+// resolveRegistries resolves connectString to the logical registries it
+// names: a single alias or addr, or every registry configured under a
+// shared host.
+func resolveRegistries(connectString string) []*Registry {
+	if reg, ok := localConf.findRegistry(connectString); ok {
+		return []*Registry{reg}
+	}
+	// an entry of the whole registry is preferred over the slices of it
+	// other entries are scoped to by a prefix, which are all scanned otherwise
+	var scoped []*Registry
+	for _, reg := range localConf.Registries {
+		if reg.key() != addrKey(connectString) {
+			continue
+		}
+		if reg.Prefix == "" {
+			return []*Registry{reg}
+		}
+		scoped = append(scoped, reg)
+	}
+	if len(scoped) > 0 {
+		return scoped
+	}
+	if regs := localConf.registriesUnder(connectString); len(regs) > 0 {
+		return regs
+	}
+	return []*Registry{resolveRegistry(connectString)}
+}
+
+// inScope reports whether repo lies under the prefix reg is scoped to, if
+// any.
+func (reg *Registry) inScope(repo string) bool {
+	return strings.HasPrefix(repo, reg.Prefix)
+}
+
+// name returns the label reg is reported under.
+func (reg *Registry) name() string {
+	if reg.Alias != "" {
+		return reg.Alias
+	}
+	return reg.displayAddr()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// RetagResult is a tag pointed at the manifest of another tag of the same
+// repository.
+type RetagResult struct {
+	Repo           string
+	Source         string
+	Tag            string
+	Digest         string
+	PreviousDigest string `json:",omitempty"`
+}
+
+// retag puts the manifest of repo at src under tag dst. The manifest is
+// uploaded byte for byte, so dst gets the same digest and no blob is copied.
+func retag(ctx context.Context, reg *Registry, repo string, src string, dst string) (*RetagResult, error) {
+	c := reg.registryClient(ctx)
+	accept := append([]string{registryclient.MediaTypeManifestList, registryclient.MediaTypeOCIIndex}, registryclient.ImageManifestTypes...)
+	m, err := c.Manifest(ctx, reg.repository(repo), src, accept...)
+	if err != nil {
+		return nil, err
+	}
+	result := &RetagResult{Repo: repo, Source: src, Tag: dst, Digest: m.Digest}
+	previous, found, err := c.Digest(ctx, reg.repository(repo), dst)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		result.PreviousDigest = previous
+	}
+	err = putManifest(ctx, reg, repo, dst, m.MediaType, m.Raw)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func retagCommand(ctx context.Context, args []string) {
+	fs := commandFlags("retag")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	repo, src := parseReference(fs.Arg(1))
+	result, err := retag(ctx, reg, repo, src, fs.Arg(2))
+	if err != nil {
+		fatal(err)
+	}
+	printJson(result)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+var (
+	timeoutFlag = flag.Duration("timeout", 10*time.Second, "timeout of a single registry request")
+	retriesFlag = flag.Int("retries", 3, "retries of a request that failed with a transient error")
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	// maxRetryAfter bounds how long a Retry-After header may make us wait;
+	// responses asking for more are returned as they are.
+	maxRetryAfter = 2 * time.Minute
+)
+
+func (reg *Registry) requestTimeout() time.Duration {
+	if reg.timeout != 0 {
+		return reg.timeout
+	}
+	return *timeoutFlag
+}
+
+func (reg *Registry) maxRetries() int {
+	if reg.Retries != nil {
+		return *reg.Retries
+	}
+	return *retriesFlag
+}
+
+// retryTransport bounds every attempt by timeout and retries idempotent
+// requests failing with connection errors, 429 or 5xx responses, backing off
+// exponentially with jitter or as long as Retry-After asks.
+type retryTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	retries int
+}
+
+func newRetryTransport(base http.RoundTripper, timeout time.Duration, retries int) *retryTransport {
+	return &retryTransport{base: base, timeout: timeout, retries: retries}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	canRetry := idempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	attempt := req
+	for n := 0; ; n++ {
+		res, err := t.roundTrip(attempt)
+		if !canRetry || n >= t.retries || req.Context().Err() != nil {
+			return res, err
+		}
+		wait, retry := retryDelay(n, res, err)
+		if !retry {
+			return res, err
+		}
+		requestStats.retry()
+		if res != nil {
+			debugf(LogRequests, logFields{URL: req.URL, Status: res.StatusCode}, "%v %v: %v, retry %d of %d in %v", req.Method, req.URL, res.Status, n+1, t.retries, wait.Round(time.Millisecond))
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		} else {
+			debugf(LogRequests, logFields{URL: req.URL, Err: err}, "%v %v: %v, retry %d of %d in %v", req.Method, req.URL, err, n+1, t.retries, wait.Round(time.Millisecond))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		attempt, err = registryclient.Rewind(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody releases the timeout of an attempt once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// idempotent reports whether req may be sent again. A PATCH of a chunk of an
+// upload is, as its Content-Range places it in the blob: a registry that
+// already got it answers the retry with 416 rather than appending it twice.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	case http.MethodPatch:
+		return req.Header.Get("Content-Range") != ""
+	}
+	return false
+}
+
+// retryDelay reports whether the outcome of attempt n is transient and how
+// long to wait before the next one.
+func retryDelay(n int, res *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		return backoff(n), transientError(err)
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500 && res.StatusCode != http.StatusNotImplemented && res.StatusCode != http.StatusHTTPVersionNotSupported:
+	default:
+		return 0, false
+	}
+	if wait, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+		return wait, wait <= maxRetryAfter
+	}
+	return backoff(n), true
+}
+
+func transientError(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// backoff is the full-jitter exponential delay before retry n+1.
+func backoff(n int) time.Duration {
+	d := retryMaxDelay
+	if n < 16 {
+		if exp := retryBaseDelay << uint(n); exp < d {
+			d = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyServer answers with the statuses in order, then 200, and records the
+// bodies it received.
+type flakyServer struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   []string
+}
+
+func (f *flakyServer) serve(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		f.bodies = append(f.bodies, string(body))
+		if len(f.statuses) == 0 {
+			return
+		}
+		for k, v := range f.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(f.statuses[0])
+		f.statuses = f.statuses[1:]
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRetryTransport(t *testing.T) {
+	retryNow := http.Header{"Retry-After": {"0"}}
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		statuses []int
+		header   http.Header
+		retries  int
+		want     int
+		attempts int
+	}{
+		{"transient errors", "GET", "", []int{503, 429}, retryNow, 3, 200, 3},
+		{"retries used up", "GET", "", []int{502, 502, 502}, retryNow, 2, 502, 3},
+		{"no retries", "GET", "", []int{503}, retryNow, 0, 503, 1},
+		{"not transient", "GET", "", []int{404}, retryNow, 3, 404, 1},
+		{"not implemented", "GET", "", []int{501}, retryNow, 3, 501, 1},
+		{"not idempotent", "POST", "", []int{503}, retryNow, 3, 503, 1},
+		{"body resent", "PUT", "manifest", []int{500}, retryNow, 3, 200, 2},
+		{"Retry-After too long", "GET", "", []int{429}, http.Header{"Retry-After": {"3600"}}, 3, 429, 1},
+	}
+	for _, tt := range tests {
+		f := &flakyServer{statuses: tt.statuses, header: tt.header}
+		s := f.serve(t)
+		req, _ := http.NewRequest(tt.method, s.URL+"/v2/", nil)
+		if tt.body != "" {
+			req, _ = http.NewRequest(tt.method, s.URL+"/v2/", bytes.NewReader([]byte(tt.body)))
+		}
+		res, err := newRetryTransport(http.DefaultTransport, time.Second, tt.retries).RoundTrip(req)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want || len(f.bodies) != tt.attempts {
+			t.Errorf("%v: %v after %d attempts, want %v after %d", tt.name, res.StatusCode, len(f.bodies), tt.want, tt.attempts)
+		}
+		for _, b := range f.bodies {
+			if b != tt.body {
+				t.Errorf("%v: sent body %q, want %q", tt.name, b, tt.body)
+			}
+		}
+	}
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer s.Close()
+	defer close(release)
+	req, _ := http.NewRequest("GET", s.URL+"/v2/", nil)
+	start := time.Now()
+	_, err := newRetryTransport(http.DefaultTransport, 50*time.Millisecond, 0).RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the attempt to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+func TestRetryTransportCanceled(t *testing.T) {
+	f := &flakyServer{statuses: []int{503}, header: http.Header{"Retry-After": {"60"}}}
+	s := f.serve(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.URL+"/v2/", nil)
+	_, err := newRetryTransport(http.DefaultTransport, time.Second, 3).RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the wait for Retry-After to end with the context", err)
+	}
+}
+
+func TestTransientError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{context.DeadlineExceeded, true},
+		{syscall.ECONNRESET, true},
+		{syscall.ECONNREFUSED, true},
+		{errors.New("x509: certificate signed by unknown authority"), false},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := transientError(tt.err); got != tt.want {
+			t.Errorf("transientError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+		ok    bool
+	}{
+		{"", 0, 0, false},
+		{"0", 0, 0, true},
+		{"120", 2 * time.Minute, 2 * time.Minute, true},
+		{"-1", 0, 0, false},
+		{"soon", 0, 0, false},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute, true},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.value)
+		if ok != tt.ok || got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v-%v, %v", tt.value, got, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for n, max := range []time.Duration{retryBaseDelay, 2 * retryBaseDelay, 4 * retryBaseDelay} {
+		for i := 0; i < 100; i++ {
+			if d := backoff(n); d <= 0 || d > max {
+				t.Fatalf("backoff(%d) = %v, want within (0, %v]", n, d, max)
+			}
+		}
+	}
+	if d := backoff(100); d <= 0 || d > retryMaxDelay {
+		t.Errorf("backoff(100) = %v, want within (0, %v]", d, retryMaxDelay)
+	}
+}
+
+func TestRetryDelayOfResponse(t *testing.T) {
+	res := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"7"}}}
+	if wait, retry := retryDelay(0, res, nil); !retry || wait != 7*time.Second {
+		t.Errorf("retryDelay = %v, %v, want 7s as Retry-After asks", wait, retry)
+	}
+	res = &http.Response{StatusCode: http.StatusServiceUnavailable, Header: make(http.Header)}
+	if wait, retry := retryDelay(0, res, nil); !retry || wait > retryBaseDelay {
+		t.Errorf("retryDelay = %v, %v, want a backoff of at most %v", wait, retry, retryBaseDelay)
+	}
+	if _, retry := retryDelay(0, nil, errors.New("tls: bad certificate")); retry {
+		t.Error("retried a permanent error")
+	}
+}
+
+// TestUploadChunkRetried checks that a PATCH of an upload chunk, placed by
+// its Content-Range, is sent again with the same bytes.
+func TestUploadChunkRetried(t *testing.T) {
+	f := &flakyServer{statuses: []int{503, http.StatusAccepted}, header: http.Header{"Retry-After": {"0"}, "Location": {"/v2/app/blobs/uploads/1?state=b"}}}
+	s := f.serve(t)
+	retries := 1
+	reg := &Registry{Addr: s.URL, Retries: &retries}
+	blob := strings.NewReader("0123456789")
+	next, err := uploadChunk(context.Background(), reg, s.URL+"/v2/app/blobs/uploads/1?state=a", io.NewSectionReader(blob, 4, 4), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := s.URL + "/v2/app/blobs/uploads/1?state=b"; next != want {
+		t.Errorf("upload continues at %v, want %v", next, want)
+	}
+	if want := []string{"4567", "4567"}; !reflect.DeepEqual(f.bodies, want) {
+		t.Errorf("sent %q, want %q", f.bodies, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient/registrytest"
+)
+
+// TestScanCancelLeavesNoGoroutines cancels scans at different points and
+// checks that every fetcher goroutine exits, as the long-running modes
+// cancel scans all the time.
+func TestScanCancelLeavesNoGoroutines(t *testing.T) {
+	s, reg := testRegistry(t)
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 4; j++ {
+			s.AddImage(fmt.Sprintf("many/repo-%d", i), fmt.Sprintf("v%d", j), registrytest.Image{Created: date("2024-01-01"), Layers: []int64{int64(i*10 + j)}})
+		}
+	}
+	for after := time.Duration(0); after < 20*time.Millisecond; after += 200 * time.Microsecond {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(after, cancel)
+		getRepoInfo(ctx, reg)
+		cancel()
+	}
+	var stacks string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		buf := make([]byte, 1<<20)
+		stacks = string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "main.fetch") && !strings.Contains(stacks, "main.getInfoOfRepos") {
+			return
+		}
+	}
+	t.Fatalf("scan goroutines left after cancelled scans:\n%s", stacks)
+}
+
+// TestScanListsIndexes checks that a multi-platform tag is listed with the
+// digest of its index rather than failing the scan.
+func TestScanListsIndexes(t *testing.T) {
+	s, reg := testRegistry(t)
+	digest := s.AddIndex("team-a/multi", "v1",
+		registrytest.Image{Schema: registrytest.OCI, Created: date("2024-04-01"), Architecture: "arm64", Layers: []int64{100}},
+		registrytest.Image{Schema: registrytest.OCI, Created: date("2024-04-02"), Layers: []int64{200}})
+	repos, errs := getInfoOfRepos(context.Background(), reg, []string{"team-a/multi"})
+	if len(errs) > 0 {
+		t.Fatalf("errors %v", errs[0].Error)
+	}
+	tags := repos["team-a/multi"]
+	if len(tags) != 1 {
+		t.Fatalf("tags %v, want v1", tags)
+	}
+	if got := tags[0]; got.Digest != digest || got.MediaType != registryclient.MediaTypeOCIIndex || !time.Time(got.Created).Equal(date("2024-04-02")) {
+		t.Errorf("v1 %v of type %v created %v, want the index %v created with its amd64 image", got.Digest, got.MediaType, time.Time(got.Created), digest)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scan priorities, most urgent first.
+const (
+	ScanPriorityChanged = iota
+	ScanPriorityNew
+	ScanPriorityActive
+	ScanPriorityStable
+)
+
+var scanPriorityNames = []string{"changed", "never-scanned", "active", "stable"}
+
+// stableAfter is the number of consecutive unchanged scans after which a
+// repository moves to the slow cadence.
+const stableAfter = 3
+
+// ScanQueue orders the repository rescans of the daemon: repositories
+// reported as changed come first, then those never scanned, and repositories
+// that keep coming back unchanged are only rescanned every stableInterval.
+type ScanQueue struct {
+	mu             sync.Mutex
+	items          map[string]*ScanItem
+	interval       time.Duration
+	stableInterval time.Duration
+}
+
+type ScanItem struct {
+	Repo        string
+	Priority    string
+	Due         JsonTime
+	LastScanned *JsonTime `json:",omitempty"`
+	Unchanged   int
+
+	priority int
+}
+
+func newScanQueue(interval time.Duration, stableInterval time.Duration) *ScanQueue {
+	return &ScanQueue{
+		items:          make(map[string]*ScanItem),
+		interval:       interval,
+		stableInterval: stableInterval,
+	}
+}
+
+func (q *ScanQueue) set(item *ScanItem, priority int, due time.Time) {
+	item.priority = priority
+	item.Priority = scanPriorityNames[priority]
+	item.Due = JsonTime(due)
+}
+
+// add queues repositories found in the catalog that are not known yet.
+func (q *ScanQueue) add(now time.Time, repos ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, repo := range repos {
+		if _, ok := q.items[repo]; !ok {
+			item := &ScanItem{Repo: repo}
+			q.set(item, ScanPriorityNew, now)
+			q.items[repo] = item
+		}
+	}
+}
+
+// notify moves repo to the front of the queue, e.g. after a push event.
+func (q *ScanQueue) notify(repo string, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[repo]
+	if !ok {
+		item = &ScanItem{Repo: repo}
+		q.items[repo] = item
+	}
+	item.Unchanged = 0
+	q.set(item, ScanPriorityChanged, now)
+}
+
+// due returns the repositories due at now of priority up to most, the most
+// urgent first.
+func (q *ScanQueue) due(now time.Time, most int) []string {
+	var repos []string
+	for _, item := range q.list() {
+		if item.priority <= most && !time.Time(item.Due).After(now) {
+			repos = append(repos, item.Repo)
+		}
+	}
+	return repos
+}
+
+// done records a finished scan of repo and schedules the next one.
+func (q *ScanQueue) done(repo string, changed bool, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[repo]
+	if !ok {
+		item = &ScanItem{Repo: repo}
+		q.items[repo] = item
+	}
+	scanned := JsonTime(now)
+	item.LastScanned = &scanned
+	if changed {
+		item.Unchanged = 0
+	} else {
+		item.Unchanged++
+	}
+	if item.Unchanged >= stableAfter {
+		q.set(item, ScanPriorityStable, now.Add(q.stableInterval))
+	} else {
+		q.set(item, ScanPriorityActive, now.Add(q.interval))
+	}
+}
+
+// remove drops repositories that disappeared from the catalog.
+func (q *ScanQueue) remove(repo string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.items, repo)
+}
+
+// list returns the queue by priority, for status endpoints.
+func (q *ScanQueue) list() []ScanItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]ScanItem, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].priority != items[j].priority {
+			return items[i].priority < items[j].priority
+		}
+		if !time.Time(items[i].Due).Equal(time.Time(items[j].Due)) {
+			return time.Time(items[i].Due).Before(time.Time(items[j].Due))
+		}
+		return items[i].Repo < items[j].Repo
+	})
+	return items
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sort"
+	"time"
+)
+
+// Versions of the JSON output of scan, chosen with -output-schema.
+const (
+	// OutputSchemaV1 is the tags keyed by repository of a registry, or
+	// those of several keyed by registry name, each tag a TagV1, and the
+	// errors of an incomplete scan under Errors; with scan -report, their
+	// whole reports.
+	OutputSchemaV1 = 1
+	// OutputSchemaV2 is ScanOutputV2.
+	OutputSchemaV2 = 2
+)
+
+var outputSchemaFlag = flag.Int("output-schema", OutputSchemaV1, "`version` of the JSON output of scan: 1, the tags keyed by repository as the first releases printed them, with Errors when incomplete, or 2, {\"schemaVersion\": 2, \"registries\": [...]} with registry metadata, scan times, errors and request stats")
+
+// TagV1 is a tag in version 1 of the JSON output of scan. It has only the
+// fields the first releases printed, so that consumers of the map of
+// repositories read the same bytes as they always did; scan -report and
+// version 2 have the digest, size and the rest.
+type TagV1 struct {
+	Tag     string
+	Created JsonTime
+}
+
+// repoTagsV1 are the tags of every repository in version 1.
+type repoTagsV1 RepoTags
+
+func (r repoTagsV1) MarshalJSON() ([]byte, error) {
+	return marshalRepos(RepoTags(r), func(tags []TagDetail) interface{} {
+		v1 := make([]TagV1, 0, len(tags))
+		for _, tag := range tags {
+			v1 = append(v1, TagV1{Tag: tag.Tag, Created: tag.Created})
+		}
+		return v1
+	})
+}
+
+// reportV1 is a report in version 1: the tags keyed by repository and,
+// when the scan is incomplete, its errors under Errors, which no repository
+// is named, as repository names are lowercase.
+type reportV1 struct {
+	repos  RepoTags
+	errors []*ScanError
+}
+
+func (r reportV1) MarshalJSON() ([]byte, error) {
+	b, err := repoTagsV1(r.repos).MarshalJSON()
+	if err != nil || len(r.errors) == 0 {
+		return b, err
+	}
+	errs, err := json.Marshal(r.errors)
+	if err != nil {
+		return nil, err
+	}
+	if r.repos == nil {
+		b = []byte("{}")
+	}
+	b = b[:len(b)-1]
+	if len(b) > 1 {
+		b = append(b, ',')
+	}
+	b = append(b, `"Errors":`...)
+	b = append(b, errs...)
+	return append(b, '}'), nil
+}
+
+// ScanOutputV2 is version 2 of the JSON output of scan. Fields are only
+// ever added to it; times are RFC 3339 and lists are never null.
+type ScanOutputV2 struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Registries    []*RegistryV2 `json:"registries"`
+	Stats         *StatsV2      `json:"stats"`
+}
+
+type RegistryV2 struct {
+	Name    string `json:"name"`
+	Alias   string `json:"alias,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Address string `json:"address"`
+	Prefix  string `json:"prefix,omitempty"`
+	// Complete is false when some of the registry could not be read, or
+	// the scan was interrupted.
+	Complete     bool                `json:"complete"`
+	ScanStarted  time.Time           `json:"scanStarted"`
+	ScanFinished time.Time           `json:"scanFinished"`
+	Unsupported  []string            `json:"unsupported"`
+	Harbor       *HarborInfo         `json:"harbor,omitempty"`
+	ServedBy     map[string][]string `json:"servedBy,omitempty"`
+	Repositories []*RepositoryV2     `json:"repositories"`
+	Errors       []*ScanErrorV2      `json:"errors"`
+}
+
+// RepositoryV2 is a repository with its tags, newest first.
+type RepositoryV2 struct {
+	Name string   `json:"name"`
+	Tags []*TagV2 `json:"tags"`
+}
+
+// TagV2 is a tag; what a scan did not learn, such as the creation time and
+// size with -head-only, is left out.
+type TagV2 struct {
+	Name            string       `json:"name"`
+	Created         *time.Time   `json:"created,omitempty"`
+	Digest          string       `json:"digest,omitempty"`
+	Size            int64        `json:"size,omitempty"`
+	MediaType       string       `json:"mediaType,omitempty"`
+	ArtifactType    string       `json:"artifactType,omitempty"`
+	SameDigest      []string     `json:"sameDigest,omitempty"`
+	Signed          *bool        `json:"signed,omitempty"`
+	Vulnerabilities *VulnSummary `json:"vulnerabilities,omitempty"`
+	InUseBy         []string     `json:"inUseBy,omitempty"`
+}
+
+type ScanErrorV2 struct {
+	Repo  string `json:"repo,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Error string `json:"error"`
+}
+
+// StatsV2 are the requests of the whole run; latencies are in milliseconds.
+type StatsV2 struct {
+	Requests       int                `json:"requests"`
+	Retries        int                `json:"retries"`
+	CacheHits      int                `json:"cacheHits"`
+	ElapsedSeconds float64            `json:"elapsedSeconds"`
+	Endpoints      []*EndpointStatsV2 `json:"endpoints"`
+	RateLimits     []*RateLimitV2     `json:"rateLimits"`
+	Quotas         []*QuotaV2         `json:"quotas"`
+}
+
+type EndpointStatsV2 struct {
+	Endpoint string  `json:"endpoint"`
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	P50      float64 `json:"p50Ms"`
+	P95      float64 `json:"p95Ms"`
+}
+
+// RateLimitV2 is the rate limit a registry told about in its responses;
+// remaining is -1 when it only turned requests away.
+type RateLimitV2 struct {
+	Registry        string `json:"registry"`
+	Limit           int    `json:"limit,omitempty"`
+	Remaining       int    `json:"remaining"`
+	LowestRemaining int    `json:"lowestRemaining"`
+	WindowSeconds   int    `json:"windowSeconds,omitempty"`
+	Throttled       int    `json:"throttled"`
+	SlowedDown      int    `json:"slowedDown"`
+}
+
+// QuotaV2 is the storage quota of a Harbor project in bytes, -1 for
+// unlimited.
+type QuotaV2 struct {
+	Registry string `json:"registry"`
+	Project  string `json:"project"`
+	Used     int64  `json:"used"`
+	Hard     int64  `json:"hard"`
+}
+
+// checkOutputSchema fails on an -output-schema that does not exist, before
+// anything is scanned.
+func checkOutputSchema() {
+	if *outputSchemaFlag != OutputSchemaV1 && *outputSchemaFlag != OutputSchemaV2 {
+		fatalf("unknown output schema %d, want %d or %d", *outputSchemaFlag, OutputSchemaV1, OutputSchemaV2)
+	}
+}
+
+// versionedOutput returns the reports of a scan in the -output-schema
+// version; other results are returned as they are.
+func versionedOutput(result interface{}) interface{} {
+	if *outputSchemaFlag != OutputSchemaV2 {
+		if reportOutput {
+			return result
+		}
+		switch o := result.(type) {
+		case *Report:
+			return reportV1{o.Repositories, o.Errors}
+		case map[string]*Report:
+			v1 := make(map[string]reportV1, len(o))
+			for name, report := range o {
+				v1[name] = reportV1{report.Repositories, report.Errors}
+			}
+			return v1
+		}
+		return result
+	}
+	var reports []*Report
+	switch o := result.(type) {
+	case *Report:
+		reports = append(reports, o)
+	case map[string]*Report:
+		for _, report := range o {
+			reports = append(reports, report)
+		}
+		sort.Slice(reports, func(i, j int) bool {
+			return reports[i].registry < reports[j].registry
+		})
+	default:
+		return result
+	}
+	output := &ScanOutputV2{
+		SchemaVersion: OutputSchemaV2,
+		Registries:    make([]*RegistryV2, 0, len(reports)),
+		Stats:         statsV2(requestStats.summary()),
+	}
+	for _, report := range reports {
+		output.Registries = append(output.Registries, registryV2(report))
+	}
+	return output
+}
+
+func registryV2(report *Report) *RegistryV2 {
+	r := &RegistryV2{
+		Name:         report.registry,
+		Complete:     len(report.Errors) == 0 && !report.interrupted,
+		ScanStarted:  report.started,
+		ScanFinished: report.finished,
+		Unsupported:  report.Unsupported,
+		Harbor:       report.Harbor,
+		ServedBy:     report.ServedBy,
+		Repositories: make([]*RepositoryV2, 0, len(report.Repositories)),
+		Errors:       make([]*ScanErrorV2, 0, len(report.Errors)),
+	}
+	if reg := report.reg; reg != nil {
+		r.Alias, r.Type, r.Address, r.Prefix = reg.Alias, reg.Type, reg.displayAddr(), reg.Prefix
+	}
+	if r.Unsupported == nil {
+		r.Unsupported = []string{}
+	}
+	for _, repo := range outputRepos(report.Repositories) {
+		tags := report.Repositories[repo]
+		rv := &RepositoryV2{Name: repo, Tags: make([]*TagV2, 0, len(tags))}
+		for _, tag := range tags {
+			t := &TagV2{
+				Name:            tag.Tag,
+				Digest:          tag.Digest,
+				Size:            tag.Size,
+				MediaType:       tag.MediaType,
+				ArtifactType:    tag.ArtifactType,
+				SameDigest:      tag.SameDigest,
+				Signed:          tag.Signed,
+				Vulnerabilities: tag.Vulnerabilities,
+				InUseBy:         tag.InUseBy,
+			}
+			if created := time.Time(tag.Created); !created.IsZero() {
+				t.Created = &created
+			}
+			rv.Tags = append(rv.Tags, t)
+		}
+		r.Repositories = append(r.Repositories, rv)
+	}
+	for _, e := range report.Errors {
+		r.Errors = append(r.Errors, &ScanErrorV2{Repo: e.Repo, Tag: e.Tag, Error: e.Error})
+	}
+	return r
+}
+
+func statsV2(s *RunStats) *StatsV2 {
+	stats := &StatsV2{
+		Requests:       s.Requests,
+		Retries:        s.Retries,
+		CacheHits:      s.CacheHits,
+		ElapsedSeconds: s.Elapsed,
+		Endpoints:      make([]*EndpointStatsV2, 0, len(s.Endpoints)),
+		RateLimits:     make([]*RateLimitV2, 0, len(s.RateLimits)),
+		Quotas:         make([]*QuotaV2, 0, len(s.Quotas)),
+	}
+	for _, e := range s.Endpoints {
+		stats.Endpoints = append(stats.Endpoints, &EndpointStatsV2{Endpoint: e.Endpoint, Requests: e.Requests, Errors: e.Errors, P50: e.P50, P95: e.P95})
+	}
+	for _, l := range s.RateLimits {
+		stats.RateLimits = append(stats.RateLimits, &RateLimitV2{
+			Registry:        l.Registry,
+			Limit:           l.Limit,
+			Remaining:       l.Remaining,
+			LowestRemaining: l.LowestRemaining,
+			WindowSeconds:   l.WindowSeconds,
+			Throttled:       l.Throttled,
+			SlowedDown:      l.SlowedDown,
+		})
+	}
+	for _, q := range s.Quotas {
+		stats.Quotas = append(stats.Quotas, &QuotaV2{Registry: q.Registry, Project: q.Project, Used: q.Used, Hard: q.Hard})
+	}
+	return stats
+}
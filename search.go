@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a search hit matches the term, best first.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchFuzzy  = "fuzzy"
+)
+
+// searchConcurrency bounds the tag lists search -tags fetches at once from
+// each registry.
+const searchConcurrency = 8
+
+// SearchHit is a repository matching a search, by its name or, with -tags,
+// one of its tags.
+type SearchHit struct {
+	Registry string
+	Repo     string
+	// Tag is the tag that matched, when the repository matched by a tag
+	// better than by its name.
+	Tag   string `json:",omitempty"`
+	Match string
+	// Score ranks the hits, higher is better.
+	Score     int
+	NewestTag string    `json:",omitempty"`
+	Created   *JsonTime `json:",omitempty"`
+}
+
+// matchTerm rates how well name matches term, ignoring case: exactly, as
+// the whole name or its last path element, by prefix, or fuzzily, by
+// substring, by its letters appearing in order or by a typo or two. It
+// returns a score of 0 when name does not match at all.
+func matchTerm(name string, term string) (match string, score int) {
+	name, term = strings.ToLower(name), strings.ToLower(term)
+	base := name[strings.LastIndex(name, "/")+1:]
+	switch {
+	case name == term:
+		return MatchExact, 100
+	case base == term:
+		return MatchExact, 95
+	case strings.HasPrefix(name, term), strings.HasPrefix(base, term):
+		// shorter names are closer to what was asked for
+		extra := len(base) - len(term)
+		if extra > 10 || extra < 0 {
+			extra = 10
+		}
+		return MatchPrefix, 80 - extra
+	case strings.Contains(name, term):
+		return MatchFuzzy, 60
+	case fuzzyMatch(term, base):
+		return MatchFuzzy, 40
+	}
+	// a typo in a term of a few letters would match most short names
+	if len(term) >= 4 {
+		if d := editDistance(base, term); d <= (len(term)+3)/4 {
+			return MatchFuzzy, 30 - 5*d
+		}
+	}
+	return "", 0
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// searchRegistry returns the repositories of reg matching term by their
+// name, or with withTags by a tag, one hit each at its best match.
+func searchRegistry(ctx context.Context, reg *Registry, term string, withTags bool) ([]*SearchHit, []*ScanError, error) {
+	repos, err := listRepos(ctx, reg)
+	if err != nil {
+		return nil, nil, err
+	}
+	hits := make(map[string]*SearchHit)
+	for _, repo := range repos {
+		if match, score := matchTerm(repo, term); score > 0 {
+			hits[repo] = &SearchHit{Registry: reg.name(), Repo: repo, Match: match, Score: score}
+		}
+	}
+
+	var errs []*ScanError
+	if withTags {
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			slots = make(chan struct{}, searchConcurrency)
+		)
+		for _, repo := range repos {
+			wg.Add(1)
+			go func(repo string) {
+				defer wg.Done()
+				slots <- struct{}{}
+				tags, err := listTags(ctx, reg, repo)
+				<-slots
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if ctx.Err() == nil {
+						errs = append(errs, &ScanError{Repo: repo, Error: err.Error()})
+					}
+					return
+				}
+				for _, tag := range tags {
+					match, score := matchTerm(tag, term)
+					if hit := hits[repo]; score == 0 || hit != nil && hit.Score >= score {
+						continue
+					}
+					hits[repo] = &SearchHit{Registry: reg.name(), Repo: repo, Tag: tag, Match: match, Score: score}
+				}
+			}(repo)
+		}
+		wg.Wait()
+	}
+
+	result := make([]*SearchHit, 0, len(hits))
+	for _, hit := range hits {
+		result = append(result, hit)
+	}
+	return result, errs, nil
+}
+
+func sortSearchHits(hits []*SearchHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Registry != b.Registry {
+			return a.Registry < b.Registry
+		}
+		return a.Repo < b.Repo
+	})
+}
+
+// addNewestTags sets the newest tag of every hit, and when it was created,
+// scanning the repositories of the hits of each registry in parallel.
+func addNewestTags(ctx context.Context, regs []*Registry, hits []*SearchHit) []*ScanError {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []*ScanError
+	)
+	for _, reg := range regs {
+		var repos []string
+		byRepo := make(map[string]*SearchHit)
+		for _, hit := range hits {
+			if hit.Registry == reg.name() {
+				repos = append(repos, hit.Repo)
+				byRepo[hit.Repo] = hit
+			}
+		}
+		if len(repos) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(reg *Registry) {
+			defer wg.Done()
+			info, scanErrs := getInfoOfRepos(ctx, reg, repos)
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, scanErrs...)
+			for repo, tags := range info {
+				if hit := byRepo[repo]; hit != nil && len(tags) > 0 {
+					hit.NewestTag = tags[0].Tag
+					if created := tags[0].Created; !time.Time(created).IsZero() {
+						hit.Created = &created
+					}
+				}
+			}
+		}(reg)
+	}
+	wg.Wait()
+	return errs
+}
+
+func search(ctx context.Context, args []string) {
+	fs := commandFlags("search")
+	withTags := fs.Bool("tags", false, "also match the tags of every repository, fetching the tag list of each")
+	limit := fs.Int("limit", 20, "the number of best hits to return, 0 for all")
+	fs.Parse(args)
+	if fs.NArg() == 0 || strings.TrimSpace(fs.Arg(0)) == "" {
+		fs.Usage()
+		exit(2)
+	}
+	term := strings.TrimSpace(fs.Arg(0))
+	regs := localConf.Registries
+	if fs.NArg() > 1 {
+		regs = nil
+		for _, arg := range fs.Args()[1:] {
+			regs = append(regs, resolveRegistries(arg)...)
+		}
+	}
+	if len(regs) == 0 {
+		fatal("search: no registries configured")
+	}
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		hits       = []*SearchHit{}
+		incomplete bool
+	)
+	for _, reg := range regs {
+		wg.Add(1)
+		go func(reg *Registry) {
+			defer wg.Done()
+			found, errs, err := searchRegistry(ctx, reg, term, *withTags)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if ctx.Err() == nil {
+					logEvent(LevelWarn, logFields{Registry: reg.name(), Err: err}, "%v: %v", reg.name(), err)
+					incomplete = true
+				}
+				return
+			}
+			warnIncomplete(errs)
+			incomplete = incomplete || len(errs) > 0
+			hits = append(hits, found...)
+		}(reg)
+	}
+	wg.Wait()
+	sortSearchHits(hits)
+	if *limit > 0 && len(hits) > *limit {
+		hits = hits[:*limit]
+	}
+	errs := addNewestTags(ctx, regs, hits)
+	if ctx.Err() != nil {
+		log.Println("interrupted")
+		exit(ExitCodeInterrupted)
+	}
+	warnIncomplete(errs)
+	incomplete = incomplete || len(errs) > 0
+
+	if *outputFlag == OutputTable {
+		for _, hit := range hits {
+			line := fmt.Sprintf("%-6v %v  %v", hit.Match, hit.Registry, hit.Repo)
+			if hit.Tag != "" {
+				line += fmt.Sprintf("  tag %v", hit.Tag)
+			}
+			if hit.NewestTag != "" {
+				line += fmt.Sprintf("  newest %v", hit.NewestTag)
+				if hit.Created != nil {
+					line += fmt.Sprintf(" (%v)", time.Time(*hit.Created).Format(TimeOutputLayout))
+				}
+			}
+			fmt.Println(line)
+		}
+	} else {
+		printJson(hits)
+	}
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
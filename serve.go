@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server answers REST queries about the configured registries from the same
+// fetch logic as the CLI, keeping results for a while so that dashboards
+// polling it do not hit the registries on every request.
+type server struct {
+	ctx context.Context
+	ttl time.Duration
+	ui  bool
+
+	// events has the notifications of the registries received at /events
+	events      bool
+	eventsToken string
+
+	// latest, when set, has the results of the latest scans of some
+	// registries, which are served instead of fetching them, as the daemon
+	// does
+	latest func(reg *Registry) (map[string][]TagDetail, []*ScanError, bool)
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+// serverCacheSize bounds the lists a server keeps, as requests may name any
+// repository.
+const serverCacheSize = 1024
+
+// defaultListen is where serve and the daemon listen unless told otherwise:
+// only on this host, as they answer without authentication with what the
+// credentials of the config can read.
+const defaultListen = "localhost:8080"
+
+type cacheEntry struct {
+	ready   chan struct{}
+	value   interface{}
+	err     error
+	fetched time.Time
+}
+
+func newServer(ctx context.Context, ttl time.Duration) *server {
+	return &server{ctx: ctx, ttl: ttl, cache: make(map[string]*cacheEntry)}
+}
+
+// cached returns the value stored under key, fetching it when it is missing
+// or older than the ttl. Concurrent requests for one key share a fetch, and
+// failures are not kept.
+func (s *server) cached(key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	e, ok := s.cache[key]
+	if ok {
+		select {
+		case <-e.ready:
+			ok = time.Since(e.fetched) < s.ttl
+		default:
+		}
+	}
+	if !ok {
+		s.evict()
+		e = &cacheEntry{ready: make(chan struct{})}
+		s.cache[key] = e
+		s.mu.Unlock()
+		e.value, e.err = fetch(s.ctx)
+		e.fetched = time.Now()
+		close(e.ready)
+		if e.err != nil {
+			s.mu.Lock()
+			if s.cache[key] == e {
+				delete(s.cache, key)
+			}
+			s.mu.Unlock()
+		}
+		return e.value, e.err
+	}
+	s.mu.Unlock()
+	<-e.ready
+	return e.value, e.err
+}
+
+// evict drops the expired entries and, while there are too many, the
+// oldest, to make room for one more. s.mu is held.
+func (s *server) evict() {
+	for key, e := range s.cache {
+		select {
+		case <-e.ready:
+			if time.Since(e.fetched) >= s.ttl {
+				delete(s.cache, key)
+			}
+		default:
+		}
+	}
+	for len(s.cache) >= serverCacheSize {
+		oldest := ""
+		var fetched time.Time
+		for key, e := range s.cache {
+			select {
+			case <-e.ready:
+				if oldest == "" || e.fetched.Before(fetched) {
+					oldest, fetched = key, e.fetched
+				}
+			default:
+			}
+		}
+		if oldest == "" {
+			// every entry is still being fetched
+			return
+		}
+		delete(s.cache, oldest)
+	}
+}
+
+// TagsResponse lists the tags of one repository, newest first.
+type TagsResponse struct {
+	Registry string
+	Repo     string
+	Tags     []TagDetail
+	Errors   []*ScanError `json:",omitempty"`
+}
+
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &httpError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+func writeJsonResponse(w http.ResponseWriter, status int, v interface{}) {
+	j, err := marshalJson(v)
+	if err != nil {
+		status, j = http.StatusInternalServerError, []byte(fmt.Sprintf(`{"Error": %q}`, err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(j, '\n'))
+}
+
+// handle adapts a handler returning a value or an error to http. Errors of
+// the registries are reported as a bad gateway.
+func handle(h func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJsonResponse(w, http.StatusMethodNotAllowed, map[string]string{"Error": "only GET is supported"})
+			return
+		}
+		v, err := h(r)
+		if err != nil {
+			status := http.StatusBadGateway
+			var he *httpError
+			if errors.As(err, &he) {
+				status = he.status
+			}
+			writeJsonResponse(w, status, map[string]string{"Error": err.Error()})
+			return
+		}
+		writeJsonResponse(w, http.StatusOK, v)
+	}
+}
+
+func (s *server) registry(alias string) (*Registry, error) {
+	reg, ok := localConf.findRegistry(alias)
+	if !ok {
+		return nil, notFound("no registry %v", alias)
+	}
+	return reg, nil
+}
+
+func (s *server) registries(r *http.Request) (interface{}, error) {
+	entries := make([]*RegistryEntry, 0, len(localConf.Registries))
+	for _, reg := range localConf.Registries {
+		entries = append(entries, &RegistryEntry{Alias: reg.Alias, Type: reg.Type, Addr: reg.displayAddr()})
+	}
+	return entries, nil
+}
+
+func (s *server) repos(reg *Registry) (interface{}, error) {
+	if s.latest != nil {
+		if repos, _, ok := s.latest(reg); ok {
+			return sortedRepos(repos), nil
+		}
+	}
+	return s.cached("repos "+reg.Alias, func(ctx context.Context) (interface{}, error) {
+		repos, err := listRepos(ctx, reg)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(repos)
+		return repos, nil
+	})
+}
+
+func (s *server) tags(reg *Registry, repo string) (interface{}, error) {
+	if s.latest != nil {
+		if repos, errs, ok := s.latest(reg); ok {
+			var repoErrs []*ScanError
+			for _, e := range errs {
+				if e.Repo == repo {
+					repoErrs = append(repoErrs, e)
+				}
+			}
+			tags, found := repos[repo]
+			if !found && len(repoErrs) == 0 {
+				return nil, notFound("no repository %v in %v", repo, reg.Alias)
+			}
+			return &TagsResponse{Registry: reg.Alias, Repo: repo, Tags: tags, Errors: repoErrs}, nil
+		}
+	}
+	return s.cached("tags "+reg.Alias+" "+repo, func(ctx context.Context) (interface{}, error) {
+		repos, errs := getInfoOfRepos(ctx, reg, []string{repo})
+		if len(repos[repo]) == 0 && len(errs) > 0 {
+			return nil, errors.New(errs[0].String())
+		}
+		return &TagsResponse{Registry: reg.Alias, Repo: repo, Tags: repos[repo], Errors: errs}, nil
+	})
+}
+
+// registryRoutes serves /registries/{alias}/repos and
+// /registries/{alias}/repos/{repo}/tags, where repo may contain slashes.
+func (s *server) registryRoutes(r *http.Request) (interface{}, error) {
+	rest := strings.TrimPrefix(r.URL.Path, "/registries/")
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 || parts[1] != "repos" {
+		return nil, notFound("%v not found", r.URL.Path)
+	}
+	reg, err := s.registry(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 || parts[2] == "" {
+		return s.repos(reg)
+	}
+	repo := strings.TrimSuffix(parts[2], "/tags")
+	if repo == parts[2] || repo == "" {
+		return nil, notFound("%v not found", r.URL.Path)
+	}
+	return s.tags(reg, repo)
+}
+
+// repoRoutes serves /repos/{repo}/tags of the registry given with
+// ?registry=, which may be left out when only one is configured.
+func (s *server) repoRoutes(r *http.Request) (interface{}, error) {
+	repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/"), "/tags")
+	if repo == "" || !strings.HasSuffix(r.URL.Path, "/tags") {
+		return nil, notFound("%v not found", r.URL.Path)
+	}
+	alias := r.URL.Query().Get("registry")
+	if alias == "" {
+		if len(localConf.Registries) != 1 {
+			return nil, &httpError{http.StatusBadRequest, fmt.Errorf("several registries are configured, choose one with ?registry=")}
+		}
+		alias = localConf.Registries[0].Alias
+	}
+	reg, err := s.registry(alias)
+	if err != nil {
+		return nil, err
+	}
+	return s.tags(reg, repo)
+}
+
+// invalidate drops what is kept of the tags and repositories of reg an
+// event changed, so that the next request fetches that repository again.
+func (s *server) invalidate(ctx context.Context, reg *Registry, ev *RegistryEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, "repos "+reg.Alias)
+	delete(s.cache, "tags "+reg.Alias+" "+ev.Target.Repository)
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/registries", handle(s.registries))
+	mux.Handle("/registries/", handle(s.registryRoutes))
+	mux.Handle("/repos/", handle(s.repoRoutes))
+	if s.events {
+		mux.Handle("/events", eventsHandler(s.ctx, localConf.Registries, s.eventsToken, s.invalidate))
+	}
+	if s.ui {
+		mux.Handle("/", webHandler())
+	}
+	return mux
+}
+
+// listenAndServe serves h on addr until ctx is done.
+func listenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdown)
+	}
+}
+
+func serve(ctx context.Context, args []string) {
+	fs := commandFlags("serve")
+	listen := fs.String("listen", defaultListen, "address to serve on; anyone who can reach it can list what the configured credentials can")
+	ttl := fs.Duration("cache-ttl", time.Minute, "how long repository and tag lists are served before they are fetched again")
+	noUI := fs.Bool("no-ui", false, "serve only the REST API, not the web browser at /")
+	events := fs.Bool("events", false, "receive the notifications of the registries at /events and fetch the repositories they change again")
+	eventsToken := fs.String("events-token", "", "bearer token the registries have to send with their notifications")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		exit(2)
+	}
+	if *events {
+		if err := eventsListenProblem(*listen, *eventsToken); err != nil {
+			fatal(err)
+		}
+	}
+	s := newServer(ctx, *ttl)
+	s.ui = !*noUI
+	s.events, s.eventsToken = *events, *eventsToken
+	log.Printf("serving %d registries on %v", len(localConf.Registries), *listen)
+	err := listenAndServe(ctx, *listen, s.handler())
+	if err != nil {
+		fatal(err)
+	}
+}
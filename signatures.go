@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+// signatureArtifactTypes are the artifact types of the referrers cosign
+// attaches when signing with the OCI 1.1 referrers API.
+var signatureArtifactTypes = []string{
+	"application/vnd.dev.cosign.artifact.sig.v1+json",
+	"application/vnd.dev.sigstore.bundle",
+}
+
+// isArtifactTag reports whether tag is one that cosign or a referrers
+// fallback keeps next to an image, such as sha256-1234….sig, rather than an
+// image of its own.
+func isArtifactTag(tag string) bool {
+	return strings.HasPrefix(tag, "sha256-")
+}
+
+func isSignature(d registryclient.Descriptor) bool {
+	for _, t := range signatureArtifactTypes {
+		if strings.HasPrefix(d.ArtifactType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignatures sets Signed on every image tag of repos: whether cosign
+// signed the manifest it points at, either with a sha256-<hex>.sig tag or
+// with a referrer. The tag lists are enough for the former; referrers are
+// only asked for where the registry serves them or keeps a fallback index.
+func checkSignatures(ctx context.Context, reg *Registry, repos map[string][]TagDetail) []*ScanError {
+	defer phase("signatures")()
+	c := reg.registryClient(ctx)
+	referrersAPI := reg.capabilities(ctx).Referrers
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []*ScanError
+		// repo@digest of the manifests with a signature among their referrers
+		referred = make(map[string]bool)
+	)
+	// per repository, whether each manifest has a signature tag
+	signed := make(map[string]map[string]bool)
+	for repo, tags := range repos {
+		present := make(map[string]bool)
+		for _, tag := range tags {
+			present[tag.Tag] = true
+		}
+		signed[repo] = make(map[string]bool)
+		for _, tag := range tags {
+			if _, seen := signed[repo][tag.Digest]; seen || isArtifactTag(tag.Tag) {
+				continue
+			}
+			fallback := registryclient.ReferrersTag(tag.Digest)
+			signed[repo][tag.Digest] = present[fallback+".sig"]
+			if signed[repo][tag.Digest] || !referrersAPI && !present[fallback] {
+				continue
+			}
+			wg.Add(1)
+			go func(repo string, digest string) {
+				defer wg.Done()
+				referrers, err := c.Referrers(ctx, reg.repository(repo), digest)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, &ScanError{Repo: repo, Error: err.Error()})
+					return
+				}
+				for _, d := range referrers {
+					referred[repo+"@"+digest] = referred[repo+"@"+digest] || isSignature(d)
+				}
+			}(repo, tag.Digest)
+		}
+	}
+	wg.Wait()
+
+	for repo, tags := range repos {
+		for i, tag := range tags {
+			if isArtifactTag(tag.Tag) {
+				continue
+			}
+			s := signed[repo][tag.Digest] || referred[repo+"@"+tag.Digest]
+			tags[i].Signed = &s
+		}
+	}
+	return sortScanErrors(errs)
+}
+
+// onlyUnsigned drops every tag of repos but the unsigned images, and the
+// repositories left without tags.
+func onlyUnsigned(repos map[string][]TagDetail) map[string][]TagDetail {
+	result := make(map[string][]TagDetail)
+	for repo, tags := range repos {
+		var unsigned []TagDetail
+		for _, tag := range tags {
+			if tag.Signed != nil && !*tag.Signed {
+				unsigned = append(unsigned, tag)
+			}
+		}
+		if len(unsigned) > 0 {
+			result[repo] = unsigned
+		}
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SigningSigV4 = "sigv4"
+	SigningHMAC  = "hmac"
+
+	amzDateLayout       = "20060102T150405Z"
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	defaultSigV4Service = "execute-api"
+)
+
+// Signing configures a gateway in front of the registry that only accepts
+// signed requests.
+//
+// sigv4 signs with AWS credentials from the config or the standard
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN variables and
+// owns the Authorization header. hmac adds X-Key-Id, X-Date and X-Signature,
+// the hex HMAC-SHA256 of "METHOD\nREQUEST-URI\nX-DATE" keyed with secret.
+type Signing struct {
+	Type            string `json:"type"`
+	Region          string `json:"region"`
+	Service         string `json:"service"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	KeyID           string `json:"keyId"`
+	Secret          string `json:"secret"`
+}
+
+// signingTransport signs the requests to the gateway at host. Requests to
+// other hosts, such as a token realm or the storage that blob downloads are
+// redirected to, go out as they are: signing them would replace their own
+// credentials, and a signature for the gateway is no use to them.
+type signingTransport struct {
+	base    http.RoundTripper
+	host    string
+	signing *Signing
+}
+
+func newSigningTransport(base http.RoundTripper, host string, signing *Signing) *signingTransport {
+	return &signingTransport{base: base, host: host, signing: signing}
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	signed := req.Clone(req.Context())
+	var err error
+	switch t.signing.Type {
+	case SigningSigV4:
+		err = t.signing.signV4(signed, time.Now().UTC())
+	case SigningHMAC:
+		t.signing.signHMAC(signed, time.Now().UTC())
+	default:
+		err = fmt.Errorf("unknown signing type %q", t.signing.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(signed)
+}
+
+func (s *Signing) signHMAC(req *http.Request, now time.Time) {
+	date := now.Format(time.RFC3339)
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	fmt.Fprintf(mac, "%v\n%v\n%v", req.Method, req.URL.RequestURI(), date)
+	req.Header.Set("X-Key-Id", s.KeyID)
+	req.Header.Set("X-Date", date)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *Signing) awsCredentials() (id string, secret string, token string) {
+	if s.AccessKeyID != "" {
+		return s.AccessKeyID, s.SecretAccessKey, s.SessionToken
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+}
+
+func (s *Signing) signV4(req *http.Request, now time.Time) error {
+	id, secret, token := s.awsCredentials()
+	if id == "" || secret == "" {
+		return fmt.Errorf("sigv4: no AWS credentials")
+	}
+	service := s.Service
+	if service == "" {
+		service = defaultSigV4Service
+	}
+
+	payloadHash, err := payloadHashOf(req)
+	if err != nil {
+		return err
+	}
+	amzDate := now.Format(amzDateLayout)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", now.Format("20060102"), s.Region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), now.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		id, scope, signedHeaders, signature))
+	return nil
+}
+
+// payloadHashOf returns the hash of the body of req, or UNSIGNED-PAYLOAD for
+// the chunks and blobs of uploads, which are too large to read twice and
+// carry their own digest.
+func payloadHashOf(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return emptyPayloadHash, nil
+	}
+	if req.GetBody == nil || strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return unsignedPayload, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(b), nil
+}
+
+// canonicalPath encodes every segment of the already escaped path once more,
+// as SigV4 requires for all services but S3.
+func canonicalPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = awsURIEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
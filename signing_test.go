@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers requests with a function, to see what a transport
+// sends on.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func okResponse(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+}
+
+var signedAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testSigV4() *Signing {
+	return &Signing{
+		Type:            SigningSigV4,
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	// the example of the AWS documentation
+	key := hmacSHA256([]byte("AWS4wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"), "20120215")
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "iam")
+	key = hmacSHA256(key, "aws4_request")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signing key %v, want %v", got, want)
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	tests := []struct {
+		method, url, body, signature string
+	}{
+		{"GET", "https://gw.example.com/v2/team/app/tags/list?n=10&last=v1", "", "81821b9c9421f4b27a5bce0168d6b385a7ec92edc03df63fa44e6446a7d1da79"},
+		{"PUT", "https://gw.example.com/v2/team/app/manifests/v1", `{"schemaVersion":2}`, "062c3741f0bd5ff85b8d6161344e1b567a4d18b9483a728ca4dd924e52f74ac2"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		if tt.body != "" {
+			req, _ = http.NewRequest(tt.method, tt.url, bytes.NewReader([]byte(tt.body)))
+		}
+		if err := testSigV4().signV4(req, signedAt); err != nil {
+			t.Fatal(err)
+		}
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/eu-west-1/execute-api/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + tt.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%v %v: Authorization\n%v\nwant\n%v", tt.method, tt.url, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20240102T030405Z" {
+			t.Errorf("%v %v: X-Amz-Date %v", tt.method, tt.url, got)
+		}
+	}
+}
+
+func TestSignV4SessionToken(t *testing.T) {
+	s := testSigV4()
+	s.SessionToken = "token"
+	req, _ := http.NewRequest("GET", "https://gw.example.com/v2/", nil)
+	if err := s.signV4(req, signedAt); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" || !strings.Contains(req.Header.Get("Authorization"), "x-amz-security-token") {
+		t.Errorf("session token not signed: %v", req.Header)
+	}
+}
+
+func TestSignV4NoCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	req, _ := http.NewRequest("GET", "https://gw.example.com/v2/", nil)
+	if err := (&Signing{Type: SigningSigV4}).signV4(req, signedAt); err == nil {
+		t.Error("signed without credentials")
+	}
+}
+
+func TestSignHMAC(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://gw.example.com/v2/team/app/tags/list?n=10", nil)
+	(&Signing{Type: SigningHMAC, KeyID: "ci", Secret: "s3cret"}).signHMAC(req, signedAt)
+	want := map[string]string{
+		"X-Key-Id":    "ci",
+		"X-Date":      "2024-01-02T03:04:05Z",
+		"X-Signature": "aa828daaff4285abea68839cca8eac3890cc9aec5c00d4a8e479a1580438962c",
+	}
+	for k, v := range want {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("%v %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestSigningTransport(t *testing.T) {
+	var sent *http.Request
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return okResponse(req)
+	})
+	transport := newSigningTransport(base, "gw.example.com", &Signing{Type: SigningHMAC, KeyID: "ci", Secret: "s3cret"})
+	tests := []struct {
+		url    string
+		signed bool
+	}{
+		{"https://gw.example.com/v2/", true},
+		{"https://GW.example.com/v2/team/app/tags/list", true},
+		// a token realm and the storage serving redirected blob downloads
+		{"https://auth.example.com/token?scope=repository:team/app:pull", false},
+		{"https://bucket.s3.amazonaws.com/blobs/sha256:aa?X-Amz-Signature=presigned", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.SetBasicAuth("ci", "password")
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if signed := sent.Header.Get("X-Signature") != ""; signed != tt.signed {
+			t.Errorf("%v: signed %v, want %v", tt.url, signed, tt.signed)
+		}
+		if !tt.signed && sent != req {
+			t.Errorf("%v: request changed", tt.url)
+		}
+		if req.Header.Get("X-Signature") != "" {
+			t.Errorf("%v: the request of the caller was changed", tt.url)
+		}
+	}
+}
+
+func TestSignV4UploadsUnsigned(t *testing.T) {
+	tests := []struct {
+		method, url, payload string
+	}{
+		{"PATCH", "https://gw.example.com/v2/team/app/blobs/uploads/8f2c?_state=x", unsignedPayload},
+		{"PUT", "https://gw.example.com/v2/team/app/blobs/uploads/8f2c?digest=sha256:aa", unsignedPayload},
+		{"PUT", "https://gw.example.com/v2/team/app/manifests/v1", sha256Hex([]byte("layer"))},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, bytes.NewReader([]byte("layer")))
+		if err := testSigV4().signV4(req, signedAt); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("X-Amz-Content-Sha256"); got != tt.payload {
+			t.Errorf("%v %v: payload hash %v, want %v", tt.method, tt.url, got, tt.payload)
+		}
+	}
+}
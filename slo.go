@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SLOStatusOK       = "ok"
+	SLOStatusViolated = "violated"
+	SLOStatusNoMatch  = "no-match"
+)
+
+// FreshnessSLO requires every repository matching Pattern to have a tag
+// created within MaxAge, e.g. {"pattern": "base-images/*", "maxAge": "14d"}.
+type FreshnessSLO struct {
+	Pattern string `json:"pattern"`
+	MaxAge  string `json:"maxAge"`
+}
+
+type SLOResult struct {
+	Pattern   string
+	Repo      string    `json:",omitempty"`
+	NewestTag string    `json:",omitempty"`
+	Created   *JsonTime `json:",omitempty"`
+	AgeDays   int
+	MaxAge    string
+	Status    string
+}
+
+// parseAge parses a duration that may also be given in days, such as 14d.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func checkSLOs(slos []*FreshnessSLO, repos map[string][]TagDetail, now time.Time) ([]*SLOResult, error) {
+	names := sortedRepos(repos)
+
+	var results []*SLOResult
+	for _, slo := range slos {
+		maxAge, err := parseAge(slo.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		matched := false
+		for _, repo := range names {
+			ok, err := path.Match(slo.Pattern, repo)
+			if err != nil {
+				return nil, fmt.Errorf("slo pattern %q: %v", slo.Pattern, err)
+			}
+			if !ok {
+				continue
+			}
+			matched = true
+			r := &SLOResult{Pattern: slo.Pattern, Repo: repo, MaxAge: slo.MaxAge, Status: SLOStatusViolated}
+			if tags := repos[repo]; len(tags) > 0 {
+				newest := tags[0]
+				age := now.Sub(time.Time(newest.Created))
+				r.NewestTag = newest.Tag
+				r.Created = &newest.Created
+				r.AgeDays = int(age.Hours() / 24)
+				if age <= maxAge {
+					r.Status = SLOStatusOK
+				}
+			}
+			results = append(results, r)
+		}
+		if !matched {
+			results = append(results, &SLOResult{Pattern: slo.Pattern, MaxAge: slo.MaxAge, Status: SLOStatusNoMatch})
+		}
+	}
+	return results, nil
+}
+
+// String formats r for logs and chat messages: the status, the repository
+// or pattern and the age of its newest tag.
+func (r *SLOResult) String() string {
+	switch {
+	case r.Repo == "":
+		return fmt.Sprintf("%v  %v", r.Status, r.Pattern)
+	case r.NewestTag == "":
+		return fmt.Sprintf("%v  %v: no tags, max age %v", r.Status, r.Repo, r.MaxAge)
+	}
+	return fmt.Sprintf("%v  %v:%v: %d days old, max age %v", r.Status, r.Repo, r.NewestTag, r.AgeDays, r.MaxAge)
+}
+
+func (r *SLOResult) key() string {
+	return r.Pattern + " " + r.Repo
+}
+
+// changedSLOs returns the results whose status differs from the one in
+// prev, keyed by pattern and repository, and the statuses of results. The
+// first results only count as changed where they are not ok.
+func changedSLOs(prev map[string]string, results []*SLOResult) ([]*SLOResult, map[string]string) {
+	statuses := make(map[string]string, len(results))
+	var changed []*SLOResult
+	for _, r := range results {
+		statuses[r.key()] = r.Status
+		status, ok := prev[r.key()]
+		if !ok {
+			status = SLOStatusOK
+		}
+		if status != r.Status {
+			changed = append(changed, r)
+		}
+	}
+	return changed, statuses
+}
+
+func sloCheck(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("slo check", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fatal("registry alias or addr not defined")
+	}
+	if len(localConf.SLOs) == 0 {
+		fatal("slo check: no slos configured")
+	}
+
+	repos, errs := getRepoInfo(ctx, resolveRegistry(fs.Arg(0)))
+	warnIncomplete(errs)
+	results, err := checkSLOs(localConf.SLOs, repos, time.Now())
+	if err != nil {
+		fatal(err)
+	}
+	printJson(results)
+	for _, r := range results {
+		if r.Status != SLOStatusOK {
+			exit(ExitCodeSLOViolation)
+		}
+	}
+}
+
+func slo(ctx context.Context, args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fatal("usage: slo check <alias|addr>")
+	}
+	sloCheck(ctx, args[1:])
+}
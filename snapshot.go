@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot records which manifest every tag pointed at, and which blobs each
+// repository referenced, at one point in time.
+type Snapshot struct {
+	Registry     string
+	Created      JsonTime
+	Repositories map[string]*SnapshotRepo
+}
+
+type SnapshotRepo struct {
+	Tags  map[string]string
+	Blobs []string
+}
+
+func newSnapshot(registry string, repos map[string][]TagDetail) *Snapshot {
+	s := &Snapshot{
+		Registry:     registry,
+		Created:      JsonTime(time.Now()),
+		Repositories: make(map[string]*SnapshotRepo),
+	}
+	for repo, tags := range repos {
+		r := &SnapshotRepo{Tags: make(map[string]string)}
+		seen := make(map[string]bool)
+		for _, tag := range tags {
+			r.Tags[tag.Tag] = tag.Digest
+			for _, b := range tag.Blobs {
+				if !seen[b.Digest] {
+					seen[b.Digest] = true
+					r.Blobs = append(r.Blobs, b.Digest)
+				}
+			}
+		}
+		s.Repositories[repo] = r
+	}
+	return s
+}
+
+func (r *SnapshotRepo) hasBlob(digest string) bool {
+	for _, b := range r.Blobs {
+		if b == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if s.Repositories == nil {
+		s.Repositories = make(map[string]*SnapshotRepo)
+	}
+	return &s, nil
+}
+
+// writeSnapshot replaces the file at path with s through a temporary file,
+// so that a crash never leaves half a snapshot behind.
+func writeSnapshot(path string, s *Snapshot) error {
+	j, err := marshalJson(s)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(j)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+const (
+	TagAdded    = "added"
+	TagRemoved  = "removed"
+	TagRetagged = "retagged"
+)
+
+// TagChange is a tag that was added, removed or moved to another manifest
+// between two snapshots.
+type TagChange struct {
+	Registry       string `json:",omitempty"`
+	Repo           string
+	Tag            string
+	Change         string
+	Digest         string `json:",omitempty"`
+	PreviousDigest string `json:",omitempty"`
+}
+
+// diffSnapshots returns the tag changes from before to after, by repository
+// and tag. Tags whose digest either snapshot lacks, as scans with -no-detail
+// leave them, are only compared by presence.
+func diffSnapshots(before *Snapshot, after *Snapshot) []*TagChange {
+	var changes []*TagChange
+	for repo, r := range after.Repositories {
+		prev := before.Repositories[repo]
+		for tag, digest := range r.Tags {
+			var previous string
+			found := false
+			if prev != nil {
+				previous, found = prev.Tags[tag]
+			}
+			switch {
+			case !found:
+				changes = append(changes, &TagChange{Repo: repo, Tag: tag, Change: TagAdded, Digest: digest})
+			case previous != "" && digest != "" && previous != digest:
+				changes = append(changes, &TagChange{Repo: repo, Tag: tag, Change: TagRetagged, Digest: digest, PreviousDigest: previous})
+			}
+		}
+	}
+	for repo, r := range before.Repositories {
+		next := after.Repositories[repo]
+		for tag, digest := range r.Tags {
+			found := false
+			if next != nil {
+				_, found = next.Tags[tag]
+			}
+			if !found {
+				changes = append(changes, &TagChange{Repo: repo, Tag: tag, Change: TagRemoved, PreviousDigest: digest})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Repo != changes[j].Repo {
+			return changes[i].Repo < changes[j].Repo
+		}
+		return changes[i].Tag < changes[j].Tag
+	})
+	return changes
+}
+
+// String formats c for table output: the change, the tag and its digests.
+func (c *TagChange) String() string {
+	digest := shortDigest(c.Digest)
+	switch c.Change {
+	case TagRetagged:
+		digest = shortDigest(c.PreviousDigest) + " -> " + digest
+	case TagRemoved:
+		digest = shortDigest(c.PreviousDigest)
+	}
+	return fmt.Sprintf("%-8v  %v:%v  %v", c.Change, c.Repo, c.Tag, digest)
+}
+
+func snapshotSave(ctx context.Context, args []string) {
+	fs := commandFlags("snapshot")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(1))
+	repos, errs := getRepoInfo(ctx, reg)
+	if ctx.Err() != nil {
+		log.Println("interrupted, no snapshot written")
+		exit(ExitCodeInterrupted)
+	}
+	warnIncomplete(errs)
+	err := writeSnapshot(fs.Arg(0), newSnapshot(reg.name(), repos))
+	if err != nil {
+		fatal(err)
+	}
+	if len(errs) > 0 {
+		exit(ExitCodeIncomplete)
+	}
+}
+
+func snapshotDiff(args []string) {
+	fs := commandFlags("snapshot")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	old, err := readSnapshot(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	cur, err := readSnapshot(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	changes := diffSnapshots(old, cur)
+	if *outputFlag == OutputTable {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		return
+	}
+	if changes == nil {
+		changes = []*TagChange{}
+	}
+	printJson(changes)
+}
+
+func snapshot(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		commandFlags("snapshot").Usage()
+		exit(2)
+	}
+	switch args[0] {
+	case "save":
+		snapshotSave(ctx, args[1:])
+	case "diff":
+		snapshotDiff(args[1:])
+	default:
+		fatalf("snapshot: unknown command %q", args[0])
+	}
+}
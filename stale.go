@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StaleRepo is a repository whose newest tag is older than the threshold.
+type StaleRepo struct {
+	Registry  string
+	Repo      string
+	NewestTag string
+	Created   JsonTime
+	AgeDays   int
+	Tags      int
+	Team      string `json:",omitempty"`
+}
+
+// staleRepos returns the repositories of repos without a tag created within
+// maxAge, oldest first.
+func staleRepos(conf *Config, registry string, repos map[string][]TagDetail, maxAge time.Duration, now time.Time) []*StaleRepo {
+	var stale []*StaleRepo
+	for repo, tags := range repos {
+		if len(tags) == 0 {
+			continue
+		}
+		newest := tags[0]
+		age := now.Sub(time.Time(newest.Created))
+		if age <= maxAge {
+			continue
+		}
+		s := &StaleRepo{
+			Registry:  registry,
+			Repo:      repo,
+			NewestTag: newest.Tag,
+			Created:   newest.Created,
+			AgeDays:   int(age.Hours() / 24),
+			Tags:      len(tags),
+		}
+		if owner := conf.findOwner(repo); owner != nil {
+			s.Team = owner.Team
+		}
+		stale = append(stale, s)
+	}
+	return stale
+}
+
+func staleCommand(ctx context.Context, args []string) {
+	fs := commandFlags("stale")
+	olderThan := fs.String("older-than", "180d", "age of the newest tag from which a repository is stale, e.g. 90d or 720h")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	maxAge, err := parseAge(*olderThan)
+	if err != nil {
+		fatal(err)
+	}
+	var regs []*Registry
+	for _, arg := range fs.Args() {
+		regs = append(regs, resolveRegistries(arg)...)
+	}
+
+	now := time.Now()
+	stale := []*StaleRepo{}
+	incomplete := false
+	for _, reg := range regs {
+		repos, errs := getRepoInfo(ctx, reg)
+		if ctx.Err() != nil {
+			log.Println("interrupted")
+			exit(ExitCodeInterrupted)
+		}
+		warnIncomplete(errs)
+		incomplete = incomplete || len(errs) > 0
+		stale = append(stale, staleRepos(localConf, reg.name(), repos, maxAge, now)...)
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		a, b := time.Time(stale[i].Created), time.Time(stale[j].Created)
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		if stale[i].Registry != stale[j].Registry {
+			return stale[i].Registry < stale[j].Registry
+		}
+		return stale[i].Repo < stale[j].Repo
+	})
+
+	if *outputFlag == OutputTable {
+		for _, s := range stale {
+			line := fmt.Sprintf("%5dd  %v  %v  newest %v (%v)  %d tags  %v", s.AgeDays, s.Registry, s.Repo, s.NewestTag, time.Time(s.Created).Format(TimeOutputLayout), s.Tags, s.Team)
+			fmt.Println(strings.TrimSpace(line))
+		}
+	} else {
+		printJson(stale)
+	}
+	if incomplete {
+		exit(ExitCodeIncomplete)
+	}
+}
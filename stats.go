@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var statsFlag = flag.Bool("stats", false, "print request counts by endpoint, retries, cache hits, latency percentiles and the time spent per phase to stderr when the run ends")
+
+// Endpoints requests are counted by.
+const (
+	EndpointPing      = "ping"
+	EndpointCatalog   = "catalog"
+	EndpointTags      = "tags"
+	EndpointManifests = "manifests"
+	EndpointBlobs     = "blobs"
+	EndpointUploads   = "uploads"
+	EndpointReferrers = "referrers"
+	EndpointToken     = "token"
+	EndpointOther     = "other"
+)
+
+// endpoint classifies a request by the API endpoint it is sent to. Token
+// requests are told apart by their scope or service parameter, as the realm
+// can be any url.
+func endpoint(req *http.Request) string {
+	path := req.URL.Path
+	query := req.URL.Query()
+	switch {
+	case query.Get("scope") != "" || query.Get("service") != "":
+		return EndpointToken
+	case strings.HasSuffix(path, "/v2/"):
+		return EndpointPing
+	case strings.HasSuffix(path, "/v2/_catalog"):
+		return EndpointCatalog
+	case strings.Contains(path, "/tags/list"):
+		return EndpointTags
+	case strings.Contains(path, "/manifests/"):
+		return EndpointManifests
+	case strings.Contains(path, "/blobs/uploads"):
+		return EndpointUploads
+	case strings.Contains(path, "/blobs/"):
+		return EndpointBlobs
+	case strings.Contains(path, "/referrers/"):
+		return EndpointReferrers
+	}
+	return EndpointOther
+}
+
+// EndpointStats are the requests sent to an endpoint; latencies are in
+// milliseconds.
+type EndpointStats struct {
+	Endpoint string
+	Requests int
+	Errors   int
+	P50      float64
+	P95      float64
+}
+
+// PhaseStats is the time a run spent in one of its phases, e.g. probing a
+// registry or listing its tags, in seconds.
+type PhaseStats struct {
+	Phase   string
+	Seconds float64
+}
+
+// RateLimitStats is the rate limit a registry told about in the headers of
+// its responses, e.g. the pull limit of Docker Hub, and the requests it
+// turned away with 429 Too Many Requests.
+type RateLimitStats struct {
+	Registry string
+	Limit    int `json:",omitempty"`
+	// Remaining is what the latest response said remains, LowestRemaining
+	// the least any did.
+	Remaining       int
+	LowestRemaining int
+	WindowSeconds   int `json:",omitempty"`
+	Throttled       int
+	// SlowedDown counts the requests sent slower because fewer than the
+	// minRemaining of the registry remained.
+	SlowedDown int `json:",omitempty"`
+}
+
+// QuotaStats is the storage quota of a Harbor project, in bytes; a Hard
+// quota of -1 is unlimited.
+type QuotaStats struct {
+	Registry string
+	Project  string
+	Used     int64
+	Hard     int64
+}
+
+// RunStats is what -stats prints.
+type RunStats struct {
+	Requests   int
+	Retries    int
+	CacheHits  int
+	Endpoints  []EndpointStats
+	Phases     []PhaseStats
+	RateLimits []RateLimitStats `json:",omitempty"`
+	Quotas     []QuotaStats     `json:",omitempty"`
+	Elapsed    float64
+}
+
+// runStats collects the requests, retries and cache hits of the run.
+type runStats struct {
+	mu        sync.Mutex
+	start     time.Time
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	retries   int
+	cacheHits int
+	phases    []string
+	spent     map[string]time.Duration
+	// rate limits by registry, and Harbor quotas in the order read
+	rateLimits map[string]*RateLimitStats
+	quotas     []QuotaStats
+}
+
+var requestStats = &runStats{
+	start:     time.Now(),
+	latencies: make(map[string][]time.Duration),
+	errors:    make(map[string]int),
+	spent:     make(map[string]time.Duration),
+
+	rateLimits: make(map[string]*RateLimitStats),
+}
+
+func (s *runStats) request(endpoint string, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[endpoint] = append(s.latencies[endpoint], d)
+	if failed {
+		s.errors[endpoint]++
+	}
+}
+
+func (s *runStats) retry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+func (s *runStats) cacheHit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cacheHits++
+}
+
+// rateLimit records the rate limit headers of a response of registry, if
+// it had any, and whether it was turned away for sending too many requests.
+func (s *runStats) rateLimit(registry string, limits rateLimitHeaders, ok bool, throttled bool) {
+	if !ok && !throttled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.rateLimits[registry]
+	if r == nil {
+		r = &RateLimitStats{Registry: registry, Remaining: -1, LowestRemaining: -1}
+		s.rateLimits[registry] = r
+	}
+	if throttled {
+		r.Throttled++
+	}
+	if !ok {
+		return
+	}
+	r.Remaining = limits.remaining
+	if r.LowestRemaining < 0 || limits.remaining < r.LowestRemaining {
+		r.LowestRemaining = limits.remaining
+	}
+	if limits.limit > 0 {
+		r.Limit = limits.limit
+	}
+	if limits.window > 0 {
+		r.WindowSeconds = int(limits.window.Seconds())
+	}
+}
+
+func (s *runStats) slowedDown(registry string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.rateLimits[registry]; r != nil {
+		r.SlowedDown++
+	}
+}
+
+func (s *runStats) quota(registry string, project string, used int64, hard int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas = append(s.quotas, QuotaStats{Registry: registry, Project: project, Used: used, Hard: hard})
+}
+
+// phase starts timing a phase of the run and returns the func ending it.
+// Phases run more than once, e.g. once per registry, add up.
+func phase(name string) func() {
+	start := time.Now()
+	return func() {
+		s := requestStats
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.spent[name]; !ok {
+			s.phases = append(s.phases, name)
+		}
+		s.spent[name] += time.Since(start)
+	}
+}
+
+// total is the number of requests sent so far.
+func (s *runStats) total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, l := range s.latencies {
+		n += len(l)
+	}
+	return n
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+func (s *runStats) summary() *RunStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &RunStats{
+		Retries:   s.retries,
+		CacheHits: s.cacheHits,
+		Elapsed:   time.Since(s.start).Seconds(),
+	}
+	for endpoint, latencies := range s.latencies {
+		sorted := append([]time.Duration(nil), latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		r.Requests += len(sorted)
+		r.Endpoints = append(r.Endpoints, EndpointStats{
+			Endpoint: endpoint,
+			Requests: len(sorted),
+			Errors:   s.errors[endpoint],
+			P50:      percentile(sorted, 0.5),
+			P95:      percentile(sorted, 0.95),
+		})
+	}
+	sort.Slice(r.Endpoints, func(i, j int) bool {
+		if r.Endpoints[i].Requests != r.Endpoints[j].Requests {
+			return r.Endpoints[i].Requests > r.Endpoints[j].Requests
+		}
+		return r.Endpoints[i].Endpoint < r.Endpoints[j].Endpoint
+	})
+	for _, name := range s.phases {
+		r.Phases = append(r.Phases, PhaseStats{Phase: name, Seconds: s.spent[name].Seconds()})
+	}
+	for _, l := range s.rateLimits {
+		r.RateLimits = append(r.RateLimits, *l)
+	}
+	sort.Slice(r.RateLimits, func(i, j int) bool {
+		return r.RateLimits[i].Registry < r.RateLimits[j].Registry
+	})
+	r.Quotas = append(r.Quotas, s.quotas...)
+	return r
+}
+
+func printStats(r *RunStats) {
+	if *outputFlag != OutputTable {
+		j, err := marshalJson(map[string]*RunStats{"Stats": r})
+		if err == nil {
+			fmt.Fprintln(os.Stderr, string(j))
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%-10v %8v %7v %9v %9v\n", "ENDPOINT", "REQUESTS", "ERRORS", "P50", "P95")
+	for _, e := range r.Endpoints {
+		fmt.Fprintf(os.Stderr, "%-10v %8d %7d %7.1fms %7.1fms\n", e.Endpoint, e.Requests, e.Errors, e.P50, e.P95)
+	}
+	fmt.Fprintf(os.Stderr, "%d requests, %d retries, %d cache hits in %.1fs\n", r.Requests, r.Retries, r.CacheHits, r.Elapsed)
+	for _, p := range r.Phases {
+		fmt.Fprintf(os.Stderr, "  %-12v %.2fs\n", p.Phase, p.Seconds)
+	}
+	for _, l := range r.RateLimits {
+		line := fmt.Sprintf("rate limit of %v: %d throttled", l.Registry, l.Throttled)
+		if l.Remaining >= 0 {
+			line = fmt.Sprintf("rate limit of %v: %d of %d remaining, %d at the lowest, %d throttled", l.Registry, l.Remaining, l.Limit, l.LowestRemaining, l.Throttled)
+		}
+		if l.WindowSeconds > 0 {
+			line += fmt.Sprintf(", window %v", time.Duration(l.WindowSeconds)*time.Second)
+		}
+		if l.SlowedDown > 0 {
+			line += fmt.Sprintf(", %d requests slowed down", l.SlowedDown)
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	for _, q := range r.Quotas {
+		hard := "unlimited"
+		if q.Hard >= 0 {
+			hard = humanBytes(q.Hard)
+		}
+		fmt.Fprintf(os.Stderr, "quota of %v/%v: %v of %v used\n", q.Registry, q.Project, humanBytes(q.Used), hard)
+	}
+}
+
+// statsTransport counts every request sent, retries included, by endpoint.
+type statsTransport struct {
+	base http.RoundTripper
+}
+
+// countedKey marks the context of a request some statsTransport counted, as
+// the transport of a registry may wrap the counted default transport again.
+type countedKey struct{}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(countedKey{}) != nil {
+		return t.base.RoundTrip(req)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), countedKey{}, true))
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	requestStats.request(endpoint(req), time.Since(start), err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests)
+	return res, err
+}
+
+func countRequests(rt http.RoundTripper) http.RoundTripper {
+	return &statsTransport{base: rt}
+}
+
+func init() {
+	httpClient.Transport = countRequests(httpClient.Transport)
+	atExit = append(atExit, func() {
+		if *statsFlag {
+			printStats(requestStats.summary())
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OutputJson  = "json"
+	OutputTable = "table"
+	OutputRefs  = "refs"
+	OutputTree  = "tree"
+)
+
+var (
+	outputFlag  = flag.String("output", OutputJson, "output format: json, table, refs, or tree for repositories grouped by namespace")
+	maxRowsFlag = flag.Int("max-rows", 100, "rows of table output before tags are truncated per repository, 0 for no limit")
+)
+
+// quietFlag is -q and -quiet, short for -output refs.
+type quietFlag struct{}
+
+func (quietFlag) String() string   { return "false" }
+func (quietFlag) IsBoolFlag() bool { return true }
+
+func (quietFlag) Set(s string) error {
+	quiet, err := strconv.ParseBool(s)
+	if quiet {
+		*outputFlag = OutputRefs
+	}
+	return err
+}
+
+func init() {
+	flag.Var(quietFlag{}, "q", "only print image references, one per line; short for -output refs")
+	flag.Var(quietFlag{}, "quiet", "same as -q")
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// detailCells formats the creation time and size of tag, left blank when
+// the scan did not fetch its manifest.
+func detailCells(tag TagDetail) (created string, size string) {
+	if !time.Time(tag.Created).IsZero() {
+		created = time.Time(tag.Created).Format(TimeOutputLayout)
+	}
+	if tag.Size > 0 {
+		size = humanBytes(tag.Size)
+	}
+	return
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > 19 {
+		return digest[:19]
+	}
+	return digest
+}
+
+func signedCell(signed *bool) string {
+	switch {
+	case signed == nil:
+		return ""
+	case *signed:
+		return "yes"
+	}
+	return "no"
+}
+
+func vulnCell(v *VulnSummary) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", v.Critical, v.High)
+}
+
+// tagsPerRepo returns how many tags of each repository fit in maxRows,
+// counting a hint line for every truncated repository, or -1 if all do.
+func tagsPerRepo(repos map[string][]TagDetail, maxRows int) int {
+	rows := func(k int) int {
+		n := 0
+		for _, tags := range repos {
+			if k < 0 || len(tags) <= k {
+				n += len(tags)
+			} else {
+				n += k + 1
+			}
+		}
+		return n
+	}
+	if maxRows <= 0 || rows(-1) <= maxRows {
+		return -1
+	}
+	k := 1
+	for rows(k+1) <= maxRows {
+		k++
+	}
+	return k
+}
+
+func writeTable(w io.Writer, registry string, repos map[string][]TagDetail, maxRows int) {
+	limit := tagsPerRepo(repos, maxRows)
+	header := []string{"REPOSITORY", "TAG", "CREATED", "SIZE", "DIGEST"}
+	artifacts, shared, checked, scanned, used := false, false, false, false, false
+	for _, tags := range repos {
+		for _, tag := range tags {
+			artifacts = artifacts || tag.ArtifactType != ""
+			shared = shared || len(tag.SameDigest) > 0
+			checked = checked || tag.Signed != nil
+			scanned = scanned || tag.Vulnerabilities != nil
+			used = used || len(tag.InUseBy) > 0
+		}
+	}
+	if artifacts {
+		header = append(header, "ARTIFACT")
+	}
+	if shared {
+		header = append(header, "SAME DIGEST")
+	}
+	if checked {
+		header = append(header, "SIGNED")
+	}
+	if scanned {
+		header = append(header, "CRITICAL/HIGH")
+	}
+	if used {
+		header = append(header, "IN USE BY")
+	}
+	var rows [][]string
+	hints := make(map[int]string)
+	for _, repo := range outputRepos(repos) {
+		tags := repos[repo]
+		if len(tags) == 0 {
+			rows = append(rows, []string{repo, "(no tags)"})
+			continue
+		}
+		shown := tags
+		if limit >= 0 && len(tags) > limit {
+			shown = tags[:limit]
+		}
+		for _, tag := range shown {
+			created, size := detailCells(tag)
+			row := []string{repo, tag.Tag, created, size, shortDigest(tag.Digest)}
+			if artifacts {
+				row = append(row, artifactKind(tag.ArtifactType))
+			}
+			if shared {
+				row = append(row, strings.Join(tag.SameDigest, ", "))
+			}
+			if checked {
+				row = append(row, signedCell(tag.Signed))
+			}
+			if scanned {
+				row = append(row, vulnCell(tag.Vulnerabilities))
+			}
+			if used {
+				row = append(row, strings.Join(tag.InUseBy, ", "))
+			}
+			rows = append(rows, row)
+		}
+		if more := len(tags) - len(shown); more > 0 {
+			hints[len(rows)-1] = fmt.Sprintf("  … %d more tags (use `tags %v %v` to expand)", more, registry, repo)
+		}
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if n := len([]rune(cell)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	line := func(row []string) {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-len([]rune(cell)))
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+	line(header)
+	for i, row := range rows {
+		line(row)
+		if hint, ok := hints[i]; ok {
+			fmt.Fprintln(w, hint)
+		}
+	}
+}
+
+// writeRefs writes a reference to every image of repos, one per line, e.g.
+// registry.example.org:5000/team-a/app:v1, for piping into docker pull or a
+// scanner. Signatures, attestations and other artifacts are left out.
+func writeRefs(w io.Writer, reg *Registry, repos map[string][]TagDetail) {
+	for _, repo := range outputRepos(repos) {
+		name, err := imageName(reg, repo)
+		if err != nil {
+			fatal(err)
+		}
+		for _, tag := range repos[repo] {
+			if tag.ArtifactType != "" || isArtifactTag(tag.Tag) {
+				continue
+			}
+			fmt.Fprintf(w, "%v:%v\n", name, tag.Tag)
+		}
+	}
+}
+
+// tags lists every tag of some repositories, without truncation.
+func tags(ctx context.Context, args []string) {
+	fs := commandFlags("tags")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	repos, errs := getInfoOfRepos(ctx, reg, fs.Args()[1:])
+	warnIncomplete(errs)
+	switch *outputFlag {
+	case OutputTable:
+		writeTable(os.Stdout, fs.Arg(0), repos, 0)
+	case OutputRefs:
+		writeRefs(os.Stdout, reg, repos)
+	case OutputTree:
+		writeTree(os.Stdout, fs.Arg(0), repos, time.Now())
+	default:
+		printOutput(RepoTags(repos))
+	}
+	if len(errs) > 0 {
+		exit(ExitCodeIncomplete)
+	}
+}
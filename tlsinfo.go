@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"time"
+)
+
+const ExitCodeTLSProblem = 2
+
+type TLSInfo struct {
+	Registry     string
+	Address      string
+	Version      string      `json:",omitempty"`
+	Chain        []*CertInfo `json:",omitempty"`
+	DaysToExpiry int
+	Problems     []string `json:",omitempty"`
+}
+
+type CertInfo struct {
+	Subject      string
+	Issuer       string
+	SANs         []string `json:",omitempty"`
+	NotBefore    JsonTime
+	NotAfter     JsonTime
+	DaysToExpiry int
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func daysUntil(t time.Time, now time.Time) int {
+	return int(t.Sub(now).Hours() / 24)
+}
+
+// tlsAddress returns the host:port reg is served on, or false for plain http.
+func tlsAddress(reg *Registry) (string, string, bool) {
+	u, err := neturl.Parse(reg.Addr)
+	if err != nil || u.Scheme != "https" {
+		return "", "", false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), u.Hostname(), true
+}
+
+// inspectTLS connects to reg and reports its certificate chain. The chain is
+// fetched without verification so that broken certificates can be reported
+// instead of just failing the handshake.
+func inspectTLS(ctx context.Context, reg *Registry, alias string, warnDays int, now time.Time) (*TLSInfo, error) {
+	info := &TLSInfo{Registry: alias, Address: reg.Addr}
+	addr, host, ok := tlsAddress(reg)
+	if !ok {
+		info.Problems = append(info.Problems, "not served over https")
+		return info, nil
+	}
+
+	conf := &tls.Config{}
+	if reg.tlsConfig != nil {
+		conf = reg.tlsConfig.Clone()
+	}
+	roots := conf.RootCAs
+	conf.InsecureSkipVerify = true
+	conf.ServerName = host
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: reg.requestTimeout()}, Config: conf}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	conn.Close()
+
+	info.Version = tlsVersions[state.Version]
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		info.Problems = append(info.Problems, "no certificate presented")
+		return info, nil
+	}
+	for _, cert := range certs {
+		info.Chain = append(info.Chain, &CertInfo{
+			Subject:      cert.Subject.String(),
+			Issuer:       cert.Issuer.String(),
+			SANs:         cert.DNSNames,
+			NotBefore:    JsonTime(cert.NotBefore),
+			NotAfter:     JsonTime(cert.NotAfter),
+			DaysToExpiry: daysUntil(cert.NotAfter, now),
+		})
+	}
+
+	leaf := certs[0]
+	info.DaysToExpiry = daysUntil(leaf.NotAfter, now)
+	for i, cert := range certs {
+		switch {
+		case now.After(cert.NotAfter):
+			info.Problems = append(info.Problems, fmt.Sprintf("certificate %d (%v) expired on %v", i, cert.Subject.CommonName, cert.NotAfter.Format(TimeOutputLayout)))
+		case now.Before(cert.NotBefore):
+			info.Problems = append(info.Problems, fmt.Sprintf("certificate %d (%v) is not valid before %v", i, cert.Subject.CommonName, cert.NotBefore.Format(TimeOutputLayout)))
+		case daysUntil(cert.NotAfter, now) < warnDays:
+			info.Problems = append(info.Problems, fmt.Sprintf("certificate %d (%v) expires in %d days", i, cert.Subject.CommonName, daysUntil(cert.NotAfter, now)))
+		}
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		info.Problems = append(info.Problems, err.Error())
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now})
+	if err != nil {
+		info.Problems = append(info.Problems, fmt.Sprintf("chain does not verify: %v", err))
+	}
+	return info, nil
+}
+
+func tlsInfo(ctx context.Context, args []string) {
+	fs := commandFlags("tls-info")
+	warnDays := fs.Int("warn-days", 30, "flag certificates expiring within this many days")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		exit(2)
+	}
+
+	exitCode := 0
+	var infos []*TLSInfo
+	for _, alias := range fs.Args() {
+		info, err := inspectTLS(ctx, resolveRegistry(alias), alias, *warnDays, time.Now())
+		if err != nil {
+			fatalf("%v: %v", alias, err)
+		}
+		if len(info.Problems) > 0 {
+			exitCode = ExitCodeTLSProblem
+		}
+		infos = append(infos, info)
+	}
+	printJson(infos)
+	exit(exitCode)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+var noTokenCacheFlag = flag.Bool("no-token-cache", false, "neither reuse the bearer tokens of earlier runs nor keep those of this run")
+
+type cachedToken struct {
+	Token  string
+	Expiry time.Time
+}
+
+// tokenCache keeps the bearer tokens of a registry, by scope, in a file
+// only the user can read, so that later runs reuse them until they expire.
+type tokenCache struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	tokens map[string]cachedToken
+}
+
+// tokenStore returns the token cache of reg, or nil when tokens are not
+// kept, as when recording or replaying a run, which needs every token
+// request. Its file is named after the address of reg and the credentials
+// configured for it, so tokens are never used with other credentials.
+func (reg *Registry) tokenStore() registryclient.TokenStore {
+	if *noTokenCacheFlag || *recordFlag != "" || *replayFlag != "" {
+		return nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return nil
+	}
+	return &tokenCache{path: filepath.Join(base, configDirName, "tokens", reg.credentialsKey()+".json")}
+}
+
+// credentialsKey is a hash of the address of reg and the credentials
+// configured for it, to keep what is cached for one login from another.
+// With docker config credentials, the user docker login stored for the host
+// is part of it, as logging in as someone else changes no setting of reg.
+func (reg *Registry) credentialsKey() string {
+	username := reg.Username
+	if reg.authType() == AuthDockerConfig {
+		username, _, _ = lookupDockerConfig(reg)
+	}
+	sum := sha256.Sum256([]byte(reg.Addr + "\x00" + reg.Type + "\x00" + reg.authType() + "\x00" + username + "\x00" + reg.Password + "\x00" + reg.Token + "\x00" + reg.KeyFile))
+	return hex.EncodeToString(sum[:16])
+}
+
+// load reads the file once; a missing or unreadable file is an empty cache.
+func (c *tokenCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.tokens = make(map[string]cachedToken)
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &c.tokens); err != nil {
+		debugf(LogRequests, logFields{}, "token cache %v: %v", c.path, err)
+		c.tokens = make(map[string]cachedToken)
+	}
+}
+
+func (c *tokenCache) Load(scope string) (string, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	t, ok := c.tokens[scope]
+	if !ok || !time.Now().Before(t.Expiry) {
+		return "", time.Time{}, false
+	}
+	return t.Token, t.Expiry, true
+}
+
+// Store adds a token and writes the tokens that have not expired back. The
+// file is read again and written while holding its lock, so that the
+// tokens concurrent runs store in between are kept, and written through a
+// temporary file so that they never read half a file.
+func (c *tokenCache) Store(scope string, token string, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := os.MkdirAll(filepath.Dir(c.path), 0700)
+	var unlock func()
+	if err == nil {
+		unlock, err = lockFile(c.path)
+	}
+	if err != nil {
+		debugf(LogRequests, logFields{}, "token cache %v: %v", c.path, err)
+		return
+	}
+	defer unlock()
+	c.loaded = false
+	c.load()
+	c.tokens[scope] = cachedToken{Token: token, Expiry: expiry}
+	now := time.Now()
+	for s, t := range c.tokens {
+		if !now.Before(t.Expiry) {
+			delete(c.tokens, s)
+		}
+	}
+	b, err := json.Marshal(c.tokens)
+	if err == nil {
+		err = writePrivateFile(c.path, b)
+	}
+	if err != nil {
+		debugf(LogRequests, logFields{}, "token cache %v: %v", c.path, err)
+	}
+}
+
+// staleLock is how long a lock is held at most; an older one was left by a
+// run that died holding it.
+const staleLock = 10 * time.Second
+
+// lockFile takes the lock of path, a file next to it only one process can
+// create, waiting for a run holding it. It works the same on every system,
+// unlike flock.
+func lockFile(path string) (unlock func(), err error) {
+	lock := path + ".lock"
+	for deadline := time.Now().Add(staleLock); ; time.Sleep(10 * time.Millisecond) {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%v: locked for %v", lock, staleLock)
+		}
+	}
+}
+
+// writePrivateFile replaces the file at path with b, readable only by the
+// user, in a directory only the user can list.
+func writePrivateFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTokenCacheConcurrentStores checks that runs storing tokens at the same
+// time keep each other's, as each reads the file before writing it.
+func TestTokenCacheConcurrentStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens", "reg.json")
+	expiry := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		// a cache of its own for every run, loaded before the others store
+		c := &tokenCache{path: path}
+		c.Load("")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Store(fmt.Sprintf("repository:app-%d:pull", i), fmt.Sprintf("token-%d", i), expiry)
+		}(i)
+	}
+	wg.Wait()
+	c := &tokenCache{path: path}
+	for i := 0; i < 8; i++ {
+		if token, _, ok := c.Load(fmt.Sprintf("repository:app-%d:pull", i)); !ok || token != fmt.Sprintf("token-%d", i) {
+			t.Errorf("token of app-%d: %q, %v", i, token, ok)
+		}
+	}
+}
+
+func TestLockFileTakesOverStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	// a run that died holding the lock
+	if _, err := lockFile(path); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(path+".lock", stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	unlock()
+}
+
+// TestCredentialsKeyOfDockerConfig checks that tokens are kept apart for
+// every user docker login stored for the same registry.
+func TestCredentialsKeyOfDockerConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	reg := &Registry{Addr: "https://reg.example.org", AuthType: AuthDockerConfig}
+	keyOf := func(username string) string {
+		config := fmt.Sprintf(`{"auths": {"reg.example.org": {"username": %q, "password": "secret"}}}`, username)
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return reg.credentialsKey()
+	}
+	if alice, bob := keyOf("alice"), keyOf("bob"); alice == bob {
+		t.Error("users of the docker config share the key of their tokens")
+	}
+	if keyOf("alice") != keyOf("alice") {
+		t.Error("key of the same user changes")
+	}
+}
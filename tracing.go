@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the run; it does nothing unless tracing is
+// set up.
+var tracer = otel.Tracer("github.com/ajjiangxin/list-docker-registry-images")
+
+// tracingEnabled reports whether the standard OpenTelemetry environment
+// asks for traces to be exported over OTLP.
+func tracingEnabled() bool {
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// envCarrier reads the TRACEPARENT and TRACESTATE environment variables a
+// calling pipeline sets, so the run joins its trace.
+type envCarrier struct{}
+
+func (envCarrier) Get(key string) string { return os.Getenv(envName(key)) }
+func (envCarrier) Set(string, string)    {}
+func (envCarrier) Keys() []string        { return []string{"traceparent", "tracestate"} }
+
+func envName(key string) string {
+	switch key {
+	case "traceparent":
+		return "TRACEPARENT"
+	case "tracestate":
+		return "TRACESTATE"
+	}
+	return ""
+}
+
+// startTracing sets up an OTLP exporter configured by the standard
+// OTEL_EXPORTER_OTLP_* variables and starts the span of the whole run,
+// named after the command args run. The span ends and the exporter is
+// flushed when the run ends.
+func startTracing(ctx context.Context, args []string) context.Context {
+	if !tracingEnabled() {
+		return ctx
+	}
+	command := "scan"
+	if cmd, ok := findCommand(args[0]); ok {
+		command = cmd.Name
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/protobuf" {
+		log.Printf("tracing: OTLP over %v is not supported, exporting over http/protobuf", protocol)
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Printf("tracing: %v", err)
+		return ctx
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.version", toolVersion())))
+	if err != nil {
+		res = resource.Default()
+	}
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		res, _ = resource.Merge(res, resource.NewSchemaless(attribute.String("service.name", programName)))
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, envCarrier{})
+	ctx, span := tracer.Start(ctx, command)
+	atExit = append(atExit, func() {
+		if exitCode != 0 {
+			span.SetStatus(codes.Error, "exit code "+strconv.Itoa(exitCode))
+		}
+		span.SetAttributes(attribute.Int("process.exit.code", exitCode))
+		span.End()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("tracing: %v", err)
+		}
+	})
+	return ctx
+}
+
+// traceTransport wraps every request to a registry in a client span named
+// after the endpoint, e.g. "GET manifests", and propagates the trace to the
+// registry.
+type traceTransport struct {
+	base     http.RoundTripper
+	registry string
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanFromContext(req.Context()).SpanContext().IsValid() {
+		return t.base.RoundTrip(req)
+	}
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+endpoint(req),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("registry", t.registry),
+		))
+	defer span.End()
+	if repo, ref := refOfURL(req.URL); repo != "" {
+		span.SetAttributes(attribute.String("registry.repository", repo))
+		if ref != "" {
+			span.SetAttributes(attribute.String("registry.reference", ref))
+		}
+	}
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return res, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 400 {
+		span.SetStatus(codes.Error, res.Status)
+	}
+	return res, err
+}
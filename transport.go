@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TLSConfig configures how the connection to a registry is secured.
+type TLSConfig struct {
+	Insecure bool   `json:"insecure"`
+	CAFile   string `json:"caFile"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// parseProxy validates a proxy url; http, https and socks5 proxies are supported.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("proxy %v: unsupported scheme %q", proxy, u.Scheme)
+}
+
+// newTransport builds a transport that connects through proxy, or through
+// the proxy selected by HTTP_PROXY/HTTPS_PROXY/NO_PROXY when proxy is nil.
+func newTransport(tlsConfig *tls.Config, proxy *url.URL) *http.Transport {
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != nil {
+		proxyFunc = http.ProxyURL(proxy)
+	}
+	return &http.Transport{
+		Proxy:           proxyFunc,
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 5 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     5 * time.Second,
+	}
+}
+
+// transport returns the base transport of reg, secured by its TLS settings
+// and connecting through its proxy or unix socket.
+func (reg *Registry) transport() http.RoundTripper {
+	if reg.socket != "" {
+		t := newTransport(reg.tlsConfig, nil)
+		t.Proxy = nil
+		t.DialContext = dialUnix(reg.socket)
+		return t
+	}
+	if reg.tlsConfig == nil && reg.proxyURL == nil {
+		return httpClient.Transport
+	}
+	return newTransport(reg.tlsConfig, reg.proxyURL)
+}
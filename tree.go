@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// namespaceNode is a repository or namespace of a registry, e.g. team-a of
+// team-a/app, with the tags of everything below it.
+type namespaceNode struct {
+	name     string
+	repo     bool
+	tags     int
+	newest   time.Time
+	children map[string]*namespaceNode
+}
+
+// namespaceTree groups repos by the slash-separated parts of their names.
+func namespaceTree(repos map[string][]TagDetail) *namespaceNode {
+	root := &namespaceNode{children: make(map[string]*namespaceNode)}
+	for repo, tags := range repos {
+		newest := newestTag(tags)
+		node := root
+		node.add(len(tags), newest)
+		for _, part := range strings.Split(repo, "/") {
+			child, ok := node.children[part]
+			if !ok {
+				child = &namespaceNode{name: part, children: make(map[string]*namespaceNode)}
+				node.children[part] = child
+			}
+			node = child
+			node.add(len(tags), newest)
+		}
+		node.repo = true
+	}
+	return root
+}
+
+func (n *namespaceNode) add(tags int, newest time.Time) {
+	n.tags += tags
+	if newest.After(n.newest) {
+		n.newest = newest
+	}
+}
+
+// sortedChildren returns the children of n in the -sort-repos order, ties
+// broken by name.
+func (n *namespaceNode) sortedChildren() []*namespaceNode {
+	children := make([]*namespaceNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		switch {
+		case sortReposFlag == SortTagCount && a.tags != b.tags:
+			return a.tags > b.tags
+		case sortReposFlag == SortNewestFirst && !a.newest.Equal(b.newest):
+			return a.newest.After(b.newest)
+		}
+		return a.name < b.name
+	})
+	return children
+}
+
+// formatAge formats how long ago t was, coarsely: minutes, hours or days.
+func formatAge(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := now.Sub(t)
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// writeTree writes the repositories of registry as a tree of their
+// namespaces, with the tag count and the age of the newest tag of every
+// namespace and repository. Namespaces end in a slash.
+func writeTree(w io.Writer, registry string, repos map[string][]TagDetail, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	root := namespaceTree(repos)
+	fmt.Fprintln(tw, "NAMESPACE\tTAGS\tNEWEST")
+	fmt.Fprintf(tw, "%v\t%d\t%v\n", registry, root.tags, formatAge(root.newest, now))
+	var walk func(n *namespaceNode, indent string)
+	walk = func(n *namespaceNode, indent string) {
+		children := n.sortedChildren()
+		for i, child := range children {
+			branch, next := "├── ", "│   "
+			if i == len(children)-1 {
+				branch, next = "└── ", "    "
+			}
+			name := child.name
+			if !child.repo {
+				name += "/"
+			}
+			fmt.Fprintf(tw, "%v%v%v\t%d\t%v\n", indent, branch, name, child.tags, formatAge(child.newest, now))
+			walk(child, indent+next)
+		}
+	}
+	walk(root, "")
+	tw.Flush()
+}
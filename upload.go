@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+func blobExists(ctx context.Context, reg *Registry, repo string, digest string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("%v/v2/%v/blobs/%v", reg.Addr, reg.repository(repo), digest), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return false, nil
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		return false, fmt.Errorf("HEAD %v: %v", req.URL, res.Status)
+	}
+	return true, nil
+}
+
+// startUpload opens a blob upload session in repo. When from names another
+// repository of the registry the blob is mounted from there instead, and
+// mounted reports whether that worked.
+func startUpload(ctx context.Context, reg *Registry, repo string, digest string, from string) (location string, mounted bool, err error) {
+	url := fmt.Sprintf("%v/v2/%v/blobs/uploads/", reg.Addr, reg.repository(repo))
+	if from != "" {
+		url += "?" + neturl.Values{"mount": {digest}, "from": {reg.repository(from)}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return
+	}
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return "", true, nil
+	case http.StatusAccepted:
+	default:
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", false, fmt.Errorf("POST %v: %v: %s", url, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	loc, err := req.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return
+	}
+	return loc.String(), false, nil
+}
+
+// uploadBlob stores content, size bytes long, as digest in repo, mounting it
+// from another repository first when from is set. Blobs larger than
+// chunkSize are sent in PATCH requests of that size before the closing PUT;
+// with a chunkSize of 0 every blob is sent in a single monolithic PUT.
+func uploadBlob(ctx context.Context, reg *Registry, repo string, digest string, content io.ReaderAt, size int64, from string, chunkSize int64) error {
+	location, mounted, err := startUpload(ctx, reg, repo, digest, from)
+	if err != nil || mounted {
+		return err
+	}
+
+	offset := int64(0)
+	for chunkSize > 0 && size-offset > chunkSize {
+		location, err = uploadChunk(ctx, reg, location, io.NewSectionReader(content, offset, chunkSize), offset)
+		if err != nil {
+			return err
+		}
+		offset += chunkSize
+	}
+
+	u, err := neturl.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	rest := io.NewSectionReader(content, offset, size-offset)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), rest)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = rest.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(content, offset, size-offset)), nil
+	}
+	return expectStatus(reg, req, http.StatusCreated)
+}
+
+// uploadChunk appends chunk, starting at offset of the blob, to the upload
+// session at location and returns where the session continues.
+func uploadChunk(ctx context.Context, reg *Registry, location string, chunk *io.SectionReader, offset int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, chunk)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = chunk.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+chunk.Size()-1))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(chunk, 0, chunk.Size())), nil
+	}
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("PATCH %v: %v: %s", req.URL, res.Status, strings.TrimSpace(string(body)))
+	}
+	next, err := req.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+func putManifest(ctx context.Context, reg *Registry, repo string, ref string, mediaType string, manifest []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%v/v2/%v/manifests/%v", reg.Addr, reg.repository(repo), ref), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	return expectStatus(reg, req, http.StatusCreated)
+}
+
+func expectStatus(reg *Registry, req *http.Request, status int) error {
+	res, err := reg.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != status {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%v %v: %v: %s", req.Method, req.URL, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
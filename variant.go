@@ -0,0 +1,10 @@
+//go:build !regman
+
+package main
+
+// The default build. regman.go holds the regman build.
+const (
+	programName    = "list_docker_registry_images"
+	configFileName = ".docker_registry_config.json"
+	configDirName  = "list-docker-registry-images"
+)
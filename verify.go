@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/ajjiangxin/list-docker-registry-images/registryclient"
+)
+
+const (
+	BlobStatusOK           = "ok"
+	BlobStatusMissing      = "missing"
+	BlobStatusSizeMismatch = "size-mismatch"
+
+	// verifyConcurrency is how many blobs verify checks at a time.
+	verifyConcurrency = 8
+)
+
+// BlobCheck is what the registry answered for a blob, or a platform
+// manifest, an image references.
+type BlobCheck struct {
+	// Manifest is the platform manifest referencing the blob, when the
+	// image is an index.
+	Manifest string `json:",omitempty"`
+	Kind     string
+	Digest   string
+	Size     int64
+	// ActualSize is the size the registry reported, when it differs.
+	ActualSize int64 `json:",omitempty"`
+	Status     string
+}
+
+type VerifyResult struct {
+	Repo       string
+	Reference  string
+	Digest     string
+	Blobs      []*BlobCheck
+	Missing    int
+	Mismatched int
+}
+
+// verifyImage checks that the registry has every blob the manifest of
+// repo at ref references, with the size the manifest tells, and does the
+// same for every platform manifest of an index.
+func verifyImage(ctx context.Context, reg *Registry, repo string, ref string) (*VerifyResult, error) {
+	c := reg.registryClient(ctx)
+	accept := append([]string{registryclient.MediaTypeManifestList, registryclient.MediaTypeOCIIndex}, registryclient.ImageManifestTypes...)
+	m, err := c.Manifest(ctx, reg.repository(repo), ref, accept...)
+	if err != nil {
+		return nil, err
+	}
+	result := &VerifyResult{Repo: repo, Reference: ref, Digest: m.Digest}
+	manifests := []*registryclient.Manifest{m}
+	for _, d := range m.Manifests {
+		pm, err := c.Manifest(ctx, reg.repository(repo), d.Digest, d.MediaType)
+		if err, ok := err.(*registryclient.StatusError); ok && err.StatusCode == http.StatusNotFound {
+			result.Blobs = append(result.Blobs, &BlobCheck{Kind: "manifest", Digest: d.Digest, Size: d.Size, Status: BlobStatusMissing})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, pm)
+	}
+
+	for _, pm := range manifests {
+		platform := ""
+		if pm != m {
+			platform = pm.Digest
+		}
+		seen := make(map[string]bool)
+		add := func(kind string, b registryclient.Blob) {
+			if seen[b.Digest] {
+				return
+			}
+			seen[b.Digest] = true
+			result.Blobs = append(result.Blobs, &BlobCheck{Manifest: platform, Kind: kind, Digest: b.Digest, Size: b.Size})
+		}
+		if pm.Config != nil {
+			add("config", *pm.Config)
+		}
+		for _, b := range pm.Layers {
+			add("layer", b)
+		}
+		// schema1 lists its layers with the history
+		for _, h := range pm.History {
+			if h.Layer != nil {
+				add("layer", *h.Layer)
+			}
+		}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		errs  []error
+		slots = make(chan struct{}, verifyConcurrency)
+	)
+	for _, check := range result.Blobs {
+		if check.Status != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(check *BlobCheck) {
+			defer wg.Done()
+			slots <- struct{}{}
+			size, found, err := c.BlobSize(ctx, reg.repository(repo), check.Digest)
+			<-slots
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, err)
+			case !found:
+				check.Status = BlobStatusMissing
+			// schema1 manifests do not always tell the size of their
+			// layers, and registries may not tell the size of a blob
+			case check.Size > 0 && size >= 0 && size != check.Size:
+				check.Status = BlobStatusSizeMismatch
+				check.ActualSize = size
+			default:
+				check.Status = BlobStatusOK
+			}
+		}(check)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	for _, check := range result.Blobs {
+		switch check.Status {
+		case BlobStatusMissing:
+			result.Missing++
+		case BlobStatusSizeMismatch:
+			result.Mismatched++
+		}
+	}
+	return result, nil
+}
+
+// verify checks that the blobs of an image are all there, exiting with 1
+// when any is missing or has the wrong size.
+func verify(ctx context.Context, args []string) {
+	fs := commandFlags("verify")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(2)
+	}
+	reg := resolveRegistry(fs.Arg(0))
+	repo, ref := parseReference(fs.Arg(1))
+	result, err := verifyImage(ctx, reg, repo, ref)
+	if err != nil {
+		fatal(err)
+	}
+	printJson(result)
+	if result.Missing > 0 || result.Mismatched > 0 {
+		log.Printf("%v: %d blobs missing, %d with the wrong size", fs.Arg(1), result.Missing, result.Mismatched)
+		exit(1)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScannerTrivy = "trivy"
+	ScannerGrype = "grype"
+
+	defaultScannerConcurrency = 2
+	defaultScannerTimeout     = 10 * time.Minute
+)
+
+// ScannerConfig sets up the vulnerability scanner run by scan -vulns, e.g.
+// {"tool": "grype", "concurrency": 4}. Command defaults to the tool name
+// looked up in PATH; Args are added to the arguments of every run.
+type ScannerConfig struct {
+	Tool        string   `json:"tool"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	Concurrency int      `json:"concurrency"`
+	Timeout     string   `json:"timeout"`
+
+	timeout time.Duration
+}
+
+func (s *ScannerConfig) setup() (err error) {
+	switch s.Tool {
+	case "":
+		s.Tool = ScannerTrivy
+	case ScannerTrivy, ScannerGrype:
+	default:
+		return fmt.Errorf("scanner: unknown tool %q, want %v or %v", s.Tool, ScannerTrivy, ScannerGrype)
+	}
+	if s.Concurrency < 0 {
+		return fmt.Errorf("scanner: invalid concurrency %d", s.Concurrency)
+	}
+	if s.Timeout != "" {
+		s.timeout, err = time.ParseDuration(s.Timeout)
+		if err != nil {
+			return fmt.Errorf("scanner: invalid timeout %q", s.Timeout)
+		}
+	}
+	return nil
+}
+
+// VulnSummary counts the vulnerabilities a scanner found in an image by
+// severity.
+type VulnSummary struct {
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+}
+
+func (v *VulnSummary) add(severity string) {
+	switch strings.ToLower(severity) {
+	case "critical":
+		v.Critical++
+	case "high":
+		v.High++
+	case "medium":
+		v.Medium++
+	case "low", "negligible":
+		v.Low++
+	default:
+		v.Unknown++
+	}
+}
+
+func parseTrivyReport(out []byte) (*VulnSummary, error) {
+	var report struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				Severity string
+			}
+		}
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, err
+	}
+	summary := &VulnSummary{}
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			summary.add(v.Severity)
+		}
+	}
+	return summary, nil
+}
+
+func parseGrypeReport(out []byte) (*VulnSummary, error) {
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, err
+	}
+	summary := &VulnSummary{}
+	for _, m := range report.Matches {
+		summary.add(m.Vulnerability.Severity)
+	}
+	return summary, nil
+}
+
+// imageName returns the name clients pull repo of reg by, e.g.
+// registry.example.org:5000/team-a/app: the host and path of its address,
+// configured or given on the command line, and the repository as requests
+// name it.
+func imageName(reg *Registry, repo string) (string, error) {
+	if reg.socket != "" {
+		return "", fmt.Errorf("%v: images cannot be pulled over a unix socket", reg.displayAddr())
+	}
+	u, err := neturl.Parse(reg.Addr)
+	if err != nil {
+		return "", err
+	}
+	return u.Host + strings.TrimSuffix(u.Path, "/") + "/" + reg.repository(repo), nil
+}
+
+// imageReference returns the reference scanners pull the manifest of repo
+// with the given digest by, e.g. registry.example.org:5000/team-a/app@sha256:….
+func imageReference(reg *Registry, repo string, digest string) (string, error) {
+	name, err := imageName(reg, repo)
+	if err != nil {
+		return "", err
+	}
+	return name + "@" + digest, nil
+}
+
+// scanImage runs the scanner on the manifest of repo with the given digest,
+// passing the credentials of reg in the environment variables the scanner
+// reads them from.
+func (s *ScannerConfig) scanImage(ctx context.Context, reg *Registry, repo string, digest string) (*VulnSummary, error) {
+	ref, err := imageReference(reg, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	var username, password string
+	if credentials := reg.credentials(); credentials != nil {
+		username, password, err = credentials()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// as the requests of the scan do it: a registry given as host:port on
+	// the command line is plain http without a Schema set
+	plainHTTP := strings.HasPrefix(reg.Addr, "http://")
+	insecure := plainHTTP || reg.tlsConfig != nil && reg.tlsConfig.InsecureSkipVerify
+
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = defaultScannerTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	command := s.Command
+	if command == "" {
+		command = s.Tool
+	}
+	var args, env []string
+	parse := parseTrivyReport
+	switch s.Tool {
+	case ScannerTrivy:
+		args = []string{"image", "--format", "json", "--quiet"}
+		if insecure {
+			args = append(args, "--insecure")
+		}
+		if username != "" {
+			env = append(env, "TRIVY_USERNAME="+username, "TRIVY_PASSWORD="+password)
+		}
+	case ScannerGrype:
+		args = []string{"--output", "json", "--quiet"}
+		if insecure {
+			env = append(env, "GRYPE_REGISTRY_INSECURE_USE_HTTP="+fmt.Sprint(plainHTTP), "GRYPE_REGISTRY_INSECURE_SKIP_TLS_VERIFY=true")
+		}
+		if username != "" {
+			env = append(env, "GRYPE_REGISTRY_AUTH_AUTHORITY="+strings.SplitN(ref, "/", 2)[0],
+				"GRYPE_REGISTRY_AUTH_USERNAME="+username, "GRYPE_REGISTRY_AUTH_PASSWORD="+password)
+		}
+		// without the scheme grype would look for the image in a local daemon first
+		ref = "registry:" + ref
+		parse = parseGrypeReport
+	}
+	args = append(append(args, s.Args...), ref)
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v %v: %v: %v", command, ref, err, msg)
+		}
+		return nil, fmt.Errorf("%v %v: %v", command, ref, err)
+	}
+	summary, err := parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("%v %v: %v", command, ref, err)
+	}
+	return summary, nil
+}
+
+// scanVulnerabilities runs the configured scanner on every manifest of repos
+// once, at most Concurrency at a time, and sets Vulnerabilities on the tags
+// pointing there.
+func scanVulnerabilities(ctx context.Context, reg *Registry, repos map[string][]TagDetail) []*ScanError {
+	defer phase("vulns")()
+	s := localConf.Scanner
+	if s == nil {
+		s = &ScannerConfig{Tool: ScannerTrivy}
+	}
+	concurrency := s.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultScannerConcurrency
+	}
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		errs      []*ScanError
+		summaries = make(map[string]*VulnSummary)
+		slots     = make(chan struct{}, concurrency)
+	)
+	for repo, tags := range repos {
+		seen := make(map[string]bool)
+		for _, tag := range tags {
+			// charts and other artifacts are no images to scan
+			if seen[tag.Digest] || tag.ArtifactType != "" || isArtifactTag(tag.Tag) {
+				continue
+			}
+			seen[tag.Digest] = true
+			wg.Add(1)
+			go func(repo string, tag string, digest string) {
+				defer wg.Done()
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				summary, err := s.scanImage(ctx, reg, repo, digest)
+				<-slots
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if ctx.Err() == nil {
+						errs = append(errs, &ScanError{Repo: repo, Tag: tag, Error: err.Error()})
+					}
+					return
+				}
+				summaries[repo+"@"+digest] = summary
+			}(repo, tag.Tag, tag.Digest)
+		}
+	}
+	wg.Wait()
+
+	for repo, tags := range repos {
+		for i, tag := range tags {
+			tags[i].Vulnerabilities = summaries[repo+"@"+tag.Digest]
+		}
+	}
+	return sortScanErrors(errs)
+}
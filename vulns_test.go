@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestImageName(t *testing.T) {
+	tests := []struct {
+		reg  *Registry
+		repo string
+		want string
+	}{
+		{&Registry{Host: "reg.example.org", Port: 5000}, "team-a/app", "reg.example.org:5000/team-a/app"},
+		{&Registry{Addr: "https://example.org/registry"}, "team-a/app", "example.org/registry/team-a/app"},
+		{&Registry{Type: "dockerhub"}, "nginx", "registry-1.docker.io/library/nginx"},
+	}
+	for _, tt := range tests {
+		if err := tt.reg.setup(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := imageName(tt.reg, tt.repo); err != nil || got != tt.want {
+			t.Errorf("%v: %v, %v, want %v", tt.reg.displayAddr(), got, err, tt.want)
+		}
+	}
+	// as given on the command line, without setup
+	addr, _, _ := parseAddr("localhost:5000")
+	if got, err := imageName(&Registry{Addr: addr}, "app"); err != nil || got != "localhost:5000/app" {
+		t.Errorf("localhost:5000: %v, %v", got, err)
+	}
+}
+
+// fakeScanner writes a scanner that records its arguments and reports no
+// vulnerabilities.
+func fakeScanner(t *testing.T) (command string, argsFile string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake scanner is a shell script")
+	}
+	dir := t.TempDir()
+	command, argsFile = filepath.Join(dir, "trivy"), filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\necho '{}'\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return command, argsFile
+}
+
+func TestScanVulnerabilities(t *testing.T) {
+	command, argsFile := fakeScanner(t)
+	prev := localConf
+	localConf = &Config{Scanner: &ScannerConfig{Tool: ScannerTrivy, Command: command}}
+	t.Cleanup(func() { localConf = prev })
+	addr, _, _ := parseAddr("localhost:5000")
+	reg := &Registry{Addr: addr}
+	repos := map[string][]TagDetail{
+		"team-a/app": {{Tag: "v1", Digest: "sha256:aa"}, {Tag: "latest", Digest: "sha256:aa"}},
+		"charts/web": {{Tag: "0.1.0", Digest: "sha256:bb", ArtifactType: "application/vnd.cncf.helm.config.v1+json"}},
+	}
+	if errs := scanVulnerabilities(context.Background(), reg, repos); len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	b, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(runs) != 1 || !strings.Contains(runs[0], "--insecure") || !strings.HasSuffix(runs[0], " localhost:5000/team-a/app@sha256:aa") {
+		t.Errorf("scanner runs %q, want one insecure run on localhost:5000/team-a/app@sha256:aa", runs)
+	}
+	if repos["team-a/app"][1].Vulnerabilities == nil || repos["charts/web"][0].Vulnerabilities != nil {
+		t.Errorf("vulnerabilities of latest %v and of the chart %v", repos["team-a/app"][1].Vulnerabilities, repos["charts/web"][0].Vulnerabilities)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// WatchEvent is a tag change seen while watching, printed as one JSON line.
+type WatchEvent struct {
+	Time JsonTime
+	*TagChange
+}
+
+// rescan scans reg and returns its snapshot, or false when the catalog could
+// not be read. Repositories that failed keep their tags from prev, so that a
+// flaky request is not reported as deleted tags.
+func rescan(ctx context.Context, reg *Registry, prev *Snapshot) (*Snapshot, bool) {
+	repos, errs := getRepoInfo(ctx, reg)
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	next := newSnapshot(reg.name(), repos)
+	for _, e := range errs {
+		if e.Repo == "" {
+			log.Printf("%v: %v", reg.name(), e)
+			return nil, false
+		}
+		log.Printf("%v: incomplete scan: %v", reg.name(), e)
+		if prev != nil && prev.Repositories[e.Repo] != nil {
+			next.Repositories[e.Repo] = prev.Repositories[e.Repo]
+		}
+	}
+	return next, true
+}
+
+func printWatchEvent(event *WatchEvent) {
+	if *outputFlag == OutputTable {
+		fmt.Printf("%v  %v  %v\n", time.Time(event.Time).Format(TimeOutputLayout), event.Registry, event.TagChange)
+		return
+	}
+	j, err := json.Marshal(event)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println(string(j))
+}
+
+// watch rescans regs every interval until ctx is done and prints the tags
+// added, removed or retagged since the previous scan, sending them to the
+// configured notification sinks too.
+func watch(ctx context.Context, regs []*Registry, interval time.Duration) {
+	prev := make(map[*Registry]*Snapshot)
+	for {
+		for _, reg := range regs {
+			next, ok := rescan(ctx, reg, prev[reg])
+			if !ok {
+				continue
+			}
+			if prev[reg] == nil {
+				tags := 0
+				for _, r := range next.Repositories {
+					tags += len(r.Tags)
+				}
+				log.Printf("watching %v: %d repositories, %d tags", reg.name(), len(next.Repositories), tags)
+			} else {
+				now := JsonTime(time.Now())
+				changes := diffSnapshots(prev[reg], next)
+				for _, change := range changes {
+					change.Registry = reg.name()
+					printWatchEvent(&WatchEvent{Time: now, TagChange: change})
+				}
+				if len(changes) > 0 {
+					notify(ctx, reg, changes, now)
+				}
+			}
+			prev[reg] = next
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// A read-only browser over the REST API of the serve command. The selected
+// registry and repository live in the url hash: #/<alias>/<repo>.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let tags = [];
+let sortKey = "Created";
+let sortDesc = true;
+
+function setStatus(text) {
+  $("status").textContent = text || "";
+}
+
+async function getJson(path) {
+  const res = await fetch(path);
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.Error || res.statusText);
+  }
+  return body;
+}
+
+function link(text, hash, selected) {
+  const a = document.createElement("a");
+  a.textContent = text;
+  a.href = hash;
+  if (selected) {
+    a.className = "selected";
+  }
+  return a;
+}
+
+function humanBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function matches(search, ...values) {
+  search = search.trim().toLowerCase();
+  return !search || values.some((v) => String(v).toLowerCase().includes(search));
+}
+
+async function showRegistries(alias) {
+  const list = $("registry-list");
+  list.replaceChildren();
+  for (const reg of await getJson("registries")) {
+    const li = document.createElement("li");
+    const a = link(reg.Alias, "#/" + encodeURIComponent(reg.Alias), reg.Alias === alias);
+    const addr = document.createElement("small");
+    addr.textContent = " " + reg.Addr;
+    a.append(addr);
+    li.append(a);
+    list.append(li);
+  }
+}
+
+let repos = [];
+
+function renderRepos(alias, repo) {
+  const list = $("repo-list");
+  list.replaceChildren();
+  for (const name of repos.filter((r) => matches($("repo-search").value, r))) {
+    const li = document.createElement("li");
+    li.append(link(name, "#/" + encodeURIComponent(alias) + "/" + name, name === repo));
+    list.append(li);
+  }
+}
+
+async function showRepos(alias, repo) {
+  $("repos").hidden = false;
+  $("repos-title").textContent = alias;
+  repos = await getJson("registries/" + encodeURIComponent(alias) + "/repos");
+  $("repo-search").oninput = () => renderRepos(alias, repo);
+  renderRepos(alias, repo);
+}
+
+function sortValue(t) {
+  const v = t[sortKey];
+  if (v === undefined) {
+    return "";
+  }
+  return Array.isArray(v) ? v.join(",") : v;
+}
+
+function renderTags() {
+  for (const th of document.querySelectorAll("th")) {
+    th.className = th.dataset.key === sortKey ? (sortDesc ? "desc" : "asc") : "";
+  }
+  const rows = tags
+    .filter((t) => matches($("tag-search").value, t.Tag, t.Digest))
+    .sort((a, b) => {
+      const x = sortValue(a), y = sortValue(b);
+      const c = x < y ? -1 : x > y ? 1 : 0;
+      return sortDesc ? -c : c;
+    });
+  const body = $("tag-rows");
+  body.replaceChildren();
+  for (const t of rows) {
+    const tr = document.createElement("tr");
+    for (const [text, cls] of [[t.Tag], [t.Created], [humanBytes(t.Size)], [t.Digest, "digest"], [(t.SameDigest || []).join(", ")]]) {
+      const td = document.createElement("td");
+      td.textContent = text;
+      if (cls) {
+        td.className = cls;
+      }
+      tr.append(td);
+    }
+    body.append(tr);
+  }
+}
+
+async function showTags(alias, repo) {
+  $("tags").hidden = false;
+  $("tags-title").textContent = repo;
+  const res = await getJson("registries/" + encodeURIComponent(alias) + "/repos/" + repo + "/tags");
+  tags = res.Tags || [];
+  if (res.Errors) {
+    setStatus(res.Errors.length + " tags could not be fetched");
+  }
+  renderTags();
+}
+
+async function route() {
+  const [alias, ...rest] = location.hash.replace(/^#\/?/, "").split("/");
+  const repo = rest.join("/");
+  const reg = decodeURIComponent(alias || "");
+  $("repos").hidden = !reg;
+  $("tags").hidden = !repo;
+  $("crumbs").replaceChildren();
+  if (reg) {
+    $("crumbs").append(link(reg, "#/" + alias));
+  }
+  setStatus("");
+  try {
+    await showRegistries(reg);
+    if (reg) {
+      await showRepos(reg, repo);
+    }
+    if (repo) {
+      await showTags(reg, repo);
+    }
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+for (const th of document.querySelectorAll("th")) {
+  th.onclick = () => {
+    sortDesc = th.dataset.key === sortKey ? !sortDesc : th.dataset.key !== "Tag";
+    sortKey = th.dataset.key;
+    renderTags();
+  };
+}
+$("tag-search").oninput = renderTags;
+window.onhashchange = route;
+route();